@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,8 +26,67 @@ type Config struct {
 	Environment string
 
 	// Payment config
+	PaymentGateway string // "razorpay" or "fake" (in-memory, no network)
 	RazorpayKey    string
 	RazorpaySecret string
+
+	// Secret configured on the Razorpay dashboard for signing webhook deliveries
+	RazorpayWebhookSecret string
+
+	// Invoice config
+	GSTRatePercent     int    // GST charged on rent and installation, e.g. 18
+	InvoiceStoragePath string // Directory where rendered invoice PDFs are kept
+
+	// Dunning config: reminders go out the given number of days after a monthly payment
+	// falls due, the late fee is added once after LateFeeAfterDays and the subscription
+	// is suspended after SuspensionGraceDays
+	DunningReminderDays []int
+	LateFeeAmount       float64
+	LateFeeAfterDays    int
+	SuspensionGraceDays int
+
+	// Days before the end of a subscription term that the customer is told it will
+	// renew or end
+	RenewalNoticeDays int
+
+	// Days ahead of a subscription's next maintenance date that the visit is raised
+	MaintenanceLeadDays int
+
+	// Minutes an order holds its unit of stock while waiting for the initial payment
+	StockReservationMinutes int
+
+	// Hours a new service agent has to set their password after being invited
+	AgentInviteExpiryHours int
+
+	// Length of a service visit booked without an explicit end
+	ServiceVisitMinutes int
+
+	// Days ahead customers can book service slots
+	ServiceSlotDays int
+
+	// Minutes a service request may wait for an agent before the franchise owner is alerted
+	DispatchSLAMinutes int
+
+	// Service SLA defaults for request types without a policy
+	SLADefaultHours         int
+	SLAAdminEscalationHours int
+
+	// Hours before the due-by time a service request counts as due soon
+	SLADueSoonHours int
+
+	// Visit verification codes sent to customers
+	VisitCodeExpiryMinutes int
+	VisitCodeMaxAttempts   int
+	VisitCodeMaxIssues     int
+
+	// Background job config
+	BillingJobIntervalMinutes     int
+	DunningJobIntervalMinutes     int
+	ExpiryJobIntervalMinutes      int
+	MaintenanceJobIntervalMinutes int
+	ReservationJobIntervalMinutes int
+	DispatchJobIntervalMinutes    int
+	SLAJobIntervalMinutes         int
 }
 
 var AppConfig Config
@@ -47,8 +107,37 @@ func InitConfig() {
 		JWTSecret:      getEnv("JWT_SECRET", "aquahome_default_secret_key"),
 		JWTExpiryHours: getEnvAsInt("JWT_EXPIRY_HOURS", 24),
 		Environment:    getEnv("ENVIRONMENT", "development"),
+		PaymentGateway: getEnv("PAYMENT_GATEWAY", "razorpay"),
 		RazorpayKey:    getEnv("RAZORPAY_KEY", "rzp_test_QfMQ0LRiTplCvR"),
 		RazorpaySecret: getEnv("RAZORPAY_SECRET", "169NdofVMND0u1o8yTWsgx47"),
+
+		RazorpayWebhookSecret:         getEnv("RAZORPAY_WEBHOOK_SECRET", ""),
+		GSTRatePercent:                getEnvAsInt("GST_RATE_PERCENT", 18),
+		InvoiceStoragePath:            getEnv("INVOICE_STORAGE_PATH", "./storage/invoices"),
+		DunningReminderDays:           getEnvAsIntList("DUNNING_REMINDER_DAYS", []int{1, 7, 14}),
+		LateFeeAmount:                 getEnvAsFloat("LATE_FEE_AMOUNT", 100),
+		LateFeeAfterDays:              getEnvAsInt("LATE_FEE_AFTER_DAYS", 7),
+		SuspensionGraceDays:           getEnvAsInt("SUSPENSION_GRACE_DAYS", 21),
+		RenewalNoticeDays:             getEnvAsInt("RENEWAL_NOTICE_DAYS", 7),
+		BillingJobIntervalMinutes:     getEnvAsInt("BILLING_JOB_INTERVAL_MINUTES", 60),
+		DunningJobIntervalMinutes:     getEnvAsInt("DUNNING_JOB_INTERVAL_MINUTES", 60),
+		ExpiryJobIntervalMinutes:      getEnvAsInt("EXPIRY_JOB_INTERVAL_MINUTES", 60),
+		MaintenanceLeadDays:           getEnvAsInt("MAINTENANCE_LEAD_DAYS", 7),
+		MaintenanceJobIntervalMinutes: getEnvAsInt("MAINTENANCE_JOB_INTERVAL_MINUTES", 60),
+		StockReservationMinutes:       getEnvAsInt("STOCK_RESERVATION_MINUTES", 30),
+		ReservationJobIntervalMinutes: getEnvAsInt("RESERVATION_JOB_INTERVAL_MINUTES", 5),
+		AgentInviteExpiryHours:        getEnvAsInt("AGENT_INVITE_EXPIRY_HOURS", 72),
+		ServiceVisitMinutes:           getEnvAsInt("SERVICE_VISIT_MINUTES", 60),
+		ServiceSlotDays:               getEnvAsInt("SERVICE_SLOT_DAYS", 14),
+		DispatchSLAMinutes:            getEnvAsInt("DISPATCH_SLA_MINUTES", 120),
+		DispatchJobIntervalMinutes:    getEnvAsInt("DISPATCH_JOB_INTERVAL_MINUTES", 10),
+		SLADefaultHours:               getEnvAsInt("SLA_DEFAULT_HOURS", 72),
+		SLAAdminEscalationHours:       getEnvAsInt("SLA_ADMIN_ESCALATION_HOURS", 24),
+		SLADueSoonHours:               getEnvAsInt("SLA_DUE_SOON_HOURS", 4),
+		SLAJobIntervalMinutes:         getEnvAsInt("SLA_JOB_INTERVAL_MINUTES", 15),
+		VisitCodeExpiryMinutes:        getEnvAsInt("VISIT_CODE_EXPIRY_MINUTES", 240),
+		VisitCodeMaxAttempts:          getEnvAsInt("VISIT_CODE_MAX_ATTEMPTS", 5),
+		VisitCodeMaxIssues:            getEnvAsInt("VISIT_CODE_MAX_ISSUES", 5),
 	}
 }
 
@@ -69,6 +158,33 @@ func getEnvAsInt(key string, fallback int) int {
 	return fallback
 }
 
+// Helper function to get float environment variable with fallback
+func getEnvAsFloat(key string, fallback float64) float64 {
+	strValue := getEnv(key, "")
+	if value, err := strconv.ParseFloat(strValue, 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Helper function to get a comma-separated integer list environment variable with fallback
+func getEnvAsIntList(key string, fallback []int) []int {
+	strValue := getEnv(key, "")
+	if strValue == "" {
+		return fallback
+	}
+
+	var values []int
+	for _, part := range strings.Split(strValue, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fallback
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
 // GetJWTExpiration returns JWT expiration time
 func GetJWTExpiration() time.Duration {
 	return time.Duration(AppConfig.JWTExpiryHours) * time.Hour
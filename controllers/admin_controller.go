@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -24,6 +25,24 @@ func AdminDashboard(c *gin.Context) {
 		return
 	}
 
+	// SLA compliance of service requests, overall and per franchise
+	slaSince, ok := slaMetricsSince(c)
+	if !ok {
+		return
+	}
+	slaMetrics, err := serviceSLAMetrics(database.DB, 0, slaSince)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SLA metrics"})
+		return
+	}
+	slaByFranchise, err := franchiseSLAMetrics(database.DB, slaSince)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SLA metrics"})
+		return
+	}
+
 	// Return simplified dashboard data
 	c.JSON(http.StatusOK, gin.H{
 		"stats": gin.H{
@@ -34,6 +53,8 @@ func AdminDashboard(c *gin.Context) {
 			"pendingServiceRequests": 0,
 			"franchiseApplications":  0,
 		},
+		"sla":            slaMetrics,
+		"slaByFranchise": slaByFranchise,
 	})
 }
 
@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// Reasons an agent cannot take a visit
+const (
+	ScheduleConflictOutsideHours = "outside_working_hours"
+	ScheduleConflictOnLeave      = "agent_on_leave"
+	ScheduleConflictBooked       = "schedule_conflict" // The agent has another visit then
+	ScheduleConflictInvalid      = "invalid_schedule"  // The visit window itself is wrong
+)
+
+// closedServiceStatuses are the statuses of service requests that no longer hold a visit
+var closedServiceStatuses = []string{ServiceStatusCompleted, ServiceStatusCancelled}
+
+// ScheduleConflict explains why an agent cannot take a visit
+type ScheduleConflict struct {
+	Code                  string `json:"code"`
+	Error                 string `json:"error"`
+	ConflictingRequestIDs []uint `json:"conflicting_request_ids,omitempty"`
+}
+
+// ServiceSlot is a bookable visit window of a franchise on a given day
+type ServiceSlot struct {
+	StartsAt     time.Time `json:"starts_at"`
+	EndsAt       time.Time `json:"ends_at"`
+	Capacity     int       `json:"capacity"`
+	AgentsOnDuty int       `json:"agents_on_duty"`
+	Booked       int       `json:"booked"`
+	Available    int       `json:"available"`
+}
+
+// respondScheduleConflict rejects a visit the agent cannot take
+func respondScheduleConflict(c *gin.Context, conflict *ScheduleConflict) {
+	status := http.StatusConflict
+	if conflict.Code == ScheduleConflictInvalid {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, conflict)
+}
+
+// visitDuration is the length of a visit booked without an explicit end
+func visitDuration() time.Duration {
+	return time.Duration(config.AppConfig.ServiceVisitMinutes) * time.Minute
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// validateWeeklyWindow checks a weekday and HH:MM window, returning the window in minutes
+// after midnight
+func validateWeeklyWindow(weekday int, startTime, endTime string) (int, int, error) {
+	if weekday < 0 || weekday > 6 {
+		return 0, 0, errors.New("weekday must be between 0 (Sunday) and 6 (Saturday)")
+	}
+	start, err := parseClock(startTime)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(endTime)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("%s must be after %s", endTime, startTime)
+	}
+	return start, end, nil
+}
+
+// atClock returns the time minutes after midnight on day
+func atClock(day time.Time, minutes int) time.Time {
+	year, month, date := day.Date()
+	return time.Date(year, month, date, 0, minutes, 0, 0, day.Location())
+}
+
+// minutesOfDay returns the minutes after midnight of t
+func minutesOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// withinWorkingHours reports whether a visit from start to end falls inside one of the
+// shifts. An agent without any shifts is taken to work whenever visits are offered.
+func withinWorkingHours(hours []database.AgentWorkingHours, start, end time.Time) bool {
+	if len(hours) == 0 {
+		return true
+	}
+	if !end.After(start) || !atClock(start, 0).Equal(atClock(end.Add(-time.Nanosecond), 0)) {
+		return false
+	}
+	for _, shift := range hours {
+		if shift.Weekday != int(start.Weekday()) {
+			continue
+		}
+		shiftStart, errStart := parseClock(shift.StartTime)
+		shiftEnd, errEnd := parseClock(shift.EndTime)
+		if errStart != nil || errEnd != nil {
+			continue
+		}
+		endMinutes := minutesOfDay(end)
+		if endMinutes == 0 {
+			endMinutes = 24 * 60
+		}
+		if minutesOfDay(start) >= shiftStart && endMinutes <= shiftEnd {
+			return true
+		}
+	}
+	return false
+}
+
+// openVisitsOverlapping scopes service requests to the open visits overlapping start to
+// end. Visits without an end last the default visit duration.
+func openVisitsOverlapping(db *gorm.DB, start, end time.Time) *gorm.DB {
+	return db.Where("service_requests.status NOT IN ? AND service_requests.scheduled_time IS NOT NULL", closedServiceStatuses).
+		Where("service_requests.scheduled_time < ? AND COALESCE(service_requests.scheduled_end, service_requests.scheduled_time + ? * INTERVAL '1 minute') > ?",
+			end, config.AppConfig.ServiceVisitMinutes, start)
+}
+
+// findAgentConflict checks that an agent can take a visit from start to end: it must fall
+// within their working hours, outside their leave and clear of their other open visits.
+// excludeRequestID is the visit being scheduled, which never conflicts with itself.
+func findAgentConflict(db *gorm.DB, agentID uint, start, end time.Time, excludeRequestID uint) (*ScheduleConflict, error) {
+	var hours []database.AgentWorkingHours
+	if err := db.Where("agent_id = ?", agentID).Find(&hours).Error; err != nil {
+		return nil, err
+	}
+	if !withinWorkingHours(hours, start, end) {
+		return &ScheduleConflict{
+			Code:  ScheduleConflictOutsideHours,
+			Error: "The visit falls outside the service agent's working hours",
+		}, nil
+	}
+
+	var leave int64
+	if err := db.Model(&database.AgentLeave{}).
+		Where("agent_id = ? AND starts_at < ? AND ends_at > ?", agentID, end, start).
+		Count(&leave).Error; err != nil {
+		return nil, err
+	}
+	if leave > 0 {
+		return &ScheduleConflict{
+			Code:  ScheduleConflictOnLeave,
+			Error: "The service agent is on leave at that time",
+		}, nil
+	}
+
+	var bookedIDs []uint
+	if err := openVisitsOverlapping(db.Model(&database.ServiceRequest{}), start, end).
+		Where("service_requests.service_agent_id = ? AND service_requests.id <> ?", agentID, excludeRequestID).
+		Order("service_requests.scheduled_time ASC").
+		Pluck("service_requests.id", &bookedIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(bookedIDs) > 0 {
+		return &ScheduleConflict{
+			Code:                  ScheduleConflictBooked,
+			Error:                 "The service agent already has a visit at that time",
+			ConflictingRequestIDs: bookedIDs,
+		}, nil
+	}
+	return nil, nil
+}
+
+// planServiceVisit works out the agent and visit window a service request will have once
+// updates are applied and checks that the agent is free then. A rescheduled visit keeps
+// its length unless updates give its end, and its due-by time moves with it. It locks the
+// agent so that concurrent bookings for them are checked one at a time.
+func planServiceVisit(tx *gorm.DB, requestID uint, updates map[string]interface{}) (*ScheduleConflict, error) {
+	newAgentID, agentChanged := updates["service_agent_id"].(uint)
+	newStart, rescheduled := updates["scheduled_time"].(time.Time)
+	newEnd, endChanged := updates["scheduled_end"].(time.Time)
+	if !agentChanged && !rescheduled && !endChanged {
+		return nil, nil
+	}
+
+	var request database.ServiceRequest
+	if err := tx.Select("id, type, service_agent_id, scheduled_time, scheduled_end, created_at").
+		First(&request, requestID).Error; err != nil {
+		return nil, err
+	}
+
+	agentID := request.ServiceAgentID
+	if agentChanged {
+		agentID = &newAgentID
+	}
+
+	start := request.ScheduledTime
+	if rescheduled {
+		start = &newStart
+	}
+	if start == nil {
+		if endChanged {
+			return &ScheduleConflict{Code: ScheduleConflictInvalid, Error: "Schedule the visit before setting its end"}, nil
+		}
+		return nil, nil
+	}
+
+	end := start.Add(visitDuration())
+	switch {
+	case endChanged:
+		end = newEnd
+	case rescheduled && request.ScheduledTime != nil && request.ScheduledEnd != nil:
+		end = start.Add(request.ScheduledEnd.Sub(*request.ScheduledTime))
+	case request.ScheduledEnd != nil:
+		end = *request.ScheduledEnd
+	}
+	if !end.After(*start) {
+		return &ScheduleConflict{Code: ScheduleConflictInvalid, Error: "The visit must end after it starts"}, nil
+	}
+	if rescheduled || endChanged {
+		updates["scheduled_end"] = end
+	}
+	if rescheduled {
+		dueBy, err := serviceDueBy(tx, request.Type, request.CreatedAt, start)
+		if err != nil {
+			return nil, err
+		}
+		updates["due_by"] = dueBy
+	}
+
+	if agentID == nil {
+		return nil, nil
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").First(&database.User{}, *agentID).Error; err != nil {
+		return nil, err
+	}
+	return findAgentConflict(tx, *agentID, *start, end, requestID)
+}
+
+// franchiseSlots returns the visit slots a franchise offers over days days from the start
+// of from's day, with how many more visits each can take. Slots that have started are left
+// out. A slot takes at most one visit per active agent on duty, less the visits booked in
+// it, and no more than its template's capacity.
+func franchiseSlots(db *gorm.DB, franchiseID uint, from time.Time, days int) ([]ServiceSlot, error) {
+	var templates []database.ServiceSlotTemplate
+	if err := db.Where("franchise_id = ?", franchiseID).
+		Order("weekday ASC, start_time ASC").
+		Find(&templates).Error; err != nil {
+		return nil, err
+	}
+	slots := []ServiceSlot{}
+	if len(templates) == 0 {
+		return slots, nil
+	}
+
+	rangeStart := atClock(from, 0)
+	rangeEnd := rangeStart.AddDate(0, 0, days)
+
+	var agentIDs []uint
+	if err := db.Model(&database.FranchiseAgent{}).
+		Where("franchise_id = ? AND status = ?", franchiseID, FranchiseAgentActive).
+		Pluck("agent_id", &agentIDs).Error; err != nil {
+		return nil, err
+	}
+
+	hours := map[uint][]database.AgentWorkingHours{}
+	var leave []database.AgentLeave
+	if len(agentIDs) > 0 {
+		var shifts []database.AgentWorkingHours
+		if err := db.Where("agent_id IN ?", agentIDs).Find(&shifts).Error; err != nil {
+			return nil, err
+		}
+		for _, shift := range shifts {
+			hours[shift.AgentID] = append(hours[shift.AgentID], shift)
+		}
+		if err := db.Where("agent_id IN ? AND starts_at < ? AND ends_at > ?", agentIDs, rangeEnd, rangeStart).
+			Find(&leave).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var visits []database.ServiceRequest
+	if err := openVisitsOverlapping(db.Model(&database.ServiceRequest{}), rangeStart, rangeEnd).
+		Joins("JOIN subscriptions ON subscriptions.id = service_requests.subscription_id").
+		Where("subscriptions.franchise_id = ?", franchiseID).
+		Select("service_requests.id, service_requests.scheduled_time, service_requests.scheduled_end").
+		Find(&visits).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for day := rangeStart; day.Before(rangeEnd); day = day.AddDate(0, 0, 1) {
+		for _, template := range templates {
+			if template.Weekday != int(day.Weekday()) {
+				continue
+			}
+			startMinutes, endMinutes, err := validateWeeklyWindow(template.Weekday, template.StartTime, template.EndTime)
+			if err != nil {
+				continue
+			}
+			slot := ServiceSlot{StartsAt: atClock(day, startMinutes), EndsAt: atClock(day, endMinutes)}
+			if !slot.StartsAt.After(now) {
+				continue
+			}
+
+			for _, agentID := range agentIDs {
+				if !withinWorkingHours(hours[agentID], slot.StartsAt, slot.EndsAt) {
+					continue
+				}
+				onLeave := false
+				for _, period := range leave {
+					if period.AgentID == agentID && period.StartsAt.Before(slot.EndsAt) && period.EndsAt.After(slot.StartsAt) {
+						onLeave = true
+						break
+					}
+				}
+				if !onLeave {
+					slot.AgentsOnDuty++
+				}
+			}
+
+			for _, visit := range visits {
+				visitEnd := visit.ScheduledTime.Add(visitDuration())
+				if visit.ScheduledEnd != nil {
+					visitEnd = *visit.ScheduledEnd
+				}
+				if visit.ScheduledTime.Before(slot.EndsAt) && visitEnd.After(slot.StartsAt) {
+					slot.Booked++
+				}
+			}
+
+			slot.Capacity = slot.AgentsOnDuty
+			if template.Capacity > 0 && template.Capacity < slot.Capacity {
+				slot.Capacity = template.Capacity
+			}
+			if slot.Capacity > slot.Booked {
+				slot.Available = slot.Capacity - slot.Booked
+			}
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
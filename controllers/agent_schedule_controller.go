@@ -0,0 +1,444 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// WeeklyWindow is a time window on one day of the week, as HH:MM in the server's local
+// time zone
+type WeeklyWindow struct {
+	Weekday   int    `json:"weekday"` // 0 is Sunday
+	StartTime string `json:"start_time" binding:"required"`
+	EndTime   string `json:"end_time" binding:"required"`
+}
+
+// WorkingHoursRequest replaces a service agent's weekly working hours
+type WorkingHoursRequest struct {
+	Hours []WeeklyWindow `json:"hours"`
+}
+
+// AgentLeaveRequest contains data for booking a service agent's leave
+type AgentLeaveRequest struct {
+	StartsAt string `json:"starts_at" binding:"required"` // RFC3339
+	EndsAt   string `json:"ends_at" binding:"required"`   // RFC3339
+	Reason   string `json:"reason"`
+}
+
+// SlotTemplateRequest is one weekly visit slot of a franchise
+type SlotTemplateRequest struct {
+	WeeklyWindow
+	Capacity int `json:"capacity"` // 0 means one visit per agent on duty
+}
+
+// SlotTemplatesRequest replaces a franchise's weekly visit slots
+type SlotTemplatesRequest struct {
+	Slots []SlotTemplateRequest `json:"slots"`
+}
+
+// managedAgentID returns the service agent whose calendar and skills the caller manages:
+// their own for service agents, and the active member in the :agentId path parameter for
+// the franchise's owner or an admin
+func managedAgentID(c *gin.Context) (uint, bool) {
+	if c.GetString("role") == RoleServiceAgent {
+		userIDValue, _ := c.Get("user_id")
+		agentID, ok := userIDValue.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		}
+		return agentID, ok
+	}
+
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return 0, false
+	}
+	agentID, err := strconv.ParseUint(c.Param("agentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service agent ID"})
+		return 0, false
+	}
+	isMember, err := isFranchiseAgent(database.DB, franchiseID, uint(agentID))
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return 0, false
+	}
+	if !isMember {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service agent is not an active member of this franchise"})
+		return 0, false
+	}
+	return uint(agentID), true
+}
+
+// parseCalendarRange reads the ?from=YYYY-MM-DD and ?days= query parameters, defaulting to
+// today and maxDays
+func parseCalendarRange(c *gin.Context, maxDays int) (time.Time, int, bool) {
+	from := time.Now()
+	if value := c.Query("from"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+			return time.Time{}, 0, false
+		}
+		from = date
+	}
+
+	days := maxDays
+	if value := c.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("days must be between 1 and %d", maxDays)})
+			return time.Time{}, 0, false
+		}
+		days = parsed
+	}
+	return atClock(from, 0), days, true
+}
+
+// GetAgentCalendar returns a service agent's working hours, leave and open visits over
+// ?days= days from ?from= (Service Agent for themselves, Franchise Owner or Admin)
+func GetAgentCalendar(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+	from, days, ok := parseCalendarRange(c, 31)
+	if !ok {
+		return
+	}
+	to := from.AddDate(0, 0, days)
+
+	var hours []database.AgentWorkingHours
+	if err := database.DB.Where("agent_id = ?", agentID).
+		Order("weekday ASC, start_time ASC").
+		Find(&hours).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calendar"})
+		return
+	}
+
+	var leave []database.AgentLeave
+	if err := database.DB.Where("agent_id = ? AND starts_at < ? AND ends_at > ?", agentID, to, from).
+		Order("starts_at ASC").
+		Find(&leave).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calendar"})
+		return
+	}
+
+	var visits []database.ServiceRequest
+	if err := openVisitsOverlapping(database.DB.Model(&database.ServiceRequest{}), from, to).
+		Preload("Customer", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, phone, address, city, zip_code") }).
+		Where("service_requests.service_agent_id = ?", agentID).
+		Order("service_requests.scheduled_time ASC").
+		Find(&visits).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calendar"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"agent_id":      agentID,
+		"from":          from,
+		"to":            to,
+		"working_hours": hours,
+		"leave":         leave,
+		"visits":        visits,
+	})
+}
+
+// SetAgentWorkingHours replaces a service agent's weekly working hours. An empty list
+// makes the agent available whenever the franchise offers visits (Service Agent for
+// themselves, Franchise Owner or Admin)
+func SetAgentWorkingHours(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+
+	var request WorkingHoursRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hours := make([]database.AgentWorkingHours, 0, len(request.Hours))
+	for _, window := range request.Hours {
+		if _, _, err := validateWeeklyWindow(window.Weekday, window.StartTime, window.EndTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hours = append(hours, database.AgentWorkingHours{
+			AgentID:   agentID,
+			Weekday:   window.Weekday,
+			StartTime: window.StartTime,
+			EndTime:   window.EndTime,
+		})
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Unscoped().Where("agent_id = ?", agentID).Delete(&database.AgentWorkingHours{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating working hours"})
+		return
+	}
+	if len(hours) > 0 {
+		if err := tx.Create(&hours).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating working hours"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Working hours updated", "working_hours": hours})
+}
+
+// AddAgentLeave books leave for a service agent. Open visits the agent already has during
+// the leave are returned so that they can be reassigned (Service Agent for themselves,
+// Franchise Owner or Admin)
+func AddAgentLeave(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+
+	var request AgentLeaveRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	startsAt, err := time.Parse(time.RFC3339, request.StartsAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid leave start format"})
+		return
+	}
+	endsAt, err := time.Parse(time.RFC3339, request.EndsAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid leave end format"})
+		return
+	}
+	if !endsAt.After(startsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Leave must end after it starts"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	creatorID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	leave := database.AgentLeave{
+		AgentID:     agentID,
+		StartsAt:    startsAt,
+		EndsAt:      endsAt,
+		Reason:      request.Reason,
+		CreatedByID: &creatorID,
+	}
+	if err := database.DB.Create(&leave).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error booking leave"})
+		return
+	}
+
+	var conflictingIDs []uint
+	if err := openVisitsOverlapping(database.DB.Model(&database.ServiceRequest{}), startsAt, endsAt).
+		Where("service_requests.service_agent_id = ?", agentID).
+		Order("service_requests.scheduled_time ASC").
+		Pluck("service_requests.id", &conflictingIDs).Error; err != nil {
+		log.Printf("Database error: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":                 "Leave booked",
+		"leave":                   leave,
+		"conflicting_request_ids": conflictingIDs,
+	})
+}
+
+// DeleteAgentLeave cancels a service agent's leave (Service Agent for themselves,
+// Franchise Owner or Admin)
+func DeleteAgentLeave(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+
+	leaveID, err := strconv.ParseUint(c.Param("leaveId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid leave ID"})
+		return
+	}
+
+	result := database.DB.Where("id = ? AND agent_id = ?", leaveID, agentID).Delete(&database.AgentLeave{})
+	if result.Error != nil {
+		log.Printf("Database error: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error cancelling leave"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leave not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Leave cancelled"})
+}
+
+// GetSlotTemplates returns the weekly visit slots of the caller's franchise (Admin or
+// Franchise Owner only)
+func GetSlotTemplates(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	var templates []database.ServiceSlotTemplate
+	if err := database.DB.Where("franchise_id = ?", franchiseID).
+		Order("weekday ASC, start_time ASC").
+		Find(&templates).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch slots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, templates)
+}
+
+// ReplaceSlotTemplates replaces the weekly visit slots of the caller's franchise. Visits
+// already booked keep their times (Admin or Franchise Owner only)
+func ReplaceSlotTemplates(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	var request SlotTemplatesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	templates := make([]database.ServiceSlotTemplate, 0, len(request.Slots))
+	for _, slot := range request.Slots {
+		if _, _, err := validateWeeklyWindow(slot.Weekday, slot.StartTime, slot.EndTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if slot.Capacity < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Slot capacity cannot be negative"})
+			return
+		}
+		templates = append(templates, database.ServiceSlotTemplate{
+			FranchiseID: franchiseID,
+			Weekday:     slot.Weekday,
+			StartTime:   slot.StartTime,
+			EndTime:     slot.EndTime,
+			Capacity:    slot.Capacity,
+		})
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Where("franchise_id = ?", franchiseID).Delete(&database.ServiceSlotTemplate{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating slots"})
+		return
+	}
+	if len(templates) > 0 {
+		if err := tx.Create(&templates).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating slots"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Slots updated", "slots": templates})
+}
+
+// GetServiceSlots returns the visit slots open to a subscription's service requests over
+// ?days= days from ?from=. Customers see the slots of their own subscriptions only.
+func GetServiceSlots(c *gin.Context) {
+	subscriptionID, err := strconv.ParseUint(c.Query("subscription_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subscription_id is required"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	query := database.DB.Select("subscriptions.id, subscriptions.franchise_id")
+	switch c.GetString("role") {
+	case RoleAdmin:
+	case RoleFranchiseOwner:
+		query = query.Joins("JOIN franchises ON franchises.id = subscriptions.franchise_id").
+			Where("franchises.owner_id = ?", userID)
+	case RoleCustomer:
+		query = query.Where("subscriptions.customer_id = ?", userID)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	var subscription database.Subscription
+	if err := query.First(&subscription, subscriptionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	from, days, ok := parseCalendarRange(c, config.AppConfig.ServiceSlotDays)
+	if !ok {
+		return
+	}
+
+	slots, err := franchiseSlots(database.DB, subscription.FranchiseID, from, days)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch slots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscription_id": subscription.ID,
+		"franchise_id":    subscription.FranchiseID,
+		"slots":           slots,
+	})
+}
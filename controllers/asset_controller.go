@@ -0,0 +1,360 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// RegisterAssetRequest contains data for registering a purifier unit
+type RegisterAssetRequest struct {
+	SerialNumber string `json:"serial_number" binding:"required"`
+	ProductID    uint   `json:"product_id" binding:"required"`
+	// Required for admins; franchise owners register units for their own franchise
+	FranchiseID uint   `json:"franchise_id"`
+	Notes       string `json:"notes"`
+}
+
+// UpdateAssetStatusRequest contains data for moving a unit between warehouse states
+type UpdateAssetStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Notes  string `json:"notes"`
+}
+
+// RegisterAsset adds a purifier unit to a franchise warehouse and receives it into the
+// franchise's stock (Admin or Franchise Owner)
+func RegisterAsset(c *gin.Context) {
+	var request RegisterAssetRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role := c.GetString("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	serialNumber := strings.TrimSpace(request.SerialNumber)
+	if serialNumber == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Serial number is required"})
+		return
+	}
+
+	franchiseQuery := database.DB.Select("id")
+	if role == RoleFranchiseOwner {
+		franchiseQuery = franchiseQuery.Where("owner_id = ?", userID)
+		if request.FranchiseID != 0 {
+			franchiseQuery = franchiseQuery.Where("id = ?", request.FranchiseID)
+		}
+	} else {
+		if request.FranchiseID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Franchise ID is required"})
+			return
+		}
+		franchiseQuery = franchiseQuery.Where("id = ?", request.FranchiseID)
+	}
+	var franchise database.Franchise
+	if err := franchiseQuery.First(&franchise).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found or you don't have permission to manage it"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	var product database.Product
+	if err := database.DB.Select("id").First(&product, request.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	var existing int64
+	if err := database.DB.Unscoped().Model(&database.Asset{}).
+		Where("serial_number = ?", serialNumber).
+		Count(&existing).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A unit with this serial number is already registered"})
+		return
+	}
+
+	asset := database.Asset{
+		SerialNumber: serialNumber,
+		ProductID:    product.ID,
+		FranchiseID:  franchise.ID,
+		Status:       AssetStatusInWarehouse,
+		Notes:        request.Notes,
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Create(&asset).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error registering asset: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register unit"})
+		return
+	}
+
+	history := database.AssetStatusHistory{
+		AssetID:   asset.ID,
+		ToStatus:  asset.Status,
+		ActorID:   &userID,
+		ActorRole: role,
+		Notes:     "Registered",
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error recording asset history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register unit"})
+		return
+	}
+
+	// A registered unit is a unit received into the franchise's stock
+	if _, err := adjustInventory(tx, franchise.ID, product.ID, InventoryMovementReceipt, 1, InventoryReference{
+		ActorRole: role,
+		ActorID:   &userID,
+		Notes:     "Registered unit " + serialNumber,
+	}); err != nil {
+		tx.Rollback()
+		log.Printf("Error recording stock receipt: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register unit"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register unit"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, asset)
+}
+
+// GetAssets lists purifier units, optionally filtered by status, product, franchise,
+// subscription or serial number (Admin or Franchise Owner)
+func GetAssets(c *gin.Context) {
+	query, ok := assetScope(c, database.DB)
+	if !ok {
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if serialNumber := c.Query("serial_number"); serialNumber != "" {
+		query = query.Where("serial_number = ?", serialNumber)
+	}
+	for _, filter := range []string{"product_id", "franchise_id", "subscription_id"} {
+		if value := c.Query(filter); value != "" {
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + filter})
+				return
+			}
+			query = query.Where(filter+" = ?", id)
+		}
+	}
+
+	var assets []database.Asset
+	if err := query.
+		Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Order("id ASC").
+		Find(&assets).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch units"})
+		return
+	}
+
+	c.JSON(http.StatusOK, assets)
+}
+
+// GetAssetByID returns a purifier unit with its status history (Admin or Franchise Owner)
+func GetAssetByID(c *gin.Context) {
+	assetID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset ID"})
+		return
+	}
+
+	query, ok := assetScope(c, database.DB)
+	if !ok {
+		return
+	}
+
+	var asset database.Asset
+	if err := query.
+		Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Preload("Franchise", func(db *gorm.DB) *gorm.DB { return db.Select("id, name") }).
+		First(&asset, assetID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unit not found or you don't have permission to view it"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	var history []database.AssetStatusHistory
+	if err := database.DB.
+		Preload("Actor", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, role") }).
+		Where("asset_id = ?", asset.ID).
+		Order("created_at ASC").
+		Find(&history).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch unit history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"asset":   asset,
+		"history": history,
+	})
+}
+
+// UpdateAssetStatus moves a unit between warehouse states, such as sending a returned
+// unit for refurbishing or scrapping it, which writes it off the franchise's stock
+// (Admin or Franchise Owner)
+func UpdateAssetStatus(c *gin.Context) {
+	assetID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset ID"})
+		return
+	}
+
+	var request UpdateAssetStatusRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	query, ok := assetScope(c, tx)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+	role := c.GetString("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, _ := userIDValue.(uint)
+
+	var asset database.Asset
+	if err := query.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&asset, assetID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unit not found or you don't have permission to manage it"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	allowed := assetTransitions[asset.Status]
+	permitted := false
+	for _, status := range allowed {
+		if status == request.Status {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		tx.Rollback()
+		if allowed == nil {
+			allowed = []string{}
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Invalid unit status transition",
+			"code":    "invalid_status_transition",
+			"from":    asset.Status,
+			"to":      request.Status,
+			"allowed": allowed,
+		})
+		return
+	}
+
+	if err := moveAsset(tx, &asset, request.Status, nil, role, &userID, request.Notes); err != nil {
+		tx.Rollback()
+		log.Printf("Error updating asset: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update unit"})
+		return
+	}
+
+	// Units are only scrapped from the franchise's hands, so they leave its stock
+	if request.Status == AssetStatusScrapped {
+		notes := "Scrapped unit " + asset.SerialNumber
+		if request.Notes != "" {
+			notes += ": " + request.Notes
+		}
+		if _, err := adjustInventory(tx, asset.FranchiseID, asset.ProductID, InventoryMovementWriteOff, -1, InventoryReference{
+			ActorRole: role,
+			ActorID:   &userID,
+			Notes:     notes,
+		}); err != nil {
+			tx.Rollback()
+			if errors.Is(err, ErrOutOfStock) {
+				c.JSON(http.StatusConflict, gin.H{"error": "The franchise has no stock of this product left to write off", "code": "out_of_stock"})
+				return
+			}
+			log.Printf("Error recording stock write-off: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update unit"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update unit"})
+		return
+	}
+
+	c.JSON(http.StatusOK, asset)
+}
+
+// assetScope returns a query on db over the units the caller may see: all of them for
+// admins and those of their own franchises for franchise owners
+func assetScope(c *gin.Context, db *gorm.DB) (*gorm.DB, bool) {
+	role := c.GetString("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	query := db.Model(&database.Asset{})
+	switch role {
+	case RoleAdmin:
+		// Admin can see every unit
+	case RoleFranchiseOwner:
+		query = query.Where("franchise_id IN (SELECT id FROM franchises WHERE owner_id = ?)", userID)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return nil, false
+	}
+	return query, true
+}
@@ -0,0 +1,302 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// assetTransitions lists the statuses an asset may be moved to by hand from its current
+// status. Reservation, installation and return happen through the order and service flows.
+var assetTransitions = map[string][]string{
+	AssetStatusInWarehouse:  {AssetStatusRefurbishing, AssetStatusScrapped},
+	AssetStatusReturned:     {AssetStatusInWarehouse, AssetStatusRefurbishing, AssetStatusScrapped},
+	AssetStatusRefurbishing: {AssetStatusInWarehouse, AssetStatusScrapped},
+}
+
+// AssetAllocationError is returned when a named unit cannot be allocated to an order
+type AssetAllocationError struct {
+	SerialNumber string
+	Reason       string
+}
+
+func (e *AssetAllocationError) Error() string {
+	return fmt.Sprintf("unit %s %s", e.SerialNumber, e.Reason)
+}
+
+// moveAsset changes the status of asset inside tx together with any other column
+// updates, and records the change in the asset history
+func moveAsset(tx *gorm.DB, asset *database.Asset, to string, updates map[string]interface{}, actorRole string, actorID *uint, notes string) error {
+	from := asset.Status
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["status"] = to
+	if err := tx.Model(asset).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	history := database.AssetStatusHistory{
+		AssetID:        asset.ID,
+		FromStatus:     from,
+		ToStatus:       to,
+		OrderID:        asset.OrderID,
+		SubscriptionID: asset.SubscriptionID,
+		ActorID:        actorID,
+		ActorRole:      actorRole,
+		Notes:          notes,
+	}
+	return tx.Create(&history).Error
+}
+
+// lockOrderAsset returns the unit reserved for or installed at order, locked for update,
+// or nil when it has none
+func lockOrderAsset(tx *gorm.DB, orderID uint) (*database.Asset, error) {
+	var asset database.Asset
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status IN ?", orderID, []string{AssetStatusReserved, AssetStatusInstalled}).
+		First(&asset).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+// lockWarehouseAsset picks a unit of product from the franchise warehouse, skipping
+// units locked by concurrent allocations. It returns nil when none is left.
+func lockWarehouseAsset(tx *gorm.DB, productID, franchiseID uint) (*database.Asset, error) {
+	var asset database.Asset
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("product_id = ? AND franchise_id = ? AND status = ?", productID, franchiseID, AssetStatusInWarehouse).
+		Order("id ASC").
+		First(&asset).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+// reserveOrderAsset reserves a warehouse unit for an approved order. Orders can be
+// approved before the franchise has registered its units, so finding none is not an
+// error; installation tries again.
+func reserveOrderAsset(tx *gorm.DB, order *database.Order, actorRole string, actorID *uint) error {
+	existing, err := lockOrderAsset(tx, order.ID)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	asset, err := lockWarehouseAsset(tx, order.ProductID, order.FranchiseID)
+	if err != nil || asset == nil {
+		return err
+	}
+
+	orderID := order.ID
+	asset.OrderID = &orderID
+	return moveAsset(tx, asset, AssetStatusReserved, map[string]interface{}{"order_id": orderID},
+		actorRole, actorID, fmt.Sprintf("Reserved for order #%d", order.ID))
+}
+
+// assignOrderAsset reserves the unit with the given serial number for order in place of
+// any unit reserved for it before
+func assignOrderAsset(tx *gorm.DB, order *database.Order, serialNumber string, actorRole string, actorID *uint) error {
+	var asset database.Asset
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("serial_number = ?", serialNumber).
+		First(&asset).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &AssetAllocationError{SerialNumber: serialNumber, Reason: "is not registered"}
+		}
+		return err
+	}
+	if asset.OrderID != nil && *asset.OrderID == order.ID {
+		return nil
+	}
+	if asset.ProductID != order.ProductID {
+		return &AssetAllocationError{SerialNumber: serialNumber, Reason: "is not a unit of the ordered product"}
+	}
+	if asset.FranchiseID != order.FranchiseID {
+		return &AssetAllocationError{SerialNumber: serialNumber, Reason: "belongs to another franchise"}
+	}
+	if asset.Status != AssetStatusInWarehouse {
+		return &AssetAllocationError{SerialNumber: serialNumber, Reason: "is " + asset.Status}
+	}
+
+	previous, err := lockOrderAsset(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		if previous.Status == AssetStatusInstalled {
+			return &AssetAllocationError{SerialNumber: serialNumber, Reason: "cannot replace the unit already installed"}
+		}
+		if err := moveAsset(tx, previous, AssetStatusInWarehouse, map[string]interface{}{"order_id": nil},
+			actorRole, actorID, fmt.Sprintf("Replaced by unit %s for order #%d", serialNumber, order.ID)); err != nil {
+			return err
+		}
+	}
+
+	orderID := order.ID
+	asset.OrderID = &orderID
+	return moveAsset(tx, &asset, AssetStatusReserved, map[string]interface{}{"order_id": orderID},
+		actorRole, actorID, fmt.Sprintf("Reserved for order #%d", order.ID))
+}
+
+// installOrderAsset marks the unit reserved for order as installed at its subscription,
+// reserving one first if none was. Stock held before the registry has no serial numbers
+// to register it by, so like a swap the step is skipped when the warehouse has no unit,
+// leaving the franchise to register the installed unit later.
+func installOrderAsset(tx *gorm.DB, order *database.Order, actorRole string, actorID *uint) error {
+	if err := reserveOrderAsset(tx, order, actorRole, actorID); err != nil {
+		return err
+	}
+	asset, err := lockOrderAsset(tx, order.ID)
+	if err != nil || asset == nil {
+		return err
+	}
+	if asset.Status == AssetStatusInstalled {
+		return nil
+	}
+
+	var subscription database.Subscription
+	if err := tx.Select("id").Where("order_id = ?", order.ID).First(&subscription).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	asset.SubscriptionID = &subscription.ID
+	return moveAsset(tx, asset, AssetStatusInstalled, map[string]interface{}{
+		"subscription_id": subscription.ID,
+		"installed_at":    now,
+	}, actorRole, actorID, fmt.Sprintf("Installed for subscription #%d", subscription.ID))
+}
+
+// releaseOrderAsset frees the unit of a cancelled or rejected order: a reserved unit goes
+// back to the warehouse and an installed one is marked returned
+func releaseOrderAsset(tx *gorm.DB, orderID uint, actorRole string, actorID *uint, notes string) error {
+	asset, err := lockOrderAsset(tx, orderID)
+	if err != nil || asset == nil {
+		return err
+	}
+
+	to := AssetStatusInWarehouse
+	if asset.Status == AssetStatusInstalled {
+		to = AssetStatusReturned
+	}
+	return moveAsset(tx, asset, to, map[string]interface{}{
+		"order_id":        nil,
+		"subscription_id": nil,
+		"installed_at":    nil,
+	}, actorRole, actorID, notes)
+}
+
+// collectSubscriptionUnit arranges for the unit of subscription to be collected from the
+// customer, unless a pickup for it is already open or done. Completing the pickup takes
+// the unit back with returnSubscriptionAsset. It returns nil when the unit was never
+// delivered to the customer.
+func collectSubscriptionUnit(tx *gorm.DB, subscription *database.Subscription, description string) (*database.ServiceRequest, error) {
+	var pickup database.ServiceRequest
+	err := tx.Where("subscription_id = ? AND type = ? AND status <> ?",
+		subscription.ID, ServiceTypeDevicePickup, ServiceStatusCancelled).
+		First(&pickup).Error
+	if err == nil {
+		return &pickup, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	delivered, err := unitWithCustomer(tx, subscription)
+	if err != nil || !delivered {
+		return nil, err
+	}
+	return raiseDevicePickup(tx, subscription, description)
+}
+
+// unitWithCustomer reports whether the unit of subscription has reached the customer:
+// a unit is installed there or its order has been delivered
+func unitWithCustomer(tx *gorm.DB, subscription *database.Subscription) (bool, error) {
+	var installed int64
+	if err := tx.Model(&database.Asset{}).
+		Where("subscription_id = ? AND status = ?", subscription.ID, AssetStatusInstalled).
+		Count(&installed).Error; err != nil {
+		return false, err
+	}
+	if installed > 0 {
+		return true, nil
+	}
+
+	deliveredStatuses := []string{OrderStatusDelivered, OrderStatusInstalled, OrderStatusCompleted}
+	var delivered int64
+	if err := tx.Model(&database.Order{}).
+		Where("id = ? AND (status IN ? OR EXISTS (?))", subscription.OrderID, deliveredStatuses,
+			tx.Model(&database.OrderStatusHistory{}).Select("1").
+				Where("order_status_histories.order_id = orders.id AND order_status_histories.to_status IN ?", deliveredStatuses)).
+		Count(&delivered).Error; err != nil {
+		return false, err
+	}
+	return delivered > 0, nil
+}
+
+// returnSubscriptionAsset takes back the unit of productID collected from subscription:
+// the unit installed there, or delivered and still reserved for its order, is marked
+// returned and counted back into the franchise's stock. Units installed before the
+// franchise registered them are counted back too.
+func returnSubscriptionAsset(tx *gorm.DB, subscription *database.Subscription, productID uint, ref InventoryReference) error {
+	var asset database.Asset
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("(subscription_id = ? AND status = ?) OR (order_id = ? AND status = ?)",
+			subscription.ID, AssetStatusInstalled, subscription.OrderID, AssetStatusReserved).
+		First(&asset).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err == nil {
+		productID = asset.ProductID
+		if err := moveAsset(tx, &asset, AssetStatusReturned, map[string]interface{}{
+			"order_id":        nil,
+			"subscription_id": nil,
+			"installed_at":    nil,
+		}, ref.ActorRole, ref.ActorID, ref.Notes); err != nil {
+			return err
+		}
+	}
+
+	orderID := subscription.OrderID
+	ref.OrderID = &orderID
+	_, err = adjustInventory(tx, subscription.FranchiseID, productID, InventoryMovementReturn, 1, ref)
+	return err
+}
+
+// swapSubscriptionAsset takes back the unit of previousProductID installed at
+// subscription and installs a unit of its current product from the franchise warehouse
+// in its place. The new unit was taken from stock when the change was requested. It is
+// skipped when the warehouse has none registered, leaving the franchise to register it.
+func swapSubscriptionAsset(tx *gorm.DB, subscription *database.Subscription, previousProductID uint, at time.Time, ref InventoryReference) error {
+	if err := returnSubscriptionAsset(tx, subscription, previousProductID, ref); err != nil {
+		return err
+	}
+
+	asset, err := lockWarehouseAsset(tx, subscription.ProductID, subscription.FranchiseID)
+	if err != nil || asset == nil {
+		return err
+	}
+
+	orderID, subscriptionID := subscription.OrderID, subscription.ID
+	asset.OrderID, asset.SubscriptionID = &orderID, &subscriptionID
+	return moveAsset(tx, asset, AssetStatusInstalled, map[string]interface{}{
+		"order_id":        orderID,
+		"subscription_id": subscriptionID,
+		"installed_at":    at,
+	}, ref.ActorRole, ref.ActorID, ref.Notes)
+}
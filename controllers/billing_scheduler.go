@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// StartBillingScheduler starts the background job that raises monthly invoices
+// for subscriptions whose billing date has passed
+func StartBillingScheduler() {
+	interval := time.Duration(config.AppConfig.BillingJobIntervalMinutes) * time.Minute
+	runPeriodically("Billing", interval, RunBillingCycle)
+}
+
+// RunBillingCycle creates a pending monthly payment for every billing period that has
+// started by now. It is safe to run repeatedly: each period is billed at most once.
+func RunBillingCycle(now time.Time) {
+	var subscriptionIDs []uint
+	if err := database.DB.Model(&database.Subscription{}).
+		Where("status IN ? AND next_billing_date <= ?",
+			[]string{SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusSuspended}, now).
+		Pluck("id", &subscriptionIDs).Error; err != nil {
+		log.Printf("Billing: failed to load due subscriptions: %v", err)
+		return
+	}
+
+	invoiced := 0
+	for _, id := range subscriptionIDs {
+		count, err := billSubscription(id, now)
+		if err != nil {
+			log.Printf("Billing: subscription #%d failed: %v", id, err)
+			continue
+		}
+		invoiced += count
+	}
+
+	if invoiced > 0 {
+		log.Printf("Billing: raised %d monthly invoice(s)", invoiced)
+	}
+}
+
+// billSubscription raises invoices for every due period of one subscription and moves
+// its billing date past now. Periods that come due while the subscription is paused are
+// skipped without an invoice. Returns the number of invoices created.
+func billSubscription(subscriptionID uint, now time.Time) (int, error) {
+	created := 0
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the subscription so concurrent runs see the advanced billing date
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&subscription, subscriptionID).Error; err != nil {
+			return err
+		}
+
+		nextBillingDate := subscription.NextBillingDate
+		for !nextBillingDate.After(now) {
+			// Nothing is billed for periods starting after the rental term ends
+			if !subscription.EndDate.IsZero() && !nextBillingDate.Before(subscription.EndDate) {
+				break
+			}
+
+			periodStart := nextBillingDate
+			periodEnd := nextBillingDateAfter(subscription.StartDate, periodStart)
+
+			// Suspended subscriptions keep accruing rent until the arrears are paid
+			if subscription.Status == SubscriptionStatusActive || subscription.Status == SubscriptionStatusSuspended {
+				ok, err := createPeriodInvoice(tx, &subscription, periodStart, periodEnd)
+				if err != nil {
+					return err
+				}
+				if ok {
+					created++
+				}
+			}
+
+			nextBillingDate = periodEnd
+		}
+
+		if nextBillingDate.Equal(subscription.NextBillingDate) {
+			return nil
+		}
+		return tx.Model(&subscription).Update("next_billing_date", nextBillingDate).Error
+	})
+
+	return created, err
+}
+
+// createPeriodInvoice creates the pending monthly payment for one billing period and
+// notifies the customer. It returns false when the period already has a payment.
+func createPeriodInvoice(tx *gorm.DB, subscription *database.Subscription, periodStart, periodEnd time.Time) (bool, error) {
+	var existing int64
+	if err := tx.Model(&database.Payment{}).
+		Where("subscription_id = ? AND billing_period_start = ?", subscription.ID, periodStart).
+		Count(&existing).Error; err != nil {
+		return false, err
+	}
+	if existing > 0 {
+		return false, nil
+	}
+
+	subscriptionID := subscription.ID
+	orderID := subscription.OrderID
+	payment := database.Payment{
+		CustomerID:         subscription.CustomerID,
+		OrderID:            &orderID,
+		SubscriptionID:     &subscriptionID,
+		Amount:             subscription.MonthlyRent,
+		PaymentType:        "monthly",
+		Status:             database.PaymentStatusPending,
+		BillingPeriodStart: &periodStart,
+		BillingPeriodEnd:   &periodEnd,
+		Notes: fmt.Sprintf("Monthly rent for %s to %s",
+			periodStart.Format("02 Jan 2006"), periodEnd.Format("02 Jan 2006")),
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return false, err
+	}
+
+	// Settle prorated charges and credits from pauses, cancellations and plan changes
+	if err := applyProrations(tx, subscription, &payment); err != nil {
+		return false, err
+	}
+
+	period := periodStart.Format("02 Jan 2006") + " to " + periodEnd.Format("02 Jan 2006")
+	title := "Monthly Rent Due"
+	message := fmt.Sprintf("Your monthly rent of ₹%.2f for %s is due.", payment.Amount, period)
+	if payment.Status == database.PaymentStatusPaid {
+		title = "Monthly Rent Paid"
+		message = fmt.Sprintf("Your monthly rent for %s has been covered by your account credit.", period)
+	}
+	notification := database.Notification{
+		UserID:      subscription.CustomerID,
+		Title:       title,
+		Message:     message,
+		Type:        "payment",
+		RelatedID:   &subscriptionID,
+		RelatedType: "subscription",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// addMonths returns t moved by whole calendar months. Unlike time.AddDate it does not
+// overflow into the following month: a day past the end of the target month is clamped
+// to its last day, so Jan 31 plus one month is Feb 28 (or 29).
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// nextBillingDateAfter returns the first billing date strictly after t. Billing dates
+// fall on whole months from the subscription start so they never drift with payment time.
+func nextBillingDateAfter(startDate, t time.Time) time.Time {
+	months := (t.Year()-startDate.Year())*12 + int(t.Month()-startDate.Month())
+	if months < 0 {
+		months = 0
+	}
+	for months > 0 && addMonths(startDate, months).After(t) {
+		months--
+	}
+	for !addMonths(startDate, months).After(t) {
+		months++
+	}
+	return addMonths(startDate, months)
+}
+
+// billingPeriodAt returns the billing period containing t. Times before the subscription
+// starts fall in its first period.
+func billingPeriodAt(startDate, t time.Time) (time.Time, time.Time) {
+	if t.Before(startDate) {
+		t = startDate
+	}
+	end := nextBillingDateAfter(startDate, t)
+	start := startDate
+	for months := 1; addMonths(startDate, months).Before(end); months++ {
+		start = addMonths(startDate, months)
+	}
+	return start, end
+}
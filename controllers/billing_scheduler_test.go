@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   time.Time
+		months int
+		want   time.Time
+	}{
+		{"same day next month", date(2026, time.March, 15), 1, date(2026, time.April, 15)},
+		{"Jan 31 clamps to Feb 28", date(2026, time.January, 31), 1, date(2026, time.February, 28)},
+		{"Jan 31 clamps to Feb 29 in a leap year", date(2028, time.January, 31), 1, date(2028, time.February, 29)},
+		{"Jan 31 plus two months keeps the 31st", date(2026, time.January, 31), 2, date(2026, time.March, 31)},
+		{"Mar 31 clamps to Apr 30", date(2026, time.March, 31), 1, date(2026, time.April, 30)},
+		{"crosses the year", date(2026, time.November, 30), 3, date(2027, time.February, 28)},
+		{"twelve months", date(2026, time.May, 31), 12, date(2027, time.May, 31)},
+		{"zero months", date(2026, time.June, 30), 0, date(2026, time.June, 30)},
+		{"backwards", date(2026, time.March, 31), -1, date(2026, time.February, 28)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addMonths(tt.from, tt.months); !got.Equal(tt.want) {
+				t.Errorf("addMonths(%s, %d) = %s, want %s", tt.from, tt.months, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextBillingDateAfter(t *testing.T) {
+	start := date(2026, time.January, 31)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want time.Time
+	}{
+		{"before the start", date(2026, time.January, 1), date(2026, time.January, 31)},
+		{"at the start", start, date(2026, time.February, 28)},
+		{"inside the first period", date(2026, time.February, 10), date(2026, time.February, 28)},
+		{"on a clamped billing date", date(2026, time.February, 28), date(2026, time.March, 31)},
+		{"inside a short month period", date(2026, time.April, 15), date(2026, time.April, 30)},
+		{"a year later", date(2027, time.February, 1), date(2027, time.February, 28)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBillingDateAfter(start, tt.at); !got.Equal(tt.want) {
+				t.Errorf("nextBillingDateAfter(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBillingPeriodAt(t *testing.T) {
+	start := date(2026, time.January, 31)
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"before the start falls in the first period", date(2026, time.January, 10), start, date(2026, time.February, 28)},
+		{"first period", date(2026, time.February, 5), start, date(2026, time.February, 28)},
+		{"period starting on a clamped date", date(2026, time.March, 10), date(2026, time.February, 28), date(2026, time.March, 31)},
+		{"period ending on a clamped date", date(2026, time.April, 10), date(2026, time.March, 31), date(2026, time.April, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStart, gotEnd := billingPeriodAt(start, tt.at)
+			if !gotStart.Equal(tt.wantStart) || !gotEnd.Equal(tt.wantEnd) {
+				t.Errorf("billingPeriodAt(%s) = %s - %s, want %s - %s", tt.at, gotStart, gotEnd, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
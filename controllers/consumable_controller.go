@@ -0,0 +1,559 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// Consumable component types
+const (
+	ComponentTypeROMembrane     = "ro_membrane"
+	ComponentTypeSedimentFilter = "sediment_filter"
+	ComponentTypeCarbonFilter   = "carbon_filter"
+	ComponentTypeUVLamp         = "uv_lamp"
+	ComponentTypeOther          = "other"
+)
+
+// ProductComponentRequest contains data for defining a consumable component of a product
+type ProductComponentRequest struct {
+	Name           string  `json:"name" binding:"required"`
+	Type           string  `json:"type" binding:"required,oneof=ro_membrane sediment_filter carbon_filter uv_lamp other"`
+	LifespanDays   int     `json:"lifespan_days" binding:"min=0"`
+	LifespanLitres int     `json:"lifespan_litres" binding:"min=0"`
+	Price          float64 `json:"price" binding:"min=0"`
+	IsActive       *bool   `json:"is_active"`
+}
+
+// ComponentReplacementRequest contains the components replaced during a service visit
+type ComponentReplacementRequest struct {
+	Replacements []ComponentReplacementItem `json:"replacements" binding:"required,min=1,dive"`
+	// Flow meter reading in litres taken during the visit
+	MeterReading *int `json:"meter_reading" binding:"omitempty,min=0"`
+}
+
+// ComponentReplacementItem identifies one replaced component
+type ComponentReplacementItem struct {
+	InstalledComponentID uint   `json:"installed_component_id" binding:"required"`
+	Notes                string `json:"notes"`
+}
+
+// InstalledComponentStatus is an installed component with its replacement due date. The
+// due date is the earlier of the day and litre lifespans; the litre one is projected
+// from the average usage since installation.
+type InstalledComponentStatus struct {
+	database.InstalledComponent
+	LitresUsed    int        `json:"litres_used"`
+	DueDate       *time.Time `json:"due_date"`
+	DaysRemaining *int       `json:"days_remaining"`
+	IsDue         bool       `json:"is_due"`
+}
+
+// CreateProductComponent adds a consumable component to a product (Admin only)
+func CreateProductComponent(c *gin.Context) {
+	productID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var request ProductComponentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.LifespanDays == 0 && request.LifespanLitres == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A lifespan in days or litres is required"})
+		return
+	}
+
+	var product database.Product
+	if err := database.DB.Select("id").First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	component := database.ProductComponent{
+		ProductID:      product.ID,
+		Name:           request.Name,
+		Type:           request.Type,
+		LifespanDays:   request.LifespanDays,
+		LifespanLitres: request.LifespanLitres,
+		Price:          request.Price,
+		IsActive:       request.IsActive == nil || *request.IsActive,
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Create(&component).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error creating product component: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create component"})
+		return
+	}
+	// GORM skips false for a field with a default
+	if !component.IsActive {
+		if err := tx.Model(&component).Update("is_active", false).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error creating product component: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create component"})
+			return
+		}
+	}
+
+	// Units already out with customers came fitted with the component
+	var subscriptions []database.Subscription
+	if err := tx.Select("id, start_date").
+		Where("product_id = ? AND status IN ?", product.ID, []string{
+			SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusSuspended,
+		}).
+		Find(&subscriptions).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	for _, subscription := range subscriptions {
+		installed := database.InstalledComponent{
+			SubscriptionID:     subscription.ID,
+			ProductComponentID: component.ID,
+			InstalledAt:        subscription.StartDate,
+		}
+		if err := tx.Create(&installed).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error installing component: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create component"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create component"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, component)
+}
+
+// GetProductComponents lists the consumable components of a product (Admin only)
+func GetProductComponents(c *gin.Context) {
+	productID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var components []database.ProductComponent
+	if err := database.DB.Where("product_id = ?", productID).Order("id ASC").Find(&components).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch components"})
+		return
+	}
+
+	c.JSON(http.StatusOK, components)
+}
+
+// UpdateProductComponent updates a consumable component definition (Admin only). New
+// lifespans apply to the due dates of components already installed.
+func UpdateProductComponent(c *gin.Context) {
+	componentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid component ID"})
+		return
+	}
+
+	var request ProductComponentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.LifespanDays == 0 && request.LifespanLitres == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A lifespan in days or litres is required"})
+		return
+	}
+
+	var component database.ProductComponent
+	if err := database.DB.First(&component, componentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Component not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	updates := map[string]interface{}{
+		"name":            request.Name,
+		"type":            request.Type,
+		"lifespan_days":   request.LifespanDays,
+		"lifespan_litres": request.LifespanLitres,
+		"price":           request.Price,
+	}
+	if request.IsActive != nil {
+		updates["is_active"] = *request.IsActive
+	}
+	if err := database.DB.Model(&component).Updates(updates).Error; err != nil {
+		log.Printf("Error updating product component: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update component"})
+		return
+	}
+
+	c.JSON(http.StatusOK, component)
+}
+
+// DeleteProductComponent removes a consumable component definition (Admin only). Installed
+// components of the definition are no longer tracked.
+func DeleteProductComponent(c *gin.Context) {
+	componentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid component ID"})
+		return
+	}
+
+	result := database.DB.Delete(&database.ProductComponent{}, componentID)
+	if result.Error != nil {
+		log.Printf("Error deleting product component: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete component"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Component not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Component deleted successfully"})
+}
+
+// GetSubscriptionComponents lists the components installed for a subscription and when
+// each is due for replacement
+func GetSubscriptionComponents(c *gin.Context) {
+	subscriptionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	role, _ := c.Get("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	query, ok := scopeSubscriptionsForRole(
+		database.DB.Model(&database.Subscription{}).Where("subscriptions.id = ?", subscriptionID), role, userID)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you don't have permission to view it"})
+		return
+	}
+
+	statuses, err := subscriptionComponentStatuses(database.DB, uint(subscriptionID), time.Now())
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch components"})
+		return
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+// ReplaceServiceComponents records the components an agent replaced during a service
+// request (Service agent only). Replaced components start a new lifespan from now.
+func ReplaceServiceComponents(c *gin.Context) {
+	requestID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+
+	var request ComponentReplacementRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var serviceRequest database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND service_agent_id = ?", requestID, agentID).
+		First(&serviceRequest).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service request not found or not assigned to you"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if serviceRequest.Status == ServiceStatusCompleted || serviceRequest.Status == ServiceStatusCancelled {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot log replacements on a " + serviceRequest.Status + " service request"})
+		return
+	}
+
+	var installed []database.InstalledComponent
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("subscription_id = ? AND is_active = ?", serviceRequest.SubscriptionID, true).
+		Find(&installed).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	byID := make(map[uint]*database.InstalledComponent, len(installed))
+	for i := range installed {
+		if request.MeterReading != nil && *request.MeterReading < installed[i].LastMeterReading {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+				"Meter reading cannot be lower than the last reading of %d litres", installed[i].LastMeterReading)})
+			return
+		}
+		byID[installed[i].ID] = &installed[i]
+	}
+
+	now := time.Now()
+	replaced := make(map[uint]bool, len(request.Replacements))
+	replacements := make([]database.ComponentReplacement, 0, len(request.Replacements))
+	for _, item := range request.Replacements {
+		component, ok := byID[item.InstalledComponentID]
+		if !ok {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+				"Component #%d is not installed for this subscription", item.InstalledComponentID)})
+			return
+		}
+		if replaced[component.ID] {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Component #%d is listed more than once", component.ID)})
+			return
+		}
+		replaced[component.ID] = true
+
+		reading := component.LastMeterReading
+		if request.MeterReading != nil {
+			reading = *request.MeterReading
+		}
+
+		replacement := database.ComponentReplacement{
+			InstalledComponentID: component.ID,
+			SubscriptionID:       serviceRequest.SubscriptionID,
+			ServiceRequestID:     serviceRequest.ID,
+			ReplacedByID:         agentID,
+			ReplacedAt:           now,
+			PreviousInstalledAt:  component.InstalledAt,
+			MeterReading:         reading,
+			LitresUsed:           reading - component.InstalledLitres,
+			Notes:                item.Notes,
+		}
+		if err := tx.Create(&replacement).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error recording component replacement: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+			return
+		}
+		replacements = append(replacements, replacement)
+
+		if err := tx.Model(component).Updates(map[string]interface{}{
+			"installed_at":       now,
+			"installed_litres":   reading,
+			"last_meter_reading": reading,
+			"last_reading_at":    now,
+			"replacement_count":  component.ReplacementCount + 1,
+		}).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error updating installed component: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+			return
+		}
+	}
+
+	// The reading also tells how far the remaining components are through their lifespan
+	if request.MeterReading != nil {
+		for i := range installed {
+			if replaced[installed[i].ID] {
+				continue
+			}
+			if err := tx.Model(&installed[i]).Updates(map[string]interface{}{
+				"last_meter_reading": *request.MeterReading,
+				"last_reading_at":    now,
+			}).Error; err != nil {
+				tx.Rollback()
+				log.Printf("Error updating installed component: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+				return
+			}
+		}
+	}
+
+	notification := database.Notification{
+		UserID:      serviceRequest.CustomerID,
+		Title:       "Filters Replaced",
+		Message:     fmt.Sprintf("Our technician replaced %d component(s) in your purifier during service request #%d.", len(replacements), serviceRequest.ID),
+		Type:        "service_request",
+		RelatedID:   &serviceRequest.ID,
+		RelatedType: "service_request",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error creating notification: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+		return
+	}
+
+	statuses, err := subscriptionComponentStatuses(tx, serviceRequest.SubscriptionID, now)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record replacements"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Replacements recorded successfully",
+		"replacements": replacements,
+		"components":   statuses,
+	})
+}
+
+// installProductComponents fits the subscription with a fresh set of its product's
+// components at the given time, retiring any components installed before
+func installProductComponents(tx *gorm.DB, subscription *database.Subscription, at time.Time) error {
+	if err := tx.Model(&database.InstalledComponent{}).
+		Where("subscription_id = ? AND is_active = ?", subscription.ID, true).
+		Update("is_active", false).Error; err != nil {
+		return err
+	}
+
+	var components []database.ProductComponent
+	if err := tx.Select("id").
+		Where("product_id = ? AND is_active = ?", subscription.ProductID, true).
+		Find(&components).Error; err != nil {
+		return err
+	}
+
+	for _, component := range components {
+		installed := database.InstalledComponent{
+			SubscriptionID:     subscription.ID,
+			ProductComponentID: component.ID,
+			InstalledAt:        at,
+		}
+		if err := tx.Create(&installed).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriptionComponentStatuses returns the tracked components installed for a
+// subscription, soonest due first
+func subscriptionComponentStatuses(tx *gorm.DB, subscriptionID uint, now time.Time) ([]InstalledComponentStatus, error) {
+	var installed []database.InstalledComponent
+	if err := tx.Preload("ProductComponent").
+		Where("subscription_id = ? AND is_active = ?", subscriptionID, true).
+		Where("product_component_id IN (?)", tx.Model(&database.ProductComponent{}).
+			Select("id").Where("is_active = ?", true)).
+		Order("id ASC").
+		Find(&installed).Error; err != nil {
+		return nil, err
+	}
+
+	statuses := make([]InstalledComponentStatus, 0, len(installed))
+	for _, component := range installed {
+		statuses = append(statuses, componentStatus(component, now))
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].DueDate == nil || statuses[j].DueDate == nil {
+			return statuses[j].DueDate == nil && statuses[i].DueDate != nil
+		}
+		return statuses[i].DueDate.Before(*statuses[j].DueDate)
+	})
+	return statuses, nil
+}
+
+// componentStatus works out when an installed component is due for replacement
+func componentStatus(component database.InstalledComponent, now time.Time) InstalledComponentStatus {
+	status := InstalledComponentStatus{InstalledComponent: component}
+	if component.LastReadingAt != nil {
+		status.LitresUsed = component.LastMeterReading - component.InstalledLitres
+	}
+
+	definition := component.ProductComponent
+	if definition == nil {
+		return status
+	}
+
+	setDue := func(due time.Time) {
+		if status.DueDate == nil || due.Before(*status.DueDate) {
+			status.DueDate = &due
+		}
+	}
+
+	if definition.LifespanDays > 0 {
+		setDue(component.InstalledAt.AddDate(0, 0, definition.LifespanDays))
+	}
+
+	if definition.LifespanLitres > 0 && status.LitresUsed > 0 {
+		if status.LitresUsed >= definition.LifespanLitres {
+			setDue(*component.LastReadingAt)
+		} else if elapsed := component.LastReadingAt.Sub(component.InstalledAt); elapsed > 0 {
+			// Project when the remaining litres run out at the average daily usage so far
+			dailyUsage := float64(status.LitresUsed) / (elapsed.Hours() / 24)
+			daysLeft := float64(definition.LifespanLitres-status.LitresUsed) / dailyUsage
+			if daysLeft < 100*365 {
+				setDue(component.LastReadingAt.AddDate(0, 0, int(math.Ceil(daysLeft))))
+			}
+		}
+	}
+
+	if status.DueDate != nil {
+		daysRemaining := int(math.Ceil(status.DueDate.Sub(now).Hours() / 24))
+		status.DaysRemaining = &daysRemaining
+		status.IsDue = !status.DueDate.After(now)
+	}
+	return status
+}
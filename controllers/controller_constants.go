@@ -35,6 +35,7 @@ const (
 	SubscriptionStatusPaused    = database.SubscriptionStatusPaused
 	SubscriptionStatusCancelled = database.SubscriptionStatusCancelled
 	SubscriptionStatusExpired   = database.SubscriptionStatusExpired
+	SubscriptionStatusSuspended = database.SubscriptionStatusSuspended
 
 	// Define missing constants used in old code
 	SubscriptionStatusInactive = "inactive"
@@ -50,6 +51,13 @@ const (
 	ServiceStatusCancelled  = database.ServiceStatusCancelled
 )
 
+// Service request type constants
+const (
+	ServiceTypeMaintenance  = "maintenance"   // Periodic maintenance raised by the maintenance scheduler
+	ServiceTypeProductSwap  = "product_swap"  // Swap the device after a plan change
+	ServiceTypeDevicePickup = "device_pickup" // Collect the device when a subscription ends
+)
+
 // Payment status constants
 const (
 	PaymentStatusPending  = database.PaymentStatusPending
@@ -58,3 +66,89 @@ const (
 	PaymentStatusFailed   = database.PaymentStatusFailed
 	PaymentStatusRefunded = database.PaymentStatusRefunded
 )
+
+// Asset status constants
+const (
+	AssetStatusInWarehouse  = database.AssetStatusInWarehouse
+	AssetStatusReserved     = database.AssetStatusReserved
+	AssetStatusInstalled    = database.AssetStatusInstalled
+	AssetStatusReturned     = database.AssetStatusReturned
+	AssetStatusRefurbishing = database.AssetStatusRefurbishing
+	AssetStatusScrapped     = database.AssetStatusScrapped
+)
+
+// Subscription plan change status constants
+const (
+	PlanChangePending   = database.PlanChangePending
+	PlanChangeApplied   = database.PlanChangeApplied
+	PlanChangeCancelled = database.PlanChangeCancelled
+)
+
+// Stock reservation status constants
+const (
+	StockReservationReserved  = database.StockReservationReserved
+	StockReservationAllocated = database.StockReservationAllocated
+	StockReservationReleased  = database.StockReservationReleased
+	StockReservationExpired   = database.StockReservationExpired
+)
+
+// Inventory movement type constants
+const (
+	InventoryMovementReceipt     = database.InventoryMovementReceipt
+	InventoryMovementAllocation  = database.InventoryMovementAllocation
+	InventoryMovementReturn      = database.InventoryMovementReturn
+	InventoryMovementTransferOut = database.InventoryMovementTransferOut
+	InventoryMovementTransferIn  = database.InventoryMovementTransferIn
+	InventoryMovementWriteOff    = database.InventoryMovementWriteOff
+	InventoryMovementServiceUse  = database.InventoryMovementServiceUse
+)
+
+// Order routing method constants
+const (
+	OrderRoutingCustomer = database.OrderRoutingCustomer
+	OrderRoutingAuto     = database.OrderRoutingAuto
+	OrderRoutingAdmin    = database.OrderRoutingAdmin
+)
+
+// Order triage status constants
+const (
+	OrderTriageOpen      = database.OrderTriageOpen
+	OrderTriageRouted    = database.OrderTriageRouted
+	OrderTriageDismissed = database.OrderTriageDismissed
+)
+
+// Franchise agent membership status constants
+const (
+	FranchiseAgentInvited  = database.FranchiseAgentInvited
+	FranchiseAgentActive   = database.FranchiseAgentActive
+	FranchiseAgentInactive = database.FranchiseAgentInactive
+)
+
+// Service dispatch action constants
+const (
+	ServiceDispatchAssigned  = database.ServiceDispatchAssigned
+	ServiceDispatchRejected  = database.ServiceDispatchRejected
+	ServiceDispatchNoAgent   = database.ServiceDispatchNoAgent
+	ServiceDispatchEscalated = database.ServiceDispatchEscalated
+)
+
+// Service SLA escalation levels
+const (
+	SLAEscalationNone  = database.SLAEscalationNone
+	SLAEscalationOwner = database.SLAEscalationOwner
+	SLAEscalationAdmin = database.SLAEscalationAdmin
+)
+
+// Job card constants
+const (
+	JobPhotoBefore = database.JobPhotoBefore
+	JobPhotoAfter  = database.JobPhotoAfter
+
+	JobCardConfirmedBySignature = database.JobCardConfirmedBySignature
+)
+
+// Visit verification subject constants
+const (
+	VisitSubjectOrder   = database.VisitSubjectOrder
+	VisitSubjectService = database.VisitSubjectService
+)
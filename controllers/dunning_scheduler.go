@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// paymentDueDateExpr is the date a monthly payment falls due. Payments raised before
+// the billing engine have no billing period and fall due when created.
+const paymentDueDateExpr = "COALESCE(payments.billing_period_start, payments.created_at)"
+
+// StartDunningScheduler starts the background job that chases overdue monthly
+// payments with reminders, late fees and suspension
+func StartDunningScheduler() {
+	interval := time.Duration(config.AppConfig.DunningJobIntervalMinutes) * time.Minute
+	runPeriodically("Dunning", interval, RunDunningCycle)
+}
+
+// RunDunningCycle escalates every subscription with overdue monthly payments. It is
+// safe to run repeatedly: each reminder level and late fee is applied at most once
+// per payment.
+func RunDunningCycle(now time.Time) {
+	var subscriptionIDs []uint
+	if err := database.DB.Model(&database.Payment{}).
+		Joins("JOIN subscriptions ON subscriptions.id = payments.subscription_id").
+		Where("payments.payment_type = ? AND payments.status = ? AND "+paymentDueDateExpr+" < ?",
+			"monthly", database.PaymentStatusPending, now).
+		Where("subscriptions.status IN ?",
+			[]string{SubscriptionStatusActive, SubscriptionStatusSuspended}).
+		Distinct().
+		Pluck("payments.subscription_id", &subscriptionIDs).Error; err != nil {
+		log.Printf("Dunning: failed to load overdue subscriptions: %v", err)
+		return
+	}
+
+	suspended := 0
+	for _, id := range subscriptionIDs {
+		ok, err := dunSubscription(id, now)
+		if err != nil {
+			log.Printf("Dunning: subscription #%d failed: %v", id, err)
+			continue
+		}
+		if ok {
+			suspended++
+		}
+	}
+
+	if suspended > 0 {
+		log.Printf("Dunning: suspended %d subscription(s)", suspended)
+	}
+}
+
+// dunSubscription sends the reminders and applies the late fees that have come due for
+// the overdue payments of one subscription, and suspends it once a payment is overdue
+// beyond the grace period. Returns true when the subscription was suspended.
+func dunSubscription(subscriptionID uint, now time.Time) (bool, error) {
+	suspended := false
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the subscription before its payments, in the same order as settlement
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&subscription, subscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.Status != SubscriptionStatusActive && subscription.Status != SubscriptionStatusSuspended {
+			return nil
+		}
+
+		var overdue []database.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("subscription_id = ? AND payment_type = ? AND status = ? AND "+paymentDueDateExpr+" < ?",
+				subscription.ID, "monthly", database.PaymentStatusPending, now).
+			Order(paymentDueDateExpr + " ASC").
+			Find(&overdue).Error; err != nil {
+			return err
+		}
+
+		reminderDays := append([]int(nil), config.AppConfig.DunningReminderDays...)
+		sort.Ints(reminderDays)
+
+		maxDaysOverdue := 0
+		for i := range overdue {
+			payment := &overdue[i]
+			overdueDays := daysOverdue(payment, now)
+			if overdueDays > maxDaysOverdue {
+				maxDaysOverdue = overdueDays
+			}
+
+			updates := map[string]interface{}{}
+
+			lateFee := config.AppConfig.LateFeeAmount
+			if lateFee > 0 && payment.LateFee == 0 && overdueDays >= config.AppConfig.LateFeeAfterDays {
+				payment.LateFee = lateFee
+				payment.Amount = roundAmount(payment.Amount + lateFee)
+				updates["late_fee"] = payment.LateFee
+				updates["amount"] = payment.Amount
+			}
+
+			level := 0
+			for _, day := range reminderDays {
+				if overdueDays >= day {
+					level++
+				}
+			}
+			if level > payment.DunningLevel {
+				payment.DunningLevel = level
+				updates["dunning_level"] = level
+				if err := sendDunningReminder(tx, &subscription, payment, overdueDays, level == len(reminderDays)); err != nil {
+					return err
+				}
+			}
+
+			if len(updates) > 0 {
+				if err := tx.Model(payment).Updates(updates).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		graceDays := config.AppConfig.SuspensionGraceDays
+		if graceDays <= 0 || subscription.Status != SubscriptionStatusActive || maxDaysOverdue < graceDays {
+			return nil
+		}
+
+		if err := tx.Model(&subscription).Update("status", SubscriptionStatusSuspended).Error; err != nil {
+			return err
+		}
+		suspended = true
+
+		notification := database.Notification{
+			UserID:      subscription.CustomerID,
+			Title:       "Subscription Suspended",
+			Message:     "Your subscription has been suspended because of overdue payments. Service requests are on hold until your dues are cleared.",
+			Type:        "subscription",
+			RelatedID:   &subscription.ID,
+			RelatedType: "subscription",
+		}
+		return tx.Create(&notification).Error
+	})
+
+	return suspended, err
+}
+
+// sendDunningReminder tells the customer that payment is overdue, warning of the late
+// fee and suspension that are still to come
+func sendDunningReminder(tx *gorm.DB, subscription *database.Subscription, payment *database.Payment, daysOverdue int, final bool) error {
+	title := "Payment Reminder"
+	if final {
+		title = "Final Payment Reminder"
+	} else if payment.DunningLevel > 1 {
+		title = "Payment Overdue"
+	}
+
+	message := fmt.Sprintf("Your monthly rent of ₹%.2f due on %s is %d day(s) overdue.",
+		payment.Amount, paymentDueDate(payment).Format("02 Jan 2006"), daysOverdue)
+	if payment.LateFee > 0 {
+		message += fmt.Sprintf(" A late fee of ₹%.2f has been added.", payment.LateFee)
+	} else if config.AppConfig.LateFeeAmount > 0 {
+		message += fmt.Sprintf(" A late fee of ₹%.2f applies after %d days.",
+			config.AppConfig.LateFeeAmount, config.AppConfig.LateFeeAfterDays)
+	}
+	if graceDays := config.AppConfig.SuspensionGraceDays; graceDays > 0 && subscription.Status == SubscriptionStatusActive {
+		message += fmt.Sprintf(" Please pay by %s to avoid suspension of your service.",
+			paymentDueDate(payment).AddDate(0, 0, graceDays).Format("02 Jan 2006"))
+	}
+
+	subscriptionID := subscription.ID
+	notification := database.Notification{
+		UserID:      subscription.CustomerID,
+		Title:       title,
+		Message:     message,
+		Type:        "payment",
+		RelatedID:   &subscriptionID,
+		RelatedType: "subscription",
+	}
+	return tx.Create(&notification).Error
+}
+
+// reactivateIfArrearsCleared returns a suspended subscription to active once none of its
+// payments is overdue beyond the grace period. subscription must be locked by the caller.
+func reactivateIfArrearsCleared(tx *gorm.DB, subscription *database.Subscription, now time.Time) error {
+	if subscription.Status != SubscriptionStatusSuspended {
+		return nil
+	}
+
+	var arrears int64
+	if err := tx.Model(&database.Payment{}).
+		Where("subscription_id = ? AND payment_type = ? AND status = ? AND "+paymentDueDateExpr+" <= ?",
+			subscription.ID, "monthly", database.PaymentStatusPending,
+			now.AddDate(0, 0, -config.AppConfig.SuspensionGraceDays)).
+		Count(&arrears).Error; err != nil {
+		return err
+	}
+	if arrears > 0 {
+		return nil
+	}
+
+	if err := tx.Model(&database.Subscription{}).
+		Where("id = ?", subscription.ID).
+		Update("status", SubscriptionStatusActive).Error; err != nil {
+		return err
+	}
+	subscription.Status = SubscriptionStatusActive
+
+	subscriptionID := subscription.ID
+	notification := database.Notification{
+		UserID:      subscription.CustomerID,
+		Title:       "Subscription Reactivated",
+		Message:     "Thank you for clearing your dues. Your subscription is active again.",
+		Type:        "subscription",
+		RelatedID:   &subscriptionID,
+		RelatedType: "subscription",
+	}
+	return tx.Create(&notification).Error
+}
+
+// paymentDueDate is the Go counterpart of paymentDueDateExpr
+func paymentDueDate(payment *database.Payment) time.Time {
+	if payment.BillingPeriodStart != nil {
+		return *payment.BillingPeriodStart
+	}
+	return payment.CreatedAt
+}
+
+// daysOverdue counts the whole days since payment fell due
+func daysOverdue(payment *database.Payment, now time.Time) int {
+	return int(now.Sub(paymentDueDate(payment)).Hours() / 24)
+}
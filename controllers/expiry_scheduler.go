@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// StartExpiryScheduler starts the background job that renews or expires subscriptions
+// at the end of their rental term
+func StartExpiryScheduler() {
+	interval := time.Duration(config.AppConfig.ExpiryJobIntervalMinutes) * time.Minute
+	runPeriodically("Expiry", interval, RunExpiryCycle)
+}
+
+// RunExpiryCycle tells customers whose term ends within the notice period what will
+// happen, then renews or expires every subscription whose term has ended. It is safe
+// to run repeatedly.
+func RunExpiryCycle(now time.Time) {
+	noticeBy := now.AddDate(0, 0, config.AppConfig.RenewalNoticeDays)
+
+	var noticeIDs []uint
+	if err := database.DB.Model(&database.Subscription{}).
+		Where("status = ? AND end_date > ? AND end_date <= ? AND renewal_noticed_at IS NULL",
+			SubscriptionStatusActive, now, noticeBy).
+		Pluck("id", &noticeIDs).Error; err != nil {
+		log.Printf("Expiry: failed to load subscriptions ending soon: %v", err)
+		return
+	}
+	for _, id := range noticeIDs {
+		if err := sendRenewalNotice(id, now); err != nil {
+			log.Printf("Expiry: renewal notice for subscription #%d failed: %v", id, err)
+		}
+	}
+
+	// Paused subscriptions have their term extended when paused and are left alone
+	var endedIDs []uint
+	if err := database.DB.Model(&database.Subscription{}).
+		Where("status IN ? AND end_date <= ?",
+			[]string{SubscriptionStatusActive, SubscriptionStatusSuspended}, now).
+		Pluck("id", &endedIDs).Error; err != nil {
+		log.Printf("Expiry: failed to load ended subscriptions: %v", err)
+		return
+	}
+
+	renewed, expired := 0, 0
+	for _, id := range endedIDs {
+		didRenew, err := endSubscriptionTerm(id, now)
+		if err != nil {
+			log.Printf("Expiry: subscription #%d failed: %v", id, err)
+			continue
+		}
+		if didRenew {
+			renewed++
+		} else {
+			expired++
+		}
+	}
+
+	if renewed > 0 || expired > 0 {
+		log.Printf("Expiry: renewed %d and expired %d subscription(s)", renewed, expired)
+	}
+}
+
+// sendRenewalNotice tells the customer that their term is about to end and whether it
+// will renew. The notice is sent once per term.
+func sendRenewalNotice(subscriptionID uint, now time.Time) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&subscription, subscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.RenewalNoticedAt != nil || subscription.Status != SubscriptionStatusActive {
+			return nil
+		}
+
+		endDate := subscription.EndDate.Format("02 Jan 2006")
+		title := "Subscription Ending Soon"
+		message := fmt.Sprintf("Your subscription ends on %s. A technician will collect the device after that. "+
+			"Turn on auto-renewal to keep it.", endDate)
+		if subscription.AutoRenew {
+			var order database.Order
+			if err := tx.Select("id, rental_duration").First(&order, subscription.OrderID).Error; err != nil {
+				return err
+			}
+			title = "Subscription Renewing Soon"
+			message = fmt.Sprintf("Your subscription will renew on %s for another %d month(s) at ₹%.2f per month.",
+				endDate, order.RentalDuration, subscription.MonthlyRent)
+		}
+
+		if err := tx.Model(&subscription).Update("renewal_noticed_at", now).Error; err != nil {
+			return err
+		}
+
+		notification := database.Notification{
+			UserID:      subscription.CustomerID,
+			Title:       title,
+			Message:     message,
+			Type:        "subscription",
+			RelatedID:   &subscription.ID,
+			RelatedType: "subscription",
+		}
+		return tx.Create(&notification).Error
+	})
+}
+
+// endSubscriptionTerm renews a subscription whose term has ended by its order's rental
+// duration when auto-renewal is on and it is not suspended for overdue payments. Otherwise the
+// subscription expires and a pickup is raised for the device. Returns true on renewal.
+func endSubscriptionTerm(subscriptionID uint, now time.Time) (bool, error) {
+	renewed := false
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&subscription, subscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.EndDate.After(now) ||
+			(subscription.Status != SubscriptionStatusActive && subscription.Status != SubscriptionStatusSuspended) {
+			return nil
+		}
+
+		var order database.Order
+		if err := tx.Select("id, rental_duration").First(&order, subscription.OrderID).Error; err != nil {
+			return err
+		}
+
+		if subscription.AutoRenew && subscription.Status == SubscriptionStatusActive && order.RentalDuration > 0 {
+			renewed = true
+			return renewSubscription(tx, &subscription, order.RentalDuration)
+		}
+		return expireSubscription(tx, &subscription)
+	})
+
+	return renewed, err
+}
+
+// renewSubscription extends subscription by months from its current end date
+func renewSubscription(tx *gorm.DB, subscription *database.Subscription, months int) error {
+	newEndDate := addMonths(subscription.EndDate, months)
+	if err := tx.Model(subscription).Updates(map[string]interface{}{
+		"end_date":           newEndDate,
+		"renewal_count":      subscription.RenewalCount + 1,
+		"renewal_noticed_at": nil,
+	}).Error; err != nil {
+		return err
+	}
+
+	notification := database.Notification{
+		UserID:      subscription.CustomerID,
+		Title:       "Subscription Renewed",
+		Message:     fmt.Sprintf("Your subscription has been renewed until %s.", newEndDate.Format("02 Jan 2006")),
+		Type:        "subscription",
+		RelatedID:   &subscription.ID,
+		RelatedType: "subscription",
+	}
+	return tx.Create(&notification).Error
+}
+
+// expireSubscription marks subscription expired and opens a service request for the
+// franchise to collect the device
+func expireSubscription(tx *gorm.DB, subscription *database.Subscription) error {
+	if err := tx.Model(subscription).Update("status", SubscriptionStatusExpired).Error; err != nil {
+		return err
+	}
+
+	pickup, err := collectSubscriptionUnit(tx, subscription, "Collect the device at the end of the rental term")
+	if err != nil {
+		return err
+	}
+
+	message := "Your rental term has ended. A technician will contact you to collect the device."
+	if pickup == nil {
+		message = "Your rental term has ended."
+	}
+	notification := database.Notification{
+		UserID:      subscription.CustomerID,
+		Title:       "Subscription Expired",
+		Message:     message,
+		Type:        "subscription",
+		RelatedID:   &subscription.ID,
+		RelatedType: "subscription",
+	}
+	if err := tx.Create(&notification).Error; err != nil || pickup == nil {
+		return err
+	}
+
+	var franchise database.Franchise
+	if err := tx.Select("id, owner_id").First(&franchise, subscription.FranchiseID).Error; err != nil || franchise.OwnerID == 0 {
+		return nil
+	}
+	franchiseNotification := database.Notification{
+		UserID:      franchise.OwnerID,
+		Title:       "Device Pickup Required",
+		Message:     "A subscription has expired. Please schedule collection of the device.",
+		Type:        "service_request",
+		RelatedID:   &pickup.ID,
+		RelatedType: "service_request",
+	}
+	return tx.Create(&franchiseNotification).Error
+}
+
+// raiseDevicePickup opens a service request for the franchise to collect the device of
+// an ended subscription. Completing it returns the unit to the asset registry and stock.
+func raiseDevicePickup(tx *gorm.DB, subscription *database.Subscription, description string) (*database.ServiceRequest, error) {
+	pickup := database.ServiceRequest{
+		CustomerID:     subscription.CustomerID,
+		SubscriptionID: subscription.ID,
+		FranchiseID:    subscription.FranchiseID,
+		Type:           ServiceTypeDevicePickup,
+		Status:         database.ServiceStatusPending,
+		Description:    description,
+	}
+	dueBy, err := serviceDueBy(tx, pickup.Type, time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	pickup.DueBy = dueBy
+	if err := tx.Create(&pickup).Error; err != nil {
+		return nil, err
+	}
+	return &pickup, nil
+}
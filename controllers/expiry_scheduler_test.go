@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"aquahome/database"
+)
+
+// createActiveSubscription stores an approved 12 month order for the fixture's product
+// and an active subscription for it that started a term ago and ends at endDate
+func createActiveSubscription(t *testing.T, fixture *testRentalFixture, endDate time.Time) database.Subscription {
+	t.Helper()
+
+	startDate := addMonths(endDate, -12)
+	order := database.Order{
+		CustomerID:      fixture.Customer.ID,
+		ProductID:       fixture.Product.ID,
+		FranchiseID:     fixture.Franchise.ID,
+		OrderType:       "rental",
+		Status:          OrderStatusApproved,
+		RentalStartDate: startDate,
+		RentalDuration:  12,
+		MonthlyRent:     fixture.Product.MonthlyRent,
+		SecurityDeposit: fixture.Product.SecurityDeposit,
+	}
+	if err := database.DB.Create(&order).Error; err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+
+	subscription := database.Subscription{
+		OrderID:         order.ID,
+		CustomerID:      fixture.Customer.ID,
+		ProductID:       fixture.Product.ID,
+		FranchiseID:     fixture.Franchise.ID,
+		Status:          database.SubscriptionStatusActive,
+		StartDate:       startDate,
+		EndDate:         endDate,
+		NextBillingDate: endDate,
+		MonthlyRent:     fixture.Product.MonthlyRent,
+	}
+	if err := database.DB.Create(&subscription).Error; err != nil {
+		t.Fatalf("creating subscription: %v", err)
+	}
+	return subscription
+}
+
+func TestAutoRenewRenewsAtEndOfTerm(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	fixture := createRentalFixture(t)
+	endDate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	subscription := createActiveSubscription(t, fixture, endDate)
+	id := gin.Param{Key: "id", Value: fmt.Sprint(subscription.ID)}
+
+	// The customer turns auto-renewal on through the API
+	recorder := callHandler(UpdateSubscription, http.MethodPut, gin.H{"auto_renew": true},
+		fixture.Customer.ID, RoleCustomer, id)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("UpdateSubscription returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if err := database.DB.First(&subscription, subscription.ID).Error; err != nil {
+		t.Fatalf("reloading subscription: %v", err)
+	}
+	if !subscription.AutoRenew {
+		t.Fatal("auto_renew was not stored")
+	}
+
+	// Another customer cannot change it
+	recorder = callHandler(UpdateSubscription, http.MethodPut, gin.H{"auto_renew": false},
+		fixture.Owner.ID, RoleCustomer, id)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("UpdateSubscription by another customer returned %d, want 404", recorder.Code)
+	}
+
+	// The expiry job renews it for the order's rental duration
+	renewed, err := endSubscriptionTerm(subscription.ID, time.Now())
+	if err != nil {
+		t.Fatalf("endSubscriptionTerm: %v", err)
+	}
+	if !renewed {
+		t.Fatal("subscription with auto-renewal on was not renewed")
+	}
+	if err := database.DB.First(&subscription, subscription.ID).Error; err != nil {
+		t.Fatalf("reloading subscription: %v", err)
+	}
+	if subscription.Status != database.SubscriptionStatusActive || subscription.RenewalCount != 1 {
+		t.Errorf("renewed subscription is %s with %d renewal(s), want active with 1", subscription.Status, subscription.RenewalCount)
+	}
+	if want := addMonths(endDate, 12); !subscription.EndDate.Equal(want) {
+		t.Errorf("end date = %s, want %s", subscription.EndDate, want)
+	}
+}
+
+func TestSubscriptionWithoutAutoRenewExpires(t *testing.T) {
+	openTestDB(t)
+	fixture := createRentalFixture(t)
+	subscription := createActiveSubscription(t, fixture, time.Now().Add(-time.Hour))
+
+	renewed, err := endSubscriptionTerm(subscription.ID, time.Now())
+	if err != nil {
+		t.Fatalf("endSubscriptionTerm: %v", err)
+	}
+	if renewed {
+		t.Fatal("subscription with auto-renewal off was renewed")
+	}
+	if err := database.DB.First(&subscription, subscription.ID).Error; err != nil {
+		t.Fatalf("reloading subscription: %v", err)
+	}
+	if subscription.Status != database.SubscriptionStatusExpired {
+		t.Errorf("subscription status = %s, want %s", subscription.Status, database.SubscriptionStatusExpired)
+	}
+
+	var pickups int64
+	database.DB.Model(&database.ServiceRequest{}).
+		Where("subscription_id = ? AND type = ?", subscription.ID, ServiceTypeDevicePickup).
+		Count(&pickups)
+	if pickups != 1 {
+		t.Errorf("expired subscription has %d device pickup(s), want 1", pickups)
+	}
+
+	// Running the job again changes nothing
+	if _, err := endSubscriptionTerm(subscription.ID, time.Now()); err != nil {
+		t.Fatalf("repeated endSubscriptionTerm: %v", err)
+	}
+	database.DB.Model(&database.ServiceRequest{}).
+		Where("subscription_id = ? AND type = ?", subscription.ID, ServiceTypeDevicePickup).
+		Count(&pickups)
+	if pickups != 1 {
+		t.Errorf("after a second run the subscription has %d device pickup(s), want 1", pickups)
+	}
+}
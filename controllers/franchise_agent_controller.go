@@ -0,0 +1,542 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+	"aquahome/utils"
+)
+
+// InviteServiceAgentRequest contains data for inviting a service agent to a franchise
+type InviteServiceAgentRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Name  string `json:"name"`  // Required when the email has no account yet
+	Phone string `json:"phone"` // Used when the email has no account yet
+	Notes string `json:"notes"`
+}
+
+// DeactivateServiceAgentRequest contains data for deactivating a franchise's service agent
+type DeactivateServiceAgentRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// isFranchiseAgent reports whether agentID is a service agent with an active membership
+// of franchiseID
+func isFranchiseAgent(db *gorm.DB, franchiseID, agentID uint) (bool, error) {
+	var count int64
+	err := db.Model(&database.FranchiseAgent{}).
+		Joins("JOIN users ON users.id = franchise_agents.agent_id").
+		Where("franchise_agents.franchise_id = ? AND franchise_agents.agent_id = ? AND franchise_agents.status = ?",
+			franchiseID, agentID, FranchiseAgentActive).
+		Where("users.role = ? AND users.deleted_at IS NULL", RoleServiceAgent).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// serviceRequestFranchiseID returns the franchise serving a service request, the one
+// holding its subscription
+func serviceRequestFranchiseID(db *gorm.DB, requestID uint) (uint, error) {
+	var franchiseIDs []uint
+	if err := db.Model(&database.ServiceRequest{}).
+		Joins("JOIN subscriptions ON subscriptions.id = service_requests.subscription_id").
+		Where("service_requests.id = ?", requestID).
+		Pluck("subscriptions.franchise_id", &franchiseIDs).Error; err != nil {
+		return 0, err
+	}
+	if len(franchiseIDs) == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return franchiseIDs[0], nil
+}
+
+// respondAgentNotInFranchise rejects assigning an agent who does not work for the franchise
+func respondAgentNotInFranchise(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "Service agent is not an active member of this franchise",
+		"code":  "agent_not_in_franchise",
+	})
+}
+
+// lockFranchiseAgent loads and locks the membership of the agent in the :agentId path
+// parameter within franchiseID, responding and returning false when there is none
+func lockFranchiseAgent(c *gin.Context, tx *gorm.DB, franchiseID uint) (*database.FranchiseAgent, bool) {
+	agentID, err := strconv.ParseUint(c.Param("agentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service agent ID"})
+		return nil, false
+	}
+
+	var membership database.FranchiseAgent
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("franchise_id = ? AND agent_id = ?", franchiseID, agentID).
+		First(&membership).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service agent is not a member of this franchise"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return nil, false
+	}
+	return &membership, true
+}
+
+// InviteServiceAgent invites a service agent to the caller's franchise. An email without
+// an account gets a new service agent account and a token to set its password with
+// (Admin or Franchise Owner only)
+func InviteServiceAgent(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	var request InviteServiceAgentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request.Email = strings.TrimSpace(request.Email)
+	request.Name = strings.TrimSpace(request.Name)
+
+	userIDValue, _ := c.Get("user_id")
+	inviterID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var franchise database.Franchise
+	if err := database.DB.Select("id, name").First(&franchise, franchiseID).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var agent database.User
+	var setupToken string
+	err := tx.Where("email = ?", request.Email).First(&agent).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if request.Name == "" {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required to invite a new service agent"})
+			return
+		}
+
+		// The agent chooses their own password with the setup token
+		passwordHash, err := utils.HashPassword(utils.GenerateResetToken())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Password hashing error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		agent = database.User{
+			Name:         request.Name,
+			Email:        request.Email,
+			PasswordHash: passwordHash,
+			Role:         RoleServiceAgent,
+			Phone:        request.Phone,
+		}
+		if err := tx.Create(&agent).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating service agent"})
+			return
+		}
+
+		setupToken = utils.GenerateResetToken()
+		reset := database.PasswordReset{
+			UserID:    agent.ID,
+			Token:     setupToken,
+			ExpiresAt: time.Now().Add(time.Duration(config.AppConfig.AgentInviteExpiryHours) * time.Hour),
+		}
+		if err := tx.Create(&reset).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Reset token creation error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate setup token"})
+			return
+		}
+	case err != nil:
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	case agent.Role != RoleServiceAgent:
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "This email belongs to a user who is not a service agent"})
+		return
+	}
+
+	var membership database.FranchiseAgent
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("agent_id = ?", agent.ID).First(&membership).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if membership.ID != 0 && membership.Status != FranchiseAgentInactive {
+		tx.Rollback()
+		if membership.FranchiseID != franchiseID {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Service agent already belongs to another franchise",
+				"code":  "agent_in_other_franchise",
+			})
+		} else if membership.Status == FranchiseAgentActive {
+			c.JSON(http.StatusConflict, gin.H{"error": "Service agent is already a member of this franchise"})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"error": "Service agent has already been invited to this franchise"})
+		}
+		return
+	}
+
+	// An agent who left another franchise can be invited again
+	membership.FranchiseID = franchiseID
+	membership.AgentID = agent.ID
+	membership.Status = FranchiseAgentInvited
+	membership.InvitedByID = &inviterID
+	membership.InvitedAt = time.Now()
+	membership.JoinedAt = nil
+	membership.DeactivatedAt = nil
+	membership.Notes = request.Notes
+	if err := tx.Save(&membership).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error inviting service agent"})
+		return
+	}
+
+	notification := database.Notification{
+		UserID:      agent.ID,
+		Title:       "Franchise Invitation",
+		Message:     franchise.Name + " has invited you to join as a service agent.",
+		Type:        "franchise",
+		RelatedID:   &membership.ID,
+		RelatedType: "franchise_agent",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	agent.Password = ""
+	agent.PasswordHash = ""
+	membership.Agent = &agent
+
+	response := gin.H{
+		"message":    "Service agent invited",
+		"membership": membership,
+	}
+	if setupToken != "" {
+		// In a real application, email the token to the agent instead
+		response["setup_token"] = setupToken
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// ActivateServiceAgent brings a deactivated service agent back into the caller's
+// franchise (Admin or Franchise Owner only)
+func ActivateServiceAgent(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	membership, ok := lockFranchiseAgent(c, tx, franchiseID)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+	switch membership.Status {
+	case FranchiseAgentActive:
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Service agent is already active"})
+		return
+	case FranchiseAgentInvited:
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Service agent has not accepted the invitation yet"})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(membership).Updates(map[string]interface{}{
+		"status":         FranchiseAgentActive,
+		"joined_at":      now,
+		"deactivated_at": nil,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error activating service agent"})
+		return
+	}
+	if err := tx.Model(&database.User{}).Where("id = ?", membership.AgentID).
+		Update("franchise_id", franchiseID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error activating service agent"})
+		return
+	}
+
+	notification := database.Notification{
+		UserID:      membership.AgentID,
+		Title:       "Franchise Membership Restored",
+		Message:     "You have been reactivated as a service agent of your franchise.",
+		Type:        "franchise",
+		RelatedID:   &membership.ID,
+		RelatedType: "franchise_agent",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service agent activated", "membership": membership})
+}
+
+// DeactivateServiceAgent removes a service agent from the caller's franchise and hands
+// their open service requests and orders back for reassignment (Admin or Franchise Owner only)
+func DeactivateServiceAgent(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	var request DeactivateServiceAgentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason for deactivation is required"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	membership, ok := lockFranchiseAgent(c, tx, franchiseID)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+	if membership.Status == FranchiseAgentInactive {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Service agent is already inactive"})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(membership).Updates(map[string]interface{}{
+		"status":         FranchiseAgentInactive,
+		"deactivated_at": now,
+		"notes":          request.Reason,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deactivating service agent"})
+		return
+	}
+	if err := tx.Model(&database.User{}).
+		Where("id = ? AND franchise_id = ?", membership.AgentID, franchiseID).
+		Update("franchise_id", nil).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deactivating service agent"})
+		return
+	}
+
+	// Work the agent has not started goes back to the franchise's queue
+	serviceRequests := tx.Model(&database.ServiceRequest{}).
+		Where("service_agent_id = ? AND status IN ?", membership.AgentID,
+			[]string{database.ServiceStatusAssigned, database.ServiceStatusScheduled}).
+		Updates(map[string]interface{}{
+			"service_agent_id": nil,
+			"status":           database.ServiceStatusPending,
+		})
+	if serviceRequests.Error != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", serviceRequests.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unassigning service requests"})
+		return
+	}
+	orders := tx.Model(&database.Order{}).
+		Where("service_agent_id = ? AND status IN ?", membership.AgentID, openOrderStatuses).
+		Update("service_agent_id", nil)
+	if orders.Error != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", orders.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unassigning orders"})
+		return
+	}
+
+	notification := database.Notification{
+		UserID:      membership.AgentID,
+		Title:       "Franchise Membership Ended",
+		Message:     "You have been deactivated as a service agent of your franchise. Reason: " + request.Reason,
+		Type:        "franchise",
+		RelatedID:   &membership.ID,
+		RelatedType: "franchise_agent",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":                     "Service agent deactivated",
+		"membership":                  membership,
+		"unassigned_service_requests": serviceRequests.RowsAffected,
+		"unassigned_orders":           orders.RowsAffected,
+	})
+}
+
+// GetMyFranchiseMembership returns the calling service agent's franchise membership
+func GetMyFranchiseMembership(c *gin.Context) {
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var membership database.FranchiseAgent
+	if err := database.DB.
+		Preload("Franchise", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id, name, address, city, state, zip_code, phone")
+		}).
+		Where("agent_id = ?", agentID).
+		First(&membership).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "You are not a member of any franchise"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, membership)
+}
+
+// AcceptFranchiseMembership accepts the calling service agent's pending franchise
+// invitation
+func AcceptFranchiseMembership(c *gin.Context) {
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var membership database.FranchiseAgent
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("agent_id = ?", agentID).
+		First(&membership).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "You have no franchise invitation"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if membership.Status != FranchiseAgentInvited {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "You have no pending franchise invitation"})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(&membership).Updates(map[string]interface{}{
+		"status":    FranchiseAgentActive,
+		"joined_at": now,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accepting invitation"})
+		return
+	}
+	if err := tx.Model(&database.User{}).Where("id = ?", agentID).
+		Update("franchise_id", membership.FranchiseID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accepting invitation"})
+		return
+	}
+
+	var franchise database.Franchise
+	if err := tx.Select("id, owner_id").First(&franchise, membership.FranchiseID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	var agent database.User
+	if err := tx.Select("id, name").First(&agent, agentID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	notification := database.Notification{
+		UserID:      franchise.OwnerID,
+		Title:       "Service Agent Joined",
+		Message:     fmt.Sprintf("%s has accepted your invitation and joined your franchise as a service agent.", agent.Name),
+		Type:        "franchise",
+		RelatedID:   &membership.ID,
+		RelatedType: "franchise_agent",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "You have joined the franchise", "membership": membership})
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,6 +17,7 @@ type FranchiseDashboardData struct {
 	PendingOrders          interface{} `json:"pendingOrders"`
 	PendingServiceRequests interface{} `json:"pendingServiceRequests"`
 	RecentActivity         interface{} `json:"recentActivity"`
+	SLA                    interface{} `json:"sla"`
 }
 
 // ✅ GET /franchise/dashboard?franchiseId=xx
@@ -108,6 +110,17 @@ func GetFranchiseDashboard(c *gin.Context) {
 
 	var recentActivity []interface{} = []interface{}{} // optional
 
+	slaSince, ok := slaMetricsSince(c)
+	if !ok {
+		return
+	}
+	slaMetrics, err := serviceSLAMetrics(database.DB, franchiseID, slaSince)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to fetch SLA metrics"})
+		return
+	}
+
 	var franchise database.Franchise
 	if err := database.DB.First(&franchise, franchiseID).Error; err != nil {
 		log.Printf("Franchise fetch error: %v", err)
@@ -128,6 +141,7 @@ func GetFranchiseDashboard(c *gin.Context) {
 		PendingOrders:          pendingOrders,
 		PendingServiceRequests: pendingRequests,
 		RecentActivity:         recentActivity,
+		SLA:                    slaMetrics,
 	})
 }
 
@@ -171,13 +185,15 @@ func AdminUpdateFranchise(c *gin.Context) {
 	}
 
 	var request struct {
-		Name    string `json:"name"`
-		Phone   string `json:"phone"`
-		Email   string `json:"email"`
-		City    string `json:"city"`
-		State   string `json:"state"`
-		ZipCode string `json:"zip_code"`
-		Address string `json:"address"`
+		Name    string  `json:"name"`
+		Phone   string  `json:"phone"`
+		Email   string  `json:"email"`
+		City    string  `json:"city"`
+		State   string  `json:"state"`
+		ZipCode string  `json:"zip_code"`
+		Address string  `json:"address"`
+		GSTIN   *string `json:"gstin"`
+		Code    *string `json:"code"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -185,6 +201,35 @@ func AdminUpdateFranchise(c *gin.Context) {
 		return
 	}
 
+	if request.Code != nil {
+		code, err := normalizeFranchiseCode(*request.Code)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if code != "" && code != franchise.Code {
+			taken, err := franchiseCodeTaken(database.DB, code, franchise.ID)
+			if err != nil {
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": "Another franchise already uses code " + code})
+				return
+			}
+		}
+		franchise.Code = code
+	}
+	if request.GSTIN != nil {
+		gstin := strings.ToUpper(strings.TrimSpace(*request.GSTIN))
+		if gstin != "" && len(gstin) != 15 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "GSTIN must be 15 characters"})
+			return
+		}
+		franchise.GSTIN = gstin
+	}
+
 	// Update fields
 	franchise.Name = request.Name
 	franchise.Phone = request.Phone
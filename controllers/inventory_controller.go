@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// InventoryAdjustmentRequest contains data for receiving or writing off stock
+type InventoryAdjustmentRequest struct {
+	FranchiseID uint   `json:"franchise_id" binding:"required"`
+	ProductID   uint   `json:"product_id" binding:"required"`
+	Quantity    int    `json:"quantity" binding:"required,min=1"`
+	Notes       string `json:"notes"`
+}
+
+// InventoryTransferRequest contains data for moving stock between franchises
+type InventoryTransferRequest struct {
+	FromFranchiseID uint   `json:"from_franchise_id" binding:"required"`
+	ToFranchiseID   uint   `json:"to_franchise_id" binding:"required"`
+	ProductID       uint   `json:"product_id" binding:"required"`
+	Quantity        int    `json:"quantity" binding:"required,min=1"`
+	Notes           string `json:"notes"`
+}
+
+// InventoryReconciliationRow compares a franchise's stock of a product with its ledger,
+// its open reservations and the units registered in its warehouse
+type InventoryReconciliationRow struct {
+	FranchiseID      uint `json:"franchise_id"`
+	ProductID        uint `json:"product_id"`
+	Quantity         int  `json:"quantity"`
+	LedgerBalance    int  `json:"ledger_balance"`
+	LedgerDifference int  `json:"ledger_difference"`
+	Reserved         int  `json:"reserved"`
+	WarehouseUnits   int  `json:"warehouse_units"`
+	Balanced         bool `json:"balanced"`
+}
+
+// ProductStockReconciliationRow compares a product's total stock with the sum of the
+// franchise inventories
+type ProductStockReconciliationRow struct {
+	ProductID      uint `json:"product_id"`
+	AvailableStock int  `json:"available_stock"`
+	InventoryTotal int  `json:"inventory_total"`
+	Balanced       bool `json:"balanced"`
+}
+
+// ReceiveInventory records stock received by a franchise (Admin only). Serial-numbered
+// units are received by registering them instead.
+func ReceiveInventory(c *gin.Context) {
+	adjustInventoryHandler(c, InventoryMovementReceipt)
+}
+
+// WriteOffInventory removes lost or damaged stock from a franchise (Admin only)
+func WriteOffInventory(c *gin.Context) {
+	adjustInventoryHandler(c, InventoryMovementWriteOff)
+}
+
+// adjustInventoryHandler applies a receipt or write-off from the request body
+func adjustInventoryHandler(c *gin.Context, movementType string) {
+	var request InventoryAdjustmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	actorID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if !inventoryTargetsExist(c, request.ProductID, request.FranchiseID) {
+		return
+	}
+
+	delta := request.Quantity
+	if movementType == InventoryMovementWriteOff {
+		delta = -delta
+	}
+
+	var movement *database.InventoryMovement
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		movement, err = adjustInventory(tx, request.FranchiseID, request.ProductID, movementType, delta, InventoryReference{
+			ActorRole: RoleAdmin,
+			ActorID:   &actorID,
+			Notes:     request.Notes,
+		})
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The franchise holds fewer units than are being written off"})
+			return
+		}
+		log.Printf("Error adjusting inventory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update inventory"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, movement)
+}
+
+// TransferInventory moves stock from one franchise to another (Admin only)
+func TransferInventory(c *gin.Context) {
+	var request InventoryTransferRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.FromFranchiseID == request.ToFranchiseID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Source and destination franchises must differ"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	actorID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if !inventoryTargetsExist(c, request.ProductID, request.FromFranchiseID, request.ToFranchiseID) {
+		return
+	}
+
+	transfer := database.InventoryTransfer{
+		FromFranchiseID: request.FromFranchiseID,
+		ToFranchiseID:   request.ToFranchiseID,
+		ProductID:       request.ProductID,
+		Quantity:        request.Quantity,
+		ActorID:         &actorID,
+		Notes:           request.Notes,
+	}
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return transferInventory(tx, &transfer, RoleAdmin)
+	}); err != nil {
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The source franchise holds fewer units than are being transferred"})
+			return
+		}
+		log.Printf("Error transferring inventory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer inventory"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, transfer)
+}
+
+// GetInventory lists franchise stock, optionally filtered by franchise or product (Admin only)
+func GetInventory(c *gin.Context) {
+	query, ok := applyInventoryFilters(c, database.DB.Model(&database.FranchiseInventory{}), "franchise_id", "product_id")
+	if !ok {
+		return
+	}
+
+	var inventory []database.FranchiseInventory
+	if err := query.
+		Preload("Franchise", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, city") }).
+		Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Order("franchise_id ASC, product_id ASC").
+		Find(&inventory).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, inventory)
+}
+
+// GetInventoryMovements lists the stock ledger, newest first, optionally filtered by
+// franchise, product, order, transfer or movement type (Admin only)
+func GetInventoryMovements(c *gin.Context) {
+	query, ok := applyInventoryFilters(c, database.DB.Model(&database.InventoryMovement{}),
+		"franchise_id", "product_id", "order_id", "transfer_id")
+	if !ok {
+		return
+	}
+	if movementType := c.Query("type"); movementType != "" {
+		query = query.Where("type = ?", movementType)
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 1000"})
+			return
+		}
+		limit = parsed
+	}
+
+	var movements []database.InventoryMovement
+	if err := query.Order("id DESC").Limit(limit).Find(&movements).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory movements"})
+		return
+	}
+
+	c.JSON(http.StatusOK, movements)
+}
+
+// GetInventoryReconciliation checks every franchise's stock against its ledger and each
+// product's total stock against the franchise inventories (Admin only)
+func GetInventoryReconciliation(c *gin.Context) {
+	type stockKey struct {
+		FranchiseID uint
+		ProductID   uint
+	}
+	type stockCount struct {
+		FranchiseID uint
+		ProductID   uint
+		Total       int
+	}
+
+	rows := map[stockKey]*InventoryReconciliationRow{}
+	row := func(franchiseID, productID uint) *InventoryReconciliationRow {
+		key := stockKey{franchiseID, productID}
+		if rows[key] == nil {
+			rows[key] = &InventoryReconciliationRow{FranchiseID: franchiseID, ProductID: productID}
+		}
+		return rows[key]
+	}
+
+	var inventory []database.FranchiseInventory
+	if err := database.DB.Find(&inventory).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile inventory"})
+		return
+	}
+	for _, item := range inventory {
+		row(item.FranchiseID, item.ProductID).Quantity = item.Quantity
+	}
+
+	var ledger, reserved, warehouse []stockCount
+	queries := []struct {
+		query *gorm.DB
+		dest  *[]stockCount
+	}{
+		{database.DB.Model(&database.InventoryMovement{}).
+			Select("franchise_id, product_id, SUM(quantity) AS total"), &ledger},
+		{database.DB.Model(&database.StockReservation{}).
+			Select("franchise_id, product_id, SUM(quantity) AS total").
+			Where("status = ?", StockReservationReserved), &reserved},
+		{database.DB.Model(&database.Asset{}).
+			Select("franchise_id, product_id, COUNT(*) AS total").
+			Where("status = ?", AssetStatusInWarehouse), &warehouse},
+	}
+	for _, q := range queries {
+		if err := q.query.Group("franchise_id, product_id").Scan(q.dest).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile inventory"})
+			return
+		}
+	}
+	for _, count := range ledger {
+		row(count.FranchiseID, count.ProductID).LedgerBalance = count.Total
+	}
+	for _, count := range reserved {
+		row(count.FranchiseID, count.ProductID).Reserved = count.Total
+	}
+	for _, count := range warehouse {
+		row(count.FranchiseID, count.ProductID).WarehouseUnits = count.Total
+	}
+
+	franchiseRows := make([]InventoryReconciliationRow, 0, len(rows))
+	productTotals := map[uint]int{}
+	for _, r := range rows {
+		r.LedgerDifference = r.Quantity - r.LedgerBalance
+		r.Balanced = r.LedgerDifference == 0
+		franchiseRows = append(franchiseRows, *r)
+		productTotals[r.ProductID] += r.Quantity
+	}
+	sort.Slice(franchiseRows, func(i, j int) bool {
+		if franchiseRows[i].FranchiseID != franchiseRows[j].FranchiseID {
+			return franchiseRows[i].FranchiseID < franchiseRows[j].FranchiseID
+		}
+		return franchiseRows[i].ProductID < franchiseRows[j].ProductID
+	})
+
+	var products []database.Product
+	if err := database.DB.Unscoped().Select("id, available_stock").Order("id ASC").Find(&products).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile inventory"})
+		return
+	}
+	productRows := make([]ProductStockReconciliationRow, 0, len(products))
+	unbalanced := 0
+	for _, product := range products {
+		r := ProductStockReconciliationRow{
+			ProductID:      product.ID,
+			AvailableStock: product.AvailableStock,
+			InventoryTotal: productTotals[product.ID],
+		}
+		r.Balanced = r.AvailableStock == r.InventoryTotal
+		if !r.Balanced {
+			unbalanced++
+		}
+		productRows = append(productRows, r)
+	}
+	for _, r := range franchiseRows {
+		if !r.Balanced {
+			unbalanced++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"balanced":   unbalanced == 0,
+		"franchises": franchiseRows,
+		"products":   productRows,
+	})
+}
+
+// inventoryTargetsExist checks that the product and franchises named in an inventory
+// request exist, responding with 404 when one does not
+func inventoryTargetsExist(c *gin.Context, productID uint, franchiseIDs ...uint) bool {
+	var product database.Product
+	if err := database.DB.Select("id").First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return false
+	}
+
+	for _, franchiseID := range franchiseIDs {
+		var franchise database.Franchise
+		if err := database.DB.Select("id").First(&franchise, franchiseID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Franchise #" + strconv.FormatUint(uint64(franchiseID), 10) + " not found"})
+			} else {
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// applyInventoryFilters narrows query by the named ID query parameters, responding with
+// 400 when one is not a number
+func applyInventoryFilters(c *gin.Context, query *gorm.DB, filters ...string) (*gorm.DB, bool) {
+	for _, filter := range filters {
+		value := c.Query(filter)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + filter})
+			return nil, false
+		}
+		query = query.Where(filter+" = ?", id)
+	}
+	return query, true
+}
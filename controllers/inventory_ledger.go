@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// InventoryReference ties an inventory movement to what caused it and who made it
+type InventoryReference struct {
+	OrderID          *uint
+	TransferID       *uint
+	ServiceRequestID *uint
+	ActorRole        string
+	ActorID          *uint
+	Notes            string
+}
+
+// lockFranchiseInventory returns the franchise's stock record of a product locked for
+// update, creating an empty one when the franchise has never held the product
+func lockFranchiseInventory(tx *gorm.DB, franchiseID, productID uint) (*database.FranchiseInventory, error) {
+	inventory := database.FranchiseInventory{FranchiseID: franchiseID, ProductID: productID}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&inventory).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("franchise_id = ? AND product_id = ?", franchiseID, productID).
+		First(&inventory).Error; err != nil {
+		return nil, err
+	}
+	return &inventory, nil
+}
+
+// adjustInventory changes a franchise's stock of a product by delta and appends the
+// movement to the ledger. The product's total stock is kept in step. Returns
+// ErrOutOfStock when the franchise holds fewer units than are taken out.
+func adjustInventory(tx *gorm.DB, franchiseID, productID uint, movementType string, delta int, ref InventoryReference) (*database.InventoryMovement, error) {
+	inventory, err := lockFranchiseInventory(tx, franchiseID, productID)
+	if err != nil {
+		return nil, err
+	}
+	return applyInventoryMovement(tx, inventory, movementType, delta, ref)
+}
+
+// applyInventoryMovement changes the stock of a locked inventory record by delta and
+// appends the movement to the ledger
+func applyInventoryMovement(tx *gorm.DB, inventory *database.FranchiseInventory, movementType string, delta int, ref InventoryReference) (*database.InventoryMovement, error) {
+	if inventory.Quantity+delta < 0 {
+		return nil, ErrOutOfStock
+	}
+
+	inventory.Quantity += delta
+	if err := tx.Model(inventory).Update("quantity", inventory.Quantity).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&database.Product{}).Unscoped().
+		Where("id = ?", inventory.ProductID).
+		Update("available_stock", gorm.Expr("available_stock + ?", delta)).Error; err != nil {
+		return nil, err
+	}
+
+	movement := database.InventoryMovement{
+		FranchiseID:      inventory.FranchiseID,
+		ProductID:        inventory.ProductID,
+		Type:             movementType,
+		Quantity:         delta,
+		BalanceAfter:     inventory.Quantity,
+		OrderID:          ref.OrderID,
+		TransferID:       ref.TransferID,
+		ServiceRequestID: ref.ServiceRequestID,
+		ActorID:          ref.ActorID,
+		ActorRole:        ref.ActorRole,
+		Notes:            ref.Notes,
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return nil, err
+	}
+	return &movement, nil
+}
+
+// transferInventory moves quantity units of a product from one franchise to another.
+// Both stock records are locked in franchise ID order so that opposite transfers cannot
+// deadlock.
+func transferInventory(tx *gorm.DB, transfer *database.InventoryTransfer, actorRole string) error {
+	if transfer.FromFranchiseID == transfer.ToFranchiseID {
+		return errors.New("cannot transfer stock to the same franchise")
+	}
+
+	firstID, secondID := transfer.FromFranchiseID, transfer.ToFranchiseID
+	if secondID < firstID {
+		firstID, secondID = secondID, firstID
+	}
+	first, err := lockFranchiseInventory(tx, firstID, transfer.ProductID)
+	if err != nil {
+		return err
+	}
+	second, err := lockFranchiseInventory(tx, secondID, transfer.ProductID)
+	if err != nil {
+		return err
+	}
+	from, to := first, second
+	if from.FranchiseID != transfer.FromFranchiseID {
+		from, to = second, first
+	}
+
+	if from.Quantity < transfer.Quantity {
+		return ErrOutOfStock
+	}
+	if err := tx.Create(transfer).Error; err != nil {
+		return err
+	}
+
+	ref := InventoryReference{
+		TransferID: &transfer.ID,
+		ActorRole:  actorRole,
+		ActorID:    transfer.ActorID,
+		Notes:      transfer.Notes,
+	}
+	if _, err := applyInventoryMovement(tx, from, InventoryMovementTransferOut, -transfer.Quantity, ref); err != nil {
+		return err
+	}
+	_, err = applyInventoryMovement(tx, to, InventoryMovementTransferIn, transfer.Quantity, ref)
+	return err
+}
@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+	"aquahome/invoices"
+)
+
+// unsafeFileChars matches characters not allowed in stored invoice file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// GetPaymentInvoice serves the tax invoice PDF for a successful payment, rendering and
+// storing it on first request. Access follows the same rules as GetPaymentByID.
+func GetPaymentInvoice(c *gin.Context) {
+	paymentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment ID"})
+		return
+	}
+
+	role, exists := c.Get("role")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in context"})
+		return
+	}
+
+	query, ok := scopePaymentsForRole(database.DB.Model(&database.Payment{}).
+		Select("payments.*").
+		Where("payments.id = ?", paymentID), role, userID)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	var payment database.Payment
+	if err := query.First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found or you don't have permission to view it"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if !isInvoiceablePayment(&payment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invoices are only available for successful payments"})
+		return
+	}
+
+	invoice, pdf, err := loadOrRenderInvoice(&payment)
+	if err != nil {
+		log.Printf("Invoice generation error for payment #%d: %v", payment.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating invoice"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, invoice.InvoiceNumber))
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
+// isInvoiceablePayment reports whether a tax invoice can be issued for payment
+func isInvoiceablePayment(payment *database.Payment) bool {
+	if payment.Status != database.PaymentStatusSuccess && payment.Status != database.PaymentStatusPaid {
+		return false
+	}
+	switch payment.PaymentType {
+	case "initial", "monthly", PaymentTypeDamageCharge, PaymentTypeAdjustment:
+		return true
+	}
+	return false
+}
+
+// loadOrRenderInvoice returns the stored invoice for payment, rendering and storing it
+// when it does not exist yet or its file has gone missing
+func loadOrRenderInvoice(payment *database.Payment) (*database.Invoice, []byte, error) {
+	var invoice database.Invoice
+	err := database.DB.Where("payment_id = ?", payment.ID).First(&invoice).Error
+	if err == nil {
+		if pdf, readErr := os.ReadFile(invoice.FilePath); readErr == nil {
+			return &invoice, pdf, nil
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	// Payments completed before sequential numbering have no number yet
+	if payment.InvoiceNumber == "" {
+		if err := database.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, payment.ID).Error; err != nil {
+				return err
+			}
+			if err := assignInvoiceNumber(tx, payment); err != nil {
+				return err
+			}
+			return tx.Model(payment).Update("invoice_number", payment.InvoiceNumber).Error
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Keep the original issue date when re-rendering a lost file
+	issuedAt := invoice.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	document, err := buildInvoiceDocument(payment, issuedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	pdf := invoices.Render(document)
+	_, totals := document.Compute()
+
+	dir := config.AppConfig.InvoiceStoragePath
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	filePath := filepath.Join(dir, fmt.Sprintf("%d-%s.pdf", payment.ID, unsafeFileChars.ReplaceAllString(document.Number, "_")))
+	if err := os.WriteFile(filePath, pdf, 0o644); err != nil {
+		return nil, nil, err
+	}
+
+	invoice = database.Invoice{
+		PaymentID:     payment.ID,
+		InvoiceNumber: document.Number,
+		IssuedAt:      issuedAt,
+		TaxableAmount: totals.TaxableValue,
+		CGST:          totals.CGST,
+		SGST:          totals.SGST,
+		IGST:          totals.IGST,
+		TotalAmount:   totals.Total,
+		FilePath:      filePath,
+	}
+	if err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "payment_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"file_path", "updated_at"}),
+	}).Create(&invoice).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &invoice, pdf, nil
+}
+
+// buildInvoiceDocument gathers the customer, franchise and order details printed on the
+// invoice for payment
+func buildInvoiceDocument(payment *database.Payment, issuedAt time.Time) (*invoices.Invoice, error) {
+	var customer database.User
+	if err := database.DB.First(&customer, payment.CustomerID).Error; err != nil {
+		return nil, err
+	}
+
+	// Monthly payments created by the billing engine always carry the order, but older
+	// ones may only reference the subscription
+	var orderID uint
+	if payment.OrderID != nil {
+		orderID = *payment.OrderID
+	} else if payment.SubscriptionID != nil {
+		var subscription database.Subscription
+		if err := database.DB.Select("id, order_id").First(&subscription, *payment.SubscriptionID).Error; err != nil {
+			return nil, err
+		}
+		orderID = subscription.OrderID
+	}
+
+	var order database.Order
+	if err := database.DB.Preload("Product").Preload("Franchise").First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+
+	// Rent after a plan change is for the subscription's current product
+	productName := order.Product.Name
+	if payment.SubscriptionID != nil {
+		var product database.Product
+		err := database.DB.Model(&database.Product{}).
+			Joins("JOIN subscriptions ON subscriptions.product_id = products.id").
+			Where("subscriptions.id = ?", *payment.SubscriptionID).
+			Select("products.name").
+			First(&product).Error
+		if err == nil {
+			productName = product.Name
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	supplier := invoices.Party{Name: "AquaHome"}
+	if order.FranchiseID != 0 {
+		supplier = invoices.Party{
+			Name:    order.Franchise.Name,
+			Address: order.Franchise.Address,
+			City:    order.Franchise.City,
+			State:   order.Franchise.State,
+			ZipCode: order.Franchise.ZipCode,
+			Phone:   order.Franchise.Phone,
+			Email:   order.Franchise.Email,
+			GSTIN:   order.Franchise.GSTIN,
+		}
+	}
+
+	document := &invoices.Invoice{
+		Number:   payment.InvoiceNumber,
+		Date:     issuedAt,
+		Supplier: supplier,
+		Customer: invoices.Party{
+			Name:    customer.Name,
+			Address: customer.Address,
+			City:    customer.City,
+			State:   customer.State,
+			ZipCode: customer.ZipCode,
+			Phone:   customer.Phone,
+			Email:   customer.Email,
+		},
+		GSTRatePercent:   float64(config.AppConfig.GSTRatePercent),
+		PaymentReference: payment.TransactionID,
+		PeriodStart:      payment.BillingPeriodStart,
+		PeriodEnd:        payment.BillingPeriodEnd,
+	}
+
+	switch payment.PaymentType {
+	case "initial":
+		document.Items = []invoices.LineItem{
+			{Description: "Refundable security deposit", Amount: order.SecurityDeposit},
+			{Description: "Installation charges", SAC: invoices.SACInstallation, Amount: order.InstallationFee, Taxable: true},
+			{Description: "First month rent - " + order.Product.Name, SAC: invoices.SACRental, Amount: order.MonthlyRent, Taxable: true},
+		}
+
+		// Orders priced differently from what was collected are invoiced as a single charge
+		if math.Abs(order.SecurityDeposit+order.InstallationFee+order.MonthlyRent-payment.Amount) > 0.01 {
+			document.Items = []invoices.LineItem{
+				{Description: "Rental charges - " + order.Product.Name, SAC: invoices.SACRental, Amount: payment.Amount, Taxable: true},
+			}
+		}
+	case "monthly":
+		// Prorated charges and credits consumed by this invoice are shown on their own lines
+		var applied []database.Payment
+		if err := database.DB.Where("applied_to_id = ?", payment.ID).Order("created_at ASC").Find(&applied).Error; err != nil {
+			return nil, err
+		}
+
+		rent := payment.Amount - payment.LateFee
+		var prorations []invoices.LineItem
+		for _, entry := range applied {
+			amount := entry.Amount
+			if isCreditEntry(entry.PaymentType) {
+				amount = -amount
+			}
+			rent -= amount
+
+			// Security deposit changes are refundable and not a taxable supply
+			if entry.PaymentType == PaymentTypeDepositTopUp || entry.PaymentType == PaymentTypeDepositCredit {
+				prorations = append(prorations, invoices.LineItem{Description: entry.Notes, Amount: amount})
+				continue
+			}
+			prorations = append(prorations, invoices.LineItem{Description: entry.Notes, SAC: invoices.SACRental, Amount: amount, Taxable: true})
+		}
+
+		document.Items = append([]invoices.LineItem{
+			{Description: "Monthly rent - " + productName, SAC: invoices.SACRental, Amount: rent, Taxable: true},
+		}, prorations...)
+		document.Items = append(document.Items,
+			invoices.LineItem{Description: "Late payment fee", SAC: invoices.SACRental, Amount: payment.LateFee, Taxable: true})
+	case PaymentTypeAdjustment:
+		document.Items = []invoices.LineItem{
+			{Description: "Prorated rent - " + productName, SAC: invoices.SACRental, Amount: payment.Amount, Taxable: true},
+		}
+	default:
+		document.Items = []invoices.LineItem{
+			{Description: "Damage charges - " + order.Product.Name, SAC: invoices.SACRental, Amount: payment.Amount, Taxable: true},
+		}
+	}
+
+	// Drop zero-value lines such as a waived installation fee
+	items := document.Items[:0]
+	for _, item := range document.Items {
+		if math.Abs(item.Amount) >= 0.005 {
+			items = append(items, item)
+		}
+	}
+	document.Items = items
+
+	return document, nil
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// headOfficeInvoicePrefix numbers invoices for payments not tied to a franchise
+const headOfficeInvoicePrefix = "AQH"
+
+// franchiseCodePattern is the form of a franchise code, e.g. HYD01
+var franchiseCodePattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// derivedPrefixPattern matches the prefixes given to franchises without a code, e.g. FR007.
+// Franchise codes may not take this form, so the two can never share a prefix.
+var derivedPrefixPattern = regexp.MustCompile(`^FR[0-9]+$`)
+
+// normalizeFranchiseCode upper-cases a franchise code and checks it can be used as an
+// invoice prefix. An empty code is allowed; the prefix is then derived from the ID.
+func normalizeFranchiseCode(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return "", nil
+	}
+	if !franchiseCodePattern.MatchString(code) {
+		return "", errors.New("code must be 2 to 10 letters or digits")
+	}
+	if code == headOfficeInvoicePrefix || derivedPrefixPattern.MatchString(code) {
+		return "", fmt.Errorf("code %s is reserved", code)
+	}
+	return code, nil
+}
+
+// franchiseCodeTaken reports whether another franchise, including a deleted one, already
+// uses the code. Invoice numbers of deleted franchises stay valid, so codes are never reused.
+func franchiseCodeTaken(db *gorm.DB, code string, franchiseID uint) (bool, error) {
+	var count int64
+	err := db.Model(&database.Franchise{}).Unscoped().
+		Where("code = ? AND id <> ?", code, franchiseID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// fiscalYear returns the Indian fiscal year (April to March) containing t, e.g. 2026-27
+func fiscalYear(t time.Time) string {
+	start := t.Year()
+	if t.Month() < time.April {
+		start--
+	}
+	return fmt.Sprintf("%d-%02d", start, (start+1)%100)
+}
+
+// allocateInvoiceNumber issues the next invoice number for a franchise in the fiscal year
+// of issuedAt, e.g. HYD01/2026-27/000123. The sequence row stays locked until tx ends,
+// so a rolled back payment gives its number back and no gaps appear.
+func allocateInvoiceNumber(tx *gorm.DB, franchiseID uint, issuedAt time.Time) (string, error) {
+	year := fiscalYear(issuedAt)
+
+	sequence := database.InvoiceSequence{FranchiseID: franchiseID, FiscalYear: year}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&sequence).Error; err != nil {
+		return "", err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("franchise_id = ? AND fiscal_year = ?", franchiseID, year).
+		First(&sequence).Error; err != nil {
+		return "", err
+	}
+
+	sequence.LastNumber++
+	if err := tx.Model(&sequence).Update("last_number", sequence.LastNumber).Error; err != nil {
+		return "", err
+	}
+
+	prefix, err := franchiseInvoicePrefix(tx, franchiseID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%06d", prefix, year, sequence.LastNumber), nil
+}
+
+// franchiseInvoicePrefix returns the franchise code, falling back to one derived from its ID
+func franchiseInvoicePrefix(tx *gorm.DB, franchiseID uint) (string, error) {
+	if franchiseID == 0 {
+		return headOfficeInvoicePrefix, nil
+	}
+
+	var franchise database.Franchise
+	if err := tx.Unscoped().Select("id, code").First(&franchise, franchiseID).Error; err != nil {
+		return "", err
+	}
+	if franchise.Code != "" {
+		return franchise.Code, nil
+	}
+	return fmt.Sprintf("FR%03d", franchise.ID), nil
+}
+
+// assignInvoiceNumber gives payment the next invoice number of its franchise unless it
+// already has one. Call it when a payment is completed, before saving the payment.
+func assignInvoiceNumber(tx *gorm.DB, payment *database.Payment) error {
+	if payment.InvoiceNumber != "" {
+		return nil
+	}
+
+	franchiseID, err := paymentFranchiseID(tx, payment)
+	if err != nil {
+		return err
+	}
+
+	number, err := allocateInvoiceNumber(tx, franchiseID, time.Now())
+	if err != nil {
+		return err
+	}
+	payment.InvoiceNumber = number
+	return nil
+}
+
+// paymentFranchiseID returns the franchise a payment was taken for
+func paymentFranchiseID(tx *gorm.DB, payment *database.Payment) (uint, error) {
+	var franchiseIDs []uint
+	var err error
+	switch {
+	case payment.OrderID != nil:
+		err = tx.Model(&database.Order{}).Unscoped().Where("id = ?", *payment.OrderID).Pluck("franchise_id", &franchiseIDs).Error
+	case payment.SubscriptionID != nil:
+		err = tx.Model(&database.Subscription{}).Unscoped().Where("id = ?", *payment.SubscriptionID).Pluck("franchise_id", &franchiseIDs).Error
+	}
+	if err != nil || len(franchiseIDs) == 0 {
+		return 0, err
+	}
+	return franchiseIDs[0], nil
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 10, 30, 0, 0, time.UTC)
+}
+
+func TestFiscalYear(t *testing.T) {
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{date(2026, time.April, 1), "2026-27"},
+		{date(2026, time.December, 31), "2026-27"},
+		{date(2027, time.January, 1), "2026-27"},
+		{date(2027, time.March, 31), "2026-27"},
+		{date(2099, time.June, 1), "2099-00"},
+		{date(2100, time.February, 1), "2099-00"},
+	}
+
+	for _, tt := range tests {
+		if got := fiscalYear(tt.at); got != tt.want {
+			t.Errorf("fiscalYear(%s) = %s, want %s", tt.at.Format("2006-01-02"), got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeFranchiseCode(t *testing.T) {
+	tests := []struct {
+		code    string
+		want    string
+		wantErr bool
+	}{
+		{"HYD01", "HYD01", false},
+		{" hyd01 ", "HYD01", false},
+		{"", "", false},
+		{"   ", "", false},
+		{"BLR", "BLR", false},
+		{"AB", "AB", false},
+		{"ABCDEFGHIJ", "ABCDEFGHIJ", false},
+		{"A", "", true},
+		{"ABCDEFGHIJK", "", true},
+		{"HYD-01", "", true},
+		{"HYD/01", "", true},
+		{"FR007", "", true},
+		{"fr12", "", true},
+		{"FRESH", "FRESH", false},
+		{"FR1A", "FR1A", false},
+		{headOfficeInvoicePrefix, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeFranchiseCode(tt.code)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeFranchiseCode(%q) error = %v, want error %v", tt.code, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeFranchiseCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
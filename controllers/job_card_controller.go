@@ -0,0 +1,494 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// jobCardUploadDir is where job card photos and signatures are stored. It is served
+// under /uploads/job-cards.
+const jobCardUploadDir = "./uploads/job-cards"
+
+// jobCardImageTypes are the accepted photo and signature file extensions
+var jobCardImageTypes = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true}
+
+// JobCardChecklistRequest is a check on a job card
+type JobCardChecklistRequest struct {
+	Item    string `json:"item" binding:"required"`
+	Done    bool   `json:"done"`
+	Remarks string `json:"remarks"`
+}
+
+// JobCardPartRequest is a part or consumable used on a service visit
+type JobCardPartRequest struct {
+	ProductID uint `json:"product_id" binding:"required"`
+	Quantity  int  `json:"quantity" binding:"required,min=1"`
+}
+
+// JobCardRequest replaces the checklist, readings and parts of a job card
+type JobCardRequest struct {
+	Checklist []JobCardChecklistRequest `json:"checklist" binding:"dive"`
+	Parts     []JobCardPartRequest      `json:"parts" binding:"dive"`
+	TDSBefore *int                      `json:"tds_before" binding:"omitempty,min=0"`
+	TDSAfter  *int                      `json:"tds_after" binding:"omitempty,min=0"`
+	PHBefore  *float64                  `json:"ph_before" binding:"omitempty,min=0,max=14"`
+	PHAfter   *float64                  `json:"ph_after" binding:"omitempty,min=0,max=14"`
+	Summary   string                    `json:"summary"`
+}
+
+// loadJobCard returns the job card of a service request with its checklist, parts and
+// photos, or nil when the agent has not started one
+func loadJobCard(db *gorm.DB, requestID uint) (*database.ServiceJobCard, error) {
+	var card database.ServiceJobCard
+	err := db.
+		Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("id ASC") }).
+		Preload("Parts", func(db *gorm.DB) *gorm.DB { return db.Order("id ASC") }).
+		Preload("Parts.Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name, image_url") }).
+		Preload("Photos", func(db *gorm.DB) *gorm.DB { return db.Order("id ASC") }).
+		Where("service_request_id = ?", requestID).
+		First(&card).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+// hasConfirmedJobCard reports whether the customer has confirmed the job card of a
+// service request
+func hasConfirmedJobCard(db *gorm.DB, requestID uint) (bool, error) {
+	var count int64
+	err := db.Model(&database.ServiceJobCard{}).
+		Where("service_request_id = ? AND confirmed_at IS NOT NULL", requestID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// lockEditableJobCard locks the service request in the :id path parameter, which must be
+// assigned to the calling agent and still open, and returns its job card, creating an
+// empty one on first use. It responds and returns false when the card cannot be edited.
+func lockEditableJobCard(c *gin.Context, tx *gorm.DB) (*database.ServiceRequest, *database.ServiceJobCard, bool) {
+	requestID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return nil, nil, false
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return nil, nil, false
+	}
+
+	var serviceRequest database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND service_agent_id = ?", requestID, agentID).
+		First(&serviceRequest).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service request not found or not assigned to you"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return nil, nil, false
+	}
+	if serviceRequest.Status == ServiceStatusCompleted || serviceRequest.Status == ServiceStatusCancelled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot edit the job card of a " + serviceRequest.Status + " service request"})
+		return nil, nil, false
+	}
+
+	card := database.ServiceJobCard{ServiceRequestID: serviceRequest.ID, AgentID: agentID}
+	if err := tx.Where("service_request_id = ?", serviceRequest.ID).FirstOrCreate(&card).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return nil, nil, false
+	}
+	if card.ConfirmedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "The customer has already confirmed this job card"})
+		return nil, nil, false
+	}
+	return &serviceRequest, &card, true
+}
+
+// saveJobCardImage stores an uploaded job card image and returns its public URL
+func saveJobCardImage(c *gin.Context, file *multipart.FileHeader, requestID uint, kind string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if !jobCardImageTypes[ext] {
+		return "", fmt.Errorf("unsupported image type %q", ext)
+	}
+	if err := os.MkdirAll(jobCardUploadDir, 0755); err != nil {
+		return "", err
+	}
+
+	filename := fmt.Sprintf("%d_%s_%d%s", requestID, kind, time.Now().UnixNano(), ext)
+	if err := c.SaveUploadedFile(file, filepath.Join(jobCardUploadDir, filename)); err != nil {
+		return "", err
+	}
+	return "/uploads/job-cards/" + filename, nil
+}
+
+// removeJobCardImage deletes a stored job card image by its public URL
+func removeJobCardImage(url string) {
+	name := strings.TrimPrefix(url, "/uploads/job-cards/")
+	if name == url || name == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(jobCardUploadDir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove job card image %s: %v", url, err)
+	}
+}
+
+// SaveJobCard replaces the checklist, water readings, summary and parts used on the job
+// card of a service request (Service Agent only)
+func SaveJobCard(c *gin.Context) {
+	var request JobCardRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	parts := map[uint]int{}
+	productIDs := []uint{}
+	for _, part := range request.Parts {
+		if _, seen := parts[part.ProductID]; !seen {
+			productIDs = append(productIDs, part.ProductID)
+		}
+		parts[part.ProductID] += part.Quantity
+	}
+
+	tx := database.DB.Begin()
+
+	serviceRequest, card, ok := lockEditableJobCard(c, tx)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if len(productIDs) > 0 {
+		var found int64
+		if err := tx.Model(&database.Product{}).Where("id IN ?", productIDs).Count(&found).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if found != int64(len(productIDs)) {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "One or more parts are not catalog products"})
+			return
+		}
+	}
+
+	if err := tx.Model(card).Updates(map[string]interface{}{
+		"tds_before": request.TDSBefore,
+		"tds_after":  request.TDSAfter,
+		"ph_before":  request.PHBefore,
+		"ph_after":   request.PHAfter,
+		"summary":    strings.TrimSpace(request.Summary),
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job card"})
+		return
+	}
+
+	if err := tx.Unscoped().Where("job_card_id = ?", card.ID).Delete(&database.JobCardChecklistItem{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job card"})
+		return
+	}
+	if len(request.Checklist) > 0 {
+		items := make([]database.JobCardChecklistItem, 0, len(request.Checklist))
+		for _, item := range request.Checklist {
+			items = append(items, database.JobCardChecklistItem{
+				JobCardID: card.ID,
+				Item:      strings.TrimSpace(item.Item),
+				Done:      item.Done,
+				Remarks:   item.Remarks,
+			})
+		}
+		if err := tx.Create(&items).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job card"})
+			return
+		}
+	}
+
+	if err := tx.Unscoped().Where("job_card_id = ?", card.ID).Delete(&database.JobCardPart{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job card"})
+		return
+	}
+	if len(productIDs) > 0 {
+		used := make([]database.JobCardPart, 0, len(productIDs))
+		for _, productID := range productIDs {
+			used = append(used, database.JobCardPart{JobCardID: card.ID, ProductID: productID, Quantity: parts[productID]})
+		}
+		if err := tx.Create(&used).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job card"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	saved, err := loadJobCard(database.DB, serviceRequest.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Job card saved", "job_card": saved})
+}
+
+// UploadJobCardPhoto adds a photo, sent as the "photo" form field, to the job card of a
+// service request. The "stage" field says whether it was taken before or after the work
+// (Service Agent only)
+func UploadJobCardPhoto(c *gin.Context) {
+	file, err := c.FormFile("photo")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo file is required"})
+		return
+	}
+	stage := c.DefaultPostForm("stage", JobPhotoAfter)
+	if stage != JobPhotoBefore && stage != JobPhotoAfter {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stage must be before or after"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	serviceRequest, card, ok := lockEditableJobCard(c, tx)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	url, err := saveJobCardImage(c, file, serviceRequest.ID, "photo")
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to save job card photo: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo must be a JPEG, PNG or WebP image"})
+		return
+	}
+
+	photo := database.JobCardPhoto{
+		JobCardID: card.ID,
+		URL:       url,
+		Stage:     stage,
+		Caption:   c.PostForm("caption"),
+	}
+	if err := tx.Create(&photo).Error; err != nil {
+		tx.Rollback()
+		removeJobCardImage(url)
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving photo"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		removeJobCardImage(url)
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Photo added", "photo": photo})
+}
+
+// DeleteJobCardPhoto removes a photo from the job card of a service request (Service
+// Agent only)
+func DeleteJobCardPhoto(c *gin.Context) {
+	photoID, err := strconv.ParseUint(c.Param("photoId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid photo ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	_, card, ok := lockEditableJobCard(c, tx)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	var photo database.JobCardPhoto
+	if err := tx.Where("id = ? AND job_card_id = ?", photoID, card.ID).First(&photo).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if err := tx.Unscoped().Delete(&photo).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting photo"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	removeJobCardImage(photo.URL)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Photo deleted"})
+}
+
+// ConfirmJobCardBySignature records the customer's signature, sent as the "signature"
+// form field with their name in "signed_by_name", on the job card of a service request.
+// The card is locked and the parts used are taken from the franchise's stock (Service
+// Agent only)
+func ConfirmJobCardBySignature(c *gin.Context) {
+	file, err := c.FormFile("signature")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Signature image is required"})
+		return
+	}
+	signedBy := strings.TrimSpace(c.PostForm("signed_by_name"))
+	if signedBy == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name of the person signing is required"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	serviceRequest, card, ok := lockEditableJobCard(c, tx)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	var checks int64
+	if err := tx.Model(&database.JobCardChecklistItem{}).Where("job_card_id = ?", card.ID).Count(&checks).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if checks == 0 || card.TDSBefore == nil || card.TDSAfter == nil {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Fill in the checklist and the TDS readings before and after the visit first",
+			"code":  "job_card_incomplete",
+		})
+		return
+	}
+
+	franchiseID, err := serviceRequestFranchiseID(tx, serviceRequest.ID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	var parts []database.JobCardPart
+	if err := tx.Where("job_card_id = ?", card.ID).Order("product_id ASC").Find(&parts).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	for _, part := range parts {
+		movement, err := adjustInventory(tx, franchiseID, part.ProductID, InventoryMovementServiceUse, -part.Quantity, InventoryReference{
+			ServiceRequestID: &serviceRequest.ID,
+			ActorRole:        RoleServiceAgent,
+			ActorID:          &agentID,
+			Notes:            fmt.Sprintf("Used on service request #%d", serviceRequest.ID),
+		})
+		if errors.Is(err, ErrOutOfStock) {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{
+				"error":      fmt.Sprintf("The franchise does not have %d of product #%d in stock", part.Quantity, part.ProductID),
+				"code":       "out_of_stock",
+				"product_id": part.ProductID,
+			})
+			return
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating inventory"})
+			return
+		}
+		if err := tx.Model(&part).Update("inventory_movement_id", movement.ID).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating inventory"})
+			return
+		}
+	}
+
+	url, err := saveJobCardImage(c, file, serviceRequest.ID, "signature")
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to save signature: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Signature must be a JPEG, PNG or WebP image"})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(card).Updates(map[string]interface{}{
+		"confirmation_method": JobCardConfirmedBySignature,
+		"signed_by_name":      signedBy,
+		"signature_url":       url,
+		"confirmed_at":        now,
+	}).Error; err != nil {
+		tx.Rollback()
+		removeJobCardImage(url)
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error confirming job card"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		removeJobCardImage(url)
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	confirmed, err := loadJobCard(database.DB, serviceRequest.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Job card confirmed", "job_card": confirmed})
+}
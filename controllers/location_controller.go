@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
@@ -41,7 +42,13 @@ type FranchiseRequest struct {
 	ZipCode     string `json:"zip_code" binding:"required"`
 	Phone       string `json:"phone" binding:"required"`
 	Email       string `json:"email" binding:"required,email"`
+	GSTIN       string `json:"gstin"`
+	Code        string `json:"code"`
 	LocationIDs []uint `json:"location_ids"` // ✅ this is news
+	// Optional; a franchise covers the ZIPs of its locations plus CoverageRadius km around its coordinates
+	Latitude       *float64 `json:"latitude"`
+	Longitude      *float64 `json:"longitude"`
+	CoverageRadius *float64 `json:"coverage_radius"`
 }
 
 // CreateFranchise creates a new franchise (Franchise Owner only)
@@ -73,6 +80,29 @@ func CreateFranchise(c *gin.Context) {
 		return
 	}
 
+	code, err := normalizeFranchiseCode(franchiseRequest.Code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	gstin := strings.ToUpper(strings.TrimSpace(franchiseRequest.GSTIN))
+	if gstin != "" && len(gstin) != 15 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "GSTIN must be 15 characters"})
+		return
+	}
+	if code != "" {
+		taken, err := franchiseCodeTaken(database.DB, code, 0)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Another franchise already uses code " + code})
+			return
+		}
+	}
+
 	// Begin transaction
 	tx := database.DB.Begin()
 	if tx.Error != nil {
@@ -91,9 +121,16 @@ func CreateFranchise(c *gin.Context) {
 		ZipCode:       franchiseRequest.ZipCode,
 		Phone:         franchiseRequest.Phone,
 		Email:         franchiseRequest.Email,
+		GSTIN:         gstin,
+		Code:          code,
 		IsActive:      false,     // Initially inactive until approved
 		ApprovalState: "pending", // Initial approval state
 	}
+	if err := applyFranchiseCoverage(&franchise, &franchiseRequest); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	result := tx.Create(&franchise)
 	if result.Error != nil {
@@ -390,6 +427,10 @@ func UpdateFranchise(c *gin.Context) {
 	franchise.ZipCode = franchiseRequest.ZipCode
 	franchise.Phone = franchiseRequest.Phone
 	franchise.Email = franchiseRequest.Email
+	if err := applyFranchiseCoverage(&franchise, &franchiseRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// ✅ Update linked locations if provided
 	if len(franchiseRequest.LocationIDs) > 0 {
@@ -654,37 +695,39 @@ func GetFranchiseServiceAgents(c *gin.Context) {
 	c.JSON(http.StatusOK, serviceAgents)
 }
 
-// SearchFranchises searches for franchises by location (Customer only)
+// SearchFranchises finds the franchises serving a location, nearest first. The location
+// is taken from the zip_code, latitude and longitude query parameters, falling back to
+// the caller's profile.
 func SearchFranchises(c *gin.Context) {
-	// This is a simplified search by zip code
-	// In a real app, you'd use spatial queries to find franchises serving the customer's location
-
-	zipCode := c.Query("zip_code")
-	if zipCode == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Zip code is required"})
-		return
+	var point ServicePoint
+	if user, exists := c.Get("user"); exists {
+		if customer, ok := user.(database.User); ok {
+			point = customerServicePoint(&customer)
+		}
 	}
 
-	// Define response structure
-	type FranchiseLocation struct {
-		ID      uint   `json:"id"`
-		Name    string `json:"name"`
-		Address string `json:"address"`
-		City    string `json:"city"`
-		State   string `json:"state"`
-		ZipCode string `json:"zip_code"`
+	if zipCode := strings.TrimSpace(c.Query("zip_code")); zipCode != "" {
+		point.ZipCode = zipCode
+	}
+	latitude, longitude := c.Query("latitude"), c.Query("longitude")
+	if latitude != "" || longitude != "" {
+		lat, latErr := strconv.ParseFloat(latitude, 64)
+		lng, lngErr := strconv.ParseFloat(longitude, 64)
+		if latErr != nil || lngErr != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latitude or longitude"})
+			return
+		}
+		point.Latitude, point.Longitude = lat, lng
 	}
 
-	var franchises []FranchiseLocation
-
-	// Get franchises that serve this zip code using GORM
-	result := database.DB.Model(&database.Franchise{}).
-		Select("id, name, address, city, state, zip_code").
-		Where("is_active = ? AND approval_state = ? AND zip_code = ?", true, "approved", zipCode).
-		Find(&franchises)
+	if point.ZipCode == "" && !point.HasCoordinates() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Zip code or coordinates are required"})
+		return
+	}
 
-	if result.Error != nil {
-		log.Printf("Database error: %v", result.Error)
+	franchises, err := findServiceableFranchises(database.DB, point)
+	if err != nil {
+		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 		return
 	}
@@ -782,23 +825,68 @@ func AddFranchiseLocations(c *gin.Context) {
 		return
 	}
 
-	var created []database.Location
-	for _, zip := range req.ZipCodes {
-		location := database.Location{
-			Name:     req.Name,
-			ZipCodes: pq.StringArray{zip},
-		}
-		if err := database.DB.Where("? = ANY(zip_codes)", zip).FirstOrCreate(&location).Error; err != nil {
-			continue
-		}
+	zipCodes, err := normalizeZipCodes(req.ZipCodes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// One location holds all the ZIPs added together, linked to this franchise only
+	tx := database.DB.Begin()
 
-		link := database.FranchiseLocation{
-			FranchiseID: *user.FranchiseID,
-			LocationID:  location.ID,
+	location := database.Location{
+		Name:     req.Name,
+		ZipCodes: pq.StringArray(zipCodes),
+		IsActive: true,
+	}
+	if err := tx.Create(&location).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add service area"})
+		return
+	}
+
+	link := database.FranchiseLocation{
+		FranchiseID: *user.FranchiseID,
+		LocationID:  location.ID,
+	}
+	if err := tx.Create(&link).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add service area"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add service area"})
+		return
+	}
+
+	// Report the ZIPs other franchises already serve so that the owner can resolve them
+	overlapping := []string{}
+	if overlaps, err := findServiceAreaOverlaps(database.DB); err != nil {
+		log.Printf("Database error: %v", err)
+	} else {
+		added := make(map[string]bool, len(zipCodes))
+		for _, zip := range zipCodes {
+			added[zip] = true
+		}
+		for _, overlap := range overlaps {
+			if overlap.Type != ServiceAreaOverlapZipCode || !added[overlap.ZipCode] {
+				continue
+			}
+			for _, franchiseID := range overlap.FranchiseIDs {
+				if franchiseID == *user.FranchiseID {
+					overlapping = append(overlapping, overlap.ZipCode)
+					break
+				}
+			}
 		}
-		database.DB.FirstOrCreate(&link, link)
-		created = append(created, location)
 	}
 
-	c.JSON(http.StatusOK, created)
+	c.JSON(http.StatusOK, gin.H{
+		"location":              location,
+		"overlapping_zip_codes": overlapping,
+	})
 }
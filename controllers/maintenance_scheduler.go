@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// defaultMaintenanceCycleMonths applies to products without a maintenance cycle
+const defaultMaintenanceCycleMonths = 3
+
+// StartMaintenanceScheduler starts the background job that raises maintenance visits
+// ahead of each subscription's next maintenance date
+func StartMaintenanceScheduler() {
+	interval := time.Duration(config.AppConfig.MaintenanceJobIntervalMinutes) * time.Minute
+	runPeriodically("Maintenance", interval, RunMaintenanceCycle)
+}
+
+// RunMaintenanceCycle raises a maintenance service request for every active
+// subscription whose next maintenance falls within the lead time and that has no open
+// maintenance request. It is safe to run repeatedly.
+func RunMaintenanceCycle(now time.Time) {
+	dueBy := now.AddDate(0, 0, config.AppConfig.MaintenanceLeadDays)
+
+	var subscriptionIDs []uint
+	if err := database.DB.Model(&database.Subscription{}).
+		Where("status = ? AND next_maintenance <= ?", SubscriptionStatusActive, dueBy).
+		Where("NOT EXISTS (?)", openMaintenanceRequests(database.DB)).
+		Pluck("id", &subscriptionIDs).Error; err != nil {
+		log.Printf("Maintenance: failed to load due subscriptions: %v", err)
+		return
+	}
+
+	raised := 0
+	for _, id := range subscriptionIDs {
+		ok, err := raiseMaintenanceRequest(id, dueBy)
+		if err != nil {
+			log.Printf("Maintenance: subscription #%d failed: %v", id, err)
+			continue
+		}
+		if ok {
+			raised++
+		}
+	}
+
+	if raised > 0 {
+		log.Printf("Maintenance: raised %d maintenance request(s)", raised)
+	}
+}
+
+// openMaintenanceRequests selects the unfinished maintenance requests of the
+// subscription in the enclosing query
+func openMaintenanceRequests(db *gorm.DB) *gorm.DB {
+	return db.Model(&database.ServiceRequest{}).
+		Select("1").
+		Where("service_requests.subscription_id = subscriptions.id AND service_requests.type = ? AND service_requests.status NOT IN ?",
+			ServiceTypeMaintenance, []string{ServiceStatusCompleted, ServiceStatusCancelled})
+}
+
+// raiseMaintenanceRequest creates the maintenance request for one subscription, routed
+// to its franchise and scheduled for its next maintenance date. It returns false when
+// the subscription is no longer due.
+func raiseMaintenanceRequest(subscriptionID uint, dueBy time.Time) (bool, error) {
+	raised := false
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the subscription so concurrent runs raise a single request
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&subscription, subscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.Status != SubscriptionStatusActive || subscription.NextMaintenance.After(dueBy) {
+			return nil
+		}
+
+		var open int64
+		if err := tx.Table("subscriptions").
+			Where("subscriptions.id = ? AND EXISTS (?)", subscription.ID, openMaintenanceRequests(tx)).
+			Count(&open).Error; err != nil {
+			return err
+		}
+		if open > 0 {
+			return nil
+		}
+
+		scheduledTime := subscription.NextMaintenance
+		request := database.ServiceRequest{
+			CustomerID:     subscription.CustomerID,
+			SubscriptionID: subscription.ID,
+			FranchiseID:    subscription.FranchiseID,
+			Type:           ServiceTypeMaintenance,
+			Status:         database.ServiceStatusPending,
+			Description:    "Scheduled maintenance",
+			ScheduledTime:  &scheduledTime,
+		}
+		dueBy, err := serviceDueBy(tx, request.Type, time.Now(), request.ScheduledTime)
+		if err != nil {
+			return err
+		}
+		request.DueBy = dueBy
+		if err := tx.Create(&request).Error; err != nil {
+			return err
+		}
+		raised = true
+
+		notification := database.Notification{
+			UserID:      subscription.CustomerID,
+			Title:       "Maintenance Due",
+			Message:     fmt.Sprintf("Your purifier is due for maintenance on %s. We will confirm the visit shortly.", scheduledTime.Format("02 Jan 2006")),
+			Type:        "service_request",
+			RelatedID:   &request.ID,
+			RelatedType: "service_request",
+		}
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+
+		var franchise database.Franchise
+		if err := tx.Select("id, owner_id").First(&franchise, subscription.FranchiseID).Error; err != nil || franchise.OwnerID == 0 {
+			return nil
+		}
+		franchiseNotification := database.Notification{
+			UserID:      franchise.OwnerID,
+			Title:       "Maintenance Visit Due",
+			Message:     fmt.Sprintf("Scheduled maintenance for subscription #%d is due on %s. Please assign a technician.", subscription.ID, scheduledTime.Format("02 Jan 2006")),
+			Type:        "service_request",
+			RelatedID:   &request.ID,
+			RelatedType: "service_request",
+		}
+		return tx.Create(&franchiseNotification).Error
+	})
+
+	return raised, err
+}
+
+// lockServiceRequestStatus locks a service request for update and returns its status
+func lockServiceRequestStatus(tx *gorm.DB, requestID uint) (string, error) {
+	var request database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id, status").
+		First(&request, requestID).Error; err != nil {
+		return "", err
+	}
+	return request.Status, nil
+}
+
+// completeServiceRequest applies the effects of a service request being completed.
+// Maintenance visits and device swaps roll the subscription's maintenance dates forward
+// by its product's cycle. A swap first moves the subscription to the product of its plan
+// change, then fits a unit of it with its components. A device pickup returns the
+// collected unit to the asset registry and the franchise's stock.
+func completeServiceRequest(tx *gorm.DB, request *database.ServiceRequest, actorRole string, actorID *uint) error {
+	if request.Type != ServiceTypeMaintenance && request.Type != ServiceTypeProductSwap &&
+		request.Type != ServiceTypeDevicePickup {
+		return nil
+	}
+
+	var subscription database.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&subscription, request.SubscriptionID).Error; err != nil {
+		return err
+	}
+
+	requestID := request.ID
+	if request.Type == ServiceTypeDevicePickup {
+		return returnSubscriptionAsset(tx, &subscription, subscription.ProductID, InventoryReference{
+			ServiceRequestID: &requestID,
+			ActorRole:        actorRole,
+			ActorID:          actorID,
+			Notes:            fmt.Sprintf("Collected by service request #%d", request.ID),
+		})
+	}
+
+	completedAt := time.Now()
+	if request.CompletionTime != nil {
+		completedAt = *request.CompletionTime
+	}
+
+	previousProductID := subscription.ProductID
+	if request.Type == ServiceTypeProductSwap {
+		if err := applyPlanChange(tx, request.ID, &subscription, completedAt); err != nil {
+			return err
+		}
+	}
+
+	cycle, err := maintenanceCycleMonths(tx, subscription.ProductID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&subscription).Updates(map[string]interface{}{
+		"last_maintenance": completedAt,
+		"next_maintenance": completedAt.AddDate(0, cycle, 0),
+	}).Error; err != nil {
+		return err
+	}
+
+	if request.Type == ServiceTypeProductSwap {
+		if err := swapSubscriptionAsset(tx, &subscription, previousProductID, completedAt, InventoryReference{
+			ServiceRequestID: &requestID,
+			ActorRole:        actorRole,
+			ActorID:          actorID,
+			Notes:            fmt.Sprintf("Swapped by service request #%d", request.ID),
+		}); err != nil {
+			return err
+		}
+		// The swapped-in unit comes with new components
+		return installProductComponents(tx, &subscription, completedAt)
+	}
+	return nil
+}
+
+// cancelServiceRequest applies the effects of a service request being cancelled. A
+// cancelled device swap drops its plan change and a cancelled maintenance visit skips
+// the cycle it was raised for.
+func cancelServiceRequest(tx *gorm.DB, request *database.ServiceRequest, actorRole string, actorID *uint) error {
+	switch request.Type {
+	case ServiceTypeProductSwap:
+		return cancelPlanChange(tx, request, actorRole, actorID)
+	case ServiceTypeMaintenance:
+		return skipMaintenanceCycle(tx, request.SubscriptionID, time.Now())
+	}
+	return nil
+}
+
+// skipMaintenanceCycle moves a subscription's next maintenance past the scheduler's lead
+// time by whole cycles, so a cancelled visit is not raised again on the next run.
+// Subscriptions whose maintenance is not yet due are left alone.
+func skipMaintenanceCycle(tx *gorm.DB, subscriptionID uint, now time.Time) error {
+	var subscription database.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&subscription, subscriptionID).Error; err != nil {
+		return err
+	}
+
+	dueBy := now.AddDate(0, 0, config.AppConfig.MaintenanceLeadDays)
+	if subscription.NextMaintenance.After(dueBy) {
+		return nil
+	}
+
+	cycle, err := maintenanceCycleMonths(tx, subscription.ProductID)
+	if err != nil {
+		return err
+	}
+	next := subscription.NextMaintenance
+	for !next.After(dueBy) {
+		next = next.AddDate(0, cycle, 0)
+	}
+	return tx.Model(&subscription).Update("next_maintenance", next).Error
+}
+
+// maintenanceCycleMonths returns the number of months between maintenance visits for a product
+func maintenanceCycleMonths(tx *gorm.DB, productID uint) (int, error) {
+	var product database.Product
+	if err := tx.Unscoped().Select("id, maintenance_cycle").First(&product, productID).Error; err != nil {
+		return 0, err
+	}
+	if product.MaintenanceCycle <= 0 {
+		return defaultMaintenanceCycleMonths, nil
+	}
+	return product.MaintenanceCycle, nil
+}
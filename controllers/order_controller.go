@@ -6,10 +6,12 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"aquahome/database"
 )
@@ -17,11 +19,15 @@ import (
 // OrderRequest contains the data for order creation
 type OrderRequest struct {
 	ProductID       int64  `json:"product_id" binding:"required"`
-	FranchiseID     int64  `json:"franchise_id" binding:"required"`
+	FranchiseID     int64  `json:"franchise_id"` // Optional; the order is routed automatically when omitted
 	ShippingAddress string `json:"shipping_address" binding:"required"`
 	BillingAddress  string `json:"billing_address" binding:"required"`
 	RentalDuration  int    `json:"rental_duration" binding:"required,min=1"`
 	Notes           string `json:"notes"`
+	// Shipping location used for routing; defaults to the customer's profile
+	ShippingZipCode string   `json:"shipping_zip_code"`
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
 }
 
 // CreateOrder creates a new order (Customer only)
@@ -75,27 +81,67 @@ func CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// Verify franchise exists and is active
-	var franchise database.Franchise
-	franchiseResult := database.DB.First(&franchise, orderRequest.FranchiseID)
-	err = franchiseResult.Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found"})
+	// Verify the chosen franchise, or rank the franchises the order can be routed to
+	var candidates []OrderRouteCandidate
+	var triage *database.OrderTriage
+	if orderRequest.FranchiseID != 0 {
+		var franchise database.Franchise
+		franchiseResult := database.DB.First(&franchise, orderRequest.FranchiseID)
+		err = franchiseResult.Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found"})
+				return
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 			return
 		}
-		log.Printf("Database error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
-	}
 
-	if !franchise.IsActive {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Franchise is not active"})
-		return
-	}
+		if !franchise.IsActive {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Franchise is not active"})
+			return
+		}
+	} else {
+		var point ServicePoint
+		if user, exists := c.Get("user"); exists {
+			if customer, ok := user.(database.User); ok {
+				point = customerServicePoint(&customer)
+			}
+		}
+		if zipCode := strings.TrimSpace(orderRequest.ShippingZipCode); zipCode != "" {
+			point.ZipCode = zipCode
+		}
+		if orderRequest.Latitude != nil && orderRequest.Longitude != nil {
+			point.Latitude, point.Longitude = *orderRequest.Latitude, *orderRequest.Longitude
+		}
+		if point.ZipCode == "" && !point.HasCoordinates() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Franchise ID or a shipping ZIP code or location is required"})
+			return
+		}
 
-	// Calculate total initial amount
-	totalInitialAmount := product.SecurityDeposit + product.InstallationFee + product.MonthlyRent
+		var reason string
+		candidates, reason, err = rankOrderFranchises(database.DB, product.ID, point)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if len(candidates) == 0 {
+			triage = &database.OrderTriage{
+				CustomerID:      userIDUint,
+				ProductID:       product.ID,
+				ShippingAddress: orderRequest.ShippingAddress,
+				BillingAddress:  orderRequest.BillingAddress,
+				ShippingZipCode: point.ZipCode,
+				Latitude:        point.Latitude,
+				Longitude:       point.Longitude,
+				RentalDuration:  orderRequest.RentalDuration,
+				Notes:           orderRequest.Notes,
+				Reason:          reason,
+			}
+		}
+	}
 
 	// Begin transaction
 	tx := database.DB.Begin()
@@ -105,79 +151,88 @@ func CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// Create order
-	franchiseIDUint := uint(orderRequest.FranchiseID)
-	order := database.Order{
-		CustomerID:         uint(customerID),
-		ProductID:          uint(orderRequest.ProductID),
-		FranchiseID:        franchiseIDUint,
-		OrderType:          "rental",
-		Status:             database.OrderStatusPending,
-		ShippingAddress:    orderRequest.ShippingAddress,
-		BillingAddress:     orderRequest.BillingAddress,
-		RentalStartDate:    time.Now(), // rental_start_date will be confirmed after approval
-		RentalDuration:     orderRequest.RentalDuration,
-		MonthlyRent:        product.MonthlyRent,
-		SecurityDeposit:    product.SecurityDeposit,
-		InstallationFee:    product.InstallationFee,
-		TotalInitialAmount: totalInitialAmount,
-		Notes:              orderRequest.Notes,
-	}
-
-	result = tx.Create(&order)
-	if result.Error != nil {
-		if err := tx.Rollback().Error; err != nil {
-			log.Printf("Failed to rollback transaction: %v", err)
+	// No franchise qualifies; queue the request for an admin to route
+	if triage != nil {
+		if err := openOrderTriage(tx, triage); err != nil {
+			if err := tx.Rollback().Error; err != nil {
+				log.Printf("Failed to rollback transaction: %v", err)
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating order"})
+			return
 		}
-		log.Printf("Database error: %v", result.Error)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating order"})
+		if err := tx.Commit().Error; err != nil {
+			log.Printf("Transaction commit error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "No franchise could be found for your address yet. Your order is under review.",
+			"triage":  triage,
+		})
 		return
 	}
 
-	orderID := int64(order.ID)
-
-	// Create pending payment
-	invoiceNumber := generateInvoiceNumber(orderID)
-
-	orderIDUint := uint(orderID)
-	payment := database.Payment{
-		CustomerID:    uint(customerID),
-		OrderID:       &orderIDUint,
-		Amount:        totalInitialAmount,
-		PaymentType:   "initial",
-		Status:        database.PaymentStatusPending,
-		InvoiceNumber: invoiceNumber,
-		Notes:         "Initial payment for order",
+	order := database.Order{
+		CustomerID:      uint(customerID),
+		ProductID:       uint(orderRequest.ProductID),
+		FranchiseID:     uint(orderRequest.FranchiseID),
+		ShippingAddress: orderRequest.ShippingAddress,
+		BillingAddress:  orderRequest.BillingAddress,
+		RentalDuration:  orderRequest.RentalDuration,
+		Notes:           orderRequest.Notes,
+	}
+
+	var candidate *OrderRouteCandidate
+	if len(candidates) > 0 {
+		candidate, err = claimOrderFranchise(tx, candidates, product.ID)
+		if err != nil {
+			if err := tx.Rollback().Error; err != nil {
+				log.Printf("Failed to rollback transaction: %v", err)
+			}
+			if errors.Is(err, ErrOutOfStock) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+				return
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error routing order"})
+			return
+		}
+		order.FranchiseID = candidate.ID
 	}
 
-	result = tx.Create(&payment)
-	if result.Error != nil {
+	if err := placeOrder(tx, &order, &product, RoleCustomer, &userIDUint, "Order placed"); err != nil {
 		if err := tx.Rollback().Error; err != nil {
 			log.Printf("Failed to rollback transaction: %v", err)
 		}
-		log.Printf("Database error: %v", result.Error)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating payment"})
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating order"})
 		return
 	}
 
-	// Create notification for customer
-	relatedID := uint(orderID)
-	notification := database.Notification{
-		UserID:      uint(customerID),
-		Title:       "Order Placed Successfully",
-		Message:     "Your order for " + product.Name + " has been placed and is pending approval.",
-		Type:        "order",
-		RelatedID:   &relatedID,
-		RelatedType: "order",
+	// Record why the order went to its franchise
+	decision := database.OrderRoutingDecision{
+		OrderID:     order.ID,
+		FranchiseID: order.FranchiseID,
+		Method:      OrderRoutingCustomer,
+		Reason:      "Chosen by the customer",
+		ActorID:     &userIDUint,
+		ActorRole:   RoleCustomer,
 	}
-
-	result = tx.Create(&notification)
-	if result.Error != nil {
+	if candidate != nil {
+		decision = autoRoutingDecision(order.ID, candidate, len(candidates))
+	}
+	if err := tx.Create(&decision).Error; err != nil {
 		if err := tx.Rollback().Error; err != nil {
 			log.Printf("Failed to rollback transaction: %v", err)
 		}
-		log.Printf("Database error: %v", result.Error)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording order routing"})
 		return
 	}
 
@@ -190,17 +245,16 @@ func CreateOrder(c *gin.Context) {
 
 	// Get the created order
 	var createdOrder database.Order
-	result = database.DB.First(&createdOrder, orderID)
-	if result.Error != nil {
-		log.Printf("Database error: %v", result.Error)
+	if err := database.DB.First(&createdOrder, order.ID).Error; err != nil {
+		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving order"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message":        "Order created successfully",
-		"order":          createdOrder,
-		"invoice_number": invoiceNumber,
+		"message": "Order created successfully",
+		"order":   createdOrder,
+		"routing": decision,
 	})
 }
 
@@ -249,14 +303,31 @@ func CancelOrder(c *gin.Context) {
 		return
 	}
 
-	order.Status = database.OrderStatusCancelled
+	tx := database.DB.Begin()
+	if tx.Error != nil {
+		log.Printf("Transaction error: %v", tx.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
 
-	if err := database.DB.Save(&order).Error; err != nil {
+	if err := transitionOrder(tx, &order, database.OrderStatusCancelled, RoleCustomer, &userID, "Cancelled by customer"); err != nil {
+		tx.Rollback()
+		var transitionErr *OrderTransitionError
+		if errors.As(err, &transitionErr) {
+			respondOrderTransitionError(c, err)
+			return
+		}
 		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order"})
 		return
 	}
 
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Order cancelled successfully"})
 }
 
@@ -464,6 +535,9 @@ type UpdateOrderStatusRequest struct {
 	Status         string `json:"status" binding:"required"`
 	ServiceAgentID *int64 `json:"service_agent_id"`
 	Notes          string `json:"notes"`
+	// Serial number of the unit to reserve or install for the order; by default any unit
+	// of the product in the franchise warehouse is used
+	SerialNumber string `json:"serial_number"`
 }
 
 // UpdateOrderStatus updates an order status (Admin or Franchise Owner only)
@@ -473,6 +547,18 @@ func UpdateOrderStatus(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
+	roleStr := role.(string)
+
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found"})
+		return
+	}
+	actorID, ok := userID.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
 
 	orderIDStr := c.Param("id")
 	orderID, err := strconv.ParseInt(orderIDStr, 10, 64)
@@ -488,22 +574,10 @@ func UpdateOrderStatus(c *gin.Context) {
 	}
 
 	// Check if order exists and get current status
-	var currentStatus string
-	var franchiseID int64
-	var customerID int64
-	var productID int64
-
 	var order database.Order
 	err = database.DB.Where("id = ?", orderID).
-		Select("status, franchise_id, customer_id, product_id").
+		Select("id, status, franchise_id, customer_id, product_id").
 		First(&order).Error
-	if err == nil {
-		currentStatus = order.Status
-		franchiseID = int64(order.FranchiseID)
-		customerID = int64(order.CustomerID)
-		productID = int64(order.ProductID)
-	}
-
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
@@ -515,10 +589,9 @@ func UpdateOrderStatus(c *gin.Context) {
 	}
 
 	// If franchise owner, check if they own the franchise
-	if role == "franchise_owner" {
-		userID, _ := c.Get("user_id")
+	if roleStr == "franchise_owner" {
 		var franchise database.Franchise
-		err = database.DB.Where("id = ?", franchiseID).
+		err = database.DB.Where("id = ?", order.FranchiseID).
 			Select("owner_id").
 			First(&franchise).Error
 		if err != nil {
@@ -526,14 +599,19 @@ func UpdateOrderStatus(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 			return
 		}
-		ownerID := int64(franchise.OwnerID)
 
-		if ownerID != userID.(int64) {
+		if franchise.OwnerID != actorID {
 			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to update this order"})
 			return
 		}
 	}
 
+	// Reject illegal moves before opening a transaction
+	if err := validateOrderTransition(roleStr, order.Status, statusRequest.Status); err != nil {
+		respondOrderTransitionError(c, err)
+		return
+	}
+
 	// Begin transaction
 	tx := database.DB.Begin()
 	if tx.Error != nil {
@@ -542,9 +620,9 @@ func UpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
-	// First get the order in the transaction
-	// Already have the order variable from earlier, reuse it
-	if err := tx.First(&order, orderID).Error; err != nil {
+	// Reload the full order inside the transaction, locking the row so that
+	// concurrent updates cannot both pass validation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, orderID).Error; err != nil {
 		if err := tx.Rollback().Error; err != nil {
 			log.Printf("Failed to rollback transaction: %v", err)
 		}
@@ -553,12 +631,21 @@ func UpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
-	// Update order status
-	order.Status = statusRequest.Status
-
 	// Only update serviceAgentID if provided
 	if statusRequest.ServiceAgentID != nil && *statusRequest.ServiceAgentID > 0 {
 		agentID := uint(*statusRequest.ServiceAgentID)
+		isMember, err := isFranchiseAgent(tx, order.FranchiseID, agentID)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if !isMember {
+			tx.Rollback()
+			respondAgentNotInFranchise(c)
+			return
+		}
 		order.ServiceAgentID = &agentID
 	}
 
@@ -571,68 +658,47 @@ func UpdateOrderStatus(c *gin.Context) {
 		}
 	}
 
-	if err := tx.Save(&order).Error; err != nil {
-		if err := tx.Rollback().Error; err != nil {
-			log.Printf("Failed to rollback transaction: %v", err)
+	if statusRequest.SerialNumber != "" {
+		switch statusRequest.Status {
+		case OrderStatusApproved, OrderStatusInTransit, OrderStatusDelivered, OrderStatusInstalled:
+		default:
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A unit can only be assigned when approving, shipping or installing an order"})
+			return
 		}
-		log.Printf("Database error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order status"})
-		return
-	}
-
-	// If status changed to "approved", create subscription
-	if statusRequest.Status == database.OrderStatusApproved && currentStatus != database.OrderStatusApproved {
-		// We already have the order from earlier, but we need to reload to get all fields
-		if err := tx.First(&order, orderID).Error; err != nil {
-			if err := tx.Rollback().Error; err != nil {
-				log.Printf("Failed to rollback transaction: %v", err)
+		if err := assignOrderAsset(tx, &order, statusRequest.SerialNumber, roleStr, &actorID); err != nil {
+			tx.Rollback()
+			var allocationErr *AssetAllocationError
+			if errors.As(err, &allocationErr) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Unit " + allocationErr.SerialNumber + " " + allocationErr.Reason})
+				return
 			}
 			log.Printf("Database error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving order details"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error assigning unit"})
 			return
 		}
+	}
 
-		// Calculate end date and next billing date
-		startDate := time.Now() // Use current time as actual start date
-		endDate := startDate.AddDate(0, order.RentalDuration, 0)
-		nextBillingDate := startDate.AddDate(0, 1, 0) // Next month
-
-		// Create subscription with GORM
-		subscription := database.Subscription{
-			OrderID:          uint(orderID),
-			CustomerID:       uint(customerID),
-			ProductID:        uint(productID),
-			FranchiseID:      uint(franchiseID),
-			Status:           database.SubscriptionStatusActive,
-			StartDate:        startDate,
-			EndDate:          endDate,
-			NextBillingDate:  nextBillingDate,
-			MonthlyRent:      order.MonthlyRent,
-			LastMaintenance:  time.Time{},                // Zero value
-			NextMaintenance:  startDate.AddDate(0, 3, 0), // 3 months after start
-			MaintenanceNotes: "Initial setup complete",
-			Notes:            "Created from order #" + strconv.FormatInt(orderID, 10),
-		}
-
-		if err := tx.Create(&subscription).Error; err != nil {
-			if err := tx.Rollback().Error; err != nil {
-				log.Printf("Failed to rollback transaction: %v", err)
-			}
-			log.Printf("Database error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating subscription"})
+	if err := transitionOrder(tx, &order, statusRequest.Status, roleStr, &actorID, statusRequest.Notes); err != nil {
+		if err := tx.Rollback().Error; err != nil {
+			log.Printf("Failed to rollback transaction: %v", err)
+		}
+		var transitionErr *OrderTransitionError
+		if errors.As(err, &transitionErr) {
+			respondOrderTransitionError(c, err)
 			return
 		}
-
-		// Update order's rental start date to actual start date
-		order.RentalStartDate = startDate
-		if err := tx.Save(&order).Error; err != nil {
-			if err := tx.Rollback().Error; err != nil {
-				log.Printf("Failed to rollback transaction: %v", err)
-			}
-			log.Printf("Database error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order start date"})
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+			return
+		}
+		if errors.Is(err, ErrVisitUnverified) {
+			respondVisitUnverified(c)
 			return
 		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order status"})
+		return
 	}
 
 	// Create notification for customer
@@ -657,7 +723,7 @@ func UpdateOrderStatus(c *gin.Context) {
 	// Create notification using GORM
 	relatedIDUint := uint(orderID)
 	notification := database.Notification{
-		UserID:      uint(customerID),
+		UserID:      order.CustomerID,
 		Title:       "Order Status Updated",
 		Message:     message,
 		Type:        "order",
@@ -684,12 +750,90 @@ func UpdateOrderStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Order status updated successfully"})
 }
 
+// respondOrderTransitionError writes a 409 describing a rejected order status change
+func respondOrderTransitionError(c *gin.Context, err error) {
+	var transitionErr *OrderTransitionError
+	if !errors.As(err, &transitionErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   "Invalid order status transition",
+		"code":    "invalid_status_transition",
+		"from":    transitionErr.From,
+		"to":      transitionErr.To,
+		"role":    transitionErr.Role,
+		"allowed": transitionErr.Allowed,
+	})
+}
+
+// GetOrderHistory returns the status transition history of an order
+func GetOrderHistory(c *gin.Context) {
+	orderIDStr := c.Param("id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	role, _ := c.Get("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Apply the same visibility rules as GetOrderByID
+	query := database.DB.Model(&database.Order{}).Where("orders.id = ?", orderID)
+	switch role {
+	case "admin":
+		// Admin can view any order
+	case "franchise_owner":
+		query = query.Joins("JOIN franchises ON orders.franchise_id = franchises.id").
+			Where("franchises.owner_id = ?", userID)
+	case "service_agent":
+		query = query.Where("orders.service_agent_id = ?", userID)
+	case "customer":
+		query = query.Where("orders.customer_id = ?", userID)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found or you don't have permission to view it"})
+		return
+	}
+
+	var history []database.OrderStatusHistory
+	if err := database.DB.
+		Preload("Actor", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, role") }).
+		Where("order_id = ?", orderID).
+		Order("created_at ASC").
+		Find(&history).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
 // AssignOrderRequest represents the payload for assigning a franchise
 type AssignOrderRequest struct {
-	FranchiseID uint `json:"franchise_id" binding:"required"`
+	FranchiseID uint   `json:"franchise_id" binding:"required"`
+	Reason      string `json:"reason"`
 }
 
-// AssignOrderToFranchise allows admin to assign a franchise to an order
+// AssignOrderToFranchise allows admin to assign a franchise to an order that has not been
+// approved yet. The order's stock reservation moves to the new franchise.
 func AssignOrderToFranchise(c *gin.Context) {
 	role, exists := c.Get("role")
 	if !exists || role != "admin" {
@@ -710,26 +854,97 @@ func AssignOrderToFranchise(c *gin.Context) {
 		return
 	}
 
+	userIDValue, _ := c.Get("user_id")
+	adminID, _ := userIDValue.(uint)
+
+	var franchise database.Franchise
+	if err := database.DB.Select("id").
+		Where("is_active = ? AND approval_state = ?", true, "approved").
+		First(&franchise, req.FranchiseID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found or not active"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
 	var order database.Order
-	if err := database.DB.First(&order, orderID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, orderID).Error; err != nil {
+		tx.Rollback()
 		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
 	}
 
-	order.FranchiseID = req.FranchiseID
+	if order.Status != OrderStatusPending && order.Status != OrderStatusConfirmed {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Only orders awaiting approval can be reassigned"})
+		return
+	}
+
+	if order.FranchiseID != franchise.ID {
+		notes := fmt.Sprintf("Order #%d reassigned to franchise #%d", order.ID, franchise.ID)
+		if err := releaseOrderStock(tx, &order, RoleAdmin, &adminID); err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
+			return
+		}
+		if err := releaseOrderAsset(tx, order.ID, RoleAdmin, &adminID, notes); err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
+			return
+		}
+
+		order.FranchiseID = franchise.ID
+		if err := tx.Model(&order).Update("franchise_id", franchise.ID).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
+			return
+		}
+
+		if err := reserveOrderStock(tx, &order, time.Now()); err != nil {
+			tx.Rollback()
+			if errors.Is(err, ErrOutOfStock) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock at this franchise", "code": "out_of_stock"})
+				return
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
+			return
+		}
+	}
 
-	if err := database.DB.Save(&order).Error; err != nil {
+	reason := "Assigned by an admin"
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+	decision := database.OrderRoutingDecision{
+		OrderID:     order.ID,
+		FranchiseID: franchise.ID,
+		Method:      OrderRoutingAdmin,
+		Reason:      reason,
+		ActorID:     &adminID,
+		ActorRole:   RoleAdmin,
+	}
+	if err := tx.Create(&decision).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Franchise assigned", "order": order})
-}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign franchise"})
+		return
+	}
 
-// Helper function to generate an invoice number
-func generateInvoiceNumber(orderID int64) string {
-	timestamp := time.Now().Format("20060102") // YYYYMMDD format
-	return "INV-" + timestamp + "-" + strconv.FormatInt(orderID, 10)
+	c.JSON(http.StatusOK, gin.H{"message": "Franchise assigned", "order": order, "routing": decision})
 }
 
 // AssignOrderToAgent allows admin to assign a service agent to an order
@@ -757,6 +972,46 @@ func AssignOrderToAgent(c *gin.Context) {
 		return
 	}
 
+	var target database.Order
+	if err := database.DB.Select("id, franchise_id").First(&target, orderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Franchise owners can only assign agents to their own franchise's orders
+	if role == "franchise_owner" {
+		userIDValue, _ := c.Get("user_id")
+		var ownedCount int64
+		if err := database.DB.Model(&database.Franchise{}).
+			Where("id = ? AND owner_id = ?", target.FranchiseID, userIDValue).
+			Count(&ownedCount).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if ownedCount == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to update this order"})
+			return
+		}
+	}
+
+	// The agent must work for the franchise fulfilling the order
+	isMember, err := isFranchiseAgent(database.DB, target.FranchiseID, req.ServiceAgentID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if !isMember {
+		respondAgentNotInFranchise(c)
+		return
+	}
+
 	// Update order with service agent ID
 	if err := database.DB.Model(&database.Order{}).
 		Where("id = ?", orderID).
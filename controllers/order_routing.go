@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// openOrderStatuses are the statuses of orders a franchise has yet to fulfil. Their count
+// is the franchise's load when routing new orders.
+var openOrderStatuses = []string{
+	OrderStatusPending,
+	OrderStatusConfirmed,
+	OrderStatusApproved,
+	OrderStatusInTransit,
+	OrderStatusDelivered,
+}
+
+// OrderRouteCandidate is a franchise that serves an order's shipping location and holds
+// the ordered product in stock
+type OrderRouteCandidate struct {
+	ServiceableFranchise
+	OpenOrders int64 `json:"open_orders"`
+}
+
+// describeServicePoint names a service point in routing reasons
+func describeServicePoint(point ServicePoint) string {
+	var parts []string
+	if point.ZipCode != "" {
+		parts = append(parts, "ZIP "+point.ZipCode)
+	}
+	if point.HasCoordinates() {
+		parts = append(parts, fmt.Sprintf("(%.5f, %.5f)", point.Latitude, point.Longitude))
+	}
+	return strings.Join(parts, " ")
+}
+
+// rankOrderFranchises returns the franchises that serve point and hold the product in
+// stock, least loaded first and nearest first among equally loaded ones. When none
+// qualifies it returns the reason instead.
+func rankOrderFranchises(db *gorm.DB, productID uint, point ServicePoint) ([]OrderRouteCandidate, string, error) {
+	serviceable, err := findServiceableFranchises(db, point)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(serviceable) == 0 {
+		return nil, "No franchise serves " + describeServicePoint(point), nil
+	}
+
+	franchiseIDs := make([]uint, 0, len(serviceable))
+	for _, franchise := range serviceable {
+		franchiseIDs = append(franchiseIDs, franchise.ID)
+	}
+
+	var stockedIDs []uint
+	if err := db.Model(&database.FranchiseInventory{}).
+		Where("product_id = ? AND quantity > 0 AND franchise_id IN ?", productID, franchiseIDs).
+		Pluck("franchise_id", &stockedIDs).Error; err != nil {
+		return nil, "", err
+	}
+	if len(stockedIDs) == 0 {
+		return nil, fmt.Sprintf("None of the %d franchise(s) serving %s has the product in stock",
+			len(serviceable), describeServicePoint(point)), nil
+	}
+
+	var loads []struct {
+		FranchiseID uint
+		OpenOrders  int64
+	}
+	if err := db.Model(&database.Order{}).
+		Select("franchise_id, COUNT(*) AS open_orders").
+		Where("franchise_id IN ? AND status IN ?", stockedIDs, openOrderStatuses).
+		Group("franchise_id").
+		Scan(&loads).Error; err != nil {
+		return nil, "", err
+	}
+
+	stocked := make(map[uint]bool, len(stockedIDs))
+	for _, id := range stockedIDs {
+		stocked[id] = true
+	}
+	openOrders := make(map[uint]int64, len(loads))
+	for _, load := range loads {
+		openOrders[load.FranchiseID] = load.OpenOrders
+	}
+
+	var candidates []OrderRouteCandidate
+	for _, franchise := range serviceable {
+		if !stocked[franchise.ID] {
+			continue
+		}
+		candidates = append(candidates, OrderRouteCandidate{ServiceableFranchise: franchise, OpenOrders: openOrders[franchise.ID]})
+	}
+	// serviceable is ranked by distance, so a stable sort keeps the nearest first among
+	// franchises with the same load
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].OpenOrders < candidates[j].OpenOrders
+	})
+	return candidates, "", nil
+}
+
+// claimOrderFranchise picks the first candidate that still has the product in stock and
+// locks its stock, so that the order can reserve a unit of it within tx. It returns
+// ErrOutOfStock when every candidate has run out since they were ranked.
+func claimOrderFranchise(tx *gorm.DB, candidates []OrderRouteCandidate, productID uint) (*OrderRouteCandidate, error) {
+	for i := range candidates {
+		inventory, err := lockFranchiseInventory(tx, candidates[i].ID, productID)
+		if err != nil {
+			return nil, err
+		}
+		if inventory.Quantity > 0 {
+			return &candidates[i], nil
+		}
+	}
+	return nil, ErrOutOfStock
+}
+
+// autoRoutingDecision describes why the order router gave an order to candidate
+func autoRoutingDecision(orderID uint, candidate *OrderRouteCandidate, candidateCount int) database.OrderRoutingDecision {
+	distance := "at an unknown distance"
+	if candidate.DistanceKm != nil {
+		distance = fmt.Sprintf("%.1f km away", *candidate.DistanceKm)
+	}
+
+	return database.OrderRoutingDecision{
+		OrderID:     orderID,
+		FranchiseID: candidate.ID,
+		Method:      OrderRoutingAuto,
+		Reason: fmt.Sprintf("Serves the shipping location by %s, %s, with the product in stock and %d open order(s), the lowest load of %d eligible franchise(s)",
+			strings.ReplaceAll(candidate.MatchedBy, "_", " "), distance, candidate.OpenOrders, candidateCount),
+		MatchedBy:      candidate.MatchedBy,
+		DistanceKm:     candidate.DistanceKm,
+		OpenOrders:     candidate.OpenOrders,
+		CandidateCount: candidateCount,
+		ActorRole:      OrderActorSystem,
+	}
+}
+
+// placeOrder creates a pending order inside tx together with its stock reservation,
+// initial payment and customer notification. It returns ErrOutOfStock when the order's
+// franchise has no unit of the product left.
+func placeOrder(tx *gorm.DB, order *database.Order, product *database.Product, actorRole string, actorID *uint, notes string) error {
+	order.OrderType = "rental"
+	order.Status = database.OrderStatusPending
+	order.RentalStartDate = time.Now() // rental_start_date will be confirmed after approval
+	order.MonthlyRent = product.MonthlyRent
+	order.SecurityDeposit = product.SecurityDeposit
+	order.InstallationFee = product.InstallationFee
+	order.TotalInitialAmount = product.SecurityDeposit + product.InstallationFee + product.MonthlyRent
+
+	if err := tx.Create(order).Error; err != nil {
+		return err
+	}
+
+	// Hold a unit of stock until the initial payment is verified
+	if err := reserveOrderStock(tx, order, time.Now()); err != nil {
+		return err
+	}
+
+	// Record the initial status in the order history
+	if err := recordOrderTransition(tx, order.ID, "", order.Status, actorRole, actorID, notes); err != nil {
+		return err
+	}
+
+	// Create pending payment; its invoice number is allocated once it is paid
+	orderID := order.ID
+	payment := database.Payment{
+		CustomerID:  order.CustomerID,
+		OrderID:     &orderID,
+		Amount:      order.TotalInitialAmount,
+		PaymentType: "initial",
+		Status:      database.PaymentStatusPending,
+		Notes:       "Initial payment for order",
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return err
+	}
+
+	notification := database.Notification{
+		UserID:      order.CustomerID,
+		Title:       "Order Placed Successfully",
+		Message:     "Your order for " + product.Name + " has been placed and is pending approval.",
+		Type:        "order",
+		RelatedID:   &orderID,
+		RelatedType: "order",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// openOrderTriage queues an order request that no franchise qualified for and notifies
+// the admins
+func openOrderTriage(tx *gorm.DB, triage *database.OrderTriage) error {
+	triage.Status = OrderTriageOpen
+	if err := tx.Create(triage).Error; err != nil {
+		return err
+	}
+
+	var adminIDs []uint
+	if err := tx.Model(&database.User{}).Where("role = ?", RoleAdmin).Pluck("id", &adminIDs).Error; err != nil {
+		return err
+	}
+	for _, adminID := range adminIDs {
+		notification := database.Notification{
+			UserID:      adminID,
+			Title:       "Order Needs Routing",
+			Message:     "An order request could not be routed to a franchise: " + triage.Reason,
+			Type:        "order",
+			RelatedID:   &triage.ID,
+			RelatedType: "order_triage",
+		}
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+	}
+
+	notification := database.Notification{
+		UserID:      triage.CustomerID,
+		Title:       "Order Under Review",
+		Message:     "We are finding a franchise to serve your address. You will be notified once your order is placed.",
+		Type:        "order",
+		RelatedID:   &triage.ID,
+		RelatedType: "order_triage",
+	}
+	return tx.Create(&notification).Error
+}
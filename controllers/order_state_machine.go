@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// OrderActorSystem identifies transitions performed by the backend itself
+// (payment verification, background jobs) rather than by a logged-in user
+const OrderActorSystem = "system"
+
+// orderTransitions lists, per actor role, the statuses an order may move to from its current status
+var orderTransitions = map[string]map[string][]string{
+	RoleAdmin: {
+		OrderStatusPending:   {OrderStatusConfirmed, OrderStatusApproved, OrderStatusRejected, OrderStatusCancelled},
+		OrderStatusConfirmed: {OrderStatusApproved, OrderStatusRejected, OrderStatusCancelled},
+		OrderStatusApproved:  {OrderStatusInTransit, OrderStatusCancelled},
+		OrderStatusInTransit: {OrderStatusDelivered, OrderStatusCancelled},
+		OrderStatusDelivered: {OrderStatusInstalled, OrderStatusCancelled},
+		OrderStatusInstalled: {OrderStatusCompleted},
+	},
+	RoleFranchiseOwner: {
+		OrderStatusPending:   {OrderStatusConfirmed, OrderStatusApproved, OrderStatusRejected},
+		OrderStatusConfirmed: {OrderStatusApproved, OrderStatusRejected},
+		OrderStatusApproved:  {OrderStatusInTransit},
+		OrderStatusInTransit: {OrderStatusDelivered},
+		OrderStatusDelivered: {OrderStatusInstalled},
+	},
+	RoleCustomer: {
+		OrderStatusPending:   {OrderStatusCancelled},
+		OrderStatusConfirmed: {OrderStatusCancelled},
+	},
+	OrderActorSystem: {
+		OrderStatusPending:   {OrderStatusApproved, OrderStatusCancelled},
+		OrderStatusConfirmed: {OrderStatusApproved, OrderStatusCancelled},
+	},
+}
+
+// OrderTransitionError is returned when an actor attempts an order status change
+// that the state machine does not allow
+type OrderTransitionError struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Role    string   `json:"role"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *OrderTransitionError) Error() string {
+	return fmt.Sprintf("cannot move order from %s to %s as %s", e.From, e.To, e.Role)
+}
+
+// allowedOrderTransitions returns the statuses the given role may move an order to from status
+func allowedOrderTransitions(role, from string) []string {
+	allowed := orderTransitions[role][from]
+	if allowed == nil {
+		return []string{}
+	}
+	return allowed
+}
+
+// validateOrderTransition checks whether role may move an order from one status to another
+func validateOrderTransition(role, from, to string) error {
+	allowed := allowedOrderTransitions(role, from)
+	for _, status := range allowed {
+		if status == to {
+			return nil
+		}
+	}
+	return &OrderTransitionError{From: from, To: to, Role: role, Allowed: allowed}
+}
+
+// transitionOrder validates and applies a status change to order inside tx, runs the
+// side effects tied to the new status and records the change in the order history
+func transitionOrder(tx *gorm.DB, order *database.Order, to, actorRole string, actorID *uint, notes string) error {
+	from := order.Status
+	if err := validateOrderTransition(actorRole, from, to); err != nil {
+		return err
+	}
+	// Installation is confirmed with the customer's visit code or an admin's override
+	if to == OrderStatusInstalled {
+		if err := requireVerifiedVisit(tx, VisitSubjectOrder, order.ID); err != nil {
+			return err
+		}
+	}
+
+	order.Status = to
+	if err := tx.Save(order).Error; err != nil {
+		return err
+	}
+
+	switch to {
+	case OrderStatusApproved:
+		if err := allocateOrderStock(tx, order); err != nil {
+			return err
+		}
+		if err := activateOrderSubscription(tx, order); err != nil {
+			return err
+		}
+		if err := reserveOrderAsset(tx, order, actorRole, actorID); err != nil {
+			return err
+		}
+	case OrderStatusDelivered:
+		// Delivery starts the installation visit, so the customer gets the code that
+		// confirms it. Once the code limit is reached only an admin override can.
+		if _, err := issueVisitCode(tx, VisitSubjectOrder, order.ID, order.CustomerID, actorID); err != nil &&
+			!errors.Is(err, ErrVisitCodeLimit) {
+			return err
+		}
+	case OrderStatusInstalled:
+		if err := installOrderAsset(tx, order, actorRole, actorID); err != nil {
+			return err
+		}
+	case OrderStatusCancelled, OrderStatusRejected:
+		if err := tx.Model(&database.Subscription{}).
+			Where("order_id = ? AND status IN ?", order.ID,
+				[]string{SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusSuspended}).
+			Update("status", SubscriptionStatusCancelled).Error; err != nil {
+			return err
+		}
+		// A delivered unit is at the customer's home and goes back into stock when collected
+		collecting, err := collectOrderUnit(tx, order, fmt.Sprintf("Collect the device after order #%d was %s", order.ID, to))
+		if err != nil {
+			return err
+		}
+		if !collecting {
+			if err := releaseOrderStock(tx, order, actorRole, actorID); err != nil {
+				return err
+			}
+			if err := releaseOrderAsset(tx, order.ID, actorRole, actorID,
+				fmt.Sprintf("Order #%d %s", order.ID, to)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return recordOrderTransition(tx, order.ID, from, to, actorRole, actorID, notes)
+}
+
+// collectOrderUnit arranges collection of the unit of a cancelled order from the
+// customer. It returns false when the unit never reached the customer and can be
+// released straight back into stock.
+func collectOrderUnit(tx *gorm.DB, order *database.Order, description string) (bool, error) {
+	var subscription database.Subscription
+	err := tx.Where("order_id = ?", order.ID).First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	pickup, err := collectSubscriptionUnit(tx, &subscription, description)
+	return pickup != nil, err
+}
+
+// recordOrderTransition appends an entry to the order status history
+func recordOrderTransition(tx *gorm.DB, orderID uint, from, to, actorRole string, actorID *uint, notes string) error {
+	history := database.OrderStatusHistory{
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorID:    actorID,
+		ActorRole:  actorRole,
+		Notes:      notes,
+	}
+	return tx.Create(&history).Error
+}
+
+// activateOrderSubscription creates the rental subscription for an approved order.
+// It is a no-op when the order already has a subscription.
+func activateOrderSubscription(tx *gorm.DB, order *database.Order) error {
+	var existing int64
+	if err := tx.Model(&database.Subscription{}).Where("order_id = ?", order.ID).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	// Calculate end date and next billing date
+	startDate := time.Now() // Use current time as actual start date
+	endDate := addMonths(startDate, order.RentalDuration)
+	nextBillingDate := addMonths(startDate, 1) // Next month
+
+	cycle, err := maintenanceCycleMonths(tx, order.ProductID)
+	if err != nil {
+		return err
+	}
+
+	subscription := database.Subscription{
+		OrderID:          order.ID,
+		CustomerID:       order.CustomerID,
+		ProductID:        order.ProductID,
+		FranchiseID:      order.FranchiseID,
+		Status:           database.SubscriptionStatusActive,
+		StartDate:        startDate,
+		EndDate:          endDate,
+		NextBillingDate:  nextBillingDate,
+		MonthlyRent:      order.MonthlyRent,
+		LastMaintenance:  time.Time{},                    // Zero value
+		NextMaintenance:  startDate.AddDate(0, cycle, 0), // One maintenance cycle after start
+		MaintenanceNotes: "Initial setup complete",
+		Notes:            "Created from order #" + strconv.FormatUint(uint64(order.ID), 10),
+	}
+
+	if err := tx.Create(&subscription).Error; err != nil {
+		return err
+	}
+
+	if err := installProductComponents(tx, &subscription, startDate); err != nil {
+		return err
+	}
+
+	// Update order's rental start date to actual start date
+	order.RentalStartDate = startDate
+	return tx.Save(order).Error
+}
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// RouteOrderTriageRequest contains data for placing a triaged order request
+type RouteOrderTriageRequest struct {
+	FranchiseID uint   `json:"franchise_id"` // Optional; routed automatically again when omitted
+	Notes       string `json:"notes"`
+}
+
+// DismissOrderTriageRequest contains data for dismissing a triaged order request
+type DismissOrderTriageRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// GetOrderTriage lists the order requests that could not be routed to a franchise,
+// open ones by default (Admin only)
+func GetOrderTriage(c *gin.Context) {
+	status := c.DefaultQuery("status", OrderTriageOpen)
+
+	var triage []database.OrderTriage
+	if err := database.DB.
+		Preload("Customer", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, email, phone") }).
+		Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Where("status = ?", status).
+		Order("created_at ASC").
+		Find(&triage).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order triage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, triage)
+}
+
+// RouteOrderTriage places a triaged order request with the given franchise, or with the
+// franchise the order router picks now (Admin only)
+func RouteOrderTriage(c *gin.Context) {
+	triageID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid triage ID"})
+		return
+	}
+
+	var request RouteOrderTriageRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	adminID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var triage database.OrderTriage
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&triage, triageID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order triage not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if triage.Status != OrderTriageOpen {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Order triage is already " + triage.Status})
+		return
+	}
+
+	var product database.Product
+	if err := tx.First(&product, triage.ProductID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not available"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if !product.IsActive {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not available"})
+		return
+	}
+
+	order := database.Order{
+		CustomerID:      triage.CustomerID,
+		ProductID:       triage.ProductID,
+		FranchiseID:     request.FranchiseID,
+		ShippingAddress: triage.ShippingAddress,
+		BillingAddress:  triage.BillingAddress,
+		RentalDuration:  triage.RentalDuration,
+		Notes:           triage.Notes,
+	}
+
+	var decision database.OrderRoutingDecision
+	if request.FranchiseID != 0 {
+		var franchise database.Franchise
+		if err := tx.Select("id").
+			Where("is_active = ? AND approval_state = ?", true, "approved").
+			First(&franchise, request.FranchiseID).Error; err != nil {
+			tx.Rollback()
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found or not active"})
+			} else {
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			}
+			return
+		}
+		reason := "Routed by an admin from the triage queue"
+		if request.Notes != "" {
+			reason += ": " + request.Notes
+		}
+		decision = database.OrderRoutingDecision{
+			FranchiseID: franchise.ID,
+			Method:      OrderRoutingAdmin,
+			Reason:      reason,
+			ActorID:     &adminID,
+			ActorRole:   RoleAdmin,
+		}
+	} else {
+		point := ServicePoint{ZipCode: triage.ShippingZipCode, Latitude: triage.Latitude, Longitude: triage.Longitude}
+		candidates, reason, err := rankOrderFranchises(tx, product.ID, point)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error routing order"})
+			return
+		}
+		if len(candidates) == 0 {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{"error": reason, "code": "no_franchise_available"})
+			return
+		}
+		candidate, err := claimOrderFranchise(tx, candidates, product.ID)
+		if err != nil {
+			tx.Rollback()
+			if errors.Is(err, ErrOutOfStock) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+				return
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error routing order"})
+			return
+		}
+		decision = autoRoutingDecision(0, candidate, len(candidates))
+		decision.ActorID, decision.ActorRole = &adminID, RoleAdmin
+	}
+	order.FranchiseID = decision.FranchiseID
+
+	if err := placeOrder(tx, &order, &product, RoleAdmin, &adminID,
+		fmt.Sprintf("Order placed from triage #%d", triage.ID)); err != nil {
+		tx.Rollback()
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating order"})
+		return
+	}
+
+	decision.OrderID = order.ID
+	if err := tx.Create(&decision).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording order routing"})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(&triage).Updates(map[string]interface{}{
+		"status":           OrderTriageRouted,
+		"order_id":         order.ID,
+		"resolved_by_id":   adminID,
+		"resolved_at":      now,
+		"resolution_notes": request.Notes,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order triage"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Order placed",
+		"order":   order,
+		"routing": decision,
+	})
+}
+
+// DismissOrderTriage closes a triaged order request that cannot be served and tells the
+// customer why (Admin only)
+func DismissOrderTriage(c *gin.Context) {
+	triageID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid triage ID"})
+		return
+	}
+
+	var request DismissOrderTriageRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason for dismissal is required"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	adminID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var triage database.OrderTriage
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&triage, triageID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order triage not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if triage.Status != OrderTriageOpen {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Order triage is already " + triage.Status})
+		return
+	}
+
+	now := time.Now()
+	if err := tx.Model(&triage).Updates(map[string]interface{}{
+		"status":           OrderTriageDismissed,
+		"resolved_by_id":   adminID,
+		"resolved_at":      now,
+		"resolution_notes": request.Reason,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order triage"})
+		return
+	}
+
+	notification := database.Notification{
+		UserID:      triage.CustomerID,
+		Title:       "Order Could Not Be Placed",
+		Message:     "We are unable to serve your address at the moment. Reason: " + request.Reason,
+		Type:        "order",
+		RelatedID:   &triage.ID,
+		RelatedType: "order_triage",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Order request dismissed", "triage": triage})
+}
+
+// GetOrderRouting returns the routing decisions of an order, latest first (Admin only)
+func GetOrderRouting(c *gin.Context) {
+	orderID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var decisions []database.OrderRoutingDecision
+	if err := database.DB.
+		Preload("Franchise", func(db *gorm.DB) *gorm.DB { return db.Select("id, name") }).
+		Where("order_id = ?", orderID).
+		Order("created_at DESC").
+		Find(&decisions).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order routing"})
+		return
+	}
+
+	c.JSON(http.StatusOK, decisions)
+}
@@ -1,9 +1,6 @@
 package controllers
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -12,11 +9,11 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/razorpay/razorpay-go"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
-	"aquahome/config"
 	"aquahome/database"
+	"aquahome/payments"
 )
 
 // RazorpayOrderRequest contains data for creating a Razorpay order
@@ -89,40 +86,44 @@ func GeneratePaymentOrder(c *gin.Context) {
 		return
 	}
 
-	// Initialize Razorpay client
-	client := razorpay.NewClient(config.AppConfig.RazorpayKey, config.AppConfig.RazorpaySecret)
+	// Renew the order's stock reservation for the duration of the payment, reserving a
+	// unit again if the previous reservation expired
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return reserveOrderStock(tx, &order, time.Now())
+	}); err != nil {
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Product is out of stock", "code": "out_of_stock"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reserving stock"})
+		return
+	}
 
-	// Get payment amount in paise (Razorpay uses smallest currency unit)
-	amountInPaise := int64(order.TotalInitialAmount * 100)
+	gateway := payments.Gateway()
 
-	// Create Razorpay order
-	data := map[string]interface{}{
-		"amount":   amountInPaise,
-		"currency": "INR",
-		"receipt":  fmt.Sprintf("order_%d", order.ID),
-		"notes": map[string]interface{}{
+	// Create gateway order (amount in paise, the smallest currency unit)
+	gatewayOrder, err := gateway.CreateOrder(payments.ToPaise(order.TotalInitialAmount), "INR",
+		fmt.Sprintf("order_%d", order.ID), map[string]interface{}{
 			"customer_id":  customerID,
 			"order_id":     order.ID,
 			"payment_type": "initial",
-		},
-	}
-
-	razorpayOrder, err := client.Order.Create(data, nil)
+		})
 	if err != nil {
-		log.Printf("Razorpay order creation error: %v", err)
+		log.Printf("Payment gateway order creation error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating payment order"})
 		return
 	}
 
-	// Update payment record with Razorpay order ID
+	// Update payment record with gateway order ID
 	orderIDUint := uint(order.ID)
-	paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, razorpayOrder["id"])
+	paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, gatewayOrder.ID)
 
 	result = database.DB.Model(&database.Payment{}).
 		Where("order_id = ? AND payment_type = ? AND status = ?",
 			orderIDUint, "initial", database.PaymentStatusPending).
 		Updates(map[string]interface{}{
-			"transaction_id":  razorpayOrder["id"],
+			"transaction_id":  gatewayOrder.ID,
 			"payment_details": paymentDetails,
 		})
 
@@ -133,10 +134,10 @@ func GeneratePaymentOrder(c *gin.Context) {
 
 	// Return necessary information for the frontend
 	c.JSON(http.StatusOK, gin.H{
-		"razorpay_order_id": razorpayOrder["id"],
+		"razorpay_order_id": gatewayOrder.ID,
 		"amount":            order.TotalInitialAmount,
 		"currency":          "INR",
-		"key":               config.AppConfig.RazorpayKey,
+		"key":               gateway.KeyID(),
 		"aquahome_order_id": order.ID,
 	})
 }
@@ -173,15 +174,7 @@ func VerifyPayment(c *gin.Context) {
 	}
 
 	// Verify payment signature
-	data := request.OrderID + "|" + request.PaymentID
-	h := hmac.New(sha256.New, []byte(config.AppConfig.RazorpaySecret))
-	h.Write([]byte(data))
-	expectedSignature := hex.EncodeToString(h.Sum(nil))
-
-	fmt.Println("🔍 Expected Signature:", expectedSignature)
-	fmt.Println("📦 Provided Signature:", request.Signature)
-
-	if expectedSignature != request.Signature {
+	if !payments.Gateway().VerifyPaymentSignature(request.OrderID, request.PaymentID, request.Signature) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment signature"})
 		return
 	}
@@ -196,16 +189,16 @@ func VerifyPayment(c *gin.Context) {
 
 	var paymentType string
 	var orderID int64
-	var result *gorm.DB
 
 	if request.SubscriptionID != nil {
 		// This is a monthly payment for subscription
 		paymentType = "monthly"
 
-		// Get subscription details
+		// Get subscription details, locking the row so billing dates advance consistently
 		var subscription database.Subscription
-		subscriptionResult := tx.Where("id = ?", *request.SubscriptionID).
-			Select("customer_id, order_id, monthly_rent").
+		subscriptionResult := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", *request.SubscriptionID).
+			Select("id, customer_id, order_id, monthly_rent, status, start_date, next_billing_date").
 			First(&subscription)
 
 		if subscriptionResult.Error != nil {
@@ -227,12 +220,28 @@ func VerifyPayment(c *gin.Context) {
 
 		orderID = int64(subscription.OrderID)
 
-		// Update or create payment record
-		var payment database.Payment
-		subscriptionIDUint := uint(*request.SubscriptionID)
+		// The payment webhook may already have settled this payment
+		settled, err := isPaymentSettled(tx, request.PaymentID)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if settled {
+			tx.Rollback()
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"message": "Payment verified successfully",
+			})
+			return
+		}
 
+		// Update or create payment record, settling the oldest outstanding invoice first
+		var payment database.Payment
 		paymentResult := tx.Where("subscription_id = ? AND payment_type = ? AND status = ?",
-			subscriptionIDUint, "monthly", database.PaymentStatusPending).
+			subscription.ID, "monthly", database.PaymentStatusPending).
+			Order("created_at ASC").
 			First(&payment)
 
 		if paymentResult.Error != nil && !errors.Is(paymentResult.Error, gorm.ErrRecordNotFound) {
@@ -242,62 +251,15 @@ func VerifyPayment(c *gin.Context) {
 			return
 		}
 
+		pendingPayment := &payment
 		if errors.Is(paymentResult.Error, gorm.ErrRecordNotFound) {
-			// Create new payment record
-			invoiceNumber := generateInvoiceNumber(int64(subscription.OrderID))
-			paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s", "razorpay_payment_id": "%s"}`, request.OrderID, request.PaymentID)
-
-			// Create new payment with GORM
-			orderIDUint := subscription.OrderID
-			newPayment := database.Payment{
-				CustomerID:     uint(customerID),
-				SubscriptionID: &subscriptionIDUint,
-				OrderID:        &orderIDUint,
-				Amount:         subscription.MonthlyRent,
-				PaymentType:    "monthly",
-				Status:         database.PaymentStatusSuccess,
-				TransactionID:  request.PaymentID,
-				PaymentMethod:  "razorpay",
-				PaymentDetails: paymentDetails,
-				InvoiceNumber:  invoiceNumber,
-			}
-
-			result = tx.Create(&newPayment)
-			if result.Error != nil {
-				tx.Rollback()
-				log.Printf("Database error: %v", result.Error)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating payment record"})
-				return
-			}
-		} else {
-			// Update existing payment record with GORM
-			paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s", "razorpay_payment_id": "%s"}`, request.OrderID, request.PaymentID)
-
-			payment.Status = database.PaymentStatusSuccess
-			payment.TransactionID = request.PaymentID
-			payment.PaymentMethod = "razorpay"
-			payment.PaymentDetails = paymentDetails
-
-			result = tx.Save(&payment)
-			if result.Error != nil {
-				tx.Rollback()
-				log.Printf("Database error: %v", result.Error)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating payment record"})
-				return
-			}
+			pendingPayment = nil
 		}
 
-		// Update subscription's next billing date with GORM
-		nextBillingDate := time.Now().AddDate(0, 1, 0) // Next month
-
-		result = tx.Model(&database.Subscription{}).
-			Where("id = ?", *request.SubscriptionID).
-			Update("next_billing_date", nextBillingDate)
-
-		if result.Error != nil {
+		if err := settleMonthlyPayment(tx, &subscription, pendingPayment, request.OrderID, request.PaymentID); err != nil {
 			tx.Rollback()
-			log.Printf("Database error: %v", result.Error)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating subscription"})
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating payment record"})
 			return
 		}
 	} else {
@@ -307,8 +269,8 @@ func VerifyPayment(c *gin.Context) {
 
 		// Get order details with GORM
 		var order database.Order
-		orderResult := tx.Where("id = ?", orderID).
-			Select("customer_id, status").
+		orderResult := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", orderID).
 			First(&order)
 
 		if orderResult.Error != nil {
@@ -328,70 +290,46 @@ func VerifyPayment(c *gin.Context) {
 			return
 		}
 
-		if order.Status != database.OrderStatusPending {
+		// The payment webhook may already have settled this payment
+		settled, err := isPaymentSettled(tx, request.PaymentID)
+		if err != nil {
 			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Order is not in pending state"})
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 			return
 		}
-
-		// Update payment record with GORM
-		paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s", "razorpay_payment_id": "%s"}`, request.OrderID, request.PaymentID)
-
-		orderIDUint := uint(orderID)
-		result = tx.Model(&database.Payment{}).
-			Where("order_id = ? AND payment_type = ?", orderIDUint, "initial").
-			Updates(map[string]interface{}{
-				"status":          database.PaymentStatusSuccess,
-				"transaction_id":  request.PaymentID,
-				"payment_method":  "razorpay",
-				"payment_details": paymentDetails,
+		if settled {
+			tx.Rollback()
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"message": "Payment verified successfully",
 			})
+			return
+		}
 
-		if result.Error != nil {
+		if order.Status != database.OrderStatusPending {
 			tx.Rollback()
-			log.Printf("Database error: %v", result.Error)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating payment record"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Order is not in pending state"})
 			return
 		}
 
-		// Update order status with GORM
-		result = tx.Model(&database.Order{}).
-			Where("id = ?", orderID).
-			Update("status", database.OrderStatusApproved)
-
-		if result.Error != nil {
+		if err := settleInitialPayment(tx, &order, request.OrderID, request.PaymentID); err != nil {
 			tx.Rollback()
-			log.Printf("Database error: %v", result.Error)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating order status"})
+			var transitionErr *OrderTransitionError
+			if errors.As(err, &transitionErr) {
+				respondOrderTransitionError(c, err)
+				return
+			}
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating payment record"})
 			return
 		}
 	}
 
 	// Create notification for customer with GORM
-	notificationTitle := "Payment Successful"
-	paymentTypeDisplay := "Monthly"
-	if paymentType == "initial" {
-		paymentTypeDisplay = "Initial"
-	}
-	notificationMessage := fmt.Sprintf("%s payment has been processed successfully.", paymentTypeDisplay)
-
-	// Create related ID for notification
-	relatedID := uint(orderID)
-
-	// Create notification with GORM
-	notification := database.Notification{
-		UserID:      uint(customerID),
-		Title:       notificationTitle,
-		Message:     notificationMessage,
-		Type:        "payment",
-		RelatedID:   &relatedID,
-		RelatedType: "order",
-	}
-
-	result = tx.Create(&notification)
-	if result.Error != nil {
+	if err := notifyPaymentSuccess(tx, uint(customerID), paymentType, uint(orderID)); err != nil {
 		tx.Rollback()
-		log.Printf("Database error: %v", result.Error)
+		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
 		return
 	}
@@ -456,43 +394,20 @@ func GenerateMonthlyPayment(c *gin.Context) {
 		return
 	}
 
-	if subscription.Status != database.SubscriptionStatusActive {
+	// Suspended subscriptions can still pay off their arrears
+	if subscription.Status != database.SubscriptionStatusActive && subscription.Status != database.SubscriptionStatusSuspended {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is not active"})
 		return
 	}
 
-	// Initialize Razorpay client
-	client := razorpay.NewClient(config.AppConfig.RazorpayKey, config.AppConfig.RazorpaySecret)
-
-	// Get payment amount in paise (Razorpay uses smallest currency unit)
-	amountInPaise := int64(subscription.MonthlyRent * 100)
-
-	// Create Razorpay order
-	data := map[string]interface{}{
-		"amount":   amountInPaise,
-		"currency": "INR",
-		"receipt":  fmt.Sprintf("subscription_%d", subscription.ID),
-		"notes": map[string]interface{}{
-			"customer_id":     customerID,
-			"subscription_id": subscription.ID,
-			"payment_type":    "monthly",
-		},
-	}
-
-	razorpayOrder, err := client.Order.Create(data, nil)
-	if err != nil {
-		log.Printf("Razorpay order creation error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating payment order"})
-		return
-	}
-
-	// Create or update payment record
+	// Charge the oldest outstanding invoice, including any late fee, before raising a new one
 	var payment database.Payment
 	subscriptionIDUint := subscription.ID
 	customerIDUint := uint(customerID)
 
 	result = database.DB.Where("subscription_id = ? AND payment_type = ? AND status = ?",
 		subscriptionIDUint, "monthly", database.PaymentStatusPending).
+		Order("created_at ASC").
 		First(&payment)
 
 	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -501,10 +416,29 @@ func GenerateMonthlyPayment(c *gin.Context) {
 		return
 	}
 
+	amount := subscription.MonthlyRent
+	if result.Error == nil {
+		amount = payment.Amount
+	}
+
+	gateway := payments.Gateway()
+
+	// Create gateway order (amount in paise, the smallest currency unit)
+	gatewayOrder, err := gateway.CreateOrder(payments.ToPaise(amount), "INR",
+		fmt.Sprintf("subscription_%d", subscription.ID), map[string]interface{}{
+			"customer_id":     customerID,
+			"subscription_id": subscription.ID,
+			"payment_type":    "monthly",
+		})
+	if err != nil {
+		log.Printf("Payment gateway order creation error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating payment order"})
+		return
+	}
+
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		// Create new payment record
-		invoiceNumber := generateMonthlyInvoiceNumber(subscription.ID)
-		paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, razorpayOrder["id"])
+		// Create new payment record; its invoice number is allocated once it is paid
+		paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, gatewayOrder.ID)
 
 		newPayment := database.Payment{
 			CustomerID:     customerIDUint,
@@ -512,9 +446,8 @@ func GenerateMonthlyPayment(c *gin.Context) {
 			Amount:         subscription.MonthlyRent,
 			PaymentType:    "monthly",
 			Status:         database.PaymentStatusPending,
-			TransactionID:  razorpayOrder["id"].(string),
+			TransactionID:  gatewayOrder.ID,
 			PaymentDetails: paymentDetails,
-			InvoiceNumber:  invoiceNumber,
 		}
 
 		result = database.DB.Create(&newPayment)
@@ -525,9 +458,9 @@ func GenerateMonthlyPayment(c *gin.Context) {
 		}
 	} else {
 		// Update existing payment record
-		paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, razorpayOrder["id"])
+		paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s"}`, gatewayOrder.ID)
 
-		payment.TransactionID = razorpayOrder["id"].(string)
+		payment.TransactionID = gatewayOrder.ID
 		payment.PaymentDetails = paymentDetails
 
 		result = database.DB.Save(&payment)
@@ -540,10 +473,10 @@ func GenerateMonthlyPayment(c *gin.Context) {
 
 	// Return necessary information for the frontend
 	c.JSON(http.StatusOK, gin.H{
-		"razorpay_order_id": razorpayOrder["id"],
-		"amount":            subscription.MonthlyRent,
+		"razorpay_order_id": gatewayOrder.ID,
+		"amount":            amount,
 		"currency":          "INR",
-		"key":               config.AppConfig.RazorpayKey,
+		"key":               gateway.KeyID(),
 		"subscription_id":   subscription.ID,
 	})
 }
@@ -703,35 +636,11 @@ func GetPaymentByID(c *gin.Context) {
 	}
 
 	var paymentDetail PaymentDetail
-	var query *gorm.DB
-
-	switch role {
-	case "admin":
-		// Admin can see any payment
-		query = database.DB.Model(&database.Payment{}).
-			Select("payments.*, users.name as customer_name, users.email as customer_email").
-			Joins("JOIN users ON payments.customer_id = users.id").
-			Where("payments.id = ?", paymentIDUint)
-
-	case "franchise_owner":
-		// Franchise owner can only see payments for orders/subscriptions in their franchise
-		query = database.DB.Model(&database.Payment{}).
-			Select("payments.*, users.name as customer_name, users.email as customer_email").
-			Joins("JOIN users ON payments.customer_id = users.id").
-			Joins("LEFT JOIN orders ON payments.order_id = orders.id").
-			Joins("LEFT JOIN subscriptions ON payments.subscription_id = subscriptions.id").
-			Where("payments.id = ? AND (orders.franchise_id IN (SELECT id FROM franchises WHERE owner_id = ?) OR "+
-				"subscriptions.franchise_id IN (SELECT id FROM franchises WHERE owner_id = ?))",
-				paymentIDUint, userIDUint, userIDUint)
-
-	case "customer":
-		// Customer can only see their own payments
-		query = database.DB.Model(&database.Payment{}).
-			Select("payments.*, users.name as customer_name, users.email as customer_email").
-			Joins("JOIN users ON payments.customer_id = users.id").
-			Where("payments.id = ? AND payments.customer_id = ?", paymentIDUint, userIDUint)
-
-	default:
+	query, ok := scopePaymentsForRole(database.DB.Model(&database.Payment{}).
+		Select("payments.*, users.name as customer_name, users.email as customer_email").
+		Joins("JOIN users ON payments.customer_id = users.id").
+		Where("payments.id = ?", paymentIDUint), role, userIDUint)
+	if !ok {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
@@ -756,16 +665,59 @@ func GetPaymentByID(c *gin.Context) {
 	c.JSON(http.StatusOK, paymentDetail)
 }
 
-// Helper function to generate a monthly invoice number
-func generateMonthlyInvoiceNumber(subscriptionID uint) string {
-	timestamp := time.Now().Format("20060102") // YYYYMMDD format
-	return "INV-M-" + timestamp + "-" + strconv.FormatUint(uint64(subscriptionID), 10)
+// scopePaymentsForRole limits a payments query to the rows the caller may see. It returns
+// false for roles that cannot see payments at all.
+func scopePaymentsForRole(query *gorm.DB, role interface{}, userID uint) (*gorm.DB, bool) {
+	switch role {
+	case "admin":
+		// Admin can see any payment
+		return query, true
+	case "franchise_owner":
+		// Franchise owner can only see payments for orders/subscriptions in their franchise
+		return query.
+			Joins("LEFT JOIN orders ON payments.order_id = orders.id").
+			Joins("LEFT JOIN subscriptions ON payments.subscription_id = subscriptions.id").
+			Where("(orders.franchise_id IN (SELECT id FROM franchises WHERE owner_id = ?) OR "+
+				"subscriptions.franchise_id IN (SELECT id FROM franchises WHERE owner_id = ?))",
+				userID, userID), true
+	case "customer":
+		// Customer can only see their own payments
+		return query.Where("payments.customer_id = ?", userID), true
+	default:
+		return nil, false
+	}
 }
 
-func verifyRazorpaySignature(data, signature, secret string) bool {
+// FakeCheckoutRequest contains data for paying a fake gateway order
+type FakeCheckoutRequest struct {
+	OrderID string `json:"order_id" binding:"required"`
+}
+
+// FakeGatewayCheckout completes checkout for an order on the in-memory fake gateway and
+// returns what the Razorpay checkout would hand to the frontend. Only available when
+// PAYMENT_GATEWAY=fake, for local development and tests.
+func FakeGatewayCheckout(c *gin.Context) {
+	fake, ok := payments.Gateway().(*payments.FakeGateway)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fake payment gateway is not enabled"})
+		return
+	}
+
+	var request FakeCheckoutRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	payment, signature, err := fake.Pay(request.OrderID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(data))
-	expectedSignature := hex.EncodeToString(h.Sum(nil))
-	return expectedSignature == signature
+	c.JSON(http.StatusOK, gin.H{
+		"payment_id": payment.ID,
+		"order_id":   payment.OrderID,
+		"signature":  signature,
+	})
 }
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"aquahome/config"
+	"aquahome/database"
+	"aquahome/payments"
+)
+
+// openTestDB connects database.DB to the PostgreSQL database named by AQUAHOME_TEST_DSN
+// and migrates it. Tests that need a database are skipped when it is not set. Records
+// are never cleaned up, so point it at a throwaway database.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("AQUAHOME_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AQUAHOME_TEST_DSN is not set")
+	}
+
+	config.InitConfig()
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	database.DB = db
+	if err := database.RunMigrations(); err != nil {
+		t.Fatalf("migrating the test database: %v", err)
+	}
+}
+
+// useFakeGateway makes the handlers take payments through a new fake gateway for the
+// rest of the test
+func useFakeGateway(t *testing.T) *payments.FakeGateway {
+	t.Helper()
+
+	gateway := payments.NewFakeGateway("test_secret", "test_webhook_secret")
+	payments.SetGateway(gateway)
+	t.Cleanup(func() { payments.SetGateway(nil) })
+	return gateway
+}
+
+// callHandler runs handler for a request with a JSON body made by the given user, as
+// the auth middleware would pass it on
+func callHandler(handler gin.HandlerFunc, method string, body interface{}, userID uint, role string, params ...gin.Param) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(method, "/", bytes.NewReader(payload))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = params
+	c.Set("user_id", userID)
+	c.Set("role", role)
+
+	handler(c)
+	return recorder
+}
+
+// decodeResponse decodes the JSON body of a handler response into v
+func decodeResponse(t *testing.T, recorder *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", recorder.Body.String(), err)
+	}
+}
+
+// testRentalFixture is an active franchise with stock of one product and a customer
+type testRentalFixture struct {
+	Customer  database.User
+	Owner     database.User
+	Franchise database.Franchise
+	Product   database.Product
+}
+
+// createRentalFixture stores a new customer, an approved franchise and a product it has
+// two units of in stock
+func createRentalFixture(t *testing.T) *testRentalFixture {
+	t.Helper()
+
+	suffix := time.Now().UnixNano()
+	fixture := &testRentalFixture{
+		Customer: database.User{Name: "Test Customer", Email: fmt.Sprintf("customer%d@example.com", suffix), Role: RoleCustomer},
+		Owner:    database.User{Name: "Test Owner", Email: fmt.Sprintf("owner%d@example.com", suffix), Role: RoleFranchiseOwner},
+	}
+	if err := database.DB.Create(&fixture.Customer).Error; err != nil {
+		t.Fatalf("creating customer: %v", err)
+	}
+	if err := database.DB.Create(&fixture.Owner).Error; err != nil {
+		t.Fatalf("creating franchise owner: %v", err)
+	}
+
+	fixture.Franchise = database.Franchise{
+		OwnerID:       fixture.Owner.ID,
+		Name:          fmt.Sprintf("Test Franchise %d", suffix),
+		City:          "Hyderabad",
+		IsActive:      true,
+		ApprovalState: "approved",
+	}
+	if err := database.DB.Create(&fixture.Franchise).Error; err != nil {
+		t.Fatalf("creating franchise: %v", err)
+	}
+
+	fixture.Product = database.Product{
+		Name:             fmt.Sprintf("Test Purifier %d", suffix),
+		MonthlyRent:      499,
+		SecurityDeposit:  1000,
+		InstallationFee:  500,
+		MaintenanceCycle: 3,
+		IsActive:         true,
+		FranchiseID:      fixture.Franchise.ID,
+	}
+	if err := database.DB.Create(&fixture.Product).Error; err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		_, err := adjustInventory(tx, fixture.Franchise.ID, fixture.Product.ID, InventoryMovementReceipt, 2, InventoryReference{
+			ActorRole: OrderActorSystem,
+			Notes:     "Test stock",
+		})
+		return err
+	}); err != nil {
+		t.Fatalf("stocking product: %v", err)
+	}
+	return fixture
+}
+
+func TestOrderPaymentActivatesSubscription(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	gateway := useFakeGateway(t)
+	fixture := createRentalFixture(t)
+	customerID := fixture.Customer.ID
+
+	// Place the order
+	recorder := callHandler(CreateOrder, http.MethodPost, gin.H{
+		"product_id":       fixture.Product.ID,
+		"franchise_id":     fixture.Franchise.ID,
+		"shipping_address": "1 Test Street",
+		"billing_address":  "1 Test Street",
+		"rental_duration":  12,
+	}, customerID, RoleCustomer)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateOrder returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var created struct {
+		Order database.Order `json:"order"`
+	}
+	decodeResponse(t, recorder, &created)
+	order := created.Order
+	if order.Status != OrderStatusPending || order.TotalInitialAmount != 1999 {
+		t.Fatalf("new order is %s for %v, want pending for 1999", order.Status, order.TotalInitialAmount)
+	}
+
+	// Start checkout on the gateway
+	recorder = callHandler(GeneratePaymentOrder, http.MethodPost, gin.H{"order_id": order.ID}, customerID, RoleCustomer)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GeneratePaymentOrder returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var checkout struct {
+		GatewayOrderID string `json:"razorpay_order_id"`
+	}
+	decodeResponse(t, recorder, &checkout)
+
+	gatewayPayment, signature, err := gateway.Pay(checkout.GatewayOrderID)
+	if err != nil {
+		t.Fatalf("paying gateway order: %v", err)
+	}
+	if gatewayPayment.Amount != payments.ToPaise(order.TotalInitialAmount) {
+		t.Fatalf("gateway charged %d paise, want %d", gatewayPayment.Amount, payments.ToPaise(order.TotalInitialAmount))
+	}
+
+	// A forged signature is rejected and changes nothing
+	recorder = callHandler(VerifyPayment, http.MethodPost, gin.H{
+		"payment_id":        gatewayPayment.ID,
+		"order_id":          checkout.GatewayOrderID,
+		"signature":         "forged",
+		"aquahome_order_id": order.ID,
+	}, customerID, RoleCustomer)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("VerifyPayment with a forged signature returned %d, want 400", recorder.Code)
+	}
+
+	recorder = callHandler(VerifyPayment, http.MethodPost, gin.H{
+		"payment_id":        gatewayPayment.ID,
+		"order_id":          checkout.GatewayOrderID,
+		"signature":         signature,
+		"aquahome_order_id": order.ID,
+	}, customerID, RoleCustomer)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("VerifyPayment returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The order is approved and its initial payment settled and invoiced
+	if err := database.DB.First(&order, order.ID).Error; err != nil {
+		t.Fatalf("reloading order: %v", err)
+	}
+	if order.Status != OrderStatusApproved {
+		t.Errorf("order status = %s, want %s", order.Status, OrderStatusApproved)
+	}
+
+	var payment database.Payment
+	if err := database.DB.Where("order_id = ? AND payment_type = ?", order.ID, "initial").First(&payment).Error; err != nil {
+		t.Fatalf("loading initial payment: %v", err)
+	}
+	if payment.Status != database.PaymentStatusSuccess || payment.TransactionID != gatewayPayment.ID {
+		t.Errorf("payment is %s with transaction %q, want %s with %q",
+			payment.Status, payment.TransactionID, database.PaymentStatusSuccess, gatewayPayment.ID)
+	}
+	if payment.PaymentMethod != payments.GatewayFake {
+		t.Errorf("payment method = %q, want %q", payment.PaymentMethod, payments.GatewayFake)
+	}
+	wantPrefix := fmt.Sprintf("FR%03d/%s/", fixture.Franchise.ID, fiscalYear(time.Now()))
+	if !strings.HasPrefix(payment.InvoiceNumber, wantPrefix) {
+		t.Errorf("invoice number = %q, want prefix %q", payment.InvoiceNumber, wantPrefix)
+	}
+
+	// The subscription is active from today and billed monthly from its start
+	var subscription database.Subscription
+	if err := database.DB.Where("order_id = ?", order.ID).First(&subscription).Error; err != nil {
+		t.Fatalf("loading subscription: %v", err)
+	}
+	if subscription.Status != database.SubscriptionStatusActive {
+		t.Errorf("subscription status = %s, want %s", subscription.Status, database.SubscriptionStatusActive)
+	}
+	if subscription.CustomerID != customerID || subscription.FranchiseID != fixture.Franchise.ID || subscription.MonthlyRent != 499 {
+		t.Errorf("subscription = customer %d, franchise %d, rent %v; want %d, %d, 499",
+			subscription.CustomerID, subscription.FranchiseID, subscription.MonthlyRent, customerID, fixture.Franchise.ID)
+	}
+	if want := addMonths(subscription.StartDate, 1); !subscription.NextBillingDate.Equal(want) {
+		t.Errorf("next billing date = %s, want %s", subscription.NextBillingDate, want)
+	}
+	if want := addMonths(subscription.StartDate, 12); !subscription.EndDate.Equal(want) {
+		t.Errorf("end date = %s, want %s", subscription.EndDate, want)
+	}
+
+	// Verifying the same payment again is a no-op
+	recorder = callHandler(VerifyPayment, http.MethodPost, gin.H{
+		"payment_id":        gatewayPayment.ID,
+		"order_id":          checkout.GatewayOrderID,
+		"signature":         signature,
+		"aquahome_order_id": order.ID,
+	}, customerID, RoleCustomer)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("repeated VerifyPayment returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var subscriptions int64
+	database.DB.Model(&database.Subscription{}).Where("order_id = ?", order.ID).Count(&subscriptions)
+	if subscriptions != 1 {
+		t.Errorf("order has %d subscriptions, want 1", subscriptions)
+	}
+}
@@ -0,0 +1,428 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+	"aquahome/payments"
+)
+
+// Payment types and methods used when settling a security deposit
+const (
+	PaymentTypeRefund              = "refund"
+	PaymentTypeDamageCharge        = "damage_charge"
+	PaymentMethodDepositAdjustment = "deposit_adjustment"
+)
+
+// DepositRefundRequest contains data for refunding an order's security deposit
+type DepositRefundRequest struct {
+	// Amount to refund; defaults to the full refundable amount
+	Amount          *float64 `json:"amount"`
+	DamageDeduction float64  `json:"damage_deduction"`
+	Reason          string   `json:"reason"`
+}
+
+// DepositRefundQuote breaks down how much of a security deposit can still be refunded
+type DepositRefundQuote struct {
+	OrderID         uint    `json:"order_id"`
+	SecurityDeposit float64 `json:"security_deposit"`
+	AlreadySettled  float64 `json:"already_settled"`
+	UnpaidDues      float64 `json:"unpaid_dues"`
+	UnusedCredit    float64 `json:"unused_credit"`
+	DamageDeduction float64 `json:"damage_deduction"`
+	Refundable      float64 `json:"refundable"`
+}
+
+// GetDepositRefundQuote returns the refundable security deposit for an order (Admin or franchise owner)
+func GetDepositRefundQuote(c *gin.Context) {
+	damageDeduction := 0.0
+	if value := c.Query("damage_deduction"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid damage deduction"})
+			return
+		}
+		damageDeduction = parsed
+	}
+
+	order, ok := findManagedOrder(c, database.DB)
+	if !ok {
+		return
+	}
+
+	quote, _, err := computeDepositRefundQuote(database.DB, order, damageDeduction)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// RefundSecurityDeposit refunds all or part of an order's security deposit after deducting
+// unpaid rent and damage charges (Admin or franchise owner)
+func RefundSecurityDeposit(c *gin.Context) {
+	var request DepositRefundRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+	if request.DamageDeduction < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Damage deduction cannot be negative"})
+		return
+	}
+
+	// Begin transaction
+	tx := database.DB.Begin()
+	if tx.Error != nil {
+		log.Printf("Transaction error: %v", tx.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Lock the order so concurrent refunds cannot exceed the deposit
+	order, ok := findManagedOrder(c, tx.Clauses(clause.Locking{Strength: "UPDATE"}))
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	// The device is still with the customer while the rental runs
+	var runningCount int64
+	if err := tx.Model(&database.Subscription{}).
+		Where("order_id = ? AND status IN ?", order.ID,
+			[]string{SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusSuspended}).
+		Count(&runningCount).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if runningCount > 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Security deposit can only be refunded after the subscription has ended"})
+		return
+	}
+
+	quote, unpaidPayments, err := computeDepositRefundQuote(tx, order, request.DamageDeduction)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	amount := quote.Refundable
+	if request.Amount != nil {
+		amount = roundAmount(*request.Amount)
+	}
+	if amount <= 0 || amount > quote.Refundable {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund amount must be between 0 and the refundable amount", "quote": quote})
+		return
+	}
+
+	// The deposit was collected with the initial payment
+	var initialPayment database.Payment
+	if err := tx.Where("order_id = ? AND payment_type = ? AND status IN ?", order.ID, "initial",
+		[]string{database.PaymentStatusSuccess, database.PaymentStatusRefunded}).
+		First(&initialPayment).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Settle unpaid rent and damage charges from the deposit, and pay out unused credit
+	// with the refund
+	for i := range unpaidPayments {
+		unpaidPayments[i].Status = database.PaymentStatusPaid
+		unpaidPayments[i].PaymentMethod = PaymentMethodDepositAdjustment
+		var err error
+		if isCreditEntry(unpaidPayments[i].PaymentType) {
+			unpaidPayments[i].Status = database.PaymentStatusApplied
+		} else if unpaidPayments[i].PaymentType != PaymentTypeDepositTopUp {
+			err = assignInvoiceNumber(tx, &unpaidPayments[i])
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error settling unpaid dues"})
+			return
+		}
+		if err := tx.Save(&unpaidPayments[i]).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error settling unpaid dues"})
+			return
+		}
+	}
+
+	orderID := order.ID
+	if quote.DamageDeduction > 0 {
+		damageCharge := database.Payment{
+			CustomerID:    order.CustomerID,
+			OrderID:       &orderID,
+			Amount:        quote.DamageDeduction,
+			PaymentType:   PaymentTypeDamageCharge,
+			Status:        database.PaymentStatusPaid,
+			PaymentMethod: PaymentMethodDepositAdjustment,
+			Notes:         request.Reason,
+		}
+		err := assignInvoiceNumber(tx, &damageCharge)
+		if err == nil {
+			err = tx.Create(&damageCharge).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording damage charge"})
+			return
+		}
+	}
+
+	// Record the refund before calling the gateway so that concurrent refunds see it and
+	// no money can leave without a record. The gateway is called outside the transaction
+	// so a slow gateway does not hold the order and invoice number locks.
+	refund := database.Payment{
+		CustomerID:    order.CustomerID,
+		OrderID:       &orderID,
+		Amount:        amount,
+		PaymentType:   PaymentTypeRefund,
+		Status:        database.PaymentStatusPending,
+		PaymentMethod: payments.Gateway().Name(),
+		RefundOfID:    &initialPayment.ID,
+		Notes:         request.Reason,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording refund"})
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	refundID, refundStatus, err := issueGatewayRefund(initialPayment.TransactionID, amount, map[string]interface{}{
+		"aquahome_order_id":  order.ID,
+		"aquahome_refund_id": refund.ID,
+		"reason":             request.Reason,
+	})
+	if err != nil {
+		log.Printf("Payment gateway refund error: %v", err)
+		// The refund.processed webhook records the refund if the gateway did issue it
+		if err := database.DB.Model(&refund).Update("status", database.PaymentStatusFailed).Error; err != nil {
+			log.Printf("Database error marking refund #%d failed: %v", refund.ID, err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Refund could not be issued by the payment gateway. Unpaid dues and damage charges were settled from the deposit; the refund can be retried.",
+		})
+		return
+	}
+
+	// Refunds the gateway has accepted but not yet processed are completed by the webhook
+	refund.TransactionID = refundID
+	if refundStatus == "processed" {
+		refund.Status = database.PaymentStatusRefunded
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&refund).Updates(map[string]interface{}{
+			"transaction_id": refund.TransactionID,
+			"status":         refund.Status,
+		}).Error; err != nil {
+			return err
+		}
+		if err := markPaymentRefundedIfSettled(tx, &initialPayment); err != nil {
+			return err
+		}
+		return notifyRefund(tx, order.CustomerID, amount, &orderID)
+	})
+	if err != nil {
+		// The refund.processed webhook claims the pending refund if this write is lost
+		log.Printf("Database error recording gateway refund %s: %v", refundID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Refund was issued but could not be recorded; it will be reconciled automatically"})
+		return
+	}
+
+	quote.AlreadySettled = roundAmount(quote.AlreadySettled + quote.UnpaidDues - quote.UnusedCredit + quote.DamageDeduction + amount)
+	quote.UnpaidDues = 0
+	quote.UnusedCredit = 0
+	quote.Refundable = roundAmount(quote.Refundable - amount)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Refund issued successfully",
+		"refund":  refund,
+		"quote":   quote,
+	})
+}
+
+// findManagedOrder loads the order named by the :id parameter if the caller may manage
+// its refunds. It writes the error response and returns false otherwise.
+func findManagedOrder(c *gin.Context, db *gorm.DB) (*database.Order, bool) {
+	orderID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return nil, false
+	}
+
+	role, _ := c.Get("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	query := db.Where("orders.id = ?", orderID)
+	switch role {
+	case "admin":
+		// Admin can manage any order
+	case "franchise_owner":
+		query = query.Joins("JOIN franchises ON orders.franchise_id = franchises.id").
+			Where("franchises.owner_id = ?", userID)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return nil, false
+	}
+
+	var order database.Order
+	if err := query.Select("orders.*").First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found or you don't have permission to manage it"})
+			return nil, false
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return nil, false
+	}
+
+	return &order, true
+}
+
+// computeDepositRefundQuote works out the refundable part of an order's security deposit.
+// It also returns the unpaid payments and unused credit notes that would be settled with it.
+func computeDepositRefundQuote(db *gorm.DB, order *database.Order, damageDeduction float64) (DepositRefundQuote, []database.Payment, error) {
+	quote := DepositRefundQuote{
+		OrderID:         order.ID,
+		DamageDeduction: roundAmount(damageDeduction),
+	}
+
+	// No deposit is held until the initial payment has gone through
+	var paidCount int64
+	if err := db.Model(&database.Payment{}).
+		Where("order_id = ? AND payment_type = ? AND status IN ?", order.ID, "initial",
+			[]string{database.PaymentStatusSuccess, database.PaymentStatusRefunded}).
+		Count(&paidCount).Error; err != nil {
+		return quote, nil, err
+	}
+	if paidCount > 0 {
+		// Applied plan changes raise or lower the deposit held from the one originally
+		// collected. Pending and cancelled changes have not moved the deposit.
+		var planChanges float64
+		if err := db.Model(&database.SubscriptionPlanChange{}).
+			Where("subscription_id IN (?) AND status = ?",
+				db.Model(&database.Subscription{}).Select("id").Where("order_id = ?", order.ID), PlanChangeApplied).
+			Select("COALESCE(SUM(new_security_deposit - old_security_deposit), 0)").
+			Scan(&planChanges).Error; err != nil {
+			return quote, nil, err
+		}
+		quote.SecurityDeposit = roundAmount(order.SecurityDeposit + planChanges)
+	}
+
+	// Earlier refunds and charges already taken from the deposit. Credit notes paid out
+	// with an earlier refund were not taken from the deposit.
+	var settled float64
+	if err := db.Model(&database.Payment{}).
+		Where("order_id = ? AND (payment_method = ? OR (payment_type = ? AND status <> ?))",
+			order.ID, PaymentMethodDepositAdjustment, PaymentTypeRefund, database.PaymentStatusFailed).
+		Select("COALESCE(SUM(CASE WHEN payment_type IN ? THEN -amount ELSE amount END), 0)", creditEntryTypes).
+		Scan(&settled).Error; err != nil {
+		return quote, nil, err
+	}
+	quote.AlreadySettled = roundAmount(settled)
+
+	// Unpaid rent, prorated charges and credit notes no invoice has consumed
+	var unpaidPayments []database.Payment
+	if err := db.Where("subscription_id IN (?) AND payment_type IN ? AND status = ?",
+		db.Model(&database.Subscription{}).Select("id").Where("order_id = ?", order.ID),
+		append([]string{"monthly"}, prorationEntryTypes...), database.PaymentStatusPending).
+		Find(&unpaidPayments).Error; err != nil {
+		return quote, nil, err
+	}
+	for _, payment := range unpaidPayments {
+		if isCreditEntry(payment.PaymentType) {
+			quote.UnusedCredit += payment.Amount
+		} else {
+			quote.UnpaidDues += payment.Amount
+		}
+	}
+	quote.UnpaidDues = roundAmount(quote.UnpaidDues)
+	quote.UnusedCredit = roundAmount(quote.UnusedCredit)
+
+	quote.Refundable = roundAmount(quote.SecurityDeposit + quote.UnusedCredit - quote.AlreadySettled - quote.UnpaidDues - quote.DamageDeduction)
+	if quote.Refundable < 0 {
+		quote.Refundable = 0
+	}
+
+	return quote, unpaidPayments, nil
+}
+
+// issueGatewayRefund refunds amount against a captured gateway payment and returns the
+// refund ID and its gateway status
+func issueGatewayRefund(gatewayPaymentID string, amount float64, notes map[string]interface{}) (string, string, error) {
+	refund, err := payments.Gateway().Refund(gatewayPaymentID, payments.ToPaise(amount), notes)
+	if err != nil {
+		return "", "", err
+	}
+	return refund.ID, refund.Status, nil
+}
+
+// markPaymentRefundedIfSettled marks a payment refunded once its refunds cover the full amount
+func markPaymentRefundedIfSettled(tx *gorm.DB, payment *database.Payment) error {
+	var refunded float64
+	if err := tx.Model(&database.Payment{}).
+		Where("refund_of_id = ? AND payment_type = ? AND status <> ?",
+			payment.ID, PaymentTypeRefund, database.PaymentStatusFailed).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&refunded).Error; err != nil {
+		return err
+	}
+
+	if roundAmount(refunded) < roundAmount(payment.Amount) {
+		return nil
+	}
+	return tx.Model(payment).Update("status", database.PaymentStatusRefunded).Error
+}
+
+// notifyRefund tells the customer that a refund has been issued
+func notifyRefund(tx *gorm.DB, customerID uint, amount float64, orderID *uint) error {
+	notification := database.Notification{
+		UserID:      customerID,
+		Title:       "Refund Processed",
+		Message:     fmt.Sprintf("A refund of ₹%.2f has been processed to your original payment method.", amount),
+		Type:        "payment",
+		RelatedID:   orderID,
+		RelatedType: "order",
+	}
+	return tx.Create(&notification).Error
+}
+
+// roundAmount rounds a rupee amount to paise
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"aquahome/database"
+)
+
+func TestDepositRefundQuoteCountsOnlyAppliedPlanChanges(t *testing.T) {
+	openTestDB(t)
+	fixture := createRentalFixture(t)
+	subscription := createActiveSubscription(t, fixture, time.Now().AddDate(0, 6, 0))
+
+	var order database.Order
+	if err := database.DB.First(&order, subscription.OrderID).Error; err != nil {
+		t.Fatalf("loading order: %v", err)
+	}
+	initial := database.Payment{
+		CustomerID:  fixture.Customer.ID,
+		OrderID:     &order.ID,
+		Amount:      order.SecurityDeposit,
+		PaymentType: "initial",
+		Status:      database.PaymentStatusSuccess,
+	}
+	if err := database.DB.Create(&initial).Error; err != nil {
+		t.Fatalf("creating initial payment: %v", err)
+	}
+
+	addPlanChange := func(status string, newDeposit float64) {
+		t.Helper()
+		change := database.SubscriptionPlanChange{
+			SubscriptionID:     subscription.ID,
+			Status:             status,
+			FromProductID:      fixture.Product.ID,
+			ToProductID:        fixture.Product.ID,
+			OldSecurityDeposit: order.SecurityDeposit,
+			NewSecurityDeposit: newDeposit,
+			EffectiveDate:      time.Now(),
+		}
+		if err := database.DB.Create(&change).Error; err != nil {
+			t.Fatalf("creating %s plan change: %v", status, err)
+		}
+	}
+	quoteDeposit := func() float64 {
+		t.Helper()
+		quote, _, err := computeDepositRefundQuote(database.DB, &order, 0)
+		if err != nil {
+			t.Fatalf("computeDepositRefundQuote: %v", err)
+		}
+		return quote.SecurityDeposit
+	}
+
+	// An upgrade the customer cancelled and one still waiting for its swap leave the
+	// deposit as collected
+	addPlanChange(PlanChangeCancelled, order.SecurityDeposit+1000)
+	addPlanChange(PlanChangePending, order.SecurityDeposit+2000)
+	if got := quoteDeposit(); got != order.SecurityDeposit {
+		t.Errorf("deposit with cancelled and pending changes = %v, want %v", got, order.SecurityDeposit)
+	}
+
+	// A completed upgrade raises it
+	addPlanChange(PlanChangeApplied, order.SecurityDeposit+500)
+	if got, want := quoteDeposit(), order.SecurityDeposit+500; got != want {
+		t.Errorf("deposit with an applied change = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"aquahome/database"
+	"aquahome/payments"
+)
+
+// settleInitialPayment marks the initial payment of a pending order as successful and
+// approves the order, which activates its subscription
+func settleInitialPayment(tx *gorm.DB, order *database.Order, gatewayOrderID, gatewayPaymentID string) error {
+	paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s", "razorpay_payment_id": "%s"}`, gatewayOrderID, gatewayPaymentID)
+
+	var payment database.Payment
+	if err := tx.Where("order_id = ? AND payment_type = ?", order.ID, "initial").First(&payment).Error; err != nil {
+		return err
+	}
+
+	payment.Status = database.PaymentStatusSuccess
+	payment.TransactionID = gatewayPaymentID
+	payment.PaymentMethod = payments.Gateway().Name()
+	payment.PaymentDetails = paymentDetails
+	if err := assignInvoiceNumber(tx, &payment); err != nil {
+		return err
+	}
+	if err := tx.Save(&payment).Error; err != nil {
+		return err
+	}
+
+	// Move the order forward through the order state machine
+	return transitionOrder(tx, order, database.OrderStatusApproved, OrderActorSystem, nil, "Initial payment verified")
+}
+
+// settleMonthlyPayment marks a monthly payment of subscription as successful. When
+// payment is nil a new payment is recorded. Payments that do not yet cover a billing
+// period claim the next unbilled one, which moves the subscription's billing date one
+// period forward. A suspended subscription is reactivated once its arrears are cleared.
+// subscription must be locked by the caller.
+func settleMonthlyPayment(tx *gorm.DB, subscription *database.Subscription, payment *database.Payment, gatewayOrderID, gatewayPaymentID string) error {
+	paymentDetails := fmt.Sprintf(`{"razorpay_order_id": "%s", "razorpay_payment_id": "%s"}`, gatewayOrderID, gatewayPaymentID)
+
+	var claimedPeriodEnd *time.Time
+	periodStart := subscription.NextBillingDate
+	periodEnd := nextBillingDateAfter(subscription.StartDate, periodStart)
+
+	if payment == nil {
+		subscriptionID := subscription.ID
+		orderID := subscription.OrderID
+		newPayment := database.Payment{
+			CustomerID:         subscription.CustomerID,
+			SubscriptionID:     &subscriptionID,
+			OrderID:            &orderID,
+			Amount:             subscription.MonthlyRent,
+			PaymentType:        "monthly",
+			Status:             database.PaymentStatusSuccess,
+			TransactionID:      gatewayPaymentID,
+			PaymentMethod:      payments.Gateway().Name(),
+			PaymentDetails:     paymentDetails,
+			BillingPeriodStart: &periodStart,
+			BillingPeriodEnd:   &periodEnd,
+		}
+		if err := assignInvoiceNumber(tx, &newPayment); err != nil {
+			return err
+		}
+		if err := tx.Create(&newPayment).Error; err != nil {
+			return err
+		}
+		claimedPeriodEnd = &periodEnd
+	} else {
+		payment.Status = database.PaymentStatusSuccess
+		payment.TransactionID = gatewayPaymentID
+		payment.PaymentMethod = payments.Gateway().Name()
+		payment.PaymentDetails = paymentDetails
+
+		if payment.BillingPeriodStart == nil {
+			payment.BillingPeriodStart = &periodStart
+			payment.BillingPeriodEnd = &periodEnd
+			claimedPeriodEnd = &periodEnd
+		}
+
+		if err := assignInvoiceNumber(tx, payment); err != nil {
+			return err
+		}
+		if err := tx.Save(payment).Error; err != nil {
+			return err
+		}
+	}
+
+	if claimedPeriodEnd != nil {
+		if err := tx.Model(&database.Subscription{}).
+			Where("id = ?", subscription.ID).
+			Update("next_billing_date", *claimedPeriodEnd).Error; err != nil {
+			return err
+		}
+	}
+
+	return reactivateIfArrearsCleared(tx, subscription, time.Now())
+}
+
+// notifyPaymentSuccess tells the customer that a payment has been processed
+func notifyPaymentSuccess(tx *gorm.DB, customerID uint, paymentType string, orderID uint) error {
+	paymentTypeDisplay := "Monthly"
+	if paymentType == "initial" {
+		paymentTypeDisplay = "Initial"
+	}
+
+	notification := database.Notification{
+		UserID:      customerID,
+		Title:       "Payment Successful",
+		Message:     fmt.Sprintf("%s payment has been processed successfully.", paymentTypeDisplay),
+		Type:        "payment",
+		RelatedID:   &orderID,
+		RelatedType: "order",
+	}
+	return tx.Create(&notification).Error
+}
+
+// isPaymentSettled reports whether the gateway payment has already been recorded as successful
+func isPaymentSettled(tx *gorm.DB, gatewayPaymentID string) (bool, error) {
+	var count int64
+	err := tx.Model(&database.Payment{}).
+		Where("transaction_id = ? AND status = ?", gatewayPaymentID, database.PaymentStatusSuccess).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+	"aquahome/payments"
+)
+
+// Razorpay webhook events handled by RazorpayWebhook
+const (
+	RazorpayEventPaymentCaptured = "payment.captured"
+	RazorpayEventPaymentFailed   = "payment.failed"
+	RazorpayEventOrderPaid       = "order.paid"
+	RazorpayEventRefundProcessed = "refund.processed"
+)
+
+// RazorpayWebhookEvent is the envelope Razorpay posts to the webhook endpoint
+type RazorpayWebhookEvent struct {
+	Event   string `json:"event"`
+	Payload struct {
+		Payment *struct {
+			Entity RazorpayPaymentEntity `json:"entity"`
+		} `json:"payment"`
+		Refund *struct {
+			Entity RazorpayRefundEntity `json:"entity"`
+		} `json:"refund"`
+	} `json:"payload"`
+}
+
+// RazorpayPaymentEntity contains the payment fields used by the webhook
+type RazorpayPaymentEntity struct {
+	ID               string `json:"id"`
+	OrderID          string `json:"order_id"`
+	Amount           int64  `json:"amount"`
+	Status           string `json:"status"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// RazorpayRefundEntity contains the refund fields used by the webhook
+type RazorpayRefundEntity struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"payment_id"`
+	Amount    int64  `json:"amount"`
+}
+
+// RazorpayWebhook receives payment events from Razorpay. Each event is verified against
+// the gateway's webhook secret and applied at most once, so payments are confirmed even when the
+// customer never returns to call VerifyPayment.
+func RazorpayWebhook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	signature := c.GetHeader("X-Razorpay-Signature")
+	if signature == "" || !payments.Gateway().VerifyWebhookSignature(body, signature) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+
+	var event RazorpayWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+
+	// Razorpay sends the same event ID on every redelivery
+	eventID := c.GetHeader("X-Razorpay-Event-Id")
+	if eventID == "" {
+		sum := sha256.Sum256(body)
+		eventID = hex.EncodeToString(sum[:])
+	}
+
+	duplicate := false
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		record := database.PaymentWebhookEvent{
+			EventID: eventID,
+			Event:   event.Event,
+			Payload: string(body),
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			duplicate = true
+			return nil
+		}
+
+		return handleRazorpayEvent(tx, &event)
+	})
+
+	if err != nil {
+		// A non-2xx response makes Razorpay redeliver the event later
+		log.Printf("Razorpay webhook %s (%s) failed: %v", eventID, event.Event, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"duplicate": duplicate,
+	})
+}
+
+// handleRazorpayEvent applies a verified webhook event inside tx
+func handleRazorpayEvent(tx *gorm.DB, event *RazorpayWebhookEvent) error {
+	switch event.Event {
+	case RazorpayEventPaymentCaptured, RazorpayEventOrderPaid:
+		if event.Payload.Payment == nil {
+			return nil
+		}
+		return captureRazorpayPayment(tx, &event.Payload.Payment.Entity)
+	case RazorpayEventPaymentFailed:
+		if event.Payload.Payment == nil {
+			return nil
+		}
+		return recordRazorpayPaymentFailure(tx, &event.Payload.Payment.Entity)
+	case RazorpayEventRefundProcessed:
+		if event.Payload.Refund == nil {
+			return nil
+		}
+		return applyRazorpayRefund(tx, &event.Payload.Refund.Entity)
+	default:
+		log.Printf("Razorpay webhook: ignoring event %s", event.Event)
+		return nil
+	}
+}
+
+// findRazorpayPayment looks up the payment record for a Razorpay order or payment ID.
+// It returns nil when the payment does not belong to this system.
+func findRazorpayPayment(tx *gorm.DB, ids ...string) (*database.Payment, error) {
+	var payment database.Payment
+	err := tx.Where("transaction_id IN ?", ids).Order("created_at ASC").First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Razorpay webhook: no payment found for %v", ids)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// captureRazorpayPayment settles the payment the same way VerifyPayment does
+func captureRazorpayPayment(tx *gorm.DB, entity *RazorpayPaymentEntity) error {
+	payment, err := findRazorpayPayment(tx, entity.OrderID, entity.ID)
+	if err != nil || payment == nil {
+		return err
+	}
+
+	switch payment.PaymentType {
+	case "initial":
+		if payment.OrderID == nil {
+			return nil
+		}
+
+		var order database.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, *payment.OrderID).Error; err != nil {
+			return err
+		}
+
+		// Re-check under the order lock in case VerifyPayment settled it meanwhile
+		if err := tx.First(payment, payment.ID).Error; err != nil {
+			return err
+		}
+		if payment.Status == database.PaymentStatusSuccess {
+			return nil
+		}
+
+		if err := validateOrderTransition(OrderActorSystem, order.Status, database.OrderStatusApproved); err != nil {
+			// The order has moved on (e.g. cancelled); keep a record of the money received
+			log.Printf("Razorpay webhook: order #%d is %s, recording payment %s without approval", order.ID, order.Status, entity.ID)
+			payment.Status = database.PaymentStatusSuccess
+			payment.TransactionID = entity.ID
+			payment.PaymentMethod = payments.Gateway().Name()
+			if err := assignInvoiceNumber(tx, payment); err != nil {
+				return err
+			}
+			return tx.Save(payment).Error
+		}
+
+		if err := settleInitialPayment(tx, &order, entity.OrderID, entity.ID); err != nil {
+			return err
+		}
+		return notifyPaymentSuccess(tx, order.CustomerID, "initial", order.ID)
+
+	case "monthly":
+		if payment.SubscriptionID == nil {
+			return nil
+		}
+
+		var subscription database.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, *payment.SubscriptionID).Error; err != nil {
+			return err
+		}
+
+		// Re-check under the subscription lock in case VerifyPayment settled it meanwhile
+		if err := tx.First(payment, payment.ID).Error; err != nil {
+			return err
+		}
+		if payment.Status == database.PaymentStatusSuccess {
+			return nil
+		}
+
+		if err := settleMonthlyPayment(tx, &subscription, payment, entity.OrderID, entity.ID); err != nil {
+			return err
+		}
+		return notifyPaymentSuccess(tx, subscription.CustomerID, "monthly", subscription.OrderID)
+	}
+
+	return nil
+}
+
+// recordRazorpayPaymentFailure notes a failed attempt and tells the customer. The
+// payment stays pending so the customer can retry against the same invoice.
+func recordRazorpayPaymentFailure(tx *gorm.DB, entity *RazorpayPaymentEntity) error {
+	payment, err := findRazorpayPayment(tx, entity.OrderID, entity.ID)
+	if err != nil || payment == nil {
+		return err
+	}
+	if payment.Status != database.PaymentStatusPending {
+		return nil
+	}
+
+	reason := entity.ErrorDescription
+	if reason == "" {
+		reason = "Payment failed"
+	}
+
+	if err := tx.Model(payment).Update("notes", fmt.Sprintf("Attempt %s failed: %s", entity.ID, reason)).Error; err != nil {
+		return err
+	}
+
+	notification := database.Notification{
+		UserID:      payment.CustomerID,
+		Title:       "Payment Failed",
+		Message:     fmt.Sprintf("Your payment of ₹%.2f could not be completed: %s. Please try again.", payment.Amount, reason),
+		Type:        "payment",
+		RelatedID:   payment.OrderID,
+		RelatedType: "order",
+	}
+	return tx.Create(&notification).Error
+}
+
+// applyRazorpayRefund completes a refund issued through RefundSecurityDeposit, including one
+// whose gateway ID was never recorded, or records one issued directly from the Razorpay
+// dashboard
+func applyRazorpayRefund(tx *gorm.DB, entity *RazorpayRefundEntity) error {
+	var refund database.Payment
+	err := tx.Where("payment_type = ? AND transaction_id = ?", PaymentTypeRefund, entity.ID).First(&refund).Error
+	if err == nil {
+		if refund.Status == database.PaymentStatusRefunded {
+			return nil
+		}
+		return tx.Model(&refund).Update("status", database.PaymentStatusRefunded).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	original, err := findRazorpayPayment(tx, entity.PaymentID)
+	if err != nil || original == nil {
+		return err
+	}
+
+	refundAmount := float64(entity.Amount) / 100
+
+	// A refund from RefundSecurityDeposit whose gateway ID was never written back
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("payment_type = ? AND refund_of_id = ? AND transaction_id = ? AND status IN ? AND amount = ?",
+			PaymentTypeRefund, original.ID, "", []string{database.PaymentStatusPending, database.PaymentStatusFailed}, refundAmount).
+		Order("id ASC").
+		First(&refund).Error
+	if err == nil {
+		if err := tx.Model(&refund).Updates(map[string]interface{}{
+			"transaction_id": entity.ID,
+			"status":         database.PaymentStatusRefunded,
+		}).Error; err != nil {
+			return err
+		}
+		if err := markPaymentRefundedIfSettled(tx, original); err != nil {
+			return err
+		}
+		return notifyRefund(tx, original.CustomerID, refundAmount, original.OrderID)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	refund = database.Payment{
+		CustomerID:    original.CustomerID,
+		OrderID:       original.OrderID,
+		Amount:        refundAmount,
+		PaymentType:   PaymentTypeRefund,
+		Status:        database.PaymentStatusRefunded,
+		PaymentMethod: "razorpay",
+		TransactionID: entity.ID,
+		RefundOfID:    &original.ID,
+		Notes:         "Refund issued from the Razorpay dashboard",
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return err
+	}
+
+	if err := markPaymentRefundedIfSettled(tx, original); err != nil {
+		return err
+	}
+	return notifyRefund(tx, original.CustomerID, refundAmount, original.OrderID)
+}
@@ -4,9 +4,9 @@ import (
 	"errors"
 	"log"
 	"net/http"
-	"path/filepath" // 
+	"path/filepath" //
 	"strconv"
-	"time" // 
+	"time" //
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -14,18 +14,18 @@ import (
 	"aquahome/database"
 )
 
-//  MODIFIED: ProductRequest to handle file upload instead of direct ImageURL
+// MODIFIED: ProductRequest to handle file upload instead of direct ImageURL
 type ProductRequest struct {
 	Name             string  `form:"name" binding:"required"` // 🆕 Changed to `form` tag
 	Description      string  `form:"description" binding:"required"`
 	MonthlyRent      float64 `form:"monthly_rent" binding:"required"`
 	SecurityDeposit  float64 `form:"security_deposit" binding:"required"`
 	InstallationFee  float64 `form:"installation_fee" binding:"required"`
-	AvailableStock   int     `form:"available_stock" binding:"required"`
+	AvailableStock   int     `form:"available_stock"` // Opening stock received by the franchise on create
 	Specifications   string  `form:"specifications"`
 	MaintenanceCycle int     `form:"maintenance_cycle"`
 	IsActive         bool    `form:"is_active"`
-	FranchiseID      uint    `form:"franchise_id" binding:"required"`
+	FranchiseID      uint    `form:"franchise_id"`
 	// ImageURL         string  `json:"image_url"` // ❌ REMOVE THIS LINE
 	// 🆕 ADD THIS FIELD to receive the uploaded file
 	ImageFile *gin.FileHeader `form:"image_file"`
@@ -71,7 +71,6 @@ func CreateProduct(c *gin.Context) {
 		MonthlyRent:      request.MonthlyRent,
 		SecurityDeposit:  request.SecurityDeposit,
 		InstallationFee:  request.InstallationFee,
-		AvailableStock:   request.AvailableStock,
 		Specifications:   request.Specifications,
 		MaintenanceCycle: request.MaintenanceCycle,
 		IsActive:         request.IsActive,
@@ -79,7 +78,36 @@ func CreateProduct(c *gin.Context) {
 		ImageURL:         imageURL, //  Save the generated image URL
 	}
 
-	if err := database.DB.Create(&product).Error; err != nil {
+	if request.AvailableStock < 0 || (request.AvailableStock > 0 && request.FranchiseID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Opening stock needs a franchise to hold it"})
+		return
+	}
+
+	tx := database.DB.Begin()
+	if err := tx.Create(&product).Error; err != nil {
+		tx.Rollback()
+		log.Println("Product creation DB error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
+		return
+	}
+
+	// Stock is held per franchise; record the opening stock as a receipt
+	if request.AvailableStock > 0 {
+		userIDValue, _ := c.Get("user_id")
+		actorID, _ := userIDValue.(uint)
+		if _, err := adjustInventory(tx, request.FranchiseID, product.ID, InventoryMovementReceipt, request.AvailableStock, InventoryReference{
+			ActorRole: RoleAdmin,
+			ActorID:   &actorID,
+			Notes:     "Opening stock",
+		}); err != nil {
+			tx.Rollback()
+			log.Println("Product creation DB error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
 		log.Println("Product creation DB error:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
 		return
@@ -160,18 +188,19 @@ func UpdateProduct(c *gin.Context) {
 		imageURL = product.ImageURL
 	}
 
-
 	// Update product fields from request
 	product.Name = request.Name
 	product.Description = request.Description
 	product.MonthlyRent = request.MonthlyRent
 	product.SecurityDeposit = request.SecurityDeposit
 	product.InstallationFee = request.InstallationFee
-	product.AvailableStock = request.AvailableStock
 	product.Specifications = request.Specifications
 	product.MaintenanceCycle = request.MaintenanceCycle
 	product.IsActive = request.IsActive
-	product.FranchiseID = request.FranchiseID
+	// Stock is changed through the franchise inventory, not here
+	if request.FranchiseID != 0 {
+		product.FranchiseID = request.FranchiseID
+	}
 	product.ImageURL = imageURL //  Update with new or existing image URL
 
 	if err := database.DB.Save(&product).Error; err != nil {
@@ -247,22 +276,26 @@ func GetCustomerProducts(c *gin.Context) {
 	}
 
 	customer := user.(database.User)
-	if customer.ZipCode == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "ZIP code is required"})
+	franchises, err := serviceableFranchiseQuery(database.DB, customerServicePoint(&customer))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ZIP code or location is required"})
 		return
 	}
 
+	// Products in stock at a franchise serving the customer
 	var products []database.Product
-	err := database.DB.
+	err = database.DB.
 		Where("is_active = ?", true).
-		Joins("JOIN franchises ON products.franchise_id = franchises.id").
-		Where("franchises.zip_code = ?", customer.ZipCode).
+		Where("EXISTS (?)", database.DB.Table("franchise_inventories").
+			Select("1").
+			Where("franchise_inventories.product_id = products.id AND franchise_inventories.quantity > 0 AND franchise_inventories.deleted_at IS NULL").
+			Where("franchise_inventories.franchise_id IN (?)", franchises.Select("franchises.id"))).
 		Find(&products).Error
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve products for customer's ZIP code"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve products for customer's location"})
 		return
 	}
 
 	c.JSON(http.StatusOK, products)
-}
\ No newline at end of file
+}
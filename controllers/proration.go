@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// Payment types for proration entries. They stay pending until the next monthly
+// invoice consumes them: adjustments and deposit top-ups are added to it, credit notes
+// and deposit credits deducted. The deposit entries carry a change in the security
+// deposit after a plan change and are not taxable.
+const (
+	PaymentTypeCreditNote    = "credit_note"
+	PaymentTypeAdjustment    = "adjustment"
+	PaymentTypeDepositTopUp  = "deposit_top_up"
+	PaymentTypeDepositCredit = "deposit_credit"
+)
+
+// prorationEntryTypes lists every payment type consumed by applyProrations
+var prorationEntryTypes = []string{PaymentTypeAdjustment, PaymentTypeDepositTopUp, PaymentTypeCreditNote, PaymentTypeDepositCredit}
+
+// creditEntryTypes lists the proration entry types that reduce the amount due
+var creditEntryTypes = []string{PaymentTypeCreditNote, PaymentTypeDepositCredit}
+
+// isCreditEntry reports whether a proration entry reduces the amount due
+func isCreditEntry(paymentType string) bool {
+	return paymentType == PaymentTypeCreditNote || paymentType == PaymentTypeDepositCredit
+}
+
+// Subscription changes that are prorated over the current billing period
+const (
+	ProrationEventPause        = "pause"
+	ProrationEventResume       = "resume"
+	ProrationEventCancellation = "cancellation"
+	ProrationEventPlanChange   = "plan_change"
+)
+
+// Proration is the part of a billing period's rent affected by a subscription change.
+// A positive Amount is owed by the customer and a negative one is credited to them.
+type Proration struct {
+	Event          string    `json:"event"`
+	EffectiveDate  time.Time `json:"effective_date"`
+	PeriodStart    time.Time `json:"period_start"`
+	PeriodEnd      time.Time `json:"period_end"`
+	DaysInPeriod   int       `json:"days_in_period"`
+	DaysRemaining  int       `json:"days_remaining"`
+	OldMonthlyRent float64   `json:"old_monthly_rent"`
+	NewMonthlyRent float64   `json:"new_monthly_rent"`
+	Amount         float64   `json:"amount"`
+}
+
+// calculateProration works out the proration for event taking effect at for the billing
+// period containing it. charged tells whether that period has already been invoiced;
+// newMonthlyRent is only used for plan changes.
+//
+//   - pause and cancellation credit the remaining days of a charged period
+//   - resume charges the remaining days, which were either credited on pause or skipped
+//     by the billing engine while paused
+//   - plan change charges or credits the rent difference for the remaining days of a
+//     charged period; uncharged periods are billed at the new rent anyway
+func calculateProration(subscription *database.Subscription, event string, at time.Time, charged bool, newMonthlyRent float64) Proration {
+	periodStart, periodEnd := billingPeriodAt(subscription.StartDate, at)
+	if at.Before(periodStart) {
+		at = periodStart
+	}
+
+	proration := Proration{
+		Event:          event,
+		EffectiveDate:  at,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		DaysInPeriod:   wholeDays(periodEnd.Sub(periodStart)),
+		DaysRemaining:  wholeDays(periodEnd.Sub(at)),
+		OldMonthlyRent: subscription.MonthlyRent,
+		NewMonthlyRent: subscription.MonthlyRent,
+	}
+	if proration.DaysInPeriod == 0 {
+		return proration
+	}
+	fraction := float64(proration.DaysRemaining) / float64(proration.DaysInPeriod)
+
+	switch event {
+	case ProrationEventPause, ProrationEventCancellation:
+		if charged {
+			proration.Amount = -subscription.MonthlyRent * fraction
+		}
+	case ProrationEventResume:
+		proration.Amount = subscription.MonthlyRent * fraction
+	case ProrationEventPlanChange:
+		proration.NewMonthlyRent = newMonthlyRent
+		if charged {
+			proration.Amount = (newMonthlyRent - subscription.MonthlyRent) * fraction
+		}
+	}
+	proration.Amount = roundAmount(proration.Amount)
+
+	return proration
+}
+
+// prorateSubscription calculates the proration for event and records it as a credit note
+// or adjustment for the next monthly invoice. It returns the calculation together with
+// the recorded entry, which is nil when nothing is owed either way.
+func prorateSubscription(tx *gorm.DB, subscription *database.Subscription, event string, at time.Time, newMonthlyRent float64) (Proration, *database.Payment, error) {
+	periodStart, _ := billingPeriodAt(subscription.StartDate, at)
+
+	var charged int64
+	if err := tx.Model(&database.Payment{}).
+		Where("subscription_id = ? AND payment_type = ? AND billing_period_start = ? AND status <> ?",
+			subscription.ID, "monthly", periodStart, database.PaymentStatusFailed).
+		Count(&charged).Error; err != nil {
+		return Proration{}, nil, err
+	}
+	// The first period is paid for by the order's initial payment rather than a monthly invoice
+	if charged == 0 && periodStart.Equal(subscription.StartDate) {
+		if err := tx.Model(&database.Payment{}).
+			Where("order_id = ? AND payment_type = ? AND status IN ?", subscription.OrderID, "initial",
+				[]string{database.PaymentStatusSuccess, database.PaymentStatusRefunded}).
+			Count(&charged).Error; err != nil {
+			return Proration{}, nil, err
+		}
+	}
+
+	proration := calculateProration(subscription, event, at, charged > 0, newMonthlyRent)
+	if math.Abs(proration.Amount) < 0.01 {
+		return proration, nil, nil
+	}
+
+	paymentType := PaymentTypeAdjustment
+	if proration.Amount < 0 {
+		paymentType = PaymentTypeCreditNote
+	}
+
+	subscriptionID := subscription.ID
+	orderID := subscription.OrderID
+	entry := database.Payment{
+		CustomerID:     subscription.CustomerID,
+		OrderID:        &orderID,
+		SubscriptionID: &subscriptionID,
+		Amount:         math.Abs(proration.Amount),
+		PaymentType:    paymentType,
+		Status:         database.PaymentStatusPending,
+		Notes: fmt.Sprintf("Prorated %s: %d of %d days for %s to %s",
+			prorationEventDisplay(event), proration.DaysRemaining, proration.DaysInPeriod,
+			proration.PeriodStart.Format("02 Jan 2006"), proration.PeriodEnd.Format("02 Jan 2006")),
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return proration, nil, err
+	}
+
+	return proration, &entry, nil
+}
+
+// applyProrations consumes the subscription's pending adjustments and credit notes into
+// invoice and updates its amount. Credit beyond the invoice amount is carried forward as
+// a new credit note. An invoice fully covered by credit is marked paid.
+func applyProrations(tx *gorm.DB, subscription *database.Subscription, invoice *database.Payment) error {
+	var entries []database.Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("subscription_id = ? AND payment_type IN ? AND status = ?", subscription.ID,
+			prorationEntryTypes, database.PaymentStatusPending).
+		Order("created_at ASC").
+		Find(&entries).Error; err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Charges first, so credit is set against the full amount due
+	amount := invoice.Amount
+	for i := range entries {
+		if !isCreditEntry(entries[i].PaymentType) {
+			amount += entries[i].Amount
+		}
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if isCreditEntry(entry.PaymentType) {
+			if amount <= 0 {
+				continue
+			}
+			if entry.Amount > amount {
+				// Carry the unused balance forward on a new credit note
+				balance := database.Payment{
+					CustomerID:     entry.CustomerID,
+					OrderID:        entry.OrderID,
+					SubscriptionID: entry.SubscriptionID,
+					Amount:         roundAmount(entry.Amount - amount),
+					PaymentType:    entry.PaymentType,
+					Status:         database.PaymentStatusPending,
+					Notes:          fmt.Sprintf("Balance of credit #%d", entry.ID),
+				}
+				if err := tx.Create(&balance).Error; err != nil {
+					return err
+				}
+				entry.Amount = roundAmount(amount)
+			}
+			amount -= entry.Amount
+		}
+
+		if err := tx.Model(entry).Updates(map[string]interface{}{
+			"amount":        entry.Amount,
+			"status":        database.PaymentStatusApplied,
+			"applied_to_id": invoice.ID,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	invoice.Amount = roundAmount(math.Max(amount, 0))
+	updates := map[string]interface{}{"amount": invoice.Amount}
+	if invoice.Amount == 0 {
+		invoice.Status = database.PaymentStatusPaid
+		invoice.PaymentMethod = PaymentTypeCreditNote
+		if err := assignInvoiceNumber(tx, invoice); err != nil {
+			return err
+		}
+		updates["status"] = invoice.Status
+		updates["payment_method"] = invoice.PaymentMethod
+		updates["invoice_number"] = invoice.InvoiceNumber
+	}
+	return tx.Model(invoice).Updates(updates).Error
+}
+
+// prorationEventDisplay is the wording used for event in payment notes
+func prorationEventDisplay(event string) string {
+	switch event {
+	case ProrationEventPause:
+		return "pause credit"
+	case ProrationEventResume:
+		return "resume charge"
+	case ProrationEventCancellation:
+		return "cancellation credit"
+	case ProrationEventPlanChange:
+		return "plan change"
+	}
+	return event
+}
+
+// wholeDays rounds a duration to the nearest number of days
+func wholeDays(d time.Duration) int {
+	return int(math.Round(d.Hours() / 24))
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"aquahome/database"
+)
+
+func TestCalculateProration(t *testing.T) {
+	subscription := &database.Subscription{
+		StartDate:   date(2026, time.January, 1),
+		MonthlyRent: 310,
+	}
+
+	tests := []struct {
+		name          string
+		event         string
+		at            time.Time
+		charged       bool
+		newRent       float64
+		wantDays      int
+		wantRemaining int
+		wantAmount    float64
+	}{
+		{"pause credits the rest of a charged period", ProrationEventPause, date(2026, time.January, 11), true, 0, 31, 21, -210},
+		{"pause of an uncharged period is free", ProrationEventPause, date(2026, time.January, 11), false, 0, 31, 21, 0},
+		{"cancellation credits the rest of a charged period", ProrationEventCancellation, date(2026, time.January, 11), true, 0, 31, 21, -210},
+		{"resume charges the rest of the period", ProrationEventResume, date(2026, time.January, 11), false, 0, 31, 21, 210},
+		{"upgrade charges the rent difference", ProrationEventPlanChange, date(2026, time.January, 11), true, 620, 31, 21, 210},
+		{"downgrade credits the rent difference", ProrationEventPlanChange, date(2026, time.January, 11), true, 155, 31, 21, -105},
+		{"plan change of an uncharged period is free", ProrationEventPlanChange, date(2026, time.January, 11), false, 620, 31, 21, 0},
+		{"February has 28 days", ProrationEventPause, date(2026, time.February, 15), true, 0, 28, 14, -155},
+		{"before the start counts from the start", ProrationEventCancellation, date(2025, time.December, 20), true, 0, 31, 31, -310},
+		{"pause the day after the start", ProrationEventPause, date(2026, time.January, 2), true, 0, 31, 30, -300},
+		{"resume a few days in", ProrationEventResume, date(2026, time.January, 4), false, 0, 31, 28, 280},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateProration(subscription, tt.event, tt.at, tt.charged, tt.newRent)
+			if got.DaysInPeriod != tt.wantDays || got.DaysRemaining != tt.wantRemaining {
+				t.Errorf("days = %d of %d, want %d of %d", got.DaysRemaining, got.DaysInPeriod, tt.wantRemaining, tt.wantDays)
+			}
+			if got.Amount != tt.wantAmount {
+				t.Errorf("amount = %v, want %v", got.Amount, tt.wantAmount)
+			}
+		})
+	}
+}
+
+func TestCalculateProrationRoundsToPaise(t *testing.T) {
+	subscription := &database.Subscription{
+		StartDate:   date(2026, time.January, 1),
+		MonthlyRent: 499,
+	}
+
+	got := calculateProration(subscription, ProrationEventPause, date(2026, time.January, 11), true, 0)
+	// 499 * 21 / 31 = 338.0322...
+	if want := -338.03; got.Amount != want {
+		t.Errorf("amount = %v, want %v", got.Amount, want)
+	}
+}
+
+func TestProrateSubscriptionInFirstPeriod(t *testing.T) {
+	openTestDB(t)
+	fixture := createRentalFixture(t)
+	now := time.Now().Truncate(time.Second)
+	subscription := createActiveSubscription(t, fixture, addMonths(now.AddDate(0, 0, -10), 12))
+
+	// Nothing was paid for the first period before the initial payment goes through
+	_, entry, err := prorateSubscription(database.DB, &subscription, ProrationEventPause, now, 0)
+	if err != nil {
+		t.Fatalf("prorateSubscription: %v", err)
+	}
+	if entry != nil {
+		t.Errorf("pause before the initial payment recorded a %s of %v, want nothing", entry.PaymentType, entry.Amount)
+	}
+
+	initial := database.Payment{
+		CustomerID:  fixture.Customer.ID,
+		OrderID:     &subscription.OrderID,
+		Amount:      fixture.Product.MonthlyRent + fixture.Product.SecurityDeposit,
+		PaymentType: "initial",
+		Status:      database.PaymentStatusSuccess,
+	}
+	if err := database.DB.Create(&initial).Error; err != nil {
+		t.Fatalf("creating initial payment: %v", err)
+	}
+
+	// The initial payment covers the first month, so pausing or cancelling credits the
+	// rest of it and resuming charges it again
+	tests := []struct {
+		event    string
+		wantType string
+	}{
+		{ProrationEventPause, PaymentTypeCreditNote},
+		{ProrationEventResume, PaymentTypeAdjustment},
+		{ProrationEventCancellation, PaymentTypeCreditNote},
+	}
+	for _, tt := range tests {
+		proration, entry, err := prorateSubscription(database.DB, &subscription, tt.event, now, 0)
+		if err != nil {
+			t.Fatalf("prorateSubscription(%s): %v", tt.event, err)
+		}
+		if !proration.PeriodStart.Equal(subscription.StartDate) {
+			t.Fatalf("%s prorated the period from %s, want the first period from %s", tt.event, proration.PeriodStart, subscription.StartDate)
+		}
+		if entry == nil {
+			t.Errorf("%s in the first month recorded nothing, want a %s", tt.event, tt.wantType)
+			continue
+		}
+		if entry.PaymentType != tt.wantType || entry.Amount != math.Abs(proration.Amount) {
+			t.Errorf("%s recorded a %s of %v, want a %s of %v", tt.event, entry.PaymentType, entry.Amount, tt.wantType, math.Abs(proration.Amount))
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"log"
+	"time"
+)
+
+// runPeriodically starts job in the background, running it once immediately and then
+// every interval. A panic inside a run is logged and does not stop later runs.
+func runPeriodically(name string, interval time.Duration, job func(now time.Time)) {
+	if interval <= 0 {
+		log.Printf("⏸️ %s job disabled (interval %v)", name, interval)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("❌ %s job panicked: %v", name, r)
+					}
+				}()
+				job(time.Now())
+			}()
+			<-ticker.C
+		}
+	}()
+
+	log.Printf("⏱️ %s job scheduled every %v", name, interval)
+}
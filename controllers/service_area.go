@@ -0,0 +1,446 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// Kinds of overlap between franchise service areas
+const (
+	ServiceAreaOverlapZipCode  = "zip_code" // Several franchises cover the same ZIP
+	ServiceAreaOverlapBoundary = "boundary" // Location boundaries of different franchises intersect
+)
+
+// zipCodePattern matches the ZIP and PIN code formats accepted in service areas
+var zipCodePattern = regexp.MustCompile(`^[0-9A-Z][0-9A-Z -]{1,9}$`)
+
+// zipCodeHeaders are the CSV column names recognised as holding ZIP codes
+var zipCodeHeaders = map[string]bool{"zip": true, "zip_code": true, "zipcode": true, "pincode": true, "pin_code": true}
+
+// ServiceAreaOverlap is a place covered by more than one franchise
+type ServiceAreaOverlap struct {
+	Type         string `json:"type"`
+	ZipCode      string `json:"zip_code,omitempty"`
+	LocationIDs  []uint `json:"location_ids"`
+	FranchiseIDs []uint `json:"franchise_ids"`
+}
+
+// UncoveredZipDemand counts the customers and unrouted order requests in a ZIP that no
+// franchise covers
+type UncoveredZipDemand struct {
+	ZipCode        string `json:"zip_code"`
+	Customers      int64  `json:"customers"`
+	TriageRequests int64  `json:"triage_requests"`
+}
+
+// ZipImportError is a CSV row whose value is not a valid ZIP code
+type ZipImportError struct {
+	Row   int    `json:"row"`
+	Value string `json:"value"`
+}
+
+// normalizeZipCode trims and upper-cases zip and reports whether it is a valid ZIP code
+func normalizeZipCode(zip string) (string, bool) {
+	zip = strings.ToUpper(strings.TrimSpace(zip))
+	return zip, zipCodePattern.MatchString(zip)
+}
+
+// normalizeZipCodes validates and de-duplicates zips, keeping their order. It returns the
+// first invalid ZIP as an error.
+func normalizeZipCodes(zips []string) ([]string, error) {
+	seen := make(map[string]bool, len(zips))
+	normalized := make([]string, 0, len(zips))
+	for _, zip := range zips {
+		zip, ok := normalizeZipCode(zip)
+		if !ok {
+			return nil, fmt.Errorf("invalid ZIP code %q", zip)
+		}
+		if !seen[zip] {
+			seen[zip] = true
+			normalized = append(normalized, zip)
+		}
+	}
+	return normalized, nil
+}
+
+// parseZipCodeCSV reads ZIP codes from a CSV file with either a single column or a header
+// row naming the ZIP column. Invalid values are returned with their row numbers.
+func parseZipCodeCSV(r io.Reader) ([]string, []ZipImportError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	column, start := 0, 0
+	if len(records) > 0 {
+		for i, cell := range records[0] {
+			if zipCodeHeaders[strings.ToLower(strings.TrimSpace(cell))] {
+				column, start = i, 1
+				break
+			}
+		}
+	}
+
+	var zips []string
+	var invalid []ZipImportError
+	for i := start; i < len(records); i++ {
+		if column >= len(records[i]) {
+			continue
+		}
+		value := strings.TrimSpace(records[i][column])
+		if value == "" {
+			continue
+		}
+		zip, ok := normalizeZipCode(value)
+		if !ok {
+			invalid = append(invalid, ZipImportError{Row: i + 1, Value: value})
+			continue
+		}
+		zips = append(zips, zip)
+	}
+	return zips, invalid, nil
+}
+
+// validateGeoPolygon checks that polygon is a GeoJSON polygon made of closed rings of
+// valid [longitude, latitude] positions
+func validateGeoPolygon(polygon *database.GeoPolygon) error {
+	if polygon.Type != "Polygon" {
+		return errors.New("boundary must be a GeoJSON Polygon")
+	}
+	if len(polygon.Coordinates) == 0 {
+		return errors.New("boundary must have an outer ring")
+	}
+	for _, ring := range polygon.Coordinates {
+		if len(ring) < 4 {
+			return errors.New("each boundary ring needs at least four positions")
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return errors.New("each boundary ring must end at its first position")
+		}
+		for _, position := range ring {
+			if position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+				return errors.New("boundary positions must be [longitude, latitude] pairs")
+			}
+		}
+	}
+	return nil
+}
+
+// ringContains reports whether the point lies inside ring, by ray casting
+func ringContains(ring [][2]float64, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > latitude) != (yj > latitude) && longitude < (xj-xi)*(latitude-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// polygonContains reports whether the point lies inside polygon and outside its holes
+func polygonContains(polygon *database.GeoPolygon, latitude, longitude float64) bool {
+	if len(polygon.Coordinates) == 0 || !ringContains(polygon.Coordinates[0], latitude, longitude) {
+		return false
+	}
+	for _, hole := range polygon.Coordinates[1:] {
+		if ringContains(hole, latitude, longitude) {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentsCross reports whether segments ab and cd cross at a point inside both
+func segmentsCross(a, b, c, d [2]float64) bool {
+	orientation := func(p, q, r [2]float64) float64 {
+		return (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	}
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// ringCentroid returns the average of the positions of a closed ring
+func ringCentroid(ring [][2]float64) [2]float64 {
+	var centroid [2]float64
+	positions := ring[:len(ring)-1]
+	for _, position := range positions {
+		centroid[0] += position[0]
+		centroid[1] += position[1]
+	}
+	centroid[0] /= float64(len(positions))
+	centroid[1] /= float64(len(positions))
+	return centroid
+}
+
+// polygonsOverlap reports whether the outer rings of two polygons share an area. Edges
+// that merely touch do not count as crossing; holes are ignored.
+func polygonsOverlap(a, b *database.GeoPolygon) bool {
+	if len(a.Coordinates) == 0 || len(b.Coordinates) == 0 {
+		return false
+	}
+	ringA, ringB := a.Coordinates[0], b.Coordinates[0]
+	for i := 0; i < len(ringA)-1; i++ {
+		for j := 0; j < len(ringB)-1; j++ {
+			if segmentsCross(ringA[i], ringA[i+1], ringB[j], ringB[j+1]) {
+				return true
+			}
+		}
+	}
+
+	// Without crossing edges one ring is either inside the other or apart from it
+	for _, position := range append(ringA[:len(ringA)-1:len(ringA)-1], ringCentroid(ringA)) {
+		if ringContains(ringB, position[1], position[0]) {
+			return true
+		}
+	}
+	for _, position := range append(ringB[:len(ringB)-1:len(ringB)-1], ringCentroid(ringB)) {
+		if ringContains(ringA, position[1], position[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundaryColumns returns the column values storing boundary with its bounding box, all
+// NULL when boundary is nil
+func boundaryColumns(boundary *database.GeoPolygon) map[string]interface{} {
+	if boundary == nil {
+		return map[string]interface{}{
+			"boundary":      gorm.Expr("NULL"),
+			"min_latitude":  gorm.Expr("NULL"),
+			"max_latitude":  gorm.Expr("NULL"),
+			"min_longitude": gorm.Expr("NULL"),
+			"max_longitude": gorm.Expr("NULL"),
+		}
+	}
+	minLatitude, maxLatitude, minLongitude, maxLongitude := boundary.Bounds()
+	return map[string]interface{}{
+		"boundary":      boundary,
+		"min_latitude":  minLatitude,
+		"max_latitude":  maxLatitude,
+		"min_longitude": minLongitude,
+		"max_longitude": maxLongitude,
+	}
+}
+
+// locationsContaining returns the IDs of the locations whose boundary contains the point.
+// Only the boundaries whose bounding box holds the point are loaded and tested.
+func locationsContaining(db *gorm.DB, latitude, longitude float64) ([]uint, error) {
+	var locations []database.Location
+	if err := db.Select("id, boundary").
+		Where("boundary IS NOT NULL").
+		Where("min_latitude <= ? AND max_latitude >= ? AND min_longitude <= ? AND max_longitude >= ?",
+			latitude, latitude, longitude, longitude).
+		Find(&locations).Error; err != nil {
+		return nil, err
+	}
+
+	var ids []uint
+	for _, location := range locations {
+		if location.Boundary != nil && polygonContains(location.Boundary, latitude, longitude) {
+			ids = append(ids, location.ID)
+		}
+	}
+	return ids, nil
+}
+
+// servingLocations returns every location with the approved active franchises linked
+// to it loaded
+func servingLocations(db *gorm.DB) ([]database.Location, error) {
+	var locations []database.Location
+	err := db.Preload("Franchises", func(db *gorm.DB) *gorm.DB {
+		return db.Select("franchises.id").Where("franchises.is_active = ? AND franchises.approval_state = ?", true, "approved")
+	}).Find(&locations).Error
+	return locations, err
+}
+
+// sortedIDs returns the keys of set in ascending order
+func sortedIDs(set map[uint]bool) []uint {
+	ids := make([]uint, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// findServiceAreaOverlaps returns the ZIPs covered by more than one approved active
+// franchise, through their own ZIP or their locations, and the location boundaries of
+// different franchises that intersect
+func findServiceAreaOverlaps(db *gorm.DB) ([]ServiceAreaOverlap, error) {
+	locations, err := servingLocations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var franchises []database.Franchise
+	if err := db.Select("id, zip_code").
+		Where("is_active = ? AND approval_state = ?", true, "approved").
+		Find(&franchises).Error; err != nil {
+		return nil, err
+	}
+
+	zipFranchises := map[string]map[uint]bool{}
+	zipLocations := map[string]map[uint]bool{}
+	addZip := func(zip string, franchiseID uint, locationID uint) {
+		if zip == "" {
+			return
+		}
+		if zipFranchises[zip] == nil {
+			zipFranchises[zip], zipLocations[zip] = map[uint]bool{}, map[uint]bool{}
+		}
+		zipFranchises[zip][franchiseID] = true
+		if locationID != 0 {
+			zipLocations[zip][locationID] = true
+		}
+	}
+	for _, franchise := range franchises {
+		addZip(franchise.ZipCode, franchise.ID, 0)
+	}
+	for _, location := range locations {
+		for _, franchise := range location.Franchises {
+			for _, zip := range location.ZipCodes {
+				addZip(zip, franchise.ID, location.ID)
+			}
+		}
+	}
+
+	var overlaps []ServiceAreaOverlap
+	zips := make([]string, 0, len(zipFranchises))
+	for zip, franchiseIDs := range zipFranchises {
+		if len(franchiseIDs) > 1 {
+			zips = append(zips, zip)
+		}
+	}
+	sort.Strings(zips)
+	for _, zip := range zips {
+		overlaps = append(overlaps, ServiceAreaOverlap{
+			Type:         ServiceAreaOverlapZipCode,
+			ZipCode:      zip,
+			LocationIDs:  sortedIDs(zipLocations[zip]),
+			FranchiseIDs: sortedIDs(zipFranchises[zip]),
+		})
+	}
+
+	var bounded []database.Location
+	for _, location := range locations {
+		if location.Boundary != nil && len(location.Franchises) > 0 {
+			bounded = append(bounded, location)
+		}
+	}
+	for i := range bounded {
+		for j := i + 1; j < len(bounded); j++ {
+			franchiseIDs := map[uint]bool{}
+			for _, franchise := range append(bounded[i].Franchises, bounded[j].Franchises...) {
+				franchiseIDs[franchise.ID] = true
+			}
+			if len(franchiseIDs) < 2 || !polygonsOverlap(bounded[i].Boundary, bounded[j].Boundary) {
+				continue
+			}
+			overlaps = append(overlaps, ServiceAreaOverlap{
+				Type:         ServiceAreaOverlapBoundary,
+				LocationIDs:  []uint{bounded[i].ID, bounded[j].ID},
+				FranchiseIDs: sortedIDs(franchiseIDs),
+			})
+		}
+	}
+
+	return overlaps, nil
+}
+
+// findUncoveredDemand returns the ZIPs that no approved active franchise covers by ZIP
+// but where customers live or order requests wait in triage, most demanded first.
+// Coverage by radius or boundary is not considered, as a ZIP has no coordinates.
+func findUncoveredDemand(db *gorm.DB) ([]UncoveredZipDemand, error) {
+	var covered []string
+	if err := db.Model(&database.Franchise{}).
+		Where("is_active = ? AND approval_state = ? AND zip_code <> ''", true, "approved").
+		Pluck("zip_code", &covered).Error; err != nil {
+		return nil, err
+	}
+	var locationZips []string
+	if err := db.Table("locations").
+		Joins("JOIN franchise_locations ON franchise_locations.location_id = locations.id").
+		Joins("JOIN franchises ON franchises.id = franchise_locations.franchise_id").
+		Where("locations.deleted_at IS NULL AND franchises.deleted_at IS NULL").
+		Where("franchises.is_active = ? AND franchises.approval_state = ?", true, "approved").
+		Pluck("UNNEST(locations.zip_codes)", &locationZips).Error; err != nil {
+		return nil, err
+	}
+	coveredZips := make(map[string]bool, len(covered)+len(locationZips))
+	for _, zip := range append(covered, locationZips...) {
+		coveredZips[strings.ToUpper(strings.TrimSpace(zip))] = true
+	}
+
+	var counts []struct {
+		ZipCode string
+		Total   int64
+	}
+	demand := map[string]*UncoveredZipDemand{}
+	entry := func(zip string) *UncoveredZipDemand {
+		zip = strings.ToUpper(strings.TrimSpace(zip))
+		if zip == "" || coveredZips[zip] {
+			return nil
+		}
+		if demand[zip] == nil {
+			demand[zip] = &UncoveredZipDemand{ZipCode: zip}
+		}
+		return demand[zip]
+	}
+
+	if err := db.Model(&database.User{}).
+		Select("zip_code, COUNT(*) AS total").
+		Where("role = ? AND zip_code <> ''", RoleCustomer).
+		Group("zip_code").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		if e := entry(count.ZipCode); e != nil {
+			e.Customers += count.Total
+		}
+	}
+
+	counts = nil
+	if err := db.Model(&database.OrderTriage{}).
+		Select("shipping_zip_code AS zip_code, COUNT(*) AS total").
+		Where("status = ? AND shipping_zip_code <> ''", OrderTriageOpen).
+		Group("shipping_zip_code").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		if e := entry(count.ZipCode); e != nil {
+			e.TriageRequests += count.Total
+		}
+	}
+
+	result := make([]UncoveredZipDemand, 0, len(demand))
+	for _, e := range demand {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].Customers+result[i].TriageRequests, result[j].Customers+result[j].TriageRequests
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].ZipCode < result[j].ZipCode
+	})
+	return result, nil
+}
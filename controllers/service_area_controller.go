@@ -0,0 +1,503 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// LocationRequest contains data for creating or updating a service location
+type LocationRequest struct {
+	Name          string               `json:"name" binding:"required"`
+	ZipCodes      []string             `json:"zip_codes"`
+	Boundary      *database.GeoPolygon `json:"boundary"`       // Optional GeoJSON polygon
+	ClearBoundary bool                 `json:"clear_boundary"` // Removes the boundary on update
+}
+
+// FranchiseLocationsRequest contains the locations a franchise should be linked to
+type FranchiseLocationsRequest struct {
+	LocationIDs []uint `json:"location_ids"`
+}
+
+// CreateLocation adds a service location with its ZIP codes and optional boundary (Admin only)
+func CreateLocation(c *gin.Context) {
+	var request LocationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	zipCodes, err := normalizeZipCodes(request.ZipCodes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Boundary != nil {
+		if err := validateGeoPolygon(request.Boundary); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if len(zipCodes) == 0 && request.Boundary == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ZIP codes or a boundary are required"})
+		return
+	}
+
+	location := database.Location{
+		Name:     request.Name,
+		ZipCodes: pq.StringArray(zipCodes),
+		IsActive: true,
+		Boundary: request.Boundary,
+	}
+	if request.Boundary != nil {
+		minLatitude, maxLatitude, minLongitude, maxLongitude := request.Boundary.Bounds()
+		location.MinLatitude, location.MaxLatitude = &minLatitude, &maxLatitude
+		location.MinLongitude, location.MaxLongitude = &minLongitude, &maxLongitude
+	}
+	if err := database.DB.Create(&location).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create location"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, location)
+}
+
+// GetLocation returns a service location with the franchises linked to it (Admin only)
+func GetLocation(c *gin.Context) {
+	locationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	var location database.Location
+	if err := database.DB.
+		Preload("Franchises", func(db *gorm.DB) *gorm.DB {
+			return db.Select("franchises.id, franchises.name, franchises.zip_code, franchises.is_active, franchises.approval_state")
+		}).
+		First(&location, locationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, location)
+}
+
+// UpdateLocation renames a service location and replaces its ZIP codes and boundary (Admin only)
+func UpdateLocation(c *gin.Context) {
+	locationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	var request LocationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	zipCodes, err := normalizeZipCodes(request.ZipCodes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Boundary != nil {
+		if err := validateGeoPolygon(request.Boundary); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var location database.Location
+	if err := database.DB.First(&location, locationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	updates := map[string]interface{}{
+		"name":      request.Name,
+		"zip_codes": pq.StringArray(zipCodes),
+	}
+	if request.Boundary != nil || request.ClearBoundary {
+		for column, value := range boundaryColumns(request.Boundary) {
+			updates[column] = value
+		}
+	}
+	if err := database.DB.Model(&location).Updates(updates).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location"})
+		return
+	}
+
+	if err := database.DB.First(&location, location.ID).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, location)
+}
+
+// DeleteLocation removes a service location and unlinks it from its franchises (Admin only)
+func DeleteLocation(c *gin.Context) {
+	locationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Where("location_id = ?", locationID).Delete(&database.FranchiseLocation{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete location"})
+		return
+	}
+
+	result := tx.Delete(&database.Location{}, locationID)
+	if result.Error != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete location"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete location"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Location deleted"})
+}
+
+// ImportLocationZipCodes adds the ZIP codes of a CSV file to a service location, or
+// replaces its ZIP codes with them when mode=replace. The file is sent as the "file"
+// form field or as the request body. (Admin only)
+func ImportLocationZipCodes(c *gin.Context) {
+	locationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	mode := c.DefaultQuery("mode", "append")
+	if mode != "append" && mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mode must be append or replace"})
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if file, err := c.FormFile("file"); err == nil {
+		opened, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+		defer opened.Close()
+		body = opened
+	}
+
+	zipCodes, invalid, err := parseZipCodeCSV(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CSV: " + err.Error()})
+		return
+	}
+	if len(zipCodes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No valid ZIP codes found", "invalid": invalid})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var location database.Location
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&location, locationID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+
+	var merged []string
+	if mode == "append" {
+		merged = append(merged, location.ZipCodes...)
+	}
+	seen := make(map[string]bool, len(merged)+len(zipCodes))
+	for _, zip := range merged {
+		seen[zip] = true
+	}
+	added, duplicates := 0, []string{}
+	for _, zip := range zipCodes {
+		if seen[zip] {
+			duplicates = append(duplicates, zip)
+			continue
+		}
+		seen[zip] = true
+		merged = append(merged, zip)
+		added++
+	}
+
+	location.ZipCodes = pq.StringArray(merged)
+	if err := tx.Model(&location).Update("zip_codes", location.ZipCodes).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import ZIP codes"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import ZIP codes"})
+		return
+	}
+
+	if invalid == nil {
+		invalid = []ZipImportError{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"location":   location,
+		"added":      added,
+		"duplicates": duplicates,
+		"invalid":    invalid,
+	})
+}
+
+// RemoveLocationZipCode removes a ZIP code from a service location (Admin only)
+func RemoveLocationZipCode(c *gin.Context) {
+	locationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+	zipCode, _ := normalizeZipCode(c.Param("zip"))
+
+	result := database.DB.Model(&database.Location{}).
+		Where("id = ? AND ? = ANY(zip_codes)", locationID, zipCode).
+		Update("zip_codes", gorm.Expr("ARRAY_REMOVE(zip_codes, ?)", zipCode))
+	if result.Error != nil {
+		log.Printf("Database error: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove ZIP code"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location not found or it does not include this ZIP code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "ZIP code removed"})
+}
+
+// GetServiceAreaOverlaps lists the ZIPs and boundaries covered by more than one
+// franchise, optionally only those involving franchise_id (Admin only)
+func GetServiceAreaOverlaps(c *gin.Context) {
+	var franchiseID uint64
+	if value := c.Query("franchise_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid franchise_id"})
+			return
+		}
+		franchiseID = id
+	}
+
+	overlaps, err := findServiceAreaOverlaps(database.DB)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find overlaps"})
+		return
+	}
+
+	filtered := []ServiceAreaOverlap{}
+	for _, overlap := range overlaps {
+		if franchiseID == 0 {
+			filtered = append(filtered, overlap)
+			continue
+		}
+		for _, id := range overlap.FranchiseIDs {
+			if uint64(id) == franchiseID {
+				filtered = append(filtered, overlap)
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, filtered)
+}
+
+// GetUncoveredDemand lists the ZIPs no franchise covers that have customers or order
+// requests waiting in triage (Admin only)
+func GetUncoveredDemand(c *gin.Context) {
+	demand, err := findUncoveredDemand(database.DB)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find uncovered demand"})
+		return
+	}
+
+	c.JSON(http.StatusOK, demand)
+}
+
+// ReplaceFranchiseLocations links a franchise to exactly the given locations, detaching
+// all others. Admins name the franchise in the path; franchise owners manage their own.
+func ReplaceFranchiseLocations(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	var request FranchiseLocationsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	locationIDs := map[uint]bool{}
+	for _, id := range request.LocationIDs {
+		locationIDs[id] = true
+	}
+	ids := sortedIDs(locationIDs)
+
+	if len(ids) > 0 {
+		var count int64
+		if err := database.DB.Model(&database.Location{}).Where("id IN ?", ids).Count(&count).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if count != int64(len(ids)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location IDs"})
+			return
+		}
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Where("franchise_id = ?", franchiseID).Delete(&database.FranchiseLocation{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update linked locations"})
+		return
+	}
+	for _, id := range ids {
+		link := database.FranchiseLocation{FranchiseID: franchiseID, LocationID: id}
+		if err := tx.Create(&link).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update linked locations"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update linked locations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Linked locations updated", "location_ids": ids})
+}
+
+// DetachFranchiseLocation unlinks a location from a franchise. Admins name the franchise
+// in the path; franchise owners manage their own.
+func DetachFranchiseLocation(c *gin.Context) {
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
+		return
+	}
+
+	locationID, err := strconv.ParseUint(c.Param("locationId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	result := database.DB.Where("franchise_id = ? AND location_id = ?", franchiseID, locationID).
+		Delete(&database.FranchiseLocation{})
+	if result.Error != nil {
+		log.Printf("Database error: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to detach location"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location is not linked to this franchise"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Location detached"})
+}
+
+// managedFranchiseID returns the franchise the caller manages:
+// the one in the path for admins and their own for franchise owners
+func managedFranchiseID(c *gin.Context) (uint, bool) {
+	role := c.GetString("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+
+	query := database.DB.Select("id")
+	switch role {
+	case RoleAdmin:
+		franchiseID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid franchise ID"})
+			return 0, false
+		}
+		query = query.Where("id = ?", franchiseID)
+	case RoleFranchiseOwner:
+		query = query.Where("owner_id = ?", userID)
+		if user, exists := c.Get("user"); exists {
+			if owner, ok := user.(database.User); ok && owner.FranchiseID != nil {
+				query = query.Where("id = ?", *owner.FranchiseID)
+			}
+		}
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return 0, false
+	}
+
+	var franchise database.Franchise
+	if err := query.Order("id ASC").First(&franchise).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Franchise not found or you don't have permission to manage it"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return 0, false
+	}
+	return franchise.ID, true
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"aquahome/database"
 )
@@ -19,6 +20,7 @@ type ServiceRequestCreateRequest struct {
 	SubscriptionID int64  `json:"subscription_id" binding:"required"`
 	RequestType    string `json:"request_type" binding:"required"`
 	Description    string `json:"description" binding:"required"`
+	SlotStartsAt   string `json:"slot_starts_at"` // Optional; RFC3339 start of a slot from GET /services/slots
 }
 
 // ServiceRequestUpdateRequest contains data for updating a service request
@@ -26,6 +28,7 @@ type ServiceRequestUpdateRequest struct {
 	Status         string `json:"status"`
 	AgentID        uint   `json:"agent_id"`
 	ScheduledDate  string `json:"scheduled_date"`
+	ScheduledEnd   string `json:"scheduled_end"` // Defaults to the visit keeping its length
 	CompletionDate string `json:"completion_date"`
 	Notes          string `json:"notes"`
 }
@@ -373,19 +376,18 @@ func CreateServiceRequest(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	userIDInt, err := strconv.ParseUint(userID, 10, 64)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
+	userIDValue, _ := c.Get("user_id")
+	customerID, ok := userIDValue.(uint)
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
 	// Check if subscription exists and belongs to the user
 	var subscription database.Subscription
-	err = database.DB.
+	err := database.DB.
 		Preload("Franchise").
-		Where("id = ? AND customer_id = ?", request.SubscriptionID, userIDInt).
+		Where("id = ? AND customer_id = ?", request.SubscriptionID, customerID).
 		First(&subscription).Error
 
 	if err != nil {
@@ -399,6 +401,10 @@ func CreateServiceRequest(c *gin.Context) {
 	}
 
 	// Check if subscription is active
+	if subscription.Status == database.SubscriptionStatusSuspended {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Subscription is suspended due to overdue payments. Please clear your dues to raise service requests"})
+		return
+	}
 	if subscription.Status != database.SubscriptionStatusActive {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot create service request for inactive subscription"})
 		return
@@ -414,13 +420,68 @@ func CreateServiceRequest(c *gin.Context) {
 
 	// Create service request
 	serviceRequest := database.ServiceRequest{
-		CustomerID:     uint(userIDInt),
+		CustomerID:     customerID,
 		SubscriptionID: uint(request.SubscriptionID),
+		FranchiseID:    subscription.FranchiseID,
 		Type:           request.RequestType,
 		Status:         database.ServiceStatusPending,
 		Description:    request.Description,
 	}
 
+	if request.SlotStartsAt != "" {
+		slotStart, err := time.Parse(time.RFC3339, request.SlotStartsAt)
+		if err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot start format"})
+			return
+		}
+
+		// Lock the franchise so that concurrent bookings cannot overfill the slot
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").First(&database.Franchise{}, subscription.FranchiseID).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		slots, err := franchiseSlots(tx, subscription.FranchiseID, slotStart.In(time.Local), 1)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+
+		var booked *ServiceSlot
+		for i := range slots {
+			if slots[i].StartsAt.Equal(slotStart) {
+				booked = &slots[i]
+				break
+			}
+		}
+		if booked == nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No bookable slot starts at that time"})
+			return
+		}
+		if booked.Available == 0 {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{"error": "The slot is fully booked", "code": "slot_full"})
+			return
+		}
+		serviceRequest.ScheduledTime = &booked.StartsAt
+		serviceRequest.ScheduledEnd = &booked.EndsAt
+	}
+
+	dueBy, err := serviceDueBy(tx, serviceRequest.Type, time.Now(), serviceRequest.ScheduledTime)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	serviceRequest.DueBy = dueBy
+
 	if err := tx.Create(&serviceRequest).Error; err != nil {
 		tx.Rollback()
 		log.Printf("Error creating service request: %v", err)
@@ -430,7 +491,7 @@ func CreateServiceRequest(c *gin.Context) {
 
 	// Create notification for customer
 	customerNotification := database.Notification{
-		UserID:      uint(userIDInt),
+		UserID:      customerID,
 		Title:       "Service Request Created",
 		Message:     "Your service request has been created and is pending assignment.",
 		Type:        "service_request",
@@ -466,6 +527,15 @@ func CreateServiceRequest(c *gin.Context) {
 		}
 	}
 
+	// Hand the request to the best available agent; the dispatch job retries otherwise
+	dispatch, err := dispatchServiceRequest(tx, serviceRequest.ID, OrderActorSystem, nil)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error dispatching service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service request"})
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit().Error; err != nil {
 		log.Printf("Error committing transaction: %v", err)
@@ -474,8 +544,9 @@ func CreateServiceRequest(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"id":      serviceRequest.ID,
-		"message": "Service request created successfully",
+		"id":       serviceRequest.ID,
+		"message":  "Service request created successfully",
+		"dispatch": dispatch,
 	})
 }
 
@@ -585,6 +656,18 @@ func UpdateServiceRequest(c *gin.Context) {
 		updates["scheduled_time"] = scheduledDate
 	}
 
+	if updateRequest.ScheduledEnd != "" && (role == database.RoleAdmin ||
+		role == database.RoleFranchiseOwner ||
+		role == database.RoleServiceAgent) {
+		scheduledEnd, err := time.Parse(time.RFC3339, updateRequest.ScheduledEnd)
+		if err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled end format"})
+			return
+		}
+		updates["scheduled_end"] = scheduledEnd
+	}
+
 	if updateRequest.CompletionDate != "" && (role == database.RoleAdmin ||
 		role == database.RoleFranchiseOwner ||
 		role == database.RoleServiceAgent) {
@@ -605,32 +688,24 @@ func UpdateServiceRequest(c *gin.Context) {
 
 	// Check if agent ID is provided and valid
 	if updateRequest.AgentID != 0 && (role == database.RoleAdmin || role == database.RoleFranchiseOwner) {
-		// Verify agent exists and is a service agent
-		var agentCount int64
-		if role == database.RoleFranchiseOwner {
-			// Franchise owners can only assign agents from their franchise
-			err = database.DB.Model(&database.User{}).
-				Joins("JOIN franchises ON franchises.id = users.franchise_id").
-				Where("users.id = ? AND users.role = ? AND franchises.owner_id = ?",
-					updateRequest.AgentID, database.RoleServiceAgent, userIDInt).
-				Count(&agentCount).Error
-		} else {
-			// Admins can assign any service agent
-			err = database.DB.Model(&database.User{}).
-				Where("id = ? AND role = ?", updateRequest.AgentID, database.RoleServiceAgent).
-				Count(&agentCount).Error
+		// The agent must work for the franchise serving the request
+		franchiseID, err := serviceRequestFranchiseID(tx, uint(requestIDInt))
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
 		}
-
+		isMember, err := isFranchiseAgent(tx, franchiseID, updateRequest.AgentID)
 		if err != nil {
 			tx.Rollback()
 			log.Printf("Database error: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 			return
 		}
-
-		if agentCount == 0 {
+		if !isMember {
 			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service agent ID"})
+			respondAgentNotInFranchise(c)
 			return
 		}
 
@@ -661,6 +736,63 @@ func UpdateServiceRequest(c *gin.Context) {
 		return
 	}
 
+	// Lock the request so completion side effects run only once
+	previousStatus, err := lockServiceRequestStatus(tx, uint(requestIDInt))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Agents close a visit only with a job card the customer has confirmed
+	if updates["status"] == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted &&
+		role == database.RoleServiceAgent {
+		confirmed, err := hasConfirmedJobCard(tx, uint(requestIDInt))
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if !confirmed {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Submit the job card and get the customer's confirmation before completing the service request",
+				"code":  "job_card_unconfirmed",
+			})
+			return
+		}
+	}
+
+	// Every visit is closed only with the customer's code or an admin's override
+	if updates["status"] == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted {
+		if err := requireVerifiedVisit(tx, VisitSubjectService, uint(requestIDInt)); err != nil {
+			tx.Rollback()
+			if errors.Is(err, ErrVisitUnverified) {
+				respondVisitUnverified(c)
+			} else {
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			}
+			return
+		}
+	}
+
+	// The agent must be free for the visit once assigned or rescheduled
+	conflict, err := planServiceVisit(tx, uint(requestIDInt), updates)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if conflict != nil {
+		tx.Rollback()
+		respondScheduleConflict(c, conflict)
+		return
+	}
+
 	// Perform the update
 	result := tx.Model(&database.ServiceRequest{}).Where("id = ?", requestIDInt).Updates(updates)
 	if result.Error != nil {
@@ -679,6 +811,29 @@ func UpdateServiceRequest(c *gin.Context) {
 		return
 	}
 
+	if updatedRequest.Status == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted {
+		actorID := uint(userIDInt)
+		if err := completeServiceRequest(tx, &updatedRequest, role, &actorID); err != nil {
+			tx.Rollback()
+			log.Printf("Error completing service request: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service request"})
+			return
+		}
+	}
+
+	// Starting the visit sends the customer the code that closes it. Once the code limit
+	// is reached only an admin override can.
+	if updatedRequest.Status == database.ServiceStatusInProgress && previousStatus != database.ServiceStatusInProgress {
+		actorID := uint(userIDInt)
+		if _, err := issueVisitCode(tx, VisitSubjectService, updatedRequest.ID, updatedRequest.CustomerID, &actorID); err != nil &&
+			!errors.Is(err, ErrVisitCodeLimit) {
+			tx.Rollback()
+			log.Printf("Error sending visit code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service request"})
+			return
+		}
+	}
+
 	// Create notifications based on changes
 	if updateRequest.Status != "" {
 		statusNotification := database.Notification{
@@ -778,17 +933,16 @@ func CancelServiceRequest(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	userIDInt, err := strconv.ParseUint(userID, 10, 64)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
 	// Check if service request exists and belongs to the user
 	var serviceRequest database.ServiceRequest
-	err = database.DB.Where("id = ? AND customer_id = ?", requestIDInt, userIDInt).First(&serviceRequest).Error
+	err = database.DB.Where("id = ? AND customer_id = ?", requestIDInt, userID).First(&serviceRequest).Error
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -800,14 +954,6 @@ func CancelServiceRequest(c *gin.Context) {
 		return
 	}
 
-	// Check if the service request can be cancelled
-	if serviceRequest.Status != database.ServiceStatusPending &&
-		serviceRequest.Status != database.ServiceStatusAssigned &&
-		serviceRequest.Status != database.ServiceStatusScheduled {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Service request cannot be cancelled in its current state"})
-		return
-	}
-
 	// Begin transaction
 	tx := database.DB.Begin()
 	if tx.Error != nil {
@@ -816,6 +962,22 @@ func CancelServiceRequest(c *gin.Context) {
 		return
 	}
 
+	// Check if the service request can be cancelled, locking it so it is cancelled only once
+	status, err := lockServiceRequestStatus(tx, serviceRequest.ID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if status != database.ServiceStatusPending &&
+		status != database.ServiceStatusAssigned &&
+		status != database.ServiceStatusScheduled {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Service request cannot be cancelled in its current state"})
+		return
+	}
+
 	// Update service request status
 	if err := tx.Model(&serviceRequest).Update("status", database.ServiceStatusCancelled).Error; err != nil {
 		tx.Rollback()
@@ -824,9 +986,16 @@ func CancelServiceRequest(c *gin.Context) {
 		return
 	}
 
+	if err := cancelServiceRequest(tx, &serviceRequest, database.RoleCustomer, &userID); err != nil {
+		tx.Rollback()
+		log.Printf("Error cancelling service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel service request"})
+		return
+	}
+
 	// Create notification for customer
 	customerNotification := database.Notification{
-		UserID:      uint(userIDInt),
+		UserID:      userID,
 		Title:       "Service Request Cancelled",
 		Message:     "Your service request has been cancelled.",
 		Type:        "service_request",
@@ -1033,6 +1202,8 @@ func GetAgentTasks(c *gin.Context) {
 			service_requests.description,
 			service_requests.scheduled_time,
 			service_requests.completion_time,
+			service_requests.due_by,
+			service_requests.sla_breached_at,
 			service_requests.rating,
 			service_requests.feedback,
 			service_requests.created_at,
@@ -25,6 +25,8 @@ type ServiceRequestWithDetails struct {
 	Description      string     `json:"description"`
 	ScheduledTime    *time.Time `json:"scheduled_time"`
 	CompletionTime   *time.Time `json:"completion_time"`
+	DueBy            *time.Time `json:"due_by"`
+	SLABreachedAt    *time.Time `json:"sla_breached_at"`
 	Rating           *int       `json:"rating"`
 	Feedback         string     `json:"feedback"`
 	CreatedAt        time.Time  `json:"created_at"`
@@ -40,6 +42,8 @@ type ServiceRequestWithDetails struct {
 	FranchiseName    string     `json:"franchise_name"`
 	ServiceAgentID   *uint      `json:"service_agent_id"`
 	ServiceAgentName string     `json:"service_agent_name"`
+
+	JobCard *database.ServiceJobCard `gorm:"-" json:"job_card,omitempty"`
 }
 
 // GetServiceRequests returns service requests based on user role
@@ -108,6 +112,8 @@ func GetServiceRequestsNew(c *gin.Context) {
                 service_requests.description,
                 service_requests.scheduled_time,
                 service_requests.completion_time,
+                service_requests.due_by,
+                service_requests.sla_breached_at,
                 service_requests.rating,
                 service_requests.feedback,
                 service_requests.created_at,
@@ -226,6 +232,8 @@ func GetServiceRequestByIDNew(c *gin.Context) {
                         service_requests.description,
                         service_requests.scheduled_time,
                         service_requests.completion_time,
+                        service_requests.due_by,
+                        service_requests.sla_breached_at,
                         service_requests.notes,
                         service_requests.rating,
                         service_requests.feedback,
@@ -251,6 +259,14 @@ func GetServiceRequestByIDNew(c *gin.Context) {
 		return
 	}
 
+	jobCard, err := loadJobCard(database.DB, result.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	result.JobCard = jobCard
+
 	c.JSON(http.StatusOK, result)
 }
 
@@ -292,6 +308,10 @@ func CreateServiceRequestNew(c *gin.Context) {
 	}
 
 	// Check if subscription is active
+	if subscription.Status == SubscriptionStatusSuspended {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Subscription is suspended due to overdue payments. Please clear your dues to raise service requests"})
+		return
+	}
 	if subscription.Status != SubscriptionStatusActive {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot create service request for inactive subscription"})
 		return
@@ -314,6 +334,15 @@ func CreateServiceRequestNew(c *gin.Context) {
 		Description:    request.Description,
 	}
 
+	dueBy, err := serviceDueBy(tx, serviceRequest.Type, time.Now(), serviceRequest.ScheduledTime)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	serviceRequest.DueBy = dueBy
+
 	if err := tx.Create(&serviceRequest).Error; err != nil {
 		tx.Rollback()
 		log.Printf("Error creating service request: %v", err)
@@ -359,6 +388,15 @@ func CreateServiceRequestNew(c *gin.Context) {
 		}
 	}
 
+	// Hand the request to the best available agent; the dispatch job retries otherwise
+	dispatch, err := dispatchServiceRequest(tx, serviceRequest.ID, OrderActorSystem, nil)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error dispatching service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service request"})
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit().Error; err != nil {
 		log.Printf("Error committing transaction: %v", err)
@@ -367,8 +405,9 @@ func CreateServiceRequestNew(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"id":      serviceRequest.ID,
-		"message": "Service request created successfully",
+		"id":       serviceRequest.ID,
+		"message":  "Service request created successfully",
+		"dispatch": dispatch,
 	})
 }
 
@@ -499,6 +538,18 @@ func UpdateServiceRequestNew(c *gin.Context) {
 		updates["scheduled_time"] = scheduledDate
 	}
 
+	if updateRequest.ScheduledEnd != "" && (role == database.RoleAdmin ||
+		role == database.RoleFranchiseOwner ||
+		role == database.RoleServiceAgent) {
+		scheduledEnd, err := time.Parse(time.RFC3339, updateRequest.ScheduledEnd)
+		if err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled end format"})
+			return
+		}
+		updates["scheduled_end"] = scheduledEnd
+	}
+
 	if updateRequest.CompletionDate != "" && (role == database.RoleAdmin ||
 		role == database.RoleFranchiseOwner ||
 		role == database.RoleServiceAgent) {
@@ -519,31 +570,24 @@ func UpdateServiceRequestNew(c *gin.Context) {
 
 	// Check if agent ID is provided and valid
 	if updateRequest.AgentID != 0 && (role == database.RoleAdmin || role == database.RoleFranchiseOwner) {
-		// Verify agent exists and is a service agent
-		var agentCount int64
-		agentQuery := database.DB.Model(&database.User{})
-
-		if role == database.RoleFranchiseOwner {
-			// Franchise owners can only assign agents from their franchise
-			agentQuery = agentQuery.
-				Joins("JOIN franchises ON franchises.id = users.franchise_id").
-				Where("users.id = ? AND users.role = ? AND franchises.owner_id = ?",
-					updateRequest.AgentID, database.RoleServiceAgent, userID)
-		} else {
-			// Admins can assign any service agent
-			agentQuery = agentQuery.Where("id = ? AND role = ?", updateRequest.AgentID, database.RoleServiceAgent)
+		// The agent must work for the franchise serving the request
+		franchiseID, err := serviceRequestFranchiseID(tx, uint(requestIDInt))
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
 		}
-
-		if err := agentQuery.Count(&agentCount).Error; err != nil {
+		isMember, err := isFranchiseAgent(tx, franchiseID, updateRequest.AgentID)
+		if err != nil {
 			tx.Rollback()
 			log.Printf("Database error: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
 			return
 		}
-
-		if agentCount == 0 {
+		if !isMember {
 			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service agent ID"})
+			respondAgentNotInFranchise(c)
 			return
 		}
 
@@ -572,6 +616,71 @@ func UpdateServiceRequestNew(c *gin.Context) {
 		return
 	}
 
+	// Lock the request and check the status change against the state machine. Completed
+	// and cancelled requests cannot be reopened, so their side effects run only once.
+	previousStatus, err := lockServiceRequestStatus(tx, uint(requestIDInt))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if status, ok := updates["status"].(string); ok && status != previousStatus {
+		if err := validateServiceTransition(role, previousStatus, status); err != nil {
+			tx.Rollback()
+			respondServiceTransitionError(c, err)
+			return
+		}
+	}
+
+	// Agents close a visit only with a job card the customer has confirmed
+	if updates["status"] == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted &&
+		role == database.RoleServiceAgent {
+		confirmed, err := hasConfirmedJobCard(tx, uint(requestIDInt))
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if !confirmed {
+			tx.Rollback()
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Submit the job card and get the customer's confirmation before completing the service request",
+				"code":  "job_card_unconfirmed",
+			})
+			return
+		}
+	}
+
+	// Every visit is closed only with the customer's code or an admin's override
+	if updates["status"] == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted {
+		if err := requireVerifiedVisit(tx, VisitSubjectService, uint(requestIDInt)); err != nil {
+			tx.Rollback()
+			if errors.Is(err, ErrVisitUnverified) {
+				respondVisitUnverified(c)
+			} else {
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			}
+			return
+		}
+	}
+
+	// The agent must be free for the visit once assigned or rescheduled
+	conflict, err := planServiceVisit(tx, uint(requestIDInt), updates)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if conflict != nil {
+		tx.Rollback()
+		respondScheduleConflict(c, conflict)
+		return
+	}
+
 	// Perform the update
 	if err := tx.Model(&database.ServiceRequest{}).Where("id = ?", requestIDInt).Updates(updates).Error; err != nil {
 		tx.Rollback()
@@ -589,6 +698,35 @@ func UpdateServiceRequestNew(c *gin.Context) {
 		return
 	}
 
+	if updatedRequest.Status == database.ServiceStatusCompleted && previousStatus != database.ServiceStatusCompleted {
+		if err := completeServiceRequest(tx, &updatedRequest, role, &userID); err != nil {
+			tx.Rollback()
+			log.Printf("Error completing service request: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service request"})
+			return
+		}
+	}
+	if updatedRequest.Status == database.ServiceStatusCancelled && previousStatus != database.ServiceStatusCancelled {
+		if err := cancelServiceRequest(tx, &updatedRequest, role, &userID); err != nil {
+			tx.Rollback()
+			log.Printf("Error cancelling service request: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service request"})
+			return
+		}
+	}
+
+	// Starting the visit sends the customer the code that closes it. Once the code limit
+	// is reached only an admin override can.
+	if updatedRequest.Status == database.ServiceStatusInProgress && previousStatus != database.ServiceStatusInProgress {
+		if _, err := issueVisitCode(tx, VisitSubjectService, updatedRequest.ID, updatedRequest.CustomerID, &userID); err != nil &&
+			!errors.Is(err, ErrVisitCodeLimit) {
+			tx.Rollback()
+			log.Printf("Error sending visit code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service request"})
+			return
+		}
+	}
+
 	// Create notifications based on changes
 	if updateRequest.Status != "" {
 		statusNotification := database.Notification{
@@ -0,0 +1,432 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// DispatchCandidate is a service agent who can take a service request
+type DispatchCandidate struct {
+	AgentID    uint       `json:"agent_id"`
+	Name       string     `json:"name"`
+	OpenTasks  int64      `json:"open_tasks"`
+	SlotStart  *time.Time `json:"slot_start"` // Nil when the franchise offers no slots
+	SlotEnd    *time.Time `json:"slot_end"`
+	DistanceKm *float64   `json:"distance_km"` // Nil when either location is unknown
+}
+
+// StartDispatchScheduler starts the background job that dispatches waiting service
+// requests and escalates those nobody took within the SLA
+func StartDispatchScheduler() {
+	interval := time.Duration(config.AppConfig.DispatchJobIntervalMinutes) * time.Minute
+	runPeriodically("Dispatch", interval, RunDispatchCycle)
+}
+
+// RunDispatchCycle tries again to dispatch every unassigned pending service request and
+// escalates to the franchise owner those that have waited longer than the SLA. It is
+// safe to run repeatedly.
+func RunDispatchCycle(now time.Time) {
+	var requestIDs []uint
+	if err := database.DB.Model(&database.ServiceRequest{}).
+		Where("status = ? AND service_agent_id IS NULL", ServiceStatusPending).
+		Order("created_at ASC").
+		Pluck("id", &requestIDs).Error; err != nil {
+		log.Printf("Dispatch: failed to load waiting service requests: %v", err)
+		return
+	}
+
+	assigned, escalated := 0, 0
+	for _, id := range requestIDs {
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			dispatch, err := dispatchServiceRequest(tx, id, OrderActorSystem, nil)
+			if err != nil {
+				return err
+			}
+			if dispatch != nil && dispatch.Action == ServiceDispatchAssigned {
+				assigned++
+				return nil
+			}
+			ok, err := escalateServiceRequest(tx, id, now)
+			if ok {
+				escalated++
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Dispatch: service request #%d failed: %v", id, err)
+		}
+	}
+
+	if assigned > 0 || escalated > 0 {
+		log.Printf("Dispatch: assigned %d and escalated %d service request(s)", assigned, escalated)
+	}
+}
+
+// haversineKm returns the great-circle distance in km between two points
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLng := (lng2 - lng1) * math.Pi / 180
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// rankDispatchCandidates returns the active agents of the request's franchise who have
+// the skill for it, have not turned it down and are free for its visit, least loaded
+// first, then soonest free, then nearest to the customer. When nobody qualifies it
+// returns the reason instead.
+func rankDispatchCandidates(db *gorm.DB, request *database.ServiceRequest) ([]DispatchCandidate, string, error) {
+	franchiseID, err := serviceRequestFranchiseID(db, request.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var agents []database.User
+	if err := db.Select("users.id, users.name, users.latitude, users.longitude").
+		Joins("JOIN franchise_agents ON franchise_agents.agent_id = users.id AND franchise_agents.deleted_at IS NULL").
+		Where("franchise_agents.franchise_id = ? AND franchise_agents.status = ? AND users.role = ?",
+			franchiseID, FranchiseAgentActive, RoleServiceAgent).
+		Where("users.id NOT IN (?)", db.Model(&database.ServiceDispatch{}).
+			Select("COALESCE(agent_id, 0)").
+			Where("service_request_id = ? AND action = ?", request.ID, ServiceDispatchRejected)).
+		Order("users.id ASC").
+		Find(&agents).Error; err != nil {
+		return nil, "", err
+	}
+	if len(agents) == 0 {
+		return nil, "The franchise has no active service agent who has not turned the request down", nil
+	}
+
+	agentIDs := make([]uint, 0, len(agents))
+	for _, agent := range agents {
+		agentIDs = append(agentIDs, agent.ID)
+	}
+
+	var skills []database.AgentSkill
+	if err := db.Where("agent_id IN ?", agentIDs).Find(&skills).Error; err != nil {
+		return nil, "", err
+	}
+	hasSkills := map[uint]bool{}
+	qualified := map[uint]bool{}
+	for _, skill := range skills {
+		hasSkills[skill.AgentID] = true
+		if skill.Skill == strings.ToLower(request.Type) {
+			qualified[skill.AgentID] = true
+		}
+	}
+
+	var loads []struct {
+		ServiceAgentID uint
+		OpenTasks      int64
+	}
+	if err := db.Model(&database.ServiceRequest{}).
+		Select("service_agent_id, COUNT(*) AS open_tasks").
+		Where("service_agent_id IN ? AND status NOT IN ?", agentIDs, closedServiceStatuses).
+		Group("service_agent_id").
+		Scan(&loads).Error; err != nil {
+		return nil, "", err
+	}
+	openTasks := make(map[uint]int64, len(loads))
+	for _, load := range loads {
+		openTasks[load.ServiceAgentID] = load.OpenTasks
+	}
+
+	// A scheduled visit needs an agent free at its time; otherwise the agent's first free
+	// slot is offered
+	var windows []ServiceSlot
+	if request.ScheduledTime != nil {
+		end := request.ScheduledTime.Add(visitDuration())
+		if request.ScheduledEnd != nil {
+			end = *request.ScheduledEnd
+		}
+		windows = []ServiceSlot{{StartsAt: *request.ScheduledTime, EndsAt: end}}
+	} else {
+		slots, err := franchiseSlots(db, franchiseID, time.Now(), config.AppConfig.ServiceSlotDays)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, slot := range slots {
+			if slot.Available > 0 {
+				windows = append(windows, slot)
+			}
+		}
+	}
+
+	var customer database.User
+	if err := db.Select("id, latitude, longitude").First(&customer, request.CustomerID).Error; err != nil {
+		return nil, "", err
+	}
+	customerLocated := customer.Latitude != 0 || customer.Longitude != 0
+
+	skilled, candidates := 0, []DispatchCandidate{}
+	for _, agent := range agents {
+		if hasSkills[agent.ID] && !qualified[agent.ID] {
+			continue
+		}
+		skilled++
+
+		candidate := DispatchCandidate{AgentID: agent.ID, Name: agent.Name, OpenTasks: openTasks[agent.ID]}
+		if len(windows) > 0 {
+			for i := range windows {
+				conflict, err := findAgentConflict(db, agent.ID, windows[i].StartsAt, windows[i].EndsAt, request.ID)
+				if err != nil {
+					return nil, "", err
+				}
+				if conflict == nil {
+					candidate.SlotStart, candidate.SlotEnd = &windows[i].StartsAt, &windows[i].EndsAt
+					break
+				}
+			}
+			if candidate.SlotStart == nil {
+				continue
+			}
+		}
+		if customerLocated && (agent.Latitude != 0 || agent.Longitude != 0) {
+			distance := haversineKm(customer.Latitude, customer.Longitude, agent.Latitude, agent.Longitude)
+			candidate.DistanceKm = &distance
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if skilled == 0 {
+		return nil, fmt.Sprintf("No active service agent has the %s skill", strings.ReplaceAll(request.Type, "_", " ")), nil
+	}
+	if len(candidates) == 0 {
+		if request.ScheduledTime != nil {
+			return nil, fmt.Sprintf("None of the %d qualified service agent(s) is free at the scheduled time", skilled), nil
+		}
+		return nil, fmt.Sprintf("None of the %d qualified service agent(s) has a free slot in the next %d days",
+			skilled, config.AppConfig.ServiceSlotDays), nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.OpenTasks != b.OpenTasks {
+			return a.OpenTasks < b.OpenTasks
+		}
+		if (a.SlotStart == nil) != (b.SlotStart == nil) {
+			return a.SlotStart != nil
+		}
+		if a.SlotStart != nil && !a.SlotStart.Equal(*b.SlotStart) {
+			return a.SlotStart.Before(*b.SlotStart)
+		}
+		if (a.DistanceKm == nil) != (b.DistanceKm == nil) {
+			return a.DistanceKm != nil
+		}
+		return a.DistanceKm != nil && *a.DistanceKm < *b.DistanceKm
+	})
+	return candidates, "", nil
+}
+
+// dispatchReason describes why the dispatcher gave a request to candidate
+func dispatchReason(candidate *DispatchCandidate, candidateCount int) string {
+	reason := fmt.Sprintf("%d open task(s), the lowest load of %d available agent(s)", candidate.OpenTasks, candidateCount)
+	if candidate.SlotStart != nil {
+		reason += ", free from " + candidate.SlotStart.Format("02 Jan 2006 15:04")
+	}
+	if candidate.DistanceKm != nil {
+		reason += fmt.Sprintf(", %.1f km from the customer", *candidate.DistanceKm)
+	}
+	return reason
+}
+
+// dispatchServiceRequest assigns an unassigned pending service request to the best
+// available agent of its franchise within tx, scheduling it into the agent's first free
+// slot, and moving its due-by time to match, when it has no visit time yet. When nobody
+// qualifies it records why and leaves the request for the dispatch job. It returns nil
+// when the request no longer waits for an agent.
+func dispatchServiceRequest(tx *gorm.DB, requestID uint, actorRole string, actorID *uint) (*database.ServiceDispatch, error) {
+	var request database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&request, requestID).Error; err != nil {
+		return nil, err
+	}
+	if request.Status != ServiceStatusPending || request.ServiceAgentID != nil {
+		return nil, nil
+	}
+
+	candidates, reason, err := rankDispatchCandidates(tx, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range candidates {
+		candidate := &candidates[i]
+
+		// Lock the agent and check again, as another booking may have taken the slot
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").First(&database.User{}, candidate.AgentID).Error; err != nil {
+			return nil, err
+		}
+		if candidate.SlotStart != nil {
+			conflict, err := findAgentConflict(tx, candidate.AgentID, *candidate.SlotStart, *candidate.SlotEnd, request.ID)
+			if err != nil {
+				return nil, err
+			}
+			if conflict != nil {
+				continue
+			}
+		}
+
+		updates := map[string]interface{}{
+			"service_agent_id": candidate.AgentID,
+			"status":           ServiceStatusAssigned,
+		}
+		if request.ScheduledTime == nil && candidate.SlotStart != nil {
+			updates["scheduled_time"] = *candidate.SlotStart
+			updates["scheduled_end"] = *candidate.SlotEnd
+			dueBy, err := serviceDueBy(tx, request.Type, request.CreatedAt, candidate.SlotStart)
+			if err != nil {
+				return nil, err
+			}
+			updates["due_by"] = dueBy
+		}
+		if err := tx.Model(&request).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+
+		dispatch := database.ServiceDispatch{
+			ServiceRequestID: request.ID,
+			AgentID:          &candidate.AgentID,
+			Action:           ServiceDispatchAssigned,
+			Reason:           dispatchReason(candidate, len(candidates)),
+			OpenTasks:        candidate.OpenTasks,
+			NextFreeAt:       candidate.SlotStart,
+			DistanceKm:       candidate.DistanceKm,
+			CandidateCount:   len(candidates),
+			ActorID:          actorID,
+			ActorRole:        actorRole,
+		}
+		if err := tx.Create(&dispatch).Error; err != nil {
+			return nil, err
+		}
+
+		agentNotification := database.Notification{
+			UserID:      candidate.AgentID,
+			Title:       "New Service Assignment",
+			Message:     fmt.Sprintf("You have been assigned to service request #%d.", request.ID),
+			Type:        "service_request",
+			RelatedID:   &request.ID,
+			RelatedType: "service_request",
+		}
+		if err := tx.Create(&agentNotification).Error; err != nil {
+			return nil, err
+		}
+
+		message := "A service agent has been assigned to your service request."
+		if request.ScheduledTime == nil && candidate.SlotStart != nil {
+			message = fmt.Sprintf("A service agent has been assigned to your service request and will visit on %s.",
+				candidate.SlotStart.Format("02 Jan 2006 at 15:04"))
+		}
+		customerNotification := database.Notification{
+			UserID:      request.CustomerID,
+			Title:       "Service Agent Assigned",
+			Message:     message,
+			Type:        "service_request",
+			RelatedID:   &request.ID,
+			RelatedType: "service_request",
+		}
+		if err := tx.Create(&customerNotification).Error; err != nil {
+			return nil, err
+		}
+		return &dispatch, nil
+	}
+
+	if len(candidates) > 0 {
+		reason = "Every available service agent was booked by the time the request was dispatched"
+	}
+	dispatch := database.ServiceDispatch{
+		ServiceRequestID: request.ID,
+		Action:           ServiceDispatchNoAgent,
+		Reason:           reason,
+		ActorID:          actorID,
+		ActorRole:        actorRole,
+	}
+
+	// Retries by the dispatch job record a failed attempt once, until something changes
+	var last database.ServiceDispatch
+	err = tx.Where("service_request_id = ?", request.ID).Order("id DESC").First(&last).Error
+	if err == nil && last.Action == ServiceDispatchNoAgent && last.Reason == reason {
+		return &last, nil
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err := tx.Create(&dispatch).Error; err != nil {
+		return nil, err
+	}
+	return &dispatch, nil
+}
+
+// escalateServiceRequest alerts the franchise owner to an unassigned service request that
+// has waited longer than the dispatch SLA. A request is escalated once; it returns false
+// when it was not escalated.
+func escalateServiceRequest(tx *gorm.DB, requestID uint, now time.Time) (bool, error) {
+	var request database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&request, requestID).Error; err != nil {
+		return false, err
+	}
+	sla := time.Duration(config.AppConfig.DispatchSLAMinutes) * time.Minute
+	if request.Status != ServiceStatusPending || request.ServiceAgentID != nil || now.Sub(request.CreatedAt) < sla {
+		return false, nil
+	}
+
+	var escalations int64
+	if err := tx.Model(&database.ServiceDispatch{}).
+		Where("service_request_id = ? AND action = ?", request.ID, ServiceDispatchEscalated).
+		Count(&escalations).Error; err != nil {
+		return false, err
+	}
+	if escalations > 0 {
+		return false, nil
+	}
+
+	reason := "No service agent could be assigned"
+	var last database.ServiceDispatch
+	if err := tx.Where("service_request_id = ? AND action = ?", request.ID, ServiceDispatchNoAgent).
+		Order("id DESC").First(&last).Error; err == nil {
+		reason = last.Reason
+	}
+
+	dispatch := database.ServiceDispatch{
+		ServiceRequestID: request.ID,
+		Action:           ServiceDispatchEscalated,
+		Reason:           fmt.Sprintf("Unassigned for over %d minutes: %s", config.AppConfig.DispatchSLAMinutes, reason),
+		ActorRole:        OrderActorSystem,
+	}
+	if err := tx.Create(&dispatch).Error; err != nil {
+		return false, err
+	}
+
+	franchiseID, err := serviceRequestFranchiseID(tx, request.ID)
+	if err != nil {
+		return false, err
+	}
+	var franchise database.Franchise
+	if err := tx.Select("id, owner_id").First(&franchise, franchiseID).Error; err != nil {
+		return false, err
+	}
+	notification := database.Notification{
+		UserID:      franchise.OwnerID,
+		Title:       "Service Request Needs an Agent",
+		Message:     fmt.Sprintf("Service request #%d has not been assigned. %s. Please assign a service agent.", request.ID, reason),
+		Type:        "service_request",
+		RelatedID:   &request.ID,
+		RelatedType: "service_request",
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
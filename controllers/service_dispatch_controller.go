@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// AgentSkillsRequest replaces the service request types a service agent takes
+type AgentSkillsRequest struct {
+	Skills []string `json:"skills"`
+}
+
+// RejectServiceAssignmentRequest contains data for an agent turning down an assignment
+type RejectServiceAssignmentRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// managedServiceRequestID returns the service request in the :id path parameter when the
+// caller is an admin or owns the franchise serving it
+func managedServiceRequestID(c *gin.Context) (uint, bool) {
+	requestID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return 0, false
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+
+	query := database.DB.Model(&database.ServiceRequest{}).Where("service_requests.id = ?", requestID)
+	switch c.GetString("role") {
+	case RoleAdmin:
+	case RoleFranchiseOwner:
+		query = query.
+			Joins("JOIN subscriptions ON service_requests.subscription_id = subscriptions.id").
+			Joins("JOIN franchises ON subscriptions.franchise_id = franchises.id").
+			Where("franchises.owner_id = ?", userID)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return 0, false
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return 0, false
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service request not found"})
+		return 0, false
+	}
+	return uint(requestID), true
+}
+
+// GetAgentSkills returns the service request types a service agent takes (Service Agent
+// for themselves, Franchise Owner or Admin)
+func GetAgentSkills(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+
+	var skills []string
+	if err := database.DB.Model(&database.AgentSkill{}).
+		Where("agent_id = ?", agentID).
+		Order("skill ASC").
+		Pluck("skill", &skills).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch skills"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"agent_id": agentID, "skills": skills})
+}
+
+// SetAgentSkills replaces the service request types a service agent takes. An empty list
+// lets the dispatcher give the agent every type (Service Agent for themselves, Franchise
+// Owner or Admin)
+func SetAgentSkills(c *gin.Context) {
+	agentID, ok := managedAgentID(c)
+	if !ok {
+		return
+	}
+
+	var request AgentSkillsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	seen := map[string]bool{}
+	skills := []database.AgentSkill{}
+	names := []string{}
+	for _, skill := range request.Skills {
+		skill = strings.ToLower(strings.TrimSpace(skill))
+		if skill == "" || seen[skill] {
+			continue
+		}
+		seen[skill] = true
+		skills = append(skills, database.AgentSkill{AgentID: agentID, Skill: skill})
+		names = append(names, skill)
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Unscoped().Where("agent_id = ?", agentID).Delete(&database.AgentSkill{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating skills"})
+		return
+	}
+	if len(skills) > 0 {
+		if err := tx.Create(&skills).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating skills"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Skills updated", "agent_id": agentID, "skills": names})
+}
+
+// RejectServiceAssignment lets the assigned service agent turn a service request down
+// before starting it. The request goes back to pending and is dispatched to another agent.
+func RejectServiceAssignment(c *gin.Context) {
+	requestID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+
+	var request RejectServiceAssignmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason for rejection is required"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	agentID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	var serviceRequest database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND service_agent_id = ?", requestID, agentID).
+		First(&serviceRequest).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service request not found or not assigned to you"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		}
+		return
+	}
+	if serviceRequest.Status != ServiceStatusAssigned && serviceRequest.Status != ServiceStatusScheduled {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Only service requests that have not been started can be turned down"})
+		return
+	}
+
+	rejection := database.ServiceDispatch{
+		ServiceRequestID: serviceRequest.ID,
+		AgentID:          &agentID,
+		Action:           ServiceDispatchRejected,
+		Reason:           request.Reason,
+		ActorID:          &agentID,
+		ActorRole:        RoleServiceAgent,
+	}
+	if err := tx.Create(&rejection).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording rejection"})
+		return
+	}
+
+	if err := tx.Model(&serviceRequest).Updates(map[string]interface{}{
+		"service_agent_id": nil,
+		"status":           ServiceStatusPending,
+	}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating service request"})
+		return
+	}
+
+	dispatch, err := dispatchServiceRequest(tx, serviceRequest.ID, OrderActorSystem, nil)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error dispatching service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error dispatching service request"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("Service request #%d turned down", serviceRequest.ID),
+		"dispatch": dispatch,
+	})
+}
+
+// DispatchServiceRequest runs the dispatcher on an unassigned pending service request
+// now (Admin or Franchise Owner only)
+func DispatchServiceRequest(c *gin.Context) {
+	requestID, ok := managedServiceRequestID(c)
+	if !ok {
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	actorID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	dispatch, err := dispatchServiceRequest(tx, requestID, c.GetString("role"), &actorID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error dispatching service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error dispatching service request"})
+		return
+	}
+	if dispatch == nil {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Service request is not waiting for an agent"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if dispatch.Action != ServiceDispatchAssigned {
+		c.JSON(http.StatusConflict, gin.H{"error": dispatch.Reason, "code": "no_agent_available", "dispatch": dispatch})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Service request dispatched", "dispatch": dispatch})
+}
+
+// GetServiceDispatches returns the dispatch history of a service request, latest first
+// (Admin or Franchise Owner only)
+func GetServiceDispatches(c *gin.Context) {
+	requestID, ok := managedServiceRequestID(c)
+	if !ok {
+		return
+	}
+
+	var dispatches []database.ServiceDispatch
+	if err := database.DB.
+		Preload("Agent", func(db *gorm.DB) *gorm.DB { return db.Select("id, name, phone") }).
+		Where("service_request_id = ?", requestID).
+		Order("created_at DESC").
+		Find(&dispatches).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dispatch history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dispatches)
+}
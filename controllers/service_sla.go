@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// ServiceSLAMetrics summarises how service requests with a due-by time fared against it.
+// Cancelled requests are left out.
+type ServiceSLAMetrics struct {
+	Tracked           int64    `json:"tracked"`
+	Closed            int64    `json:"closed"`
+	Met               int64    `json:"met"`      // Completed by the due-by time
+	Breached          int64    `json:"breached"` // Completed late or still open past the due-by time
+	OpenOverdue       int64    `json:"open_overdue"`
+	OpenDueSoon       int64    `json:"open_due_soon"`
+	CompliancePercent *float64 `json:"compliance_percent"` // Nil until a request is completed or overdue
+}
+
+// FranchiseSLAMetrics is the SLA compliance of one franchise
+type FranchiseSLAMetrics struct {
+	FranchiseID   uint   `json:"franchise_id"`
+	FranchiseName string `json:"franchise_name"`
+	ServiceSLAMetrics
+}
+
+// slaPolicyFor returns the SLA policy for a service request type, falling back to the
+// configured defaults when the type has none
+func slaPolicyFor(db *gorm.DB, requestType string) (database.ServiceSLAPolicy, error) {
+	var policy database.ServiceSLAPolicy
+	err := db.Where("request_type = ?", strings.ToLower(requestType)).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.ServiceSLAPolicy{
+			RequestType:          strings.ToLower(requestType),
+			ResolveWithinHours:   config.AppConfig.SLADefaultHours,
+			AdminEscalationHours: config.AppConfig.SLAAdminEscalationHours,
+		}, nil
+	}
+	return policy, err
+}
+
+// serviceDueBy returns when a service request of the given type must be resolved. The
+// clock starts when the request is raised or, for a visit booked later, when the visit
+// starts, so it is worked out again whenever the visit is rescheduled.
+func serviceDueBy(db *gorm.DB, requestType string, raisedAt time.Time, scheduled *time.Time) (*time.Time, error) {
+	policy, err := slaPolicyFor(db, requestType)
+	if err != nil {
+		return nil, err
+	}
+
+	start := raisedAt
+	if scheduled != nil && scheduled.After(start) {
+		start = *scheduled
+	}
+	dueBy := start.Add(time.Duration(policy.ResolveWithinHours) * time.Hour)
+	return &dueBy, nil
+}
+
+// StartSLAScheduler starts the background job that escalates service requests that
+// breach their SLA
+func StartSLAScheduler() {
+	interval := time.Duration(config.AppConfig.SLAJobIntervalMinutes) * time.Minute
+	runPeriodically("SLA", interval, RunSLACycle)
+}
+
+// RunSLACycle escalates open service requests past their due-by time: first to the
+// franchise owner and, if still open after the policy's admin escalation hours, to the
+// admins. It is safe to run repeatedly.
+func RunSLACycle(now time.Time) {
+	var requestIDs []uint
+	if err := database.DB.Model(&database.ServiceRequest{}).
+		Where("status NOT IN ? AND due_by IS NOT NULL AND due_by < ? AND sla_escalation_level < ?",
+			closedServiceStatuses, now, SLAEscalationAdmin).
+		Order("due_by ASC").
+		Pluck("id", &requestIDs).Error; err != nil {
+		log.Printf("SLA: failed to load overdue service requests: %v", err)
+		return
+	}
+
+	escalated := 0
+	for _, id := range requestIDs {
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			ok, err := escalateSLABreach(tx, id, now)
+			if ok {
+				escalated++
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("SLA: service request #%d failed: %v", id, err)
+		}
+	}
+
+	if escalated > 0 {
+		log.Printf("SLA: escalated %d service request breach(es)", escalated)
+	}
+}
+
+// escalateSLABreach raises the escalation level of an overdue service request by one
+// step and notifies whoever is responsible at that level
+func escalateSLABreach(tx *gorm.DB, requestID uint, now time.Time) (bool, error) {
+	var request database.ServiceRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&request, requestID).Error; err != nil {
+		return false, err
+	}
+	if request.DueBy == nil || !request.DueBy.Before(now) ||
+		request.Status == ServiceStatusCompleted || request.Status == ServiceStatusCancelled {
+		return false, nil
+	}
+
+	switch request.SLAEscalation {
+	case SLAEscalationNone:
+		if err := tx.Model(&request).Updates(map[string]interface{}{
+			"sla_breached_at":      *request.DueBy,
+			"sla_escalation_level": SLAEscalationOwner,
+		}).Error; err != nil {
+			return false, err
+		}
+
+		franchiseID, err := serviceRequestFranchiseID(tx, request.ID)
+		if err != nil {
+			return false, err
+		}
+		var franchise database.Franchise
+		if err := tx.Select("id, owner_id").First(&franchise, franchiseID).Error; err != nil {
+			return false, err
+		}
+		notification := database.Notification{
+			UserID:      franchise.OwnerID,
+			Title:       "Service SLA Breached",
+			Message:     fmt.Sprintf("Service request #%d (%s) was due by %s and is still %s.", request.ID, request.Type, request.DueBy.Format("02 Jan 2006 15:04"), request.Status),
+			Type:        "service_request",
+			RelatedID:   &request.ID,
+			RelatedType: "service_request",
+		}
+		if err := tx.Create(&notification).Error; err != nil {
+			return false, err
+		}
+		return true, nil
+
+	case SLAEscalationOwner:
+		policy, err := slaPolicyFor(tx, request.Type)
+		if err != nil {
+			return false, err
+		}
+		if now.Before(request.DueBy.Add(time.Duration(policy.AdminEscalationHours) * time.Hour)) {
+			return false, nil
+		}
+		if err := tx.Model(&request).Update("sla_escalation_level", SLAEscalationAdmin).Error; err != nil {
+			return false, err
+		}
+
+		var adminIDs []uint
+		if err := tx.Model(&database.User{}).Where("role = ?", RoleAdmin).Pluck("id", &adminIDs).Error; err != nil {
+			return false, err
+		}
+		for _, adminID := range adminIDs {
+			notification := database.Notification{
+				UserID:      adminID,
+				Title:       "Service SLA Breach Unresolved",
+				Message:     fmt.Sprintf("Service request #%d (%s) was due by %s and is still %s after the franchise was alerted.", request.ID, request.Type, request.DueBy.Format("02 Jan 2006 15:04"), request.Status),
+				Type:        "service_request",
+				RelatedID:   &request.ID,
+				RelatedType: "service_request",
+			}
+			if err := tx.Create(&notification).Error; err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// slaMetricsSelect counts service requests against their due-by time as of now
+func slaMetricsSelect(now time.Time, dueSoon time.Time) (string, []interface{}) {
+	open := "service_requests.status NOT IN ('" + ServiceStatusCompleted + "', '" + ServiceStatusCancelled + "')"
+	completedAt := "COALESCE(service_requests.completion_time, service_requests.updated_at)"
+	completed := "service_requests.status = '" + ServiceStatusCompleted + "'"
+
+	query := `
+		COUNT(*) AS tracked,
+		COUNT(*) FILTER (WHERE ` + completed + `) AS closed,
+		COUNT(*) FILTER (WHERE ` + completed + ` AND ` + completedAt + ` <= service_requests.due_by) AS met,
+		COUNT(*) FILTER (WHERE (` + completed + ` AND ` + completedAt + ` > service_requests.due_by)
+			OR (` + open + ` AND service_requests.due_by < ?)) AS breached,
+		COUNT(*) FILTER (WHERE ` + open + ` AND service_requests.due_by < ?) AS open_overdue,
+		COUNT(*) FILTER (WHERE ` + open + ` AND service_requests.due_by >= ? AND service_requests.due_by < ?) AS open_due_soon`
+	return query, []interface{}{now, now, now, dueSoon}
+}
+
+// slaTrackedRequests limits a query to service requests that have a due-by time and were
+// not cancelled
+func slaTrackedRequests(db *gorm.DB) *gorm.DB {
+	return db.Table("service_requests").
+		Where("service_requests.deleted_at IS NULL AND service_requests.due_by IS NOT NULL AND service_requests.status <> ?", ServiceStatusCancelled)
+}
+
+// withCompliance fills in the compliance percentage of the metrics
+func (m *ServiceSLAMetrics) withCompliance() {
+	judged := m.Closed + m.OpenOverdue
+	if judged == 0 {
+		m.CompliancePercent = nil
+		return
+	}
+	percent := float64(m.Met) * 100 / float64(judged)
+	percent = float64(int64(percent*100+0.5)) / 100
+	m.CompliancePercent = &percent
+}
+
+// serviceSLAMetrics returns the SLA compliance of service requests raised since the given
+// time, limited to one franchise unless franchiseID is 0
+func serviceSLAMetrics(db *gorm.DB, franchiseID uint, since time.Time) (ServiceSLAMetrics, error) {
+	now := time.Now()
+	selectSQL, args := slaMetricsSelect(now, now.Add(time.Duration(config.AppConfig.SLADueSoonHours)*time.Hour))
+
+	query := slaTrackedRequests(db).Where("service_requests.created_at >= ?", since)
+	if franchiseID != 0 {
+		query = query.Where("service_requests.subscription_id IN (?)",
+			db.Table("subscriptions").Select("id").Where("franchise_id = ?", franchiseID))
+	}
+
+	var metrics ServiceSLAMetrics
+	if err := query.Select(selectSQL, args...).Scan(&metrics).Error; err != nil {
+		return metrics, err
+	}
+	metrics.withCompliance()
+	return metrics, nil
+}
+
+// franchiseSLAMetrics returns the SLA compliance of each franchise for service requests
+// raised since the given time, least compliant first
+func franchiseSLAMetrics(db *gorm.DB, since time.Time) ([]FranchiseSLAMetrics, error) {
+	now := time.Now()
+	selectSQL, args := slaMetricsSelect(now, now.Add(time.Duration(config.AppConfig.SLADueSoonHours)*time.Hour))
+
+	var rows []FranchiseSLAMetrics
+	if err := slaTrackedRequests(db).
+		Joins("JOIN subscriptions ON subscriptions.id = service_requests.subscription_id").
+		Joins("JOIN franchises ON franchises.id = subscriptions.franchise_id").
+		Where("service_requests.created_at >= ?", since).
+		Select("franchises.id AS franchise_id, franchises.name AS franchise_name,"+selectSQL, args...).
+		Group("franchises.id, franchises.name").
+		Order("franchises.name ASC").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		rows[i].withCompliance()
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i].CompliancePercent, rows[j].CompliancePercent
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return *a < *b
+	})
+	return rows, nil
+}
+
+// slaMetricsSince returns the start of the window dashboards report SLA compliance for,
+// taken from the sla_days query parameter (30 days by default)
+func slaMetricsSince(c *gin.Context) (time.Time, bool) {
+	days, err := strconv.Atoi(c.DefaultQuery("sla_days", "30"))
+	if err != nil || days < 1 || days > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sla_days must be between 1 and 366"})
+		return time.Time{}, false
+	}
+	return time.Now().AddDate(0, 0, -days), true
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// SLAPolicyRequest contains data for setting the SLA of a service request type
+type SLAPolicyRequest struct {
+	ResolveWithinHours   int  `json:"resolve_within_hours" binding:"required,min=1"`
+	AdminEscalationHours *int `json:"admin_escalation_hours" binding:"omitempty,min=0"`
+}
+
+// GetSLAPolicies returns the SLA policy of every service request type that has one, and
+// the defaults used for the rest (Admin only)
+func GetSLAPolicies(c *gin.Context) {
+	var policies []database.ServiceSLAPolicy
+	if err := database.DB.Order("request_type ASC").Find(&policies).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SLA policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies": policies,
+		"default": gin.H{
+			"resolve_within_hours":   config.AppConfig.SLADefaultHours,
+			"admin_escalation_hours": config.AppConfig.SLAAdminEscalationHours,
+		},
+	})
+}
+
+// SetSLAPolicy creates or replaces the SLA policy of a service request type. It applies
+// to requests raised afterwards (Admin only)
+func SetSLAPolicy(c *gin.Context) {
+	requestType := strings.ToLower(strings.TrimSpace(c.Param("type")))
+	if requestType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request type"})
+		return
+	}
+
+	var request SLAPolicyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	escalationHours := config.AppConfig.SLAAdminEscalationHours
+	if request.AdminEscalationHours != nil {
+		escalationHours = *request.AdminEscalationHours
+	}
+
+	var policy database.ServiceSLAPolicy
+	err := database.DB.Unscoped().Where("request_type = ?", requestType).First(&policy).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	policy.RequestType = requestType
+	policy.ResolveWithinHours = request.ResolveWithinHours
+	policy.AdminEscalationHours = escalationHours
+	policy.DeletedAt = gorm.DeletedAt{}
+	if err := database.DB.Unscoped().Save(&policy).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving SLA policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SLA policy saved", "policy": policy})
+}
+
+// DeleteSLAPolicy removes the SLA policy of a service request type so that it falls back
+// to the defaults (Admin only)
+func DeleteSLAPolicy(c *gin.Context) {
+	requestType := strings.ToLower(strings.TrimSpace(c.Param("type")))
+
+	result := database.DB.Unscoped().Where("request_type = ?", requestType).Delete(&database.ServiceSLAPolicy{})
+	if result.Error != nil {
+		log.Printf("Database error: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting SLA policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SLA policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SLA policy deleted"})
+}
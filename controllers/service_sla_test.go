@@ -0,0 +1,37 @@
+package controllers
+
+import "testing"
+
+func TestServiceSLAMetricsWithCompliance(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics ServiceSLAMetrics
+		want    *float64
+	}{
+		{"nothing judged yet", ServiceSLAMetrics{Tracked: 3, OpenDueSoon: 1}, nil},
+		{"all met", ServiceSLAMetrics{Tracked: 4, Closed: 4, Met: 4}, floatPtr(100)},
+		{"none met", ServiceSLAMetrics{Tracked: 2, Closed: 2, Breached: 2}, floatPtr(0)},
+		{"overdue open requests count against compliance", ServiceSLAMetrics{Tracked: 4, Closed: 3, Met: 3, Breached: 1, OpenOverdue: 1}, floatPtr(75)},
+		{"open requests not yet due are left out", ServiceSLAMetrics{Tracked: 5, Closed: 2, Met: 1, Breached: 1, OpenDueSoon: 3}, floatPtr(50)},
+		{"rounded to two decimals", ServiceSLAMetrics{Tracked: 3, Closed: 3, Met: 2, Breached: 1}, floatPtr(66.67)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := tt.metrics
+			metrics.withCompliance()
+			got := metrics.CompliancePercent
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil:
+				t.Errorf("compliance = %v, want %v", got, tt.want)
+			case *got != *tt.want:
+				t.Errorf("compliance = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceTransitions lists, per actor role, the statuses a service request may move to
+// from its current status. Completed and cancelled requests are final, so the effects
+// of completing or cancelling one are applied only once.
+var serviceTransitions = map[string]map[string][]string{
+	RoleAdmin: {
+		ServiceStatusPending:    {ServiceStatusAssigned, ServiceStatusScheduled, ServiceStatusCancelled},
+		ServiceStatusAssigned:   {ServiceStatusScheduled, ServiceStatusInProgress, ServiceStatusCompleted, ServiceStatusCancelled},
+		ServiceStatusScheduled:  {ServiceStatusInProgress, ServiceStatusCompleted, ServiceStatusCancelled},
+		ServiceStatusInProgress: {ServiceStatusCompleted, ServiceStatusCancelled},
+	},
+	RoleFranchiseOwner: {
+		ServiceStatusPending:    {ServiceStatusAssigned, ServiceStatusScheduled, ServiceStatusCancelled},
+		ServiceStatusAssigned:   {ServiceStatusScheduled, ServiceStatusInProgress, ServiceStatusCompleted, ServiceStatusCancelled},
+		ServiceStatusScheduled:  {ServiceStatusInProgress, ServiceStatusCompleted, ServiceStatusCancelled},
+		ServiceStatusInProgress: {ServiceStatusCompleted, ServiceStatusCancelled},
+	},
+	RoleServiceAgent: {
+		ServiceStatusAssigned:   {ServiceStatusScheduled, ServiceStatusInProgress},
+		ServiceStatusScheduled:  {ServiceStatusInProgress},
+		ServiceStatusInProgress: {ServiceStatusCompleted},
+	},
+	RoleCustomer: {
+		ServiceStatusPending: {ServiceStatusCancelled},
+	},
+}
+
+// ServiceTransitionError is returned when an actor attempts a service request status
+// change that the state machine does not allow
+type ServiceTransitionError struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Role    string   `json:"role"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *ServiceTransitionError) Error() string {
+	return fmt.Sprintf("cannot move service request from %s to %s as %s", e.From, e.To, e.Role)
+}
+
+// allowedServiceTransitions returns the statuses the given role may move a service
+// request to from status
+func allowedServiceTransitions(role, from string) []string {
+	allowed := serviceTransitions[role][from]
+	if allowed == nil {
+		return []string{}
+	}
+	return allowed
+}
+
+// validateServiceTransition checks whether role may move a service request from one
+// status to another
+func validateServiceTransition(role, from, to string) error {
+	allowed := allowedServiceTransitions(role, from)
+	for _, status := range allowed {
+		if status == to {
+			return nil
+		}
+	}
+	return &ServiceTransitionError{From: from, To: to, Role: role, Allowed: allowed}
+}
+
+// respondServiceTransitionError writes a 409 describing a rejected service request status change
+func respondServiceTransitionError(c *gin.Context, err error) {
+	var transitionErr *ServiceTransitionError
+	if !errors.As(err, &transitionErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   "Invalid service request status transition",
+		"code":    "invalid_status_transition",
+		"from":    transitionErr.From,
+		"to":      transitionErr.To,
+		"role":    transitionErr.Role,
+		"allowed": transitionErr.Allowed,
+	})
+}
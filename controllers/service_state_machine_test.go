@@ -0,0 +1,33 @@
+package controllers
+
+import "testing"
+
+func TestValidateServiceTransition(t *testing.T) {
+	tests := []struct {
+		role    string
+		from    string
+		to      string
+		wantErr bool
+	}{
+		{RoleFranchiseOwner, ServiceStatusPending, ServiceStatusAssigned, false},
+		{RoleServiceAgent, ServiceStatusAssigned, ServiceStatusInProgress, false},
+		{RoleServiceAgent, ServiceStatusInProgress, ServiceStatusCompleted, false},
+		{RoleAdmin, ServiceStatusScheduled, ServiceStatusCompleted, false},
+		{RoleCustomer, ServiceStatusPending, ServiceStatusCancelled, false},
+		{RoleServiceAgent, ServiceStatusPending, ServiceStatusCompleted, true},
+		{RoleServiceAgent, ServiceStatusInProgress, ServiceStatusCancelled, true},
+		{RoleCustomer, ServiceStatusAssigned, ServiceStatusCancelled, true},
+		{RoleAdmin, ServiceStatusCompleted, ServiceStatusInProgress, true},
+		{RoleFranchiseOwner, ServiceStatusCompleted, ServiceStatusCancelled, true},
+		{RoleServiceAgent, ServiceStatusCompleted, ServiceStatusInProgress, true},
+		{RoleAdmin, ServiceStatusCancelled, ServiceStatusPending, true},
+		{"unknown", ServiceStatusPending, ServiceStatusAssigned, true},
+	}
+
+	for _, tt := range tests {
+		err := validateServiceTransition(tt.role, tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateServiceTransition(%s, %s, %s) error = %v, want error %v", tt.role, tt.from, tt.to, err, tt.wantErr)
+		}
+	}
+}
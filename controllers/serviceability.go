@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// Ways a franchise can cover a customer, from the most to the least specific
+const (
+	CoverageMatchZipCode  = "zip_code" // The franchise is based in the customer's ZIP
+	CoverageMatchLocation = "location" // The ZIP is in one of the franchise's locations
+	CoverageMatchBoundary = "boundary" // The customer is inside one of the franchise's location boundaries
+	CoverageMatchRadius   = "radius"   // The customer is within the franchise's coverage radius
+)
+
+// ServicePoint is the place a customer wants to be served at. Either the ZIP code or the
+// coordinates may be missing; zero coordinates mean the location is unknown.
+type ServicePoint struct {
+	ZipCode   string
+	Latitude  float64
+	Longitude float64
+}
+
+// HasCoordinates reports whether the point has a known latitude and longitude
+func (p ServicePoint) HasCoordinates() bool {
+	return p.Latitude != 0 || p.Longitude != 0
+}
+
+// ServiceableFranchise is an approved active franchise that covers a service point
+type ServiceableFranchise struct {
+	ID             uint     `json:"id"`
+	Name           string   `json:"name"`
+	Address        string   `json:"address"`
+	City           string   `json:"city"`
+	State          string   `json:"state"`
+	ZipCode        string   `json:"zip_code"`
+	Phone          string   `json:"phone"`
+	Latitude       float64  `json:"latitude"`
+	Longitude      float64  `json:"longitude"`
+	CoverageRadius float64  `json:"coverage_radius"`
+	DistanceKm     *float64 `json:"distance_km"` // Nil when either side has no coordinates
+	MatchedBy      string   `json:"matched_by"`
+}
+
+// customerServicePoint returns the service point on a customer's profile
+func customerServicePoint(customer *database.User) ServicePoint {
+	return ServicePoint{
+		ZipCode:   strings.TrimSpace(customer.ZipCode),
+		Latitude:  customer.Latitude,
+		Longitude: customer.Longitude,
+	}
+}
+
+// applyFranchiseCoverage copies the coordinates and coverage radius given in request onto
+// franchise, leaving those that were not given unchanged
+func applyFranchiseCoverage(franchise *database.Franchise, request *FranchiseRequest) error {
+	if request.Latitude != nil {
+		if *request.Latitude < -90 || *request.Latitude > 90 {
+			return errors.New("latitude must be between -90 and 90")
+		}
+		franchise.Latitude = *request.Latitude
+	}
+	if request.Longitude != nil {
+		if *request.Longitude < -180 || *request.Longitude > 180 {
+			return errors.New("longitude must be between -180 and 180")
+		}
+		franchise.Longitude = *request.Longitude
+	}
+	if request.CoverageRadius != nil {
+		if *request.CoverageRadius < 0 {
+			return errors.New("coverage radius cannot be negative")
+		}
+		franchise.CoverageRadius = *request.CoverageRadius
+	}
+	return nil
+}
+
+// franchiseDistanceSQL is the great-circle distance in km between a franchise and the
+// point bound to its three parameters (latitude, latitude, longitude), using the mean
+// radius of the Earth
+const franchiseDistanceSQL = `(2 * 6371.0 * ASIN(LEAST(1, SQRT(
+	POWER(SIN(RADIANS(franchises.latitude - ?) / 2), 2) +
+	COS(RADIANS(?)) * COS(RADIANS(franchises.latitude)) *
+	POWER(SIN(RADIANS(franchises.longitude - ?) / 2), 2)))))`
+
+// franchiseHasCoordinatesSQL is true for franchises whose location is known
+const franchiseHasCoordinatesSQL = "(franchises.latitude <> 0 OR franchises.longitude <> 0)"
+
+// franchiseLocationZipSQL is true when the ZIP bound to its parameter is in one of the
+// franchise's locations
+const franchiseLocationZipSQL = `EXISTS (SELECT 1 FROM franchise_locations
+	JOIN locations ON locations.id = franchise_locations.location_id
+	WHERE franchise_locations.franchise_id = franchises.id
+	AND locations.deleted_at IS NULL AND ? = ANY(locations.zip_codes))`
+
+// franchiseBoundarySQL is true when one of the franchise's locations is among those bound
+// to its parameter
+const franchiseBoundarySQL = `EXISTS (SELECT 1 FROM franchise_locations
+	WHERE franchise_locations.franchise_id = franchises.id
+	AND franchise_locations.location_id IN ?)`
+
+// serviceCoverage holds the SQL deciding whether a franchise covers a service point and
+// which way it covers it
+type serviceCoverage struct {
+	conditions []string
+	args       []interface{}
+	cases      []string
+	caseArgs   []interface{}
+}
+
+// add appends a way of covering the point, given as a condition on franchises
+func (c *serviceCoverage) add(match, condition string, args ...interface{}) {
+	c.conditions = append(c.conditions, condition)
+	c.args = append(c.args, args...)
+	c.cases = append(c.cases, "WHEN "+condition+" THEN ?")
+	c.caseArgs = append(append(c.caseArgs, args...), match)
+}
+
+// resolveServiceCoverage works out the ways a franchise can cover point, most specific
+// first. It returns an error when the point has neither a ZIP nor coordinates.
+func resolveServiceCoverage(db *gorm.DB, point ServicePoint) (*serviceCoverage, error) {
+	coverage := &serviceCoverage{}
+	if point.ZipCode != "" {
+		coverage.add(CoverageMatchZipCode, "franchises.zip_code = ?", point.ZipCode)
+		coverage.add(CoverageMatchLocation, franchiseLocationZipSQL, point.ZipCode)
+	}
+	if point.HasCoordinates() {
+		locationIDs, err := locationsContaining(db, point.Latitude, point.Longitude)
+		if err != nil {
+			return nil, err
+		}
+		if len(locationIDs) > 0 {
+			coverage.add(CoverageMatchBoundary, franchiseBoundarySQL, locationIDs)
+		}
+		coverage.add(CoverageMatchRadius, "(franchises.coverage_radius > 0 AND "+franchiseHasCoordinatesSQL+
+			" AND "+franchiseDistanceSQL+" <= franchises.coverage_radius)",
+			point.Latitude, point.Latitude, point.Longitude)
+	}
+	if len(coverage.conditions) == 0 {
+		return nil, errors.New("a ZIP code or coordinates are required")
+	}
+	return coverage, nil
+}
+
+// scope returns a query on db over the approved active franchises meeting the coverage
+func (c *serviceCoverage) scope(db *gorm.DB) *gorm.DB {
+	return db.Model(&database.Franchise{}).
+		Where("franchises.is_active = ? AND franchises.approval_state = ?", true, "approved").
+		Where("("+strings.Join(c.conditions, " OR ")+")", c.args...)
+}
+
+// serviceableFranchiseQuery returns a query on db over the approved active franchises
+// that cover point: those based in its ZIP, listing it in a linked location or whose
+// location boundary contains it, and those whose coverage radius reaches it. It returns
+// an error when the point has neither a ZIP nor coordinates.
+func serviceableFranchiseQuery(db *gorm.DB, point ServicePoint) (*gorm.DB, error) {
+	coverage, err := resolveServiceCoverage(db, point)
+	if err != nil {
+		return nil, err
+	}
+	return coverage.scope(db), nil
+}
+
+// findServiceableFranchises returns the franchises covering point ranked by distance,
+// nearest first. Franchises without a known distance follow, ordered by how specifically
+// they cover the point.
+func findServiceableFranchises(db *gorm.DB, point ServicePoint) ([]ServiceableFranchise, error) {
+	coverage, err := resolveServiceCoverage(db, point)
+	if err != nil {
+		return nil, err
+	}
+
+	distanceSQL := "NULL::float8"
+	var distanceArgs []interface{}
+	if point.HasCoordinates() {
+		distanceSQL = "CASE WHEN " + franchiseHasCoordinatesSQL + " THEN " + franchiseDistanceSQL + " END"
+		distanceArgs = []interface{}{point.Latitude, point.Latitude, point.Longitude}
+	}
+	matchSQL := "CASE " + strings.Join(coverage.cases, " ") + " END"
+
+	var franchises []ServiceableFranchise
+	if err := db.Table("(?) AS serviceable", coverage.scope(db).Select(
+		"franchises.id, franchises.name, franchises.address, franchises.city, franchises.state, "+
+			"franchises.zip_code, franchises.phone, franchises.latitude, franchises.longitude, "+
+			"franchises.coverage_radius, "+distanceSQL+" AS distance_km, "+matchSQL+" AS matched_by",
+		append(distanceArgs, coverage.caseArgs...)...)).
+		Order("distance_km ASC NULLS LAST").
+		Order("CASE matched_by WHEN '" + CoverageMatchZipCode + "' THEN 0 WHEN '" + CoverageMatchLocation +
+			"' THEN 1 WHEN '" + CoverageMatchBoundary + "' THEN 2 ELSE 3 END").
+		Order("id ASC").
+		Find(&franchises).Error; err != nil {
+		return nil, err
+	}
+	return franchises, nil
+}
@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+)
+
+// ErrOutOfStock is returned when a franchise has no stock of a product left to take
+var ErrOutOfStock = errors.New("product is out of stock")
+
+// StartReservationScheduler starts the background job that releases the stock held by
+// orders whose initial payment was not verified in time
+func StartReservationScheduler() {
+	interval := time.Duration(config.AppConfig.ReservationJobIntervalMinutes) * time.Minute
+	runPeriodically("Reservation", interval, RunReservationCycle)
+}
+
+// RunReservationCycle expires every stock reservation past its expiry time. It is safe
+// to run repeatedly.
+func RunReservationCycle(now time.Time) {
+	var reservationIDs []uint
+	if err := database.DB.Model(&database.StockReservation{}).
+		Where("status = ? AND expires_at <= ?", StockReservationReserved, now).
+		Pluck("id", &reservationIDs).Error; err != nil {
+		log.Printf("Reservation: failed to load expired reservations: %v", err)
+		return
+	}
+
+	expired := 0
+	for _, id := range reservationIDs {
+		ok, err := expireStockReservation(id, now)
+		if err != nil {
+			log.Printf("Reservation: reservation #%d failed: %v", id, err)
+			continue
+		}
+		if ok {
+			expired++
+		}
+	}
+
+	if expired > 0 {
+		log.Printf("Reservation: released %d expired reservation(s)", expired)
+	}
+}
+
+// expireStockReservation puts the unit held by an expired reservation back into stock.
+// The order stays pending; generating its payment again reserves a new unit. Returns
+// false when the reservation was allocated or renewed in the meantime.
+func expireStockReservation(reservationID uint, now time.Time) (bool, error) {
+	expired := false
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the stock before the reservation, in the same order as reserving
+		var reservation database.StockReservation
+		if err := tx.Select("id, franchise_id, product_id").First(&reservation, reservationID).Error; err != nil {
+			return err
+		}
+		if _, err := lockFranchiseInventory(tx, reservation.FranchiseID, reservation.ProductID); err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&reservation, reservationID).Error; err != nil {
+			return err
+		}
+		if reservation.Status != StockReservationReserved || reservation.ExpiresAt.After(now) {
+			return nil
+		}
+
+		if err := returnReservedStock(tx, &reservation, StockReservationExpired, now,
+			InventoryReference{ActorRole: OrderActorSystem, Notes: "Reservation expired before payment"}); err != nil {
+			return err
+		}
+		expired = true
+
+		var order database.Order
+		if err := tx.Select("id, customer_id").First(&order, reservation.OrderID).Error; err != nil {
+			return err
+		}
+		notification := database.Notification{
+			UserID:      order.CustomerID,
+			Title:       "Reservation Expired",
+			Message:     "We could not hold your purifier because the payment was not completed in time. Complete the payment to reserve it again.",
+			Type:        "order",
+			RelatedID:   &order.ID,
+			RelatedType: "order",
+		}
+		return tx.Create(&notification).Error
+	})
+
+	return expired, err
+}
+
+// reserveOrderStock holds a unit of the order's product until the initial payment is
+// verified, taking it from the stock of the order's franchise. A live reservation has its
+// expiry renewed instead. Returns ErrOutOfStock when the franchise has no unit left.
+func reserveOrderStock(tx *gorm.DB, order *database.Order, now time.Time) error {
+	inventory, err := lockFranchiseInventory(tx, order.FranchiseID, order.ProductID)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := now.Add(time.Duration(config.AppConfig.StockReservationMinutes) * time.Minute)
+
+	var reservation database.StockReservation
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_id = ?", order.ID).First(&reservation).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	exists := err == nil
+
+	switch reservation.Status {
+	case StockReservationAllocated:
+		return nil
+	case StockReservationReserved:
+		return tx.Model(&reservation).Update("expires_at", expiresAt).Error
+	}
+
+	orderID := order.ID
+	if _, err := applyInventoryMovement(tx, inventory, InventoryMovementAllocation, -1, InventoryReference{
+		OrderID:   &orderID,
+		ActorRole: OrderActorSystem,
+		Notes:     fmt.Sprintf("Reserved for order #%d", order.ID),
+	}); err != nil {
+		return err
+	}
+
+	if exists {
+		return tx.Model(&reservation).Updates(map[string]interface{}{
+			"franchise_id": order.FranchiseID,
+			"product_id":   order.ProductID,
+			"quantity":     1,
+			"status":       StockReservationReserved,
+			"expires_at":   expiresAt,
+			"released_at":  nil,
+			"allocated_at": nil,
+		}).Error
+	}
+
+	reservation = database.StockReservation{
+		OrderID:     order.ID,
+		FranchiseID: order.FranchiseID,
+		ProductID:   order.ProductID,
+		Quantity:    1,
+		Status:      StockReservationReserved,
+		ExpiresAt:   expiresAt,
+	}
+	return tx.Create(&reservation).Error
+}
+
+// allocateOrderStock converts the order's reservation into an allocation when the order
+// is approved. An order whose reservation has lapsed takes a unit from stock again.
+func allocateOrderStock(tx *gorm.DB, order *database.Order) error {
+	now := time.Now()
+	if err := reserveOrderStock(tx, order, now); err != nil {
+		return err
+	}
+
+	return tx.Model(&database.StockReservation{}).
+		Where("order_id = ? AND status = ?", order.ID, StockReservationReserved).
+		Updates(map[string]interface{}{
+			"status":       StockReservationAllocated,
+			"allocated_at": now,
+		}).Error
+}
+
+// releaseOrderStock puts the unit reserved or allocated to a cancelled or rejected order
+// back into the stock it was taken from
+func releaseOrderStock(tx *gorm.DB, order *database.Order, actorRole string, actorID *uint) error {
+	var reservation database.StockReservation
+	err := tx.Select("id, franchise_id, product_id").
+		Where("order_id = ? AND status IN ?", order.ID, []string{StockReservationReserved, StockReservationAllocated}).
+		First(&reservation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := lockFranchiseInventory(tx, reservation.FranchiseID, reservation.ProductID); err != nil {
+		return err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&reservation, reservation.ID).Error; err != nil {
+		return err
+	}
+	if reservation.Status != StockReservationReserved && reservation.Status != StockReservationAllocated {
+		return nil
+	}
+
+	return returnReservedStock(tx, &reservation, StockReservationReleased, time.Now(), InventoryReference{
+		ActorRole: actorRole,
+		ActorID:   actorID,
+		Notes:     fmt.Sprintf("Released by order #%d", order.ID),
+	})
+}
+
+// returnReservedStock puts the reservation's units back into the franchise's stock and
+// closes the reservation with status
+func returnReservedStock(tx *gorm.DB, reservation *database.StockReservation, status string, at time.Time, ref InventoryReference) error {
+	orderID := reservation.OrderID
+	ref.OrderID = &orderID
+	if _, err := adjustInventory(tx, reservation.FranchiseID, reservation.ProductID,
+		InventoryMovementReturn, reservation.Quantity, ref); err != nil {
+		return err
+	}
+
+	return tx.Model(reservation).Updates(map[string]interface{}{
+		"status":      status,
+		"released_at": at,
+	}).Error
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"aquahome/database"
 )
@@ -126,6 +127,7 @@ func GetAllSubscriptions(c *gin.Context) {
                         subscriptions.end_date, 
                         subscriptions.next_billing_date, 
                         subscriptions.monthly_rent,
+                        subscriptions.auto_renew,
                         subscriptions.created_at, 
                         subscriptions.updated_at,
                         products.name as product_name, 
@@ -159,9 +161,6 @@ func GetAllSubscriptions(c *gin.Context) {
 		} else {
 			subscriptions[i].RemainingDuration = 0
 		}
-
-		// Set default auto-renew for now (this would normally come from the database)
-		subscriptions[i].AutoRenew = false
 	}
 
 	c.JSON(http.StatusOK, subscriptions)
@@ -202,6 +201,7 @@ func GetMySubscriptions(c *gin.Context) {
                         subscriptions.end_date, 
                         subscriptions.next_billing_date, 
                         subscriptions.monthly_rent,
+                        subscriptions.auto_renew,
                         subscriptions.created_at, 
                         subscriptions.updated_at,
                         products.name as product_name, 
@@ -236,14 +236,33 @@ func GetMySubscriptions(c *gin.Context) {
 		} else {
 			subscriptions[i].RemainingDuration = 0
 		}
-
-		// Set default auto-renew for now (this would normally come from the database)
-		subscriptions[i].AutoRenew = false
 	}
 
 	c.JSON(http.StatusOK, subscriptions)
 }
 
+// scopeSubscriptionsForRole limits a subscriptions query to the rows the caller may see.
+// Service agents see the subscriptions assigned to them and those they have a service
+// request for. It returns false for roles that cannot see subscriptions at all.
+func scopeSubscriptionsForRole(query *gorm.DB, role interface{}, userID uint) (*gorm.DB, bool) {
+	switch role {
+	case RoleAdmin:
+		// Admin can view any subscription
+		return query, true
+	case RoleFranchiseOwner:
+		return query.Joins("JOIN franchises ON subscriptions.franchise_id = franchises.id").
+			Where("franchises.owner_id = ?", userID), true
+	case RoleServiceAgent:
+		return query.Where("(subscriptions.service_agent_id = ? OR EXISTS (?))", userID,
+			database.DB.Model(&database.ServiceRequest{}).Select("1").
+				Where("service_requests.subscription_id = subscriptions.id AND service_requests.service_agent_id = ?", userID)), true
+	case RoleCustomer:
+		return query.Where("subscriptions.customer_id = ?", userID), true
+	default:
+		return nil, false
+	}
+}
+
 // GetSubscriptionDetails gets detailed information for a specific subscription
 func GetSubscriptionDetails(c *gin.Context) {
 	subscriptionID := c.Param("id")
@@ -253,43 +272,29 @@ func GetSubscriptionDetails(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	userIDUint, err := strconv.ParseUint(userID, 10, 64)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	role, _ := c.Get("role")
+	userIDValue, _ := c.Get("user_id")
+	userIDUint, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	role := c.GetString("role")
-
 	// Check if the user has permission to view this subscription
-	var count int64
-	switch role {
-	case database.RoleAdmin:
-		// Admin can view any subscription
-		database.DB.Model(&database.Subscription{}).Where("id = ?", subscriptionIDUint).Count(&count)
-	case database.RoleFranchiseOwner:
-		// Check if subscription belongs to this franchise owner
-		database.DB.Model(&database.Subscription{}).
-			Joins("JOIN franchises ON subscriptions.franchise_id = franchises.id").
-			Where("subscriptions.id = ? AND franchises.owner_id = ?", subscriptionIDUint, userIDUint).
-			Count(&count)
-	case database.RoleServiceAgent:
-		// Service agents can view subscriptions they're assigned to
-		database.DB.Model(&database.Subscription{}).
-			Where("id = ? AND service_agent_id = ?", subscriptionIDUint, userIDUint).
-			Count(&count)
-	case database.RoleCustomer:
-		// Customer can only view their own subscriptions
-		database.DB.Model(&database.Subscription{}).
-			Where("id = ? AND customer_id = ?", subscriptionIDUint, userIDUint).
-			Count(&count)
-	default:
+	query, ok := scopeSubscriptionsForRole(
+		database.DB.Model(&database.Subscription{}).Where("subscriptions.id = ?", subscriptionIDUint), role, userIDUint)
+	if !ok {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid role"})
 		return
 	}
 
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
 	if count == 0 {
 		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this subscription"})
 		return
@@ -310,6 +315,7 @@ func GetSubscriptionDetails(c *gin.Context) {
                         subscriptions.end_date, 
                         subscriptions.next_billing_date, 
                         subscriptions.monthly_rent,
+                        subscriptions.auto_renew,
                         subscriptions.created_at, 
                         subscriptions.updated_at,
                         products.name as product_name, 
@@ -354,9 +360,6 @@ func GetSubscriptionDetails(c *gin.Context) {
 		subscriptionDetail.RemainingDuration = 0
 	}
 
-	// Set default auto-renew for now (this would normally come from the database)
-	subscriptionDetail.AutoRenew = false
-
 	// Fetch service history
 	var serviceHistory []ServiceHistory
 	err = database.DB.Table("service_requests").
@@ -468,6 +471,7 @@ func GetFranchiseSubscriptions(c *gin.Context) {
                         subscriptions.end_date, 
                         subscriptions.next_billing_date, 
                         subscriptions.monthly_rent,
+                        subscriptions.auto_renew,
                         subscriptions.created_at, 
                         subscriptions.updated_at,
                         products.name as product_name, 
@@ -511,15 +515,13 @@ func GetFranchiseSubscriptions(c *gin.Context) {
 		} else {
 			subscriptions[i].RemainingDuration = 0
 		}
-
-		// Set default auto-renew
-		subscriptions[i].AutoRenew = false
 	}
 
 	c.JSON(http.StatusOK, subscriptions)
 }
 
-// UpdateSubscription updates a subscription
+// UpdateSubscription updates a subscription. Admins and franchise owners can pause and
+// resume it; anyone with access to it can turn auto-renewal on or off.
 func UpdateSubscription(c *gin.Context) {
 	subscriptionID := c.Param("id")
 	subscriptionIDUint, err := strconv.ParseUint(subscriptionID, 10, 64)
@@ -534,11 +536,10 @@ func UpdateSubscription(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	userIDUint, err := strconv.ParseUint(userID, 10, 64)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userIDValue, _ := c.Get("user_id")
+	userIDUint, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
@@ -586,12 +587,31 @@ func UpdateSubscription(c *gin.Context) {
 		return
 	}
 
+	// Lock the subscription so concurrent pauses and resumes are prorated only once
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, subscription.ID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
 	// Update subscription fields
 	updates := map[string]interface{}{}
+	var proration *Proration
 
 	// Status can be updated by admin or franchise owner
 	if updateRequest.Status != "" && (role == database.RoleAdmin || role == database.RoleFranchiseOwner) {
-		if updateRequest.Status == database.SubscriptionStatusPaused {
+		pausing := updateRequest.Status == database.SubscriptionStatusPaused &&
+			subscription.Status == database.SubscriptionStatusActive
+		resuming := updateRequest.Status == database.SubscriptionStatusActive &&
+			subscription.Status == database.SubscriptionStatusPaused
+		if !pausing && !resuming {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only active subscriptions can be paused and only paused ones resumed"})
+			return
+		}
+
+		if pausing {
 			// If pausing, require a pause end date
 			if updateRequest.PauseEndDate == "" {
 				tx.Rollback()
@@ -612,10 +632,35 @@ func UpdateSubscription(c *gin.Context) {
 			newEndDate := subscription.EndDate.Add(pauseDuration)
 
 			updates["end_date"] = newEndDate
-		} else if updateRequest.Status == database.SubscriptionStatusActive &&
-			subscription.Status == database.SubscriptionStatusPaused {
+
+			// Credit the rest of a billing period the customer has already been charged for
+			result, _, err := prorateSubscription(tx, &subscription, ProrationEventPause, now, 0)
+			if err != nil {
+				tx.Rollback()
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prorate subscription"})
+				return
+			}
+			proration = &result
+		} else {
 			// If resuming from pause, recalculate end date
 			// This would normally consider how long it was paused
+
+			// Periods that started during the pause are not billed
+			now := time.Now()
+			if subscription.NextBillingDate.Before(now) {
+				updates["next_billing_date"] = nextBillingDateAfter(subscription.StartDate, now)
+			}
+
+			// Charge for the rest of the current billing period
+			result, _, err := prorateSubscription(tx, &subscription, ProrationEventResume, now, 0)
+			if err != nil {
+				tx.Rollback()
+				log.Printf("Database error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prorate subscription"})
+				return
+			}
+			proration = &result
 		}
 
 		updates["status"] = updateRequest.Status
@@ -679,7 +724,8 @@ func UpdateSubscription(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Subscription updated successfully",
+		"message":   "Subscription updated successfully",
+		"proration": proration,
 	})
 }
 
@@ -692,11 +738,10 @@ func CancelSubscription(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	userIDUint, err := strconv.ParseUint(userID, 10, 64)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+	userIDValue, _ := c.Get("user_id")
+	userIDUint, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
@@ -722,6 +767,34 @@ func CancelSubscription(c *gin.Context) {
 		return
 	}
 
+	// Lock the subscription so a retried cancellation is credited and collected only once
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, subscription.ID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if subscription.Status != database.SubscriptionStatusActive &&
+		subscription.Status != database.SubscriptionStatusPaused &&
+		subscription.Status != database.SubscriptionStatusSuspended {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is already " + subscription.Status})
+		return
+	}
+
+	// Credit the unused part of a billing period the customer has already been charged for
+	var proration *Proration
+	if subscription.Status == database.SubscriptionStatusActive || subscription.Status == database.SubscriptionStatusSuspended {
+		result, _, err := prorateSubscription(tx, &subscription, ProrationEventCancellation, time.Now(), 0)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prorate subscription"})
+			return
+		}
+		proration = &result
+	}
+
 	// Update subscription status
 	if err := tx.Model(&subscription).Update("status", database.SubscriptionStatusCancelled).Error; err != nil {
 		tx.Rollback()
@@ -730,9 +803,17 @@ func CancelSubscription(c *gin.Context) {
 		return
 	}
 
+	// Arrange collection of the unit at the customer's home
+	if _, err := collectSubscriptionUnit(tx, &subscription, "Collect the device after the subscription was cancelled"); err != nil {
+		tx.Rollback()
+		log.Printf("Error creating pickup request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel subscription"})
+		return
+	}
+
 	// Create notification for customer
 	customerNotification := database.Notification{
-		UserID:      uint(userIDUint),
+		UserID:      userIDUint,
 		Title:       "Subscription Cancelled",
 		Message:     "Your subscription has been cancelled.",
 		Type:        "subscription",
@@ -780,7 +861,8 @@ func CancelSubscription(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Subscription cancelled successfully",
+		"message":   "Subscription cancelled successfully",
+		"proration": proration,
 	})
 }
 
@@ -850,6 +932,7 @@ func GetCustomerSubscriptionsByAdmin(c *gin.Context) {
 			subscriptions.end_date, 
 			subscriptions.next_billing_date, 
 			subscriptions.monthly_rent,
+			subscriptions.auto_renew,
 			subscriptions.created_at, 
 			subscriptions.updated_at,
 			products.name as product_name, 
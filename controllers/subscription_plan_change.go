@@ -0,0 +1,450 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/database"
+)
+
+// ChangeProductRequest contains data for moving a subscription to another product
+type ChangeProductRequest struct {
+	ProductID uint `json:"product_id" binding:"required"`
+	// RFC3339 date the device swap is booked for; defaults to now. The new rent applies
+	// from when the swap is completed.
+	EffectiveDate string `json:"effective_date"`
+	Notes         string `json:"notes"`
+}
+
+// ChangeSubscriptionProduct requests an upgrade or downgrade of a subscription to another
+// product and raises the device swap. The change takes effect when the swap is completed
+// (Customer only)
+func ChangeSubscriptionProduct(c *gin.Context) {
+	subscriptionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	var request ChangeProductRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Begin transaction
+	tx := database.DB.Begin()
+	if tx.Error != nil {
+		log.Printf("Transaction error: %v", tx.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Lock the subscription so billing and other changes see a consistent product and rent
+	var subscription database.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND customer_id = ?", subscriptionID, userID).
+		First(&subscription).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or doesn't belong to you"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if subscription.Status != SubscriptionStatusActive {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only active subscriptions can change product"})
+		return
+	}
+	if request.ProductID == subscription.ProductID {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is already on this product"})
+		return
+	}
+
+	var pendingChanges int64
+	if err := tx.Model(&database.SubscriptionPlanChange{}).
+		Where("subscription_id = ? AND status = ?", subscription.ID, PlanChangePending).
+		Count(&pendingChanges).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if pendingChanges > 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "A product change is already waiting for its device swap"})
+		return
+	}
+
+	now := time.Now()
+	effectiveDate := now
+	if request.EffectiveDate != "" {
+		effectiveDate, err = time.Parse(time.RFC3339, request.EffectiveDate)
+		if err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid effective date format"})
+			return
+		}
+		if effectiveDate.Before(now) {
+			effectiveDate = now
+		}
+	}
+
+	var product database.Product
+	if err := tx.First(&product, request.ProductID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if !product.IsActive {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not available"})
+		return
+	}
+	// The replacement unit comes out of the franchise's stock of the new product
+	subscriptionOrderID := subscription.OrderID
+	if _, err := adjustInventory(tx, subscription.FranchiseID, product.ID, InventoryMovementAllocation, -1, InventoryReference{
+		OrderID:   &subscriptionOrderID,
+		ActorRole: RoleCustomer,
+		ActorID:   &userID,
+		Notes:     fmt.Sprintf("Product change on subscription #%d", subscription.ID),
+	}); err != nil {
+		tx.Rollback()
+		if errors.Is(err, ErrOutOfStock) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not in stock at your franchise"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	var currentProduct database.Product
+	if err := tx.Unscoped().Select("id, name").First(&currentProduct, subscription.ProductID).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	oldDeposit, err := subscriptionSecurityDeposit(tx, &subscription)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	serviceRequest := database.ServiceRequest{
+		CustomerID:     subscription.CustomerID,
+		SubscriptionID: subscription.ID,
+		FranchiseID:    subscription.FranchiseID,
+		Type:           ServiceTypeProductSwap,
+		Status:         database.ServiceStatusPending,
+		Description:    fmt.Sprintf("Swap %s for %s", currentProduct.Name, product.Name),
+		ScheduledTime:  &effectiveDate,
+		Notes:          request.Notes,
+	}
+	if err := tx.Create(&serviceRequest).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error creating service request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service request"})
+		return
+	}
+
+	planChange := database.SubscriptionPlanChange{
+		SubscriptionID:     subscription.ID,
+		Status:             PlanChangePending,
+		FromProductID:      subscription.ProductID,
+		ToProductID:        product.ID,
+		OldMonthlyRent:     subscription.MonthlyRent,
+		NewMonthlyRent:     product.MonthlyRent,
+		OldSecurityDeposit: oldDeposit,
+		NewSecurityDeposit: product.SecurityDeposit,
+		EffectiveDate:      effectiveDate,
+		ServiceRequestID:   &serviceRequest.ID,
+		RequestedByID:      &userID,
+		Notes:              request.Notes,
+	}
+	if err := tx.Create(&planChange).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record plan change"})
+		return
+	}
+
+	customerNotification := database.Notification{
+		UserID: subscription.CustomerID,
+		Title:  "Plan Change Requested",
+		Message: fmt.Sprintf("A technician will swap your device for %s on or after %s. Your subscription moves to ₹%.2f per month once the swap is done.",
+			product.Name, effectiveDate.Format("02 Jan 2006"), product.MonthlyRent),
+		Type:        "subscription",
+		RelatedID:   &subscription.ID,
+		RelatedType: "subscription",
+	}
+	if err := tx.Create(&customerNotification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error creating customer notification: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notification"})
+		return
+	}
+
+	var franchise database.Franchise
+	if err := tx.Select("id, owner_id").First(&franchise, subscription.FranchiseID).Error; err == nil && franchise.OwnerID != 0 {
+		franchiseNotification := database.Notification{
+			UserID:      franchise.OwnerID,
+			Title:       "Product Swap Requested",
+			Message:     fmt.Sprintf("A customer has switched from %s to %s. Please schedule the swap.", currentProduct.Name, product.Name),
+			Type:        "service_request",
+			RelatedID:   &serviceRequest.ID,
+			RelatedType: "service_request",
+		}
+		if err := tx.Create(&franchiseNotification).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error creating franchise notification: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notification"})
+			return
+		}
+	}
+
+	// Commit transaction
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change product"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Product change requested. It takes effect when the device is swapped.",
+		"plan_change":     planChange,
+		"service_request": serviceRequest,
+	})
+}
+
+// GetSubscriptionPlanChanges returns the product changes made on a subscription, oldest first
+func GetSubscriptionPlanChanges(c *gin.Context) {
+	subscriptionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	role, _ := c.Get("role")
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	query, ok := scopeSubscriptionsForRole(
+		database.DB.Model(&database.Subscription{}).Where("subscriptions.id = ?", subscriptionID), role, userID)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or you don't have permission to view it"})
+		return
+	}
+
+	var planChanges []database.SubscriptionPlanChange
+	if err := database.DB.
+		Preload("FromProduct", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Preload("ToProduct", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id, name") }).
+		Where("subscription_id = ?", subscriptionID).
+		Order("created_at ASC").
+		Find(&planChanges).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch plan changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, planChanges)
+}
+
+// subscriptionSecurityDeposit returns the security deposit currently required for
+// subscription: the one set by its latest applied plan change, or else the order's
+func subscriptionSecurityDeposit(tx *gorm.DB, subscription *database.Subscription) (float64, error) {
+	var latest database.SubscriptionPlanChange
+	err := tx.Where("subscription_id = ? AND status = ?", subscription.ID, PlanChangeApplied).
+		Order("created_at DESC").
+		First(&latest).Error
+	if err == nil {
+		return latest.NewSecurityDeposit, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	var order database.Order
+	if err := tx.Select("id, security_deposit").First(&order, subscription.OrderID).Error; err != nil {
+		return 0, err
+	}
+	return order.SecurityDeposit, nil
+}
+
+// recordDepositChange records the difference between two security deposits as a deposit
+// top-up or credit for the next monthly invoice. It returns nil when they are equal.
+func recordDepositChange(tx *gorm.DB, subscription *database.Subscription, oldDeposit, newDeposit float64, productName string) (*database.Payment, error) {
+	difference := roundAmount(newDeposit - oldDeposit)
+	if math.Abs(difference) < 0.01 {
+		return nil, nil
+	}
+
+	paymentType := PaymentTypeDepositTopUp
+	description := "Security deposit top-up"
+	if difference < 0 {
+		paymentType = PaymentTypeDepositCredit
+		description = "Security deposit returned"
+	}
+
+	subscriptionID := subscription.ID
+	orderID := subscription.OrderID
+	entry := database.Payment{
+		CustomerID:     subscription.CustomerID,
+		OrderID:        &orderID,
+		SubscriptionID: &subscriptionID,
+		Amount:         math.Abs(difference),
+		PaymentType:    paymentType,
+		Status:         database.PaymentStatusPending,
+		Notes:          fmt.Sprintf("%s for %s", description, productName),
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// lockPendingPlanChange returns the pending plan change whose device swap is the given
+// service request, locked for update, or nil when there is none
+func lockPendingPlanChange(tx *gorm.DB, serviceRequestID uint) (*database.SubscriptionPlanChange, error) {
+	var planChange database.SubscriptionPlanChange
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("service_request_id = ? AND status = ?", serviceRequestID, PlanChangePending).
+		First(&planChange).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &planChange, nil
+}
+
+// applyPlanChange moves a locked subscription to the product of the plan change whose
+// device swap was completed at the given time. The rent difference for the rest of the
+// billing period and the deposit difference are recorded for the next monthly invoice.
+func applyPlanChange(tx *gorm.DB, serviceRequestID uint, subscription *database.Subscription, at time.Time) error {
+	planChange, err := lockPendingPlanChange(tx, serviceRequestID)
+	if err != nil || planChange == nil {
+		return err
+	}
+
+	var product database.Product
+	if err := tx.Unscoped().Select("id, name").First(&product, planChange.ToProductID).Error; err != nil {
+		return err
+	}
+
+	oldDeposit, err := subscriptionSecurityDeposit(tx, subscription)
+	if err != nil {
+		return err
+	}
+	updates := map[string]interface{}{
+		"status":               PlanChangeApplied,
+		"effective_date":       at,
+		"old_monthly_rent":     subscription.MonthlyRent,
+		"old_security_deposit": oldDeposit,
+	}
+
+	// Charge or credit the rent difference for the rest of the billing period
+	_, prorationEntry, err := prorateSubscription(tx, subscription, ProrationEventPlanChange, at, planChange.NewMonthlyRent)
+	if err != nil {
+		return err
+	}
+	if prorationEntry != nil {
+		updates["proration_id"] = prorationEntry.ID
+	}
+
+	// The deposit difference is collected or returned with the next monthly invoice
+	depositEntry, err := recordDepositChange(tx, subscription, oldDeposit, planChange.NewSecurityDeposit, product.Name)
+	if err != nil {
+		return err
+	}
+	if depositEntry != nil {
+		updates["deposit_change_id"] = depositEntry.ID
+	}
+
+	if err := tx.Model(planChange).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	// Later periods are billed at the new product's rent
+	subscription.ProductID = planChange.ToProductID
+	subscription.MonthlyRent = planChange.NewMonthlyRent
+	return tx.Model(subscription).Updates(map[string]interface{}{
+		"product_id":   subscription.ProductID,
+		"monthly_rent": subscription.MonthlyRent,
+	}).Error
+}
+
+// cancelPlanChange drops the plan change whose device swap was cancelled. The subscription
+// keeps its product and the unit set aside for the swap goes back into stock.
+func cancelPlanChange(tx *gorm.DB, request *database.ServiceRequest, actorRole string, actorID *uint) error {
+	planChange, err := lockPendingPlanChange(tx, request.ID)
+	if err != nil || planChange == nil {
+		return err
+	}
+
+	if err := tx.Model(planChange).Update("status", PlanChangeCancelled).Error; err != nil {
+		return err
+	}
+
+	var subscription database.Subscription
+	if err := tx.Select("id, order_id, franchise_id").First(&subscription, planChange.SubscriptionID).Error; err != nil {
+		return err
+	}
+	orderID, requestID := subscription.OrderID, request.ID
+	_, err = adjustInventory(tx, subscription.FranchiseID, planChange.ToProductID, InventoryMovementReturn, 1, InventoryReference{
+		OrderID:          &orderID,
+		ServiceRequestID: &requestID,
+		ActorRole:        actorRole,
+		ActorID:          actorID,
+		Notes:            fmt.Sprintf("Product change on subscription #%d cancelled", subscription.ID),
+	})
+	return err
+}
@@ -348,18 +348,22 @@ func UpdateUserLocation(c *gin.Context) {
 	})
 }
 
-// GetServiceAgentsForFranchise lists all service agents for franchise owners
+// GetServiceAgentsForFranchise lists the service agents of the caller's franchise with the
+// membership status in ?status, active by default (Admin or Franchise Owner only)
 func GetServiceAgentsForFranchise(c *gin.Context) {
-	role, _ := c.Get("role")
-	if role != "franchise_owner" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+	franchiseID, ok := managedFranchiseID(c)
+	if !ok {
 		return
 	}
 
+	query := database.DB.
+		Joins("JOIN franchise_agents ON franchise_agents.agent_id = users.id AND franchise_agents.deleted_at IS NULL").
+		Where("franchise_agents.franchise_id = ? AND franchise_agents.status = ? AND users.role = ?",
+			franchiseID, c.DefaultQuery("status", FranchiseAgentActive), "service_agent")
+
 	var agents []database.User
-	if err := database.DB.
-		Where("role = ?", "service_agent").
-		Find(&agents).Error; err != nil {
+	if err := query.Order("users.name ASC").Find(&agents).Error; err != nil {
+		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch service agents"})
 		return
 	}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"aquahome/config"
+	"aquahome/database"
+	"aquahome/utils"
+)
+
+// ErrVisitUnverified is returned when an installation or service visit is closed before
+// the customer's code was entered or an admin waived it
+var ErrVisitUnverified = errors.New("the visit has not been verified by the customer")
+
+// ErrVisitCodeLimit is returned when no more codes may be sent for a visit
+var ErrVisitCodeLimit = errors.New("too many visit codes have been sent")
+
+// VisitCodeError explains why a visit code was not accepted
+type VisitCodeError struct {
+	Code              string `json:"code"`
+	Error             string `json:"error"`
+	AttemptsRemaining int    `json:"attempts_remaining"`
+}
+
+// visitCodeLength is the number of digits in a visit code
+const visitCodeLength = 6
+
+// generateVisitCode returns a random numeric visit code
+func generateVisitCode() (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < visitCodeLength; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", visitCodeLength, n), nil
+}
+
+// visitSubjectLabel describes an order or service request for customer messages
+func visitSubjectLabel(subjectType string, subjectID uint) string {
+	if subjectType == VisitSubjectOrder {
+		return fmt.Sprintf("the installation for order #%d", subjectID)
+	}
+	return fmt.Sprintf("service request #%d", subjectID)
+}
+
+// lockVisitVerification returns the verification of an order or service request locked
+// for update, or nil when no code has been sent for it
+func lockVisitVerification(tx *gorm.DB, subjectType string, subjectID uint) (*database.VisitVerification, error) {
+	var verification database.VisitVerification
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("subject_type = ? AND subject_id = ?", subjectType, subjectID).
+		First(&verification).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &verification, nil
+}
+
+// issueVisitCode sends the customer a new code for a visit, replacing any earlier one,
+// through their notifications. A visit that is already verified keeps its verification.
+// Returns ErrVisitCodeLimit once the configured number of codes has been sent.
+func issueVisitCode(tx *gorm.DB, subjectType string, subjectID, customerID uint, issuedByID *uint) (*database.VisitVerification, error) {
+	verification, err := lockVisitVerification(tx, subjectType, subjectID)
+	if err != nil {
+		return nil, err
+	}
+	if verification == nil {
+		verification = &database.VisitVerification{SubjectType: subjectType, SubjectID: subjectID}
+	}
+	if verification.VerifiedAt != nil {
+		return verification, nil
+	}
+	if verification.IssueCount >= config.AppConfig.VisitCodeMaxIssues {
+		return nil, ErrVisitCodeLimit
+	}
+
+	code, err := generateVisitCode()
+	if err != nil {
+		return nil, err
+	}
+	codeHash, err := utils.HashPassword(code)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Duration(config.AppConfig.VisitCodeExpiryMinutes) * time.Minute
+	verification.CustomerID = customerID
+	verification.CodeHash = codeHash
+	verification.ExpiresAt = time.Now().Add(expiry)
+	verification.Attempts = 0
+	verification.IssueCount++
+	verification.IssuedByID = issuedByID
+	if err := tx.Save(verification).Error; err != nil {
+		return nil, err
+	}
+
+	notification := database.Notification{
+		UserID:      customerID,
+		Title:       "Visit Verification Code",
+		Message:     fmt.Sprintf("Your code for %s is %s. Share it with the agent only once the work is done. It expires in %d minutes.", visitSubjectLabel(subjectType, subjectID), code, config.AppConfig.VisitCodeExpiryMinutes),
+		Type:        subjectType,
+		RelatedID:   &subjectID,
+		RelatedType: subjectType,
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+// checkVisitCode records an attempt at entering the code of a locked verification and
+// marks the visit verified when it matches. The attempt is counted even when the code
+// is wrong, so the caller must commit either way.
+func checkVisitCode(tx *gorm.DB, verification *database.VisitVerification, code string, now time.Time) (*VisitCodeError, error) {
+	maxAttempts := config.AppConfig.VisitCodeMaxAttempts
+	if verification.Attempts >= maxAttempts {
+		return &VisitCodeError{Code: "visit_code_locked", Error: "Too many wrong codes. Send the customer a new code."}, nil
+	}
+	if now.After(verification.ExpiresAt) {
+		return &VisitCodeError{Code: "visit_code_expired", Error: "The code has expired. Send the customer a new code."}, nil
+	}
+
+	if !utils.CheckPasswordHash(code, verification.CodeHash) {
+		verification.Attempts++
+		if err := tx.Model(verification).Update("attempts", verification.Attempts).Error; err != nil {
+			return nil, err
+		}
+		return &VisitCodeError{
+			Code:              "visit_code_invalid",
+			Error:             "The code is incorrect",
+			AttemptsRemaining: maxAttempts - verification.Attempts,
+		}, nil
+	}
+
+	verification.VerifiedAt = &now
+	if err := tx.Model(verification).Update("verified_at", now).Error; err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// isVisitVerified reports whether the customer's code was entered for an order or
+// service request, or an admin waived it
+func isVisitVerified(db *gorm.DB, subjectType string, subjectID uint) (bool, error) {
+	var count int64
+	err := db.Model(&database.VisitVerification{}).
+		Where("subject_type = ? AND subject_id = ? AND verified_at IS NOT NULL", subjectType, subjectID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// requireVerifiedVisit returns ErrVisitUnverified unless the visit is verified
+func requireVerifiedVisit(db *gorm.DB, subjectType string, subjectID uint) error {
+	verified, err := isVisitVerified(db, subjectType, subjectID)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrVisitUnverified
+	}
+	return nil
+}
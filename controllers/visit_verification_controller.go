@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"aquahome/database"
+)
+
+// VerifyVisitRequest contains the code the customer gave the agent
+type VerifyVisitRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// OverrideVisitRequest contains an admin's reason for waiving a visit code
+type OverrideVisitRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// visitSubject is the order or service request a visit code belongs to
+type visitSubject struct {
+	ID         uint
+	CustomerID uint
+	Status     string
+}
+
+// respondVisitUnverified tells the caller that the customer's code is needed first
+func respondVisitUnverified(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "Enter the code sent to the customer, or ask an admin to override it, before closing the visit",
+		"code":  "visit_unverified",
+	})
+}
+
+// loadVisitSubject returns the order or service request in the :id path parameter when
+// the caller is an admin, owns the franchise serving it or is the agent assigned to it
+func loadVisitSubject(c *gin.Context, subjectType string) (*visitSubject, bool) {
+	subjectID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return nil, false
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	userID, ok := userIDValue.(uint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	var query *gorm.DB
+	notFound := "Service request not found"
+	if subjectType == VisitSubjectOrder {
+		notFound = "Order not found"
+		query = database.DB.Model(&database.Order{}).
+			Select("orders.id, orders.customer_id, orders.status").
+			Where("orders.id = ?", subjectID)
+		switch c.GetString("role") {
+		case RoleAdmin:
+		case RoleFranchiseOwner:
+			query = query.Joins("JOIN franchises ON orders.franchise_id = franchises.id").
+				Where("franchises.owner_id = ?", userID)
+		case RoleServiceAgent:
+			query = query.Where("orders.service_agent_id = ?", userID)
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return nil, false
+		}
+	} else {
+		query = database.DB.Model(&database.ServiceRequest{}).
+			Select("service_requests.id, service_requests.customer_id, service_requests.status").
+			Where("service_requests.id = ?", subjectID)
+		switch c.GetString("role") {
+		case RoleAdmin:
+		case RoleFranchiseOwner:
+			query = query.
+				Joins("JOIN subscriptions ON service_requests.subscription_id = subscriptions.id").
+				Joins("JOIN franchises ON subscriptions.franchise_id = franchises.id").
+				Where("franchises.owner_id = ?", userID)
+		case RoleServiceAgent:
+			query = query.Where("service_requests.service_agent_id = ?", userID)
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return nil, false
+		}
+	}
+
+	var subject visitSubject
+	if err := query.Scan(&subject).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return nil, false
+	}
+	if subject.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return nil, false
+	}
+	return &subject, true
+}
+
+// sendVisitCode sends the customer a new code for the visit of an order or service
+// request whose visit has started
+func sendVisitCode(c *gin.Context, subjectType string) {
+	subject, ok := loadVisitSubject(c, subjectType)
+	if !ok {
+		return
+	}
+
+	started := subject.Status == ServiceStatusInProgress
+	if subjectType == VisitSubjectOrder {
+		started = subject.Status == OrderStatusInTransit || subject.Status == OrderStatusDelivered
+	}
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "The visit has not started"})
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	actorID, _ := userIDValue.(uint)
+
+	tx := database.DB.Begin()
+
+	verification, err := issueVisitCode(tx, subjectType, subject.ID, subject.CustomerID, &actorID)
+	if errors.Is(err, ErrVisitCodeLimit) {
+		tx.Rollback()
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "No more codes can be sent for this visit. Ask an admin to override the verification.",
+			"code":  "visit_code_limit",
+		})
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error sending visit code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send visit code"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if verification.VerifiedAt != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "The visit is already verified", "verification": verification})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification code sent to the customer", "verification": verification})
+}
+
+// verifyVisit checks the code the customer gave the agent for the visit of an order or
+// service request. Wrong attempts are recorded even though the code is rejected.
+func verifyVisit(c *gin.Context, subjectType string) {
+	var request VerifyVisitRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	subject, ok := loadVisitSubject(c, subjectType)
+	if !ok {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	verification, err := lockVisitVerification(tx, subjectType, subject.ID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if verification == nil {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "No code has been sent for this visit", "code": "visit_code_not_sent"})
+		return
+	}
+	if verification.VerifiedAt != nil {
+		tx.Rollback()
+		c.JSON(http.StatusOK, gin.H{"message": "The visit is already verified", "verification": verification})
+		return
+	}
+
+	codeErr, err := checkVisitCode(tx, verification, request.Code, time.Now())
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if codeErr != nil {
+		status := http.StatusConflict
+		if codeErr.Code == "visit_code_invalid" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, codeErr)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Visit verified", "verification": verification})
+}
+
+// overrideVisit lets an admin mark the visit of an order or service request verified
+// without the customer's code. The override is recorded in the audit log.
+func overrideVisit(c *gin.Context, subjectType string) {
+	var request OverrideVisitRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason for the override is required"})
+		return
+	}
+
+	subject, ok := loadVisitSubject(c, subjectType)
+	if !ok {
+		return
+	}
+
+	userIDValue, _ := c.Get("user_id")
+	adminID, _ := userIDValue.(uint)
+
+	tx := database.DB.Begin()
+
+	verification, err := lockVisitVerification(tx, subjectType, subject.ID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if verification == nil {
+		verification = &database.VisitVerification{
+			SubjectType: subjectType,
+			SubjectID:   subject.ID,
+			CustomerID:  subject.CustomerID,
+		}
+	}
+	if verification.VerifiedAt != nil {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "The visit is already verified"})
+		return
+	}
+
+	previous := fmt.Sprintf("unverified; %d code(s) sent, %d wrong attempt(s)", verification.IssueCount, verification.Attempts)
+
+	now := time.Now()
+	verification.VerifiedAt = &now
+	verification.OverriddenByID = &adminID
+	verification.OverrideReason = request.Reason
+	if err := tx.Save(verification).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error overriding verification"})
+		return
+	}
+
+	audit := database.Audit{
+		UserID:     &adminID,
+		Action:     "visit_verification_override",
+		EntityType: subjectType,
+		EntityID:   subject.ID,
+		OldValue:   previous,
+		NewValue:   "verified by admin override: " + request.Reason,
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+	if err := tx.Create(&audit).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error recording audit log"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Visit verification overridden", "verification": verification})
+}
+
+// SendOrderVisitCode sends the customer a new code that confirms an order's
+// installation. A code is sent automatically when the order is delivered (Admin,
+// Franchise Owner or the assigned Service Agent)
+func SendOrderVisitCode(c *gin.Context) {
+	sendVisitCode(c, VisitSubjectOrder)
+}
+
+// VerifyOrderVisit checks the customer's code for an order's installation (Admin,
+// Franchise Owner or the assigned Service Agent)
+func VerifyOrderVisit(c *gin.Context) {
+	verifyVisit(c, VisitSubjectOrder)
+}
+
+// OverrideOrderVisit waives the customer's code for an order's installation (Admin only)
+func OverrideOrderVisit(c *gin.Context) {
+	overrideVisit(c, VisitSubjectOrder)
+}
+
+// SendServiceVisitCode sends the customer a new code that confirms a service visit. A
+// code is sent automatically when the visit starts (Admin, Franchise Owner or the
+// assigned Service Agent)
+func SendServiceVisitCode(c *gin.Context) {
+	sendVisitCode(c, VisitSubjectService)
+}
+
+// VerifyServiceVisit checks the customer's code for a service visit (Admin, Franchise
+// Owner or the assigned Service Agent)
+func VerifyServiceVisit(c *gin.Context) {
+	verifyVisit(c, VisitSubjectService)
+}
+
+// OverrideServiceVisit waives the customer's code for a service visit (Admin only)
+func OverrideServiceVisit(c *gin.Context) {
+	overrideVisit(c, VisitSubjectService)
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // RunMigrations runs all database migrations
@@ -25,15 +26,174 @@ func RunMigrations() error {
 		&PasswordReset{},
 		&Audit{},
 		&AuditLog{},
+		&OrderStatusHistory{},
+		&PaymentWebhookEvent{},
+		&Invoice{},
+		&InvoiceSequence{},
+		&SubscriptionPlanChange{},
+		&ProductComponent{},
+		&InstalledComponent{},
+		&ComponentReplacement{},
+		&Asset{},
+		&AssetStatusHistory{},
+		&StockReservation{},
+		&FranchiseInventory{},
+		&InventoryMovement{},
+		&InventoryTransfer{},
+		&OrderRoutingDecision{},
+		&OrderTriage{},
+		&FranchiseAgent{},
+		&AgentWorkingHours{},
+		&AgentLeave{},
+		&ServiceSlotTemplate{},
+		&AgentSkill{},
+		&ServiceDispatch{},
+		&ServiceSLAPolicy{},
+		&ServiceJobCard{},
+		&JobCardChecklistItem{},
+		&JobCardPart{},
+		&JobCardPhoto{},
+		&VisitVerification{},
 	); err != nil {
 		log.Printf("Migration failed: %v", err)
 		return err
 	}
 
+	if err := MigrateLegacyInvoiceNumbers(); err != nil {
+		log.Printf("Migration failed: %v", err)
+		return err
+	}
+
+	if err := MigrateProductStockToInventory(); err != nil {
+		log.Printf("Migration failed: %v", err)
+		return err
+	}
+
+	if err := MigrateServiceAgentMemberships(); err != nil {
+		log.Printf("Migration failed: %v", err)
+		return err
+	}
+
+	if err := MigrateLocationBounds(); err != nil {
+		log.Printf("Migration failed: %v", err)
+		return err
+	}
+
 	log.Println("Database migrations completed successfully")
 	return nil
 }
 
+// MigrateLegacyInvoiceNumbers moves payments off the old date-based invoice numbers.
+// Numbers on completed payments have already been issued to customers and are kept.
+// Pending and failed payments lose theirs and receive a sequential number when they
+// are paid. Safe to run on every start.
+func MigrateLegacyInvoiceNumbers() error {
+	result := DB.Model(&Payment{}).
+		Where("invoice_number LIKE ? AND status IN ?", "INV-%",
+			[]string{PaymentStatusPending, PaymentStatusFailed}).
+		Update("invoice_number", "")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Released %d legacy invoice numbers from unpaid payments", result.RowsAffected)
+	}
+	return nil
+}
+
+// MigrateProductStockToInventory moves the stock recorded on products into the
+// inventory of the franchise that listed them, with an opening receipt in the ledger.
+// Products that already have franchise inventory are skipped, so it is safe to run on
+// every start.
+func MigrateProductStockToInventory() error {
+	var products []Product
+	if err := DB.Select("id, franchise_id, available_stock").
+		Where("franchise_id <> 0 AND available_stock > 0").
+		Where("NOT EXISTS (SELECT 1 FROM franchise_inventories WHERE franchise_inventories.product_id = products.id)").
+		Find(&products).Error; err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			inventory := FranchiseInventory{
+				FranchiseID: product.FranchiseID,
+				ProductID:   product.ID,
+				Quantity:    product.AvailableStock,
+			}
+			if err := tx.Create(&inventory).Error; err != nil {
+				return err
+			}
+			movement := InventoryMovement{
+				FranchiseID:  product.FranchiseID,
+				ProductID:    product.ID,
+				Type:         InventoryMovementReceipt,
+				Quantity:     product.AvailableStock,
+				BalanceAfter: product.AvailableStock,
+				ActorRole:    "system",
+				Notes:        "Opening balance from product stock",
+			}
+			return tx.Create(&movement).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(products) > 0 {
+		log.Printf("Moved the stock of %d products into franchise inventory", len(products))
+	}
+	return nil
+}
+
+// MigrateServiceAgentMemberships gives every service agent already linked to a franchise
+// through User.FranchiseID an active membership of it. Agents with a membership are
+// skipped, so it is safe to run on every start.
+func MigrateServiceAgentMemberships() error {
+	result := DB.Exec(`INSERT INTO franchise_agents
+		(created_at, updated_at, franchise_id, agent_id, status, invited_at, joined_at)
+		SELECT NOW(), NOW(), users.franchise_id, users.id, ?, users.created_at, users.created_at
+		FROM users
+		WHERE users.role = ? AND users.franchise_id IS NOT NULL AND users.deleted_at IS NULL
+		ON CONFLICT (agent_id) DO NOTHING`, FranchiseAgentActive, RoleServiceAgent)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Created franchise memberships for %d service agents", result.RowsAffected)
+	}
+	return nil
+}
+
+// MigrateLocationBounds stores the bounding box of location boundaries saved before it
+// was kept. Locations that have one are skipped, so it is safe to run on every start.
+func MigrateLocationBounds() error {
+	var locations []Location
+	if err := DB.Select("id, boundary").
+		Where("boundary IS NOT NULL AND min_latitude IS NULL").
+		Find(&locations).Error; err != nil {
+		return err
+	}
+
+	for _, location := range locations {
+		if location.Boundary == nil {
+			continue
+		}
+		minLatitude, maxLatitude, minLongitude, maxLongitude := location.Boundary.Bounds()
+		if err := DB.Model(&Location{}).Where("id = ?", location.ID).Updates(map[string]interface{}{
+			"min_latitude":  minLatitude,
+			"max_latitude":  maxLatitude,
+			"min_longitude": minLongitude,
+			"max_longitude": maxLongitude,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	if len(locations) > 0 {
+		log.Printf("Stored the bounding box of %d location boundaries", len(locations))
+	}
+	return nil
+}
+
 // SeedDefaultAdmin creates a default admin if none exists
 func SeedDefaultAdmin() {
 	var count int64
@@ -37,10 +37,10 @@ type Product struct {
 	ImageURL         string    `json:"image_url"`
 	Features         string    `json:"features"`
 	Specifications   string    `json:"specifications"`
-	AvailableStock   int       `json:"available_stock"`
+	AvailableStock   int       `json:"available_stock"` // Total across franchises, see FranchiseInventory
 	MaintenanceCycle int       `json:"maintenance_cycle"`
 	IsActive         bool      `json:"is_active" gorm:"column:is_active"` // ED THIS
-	FranchiseID      uint      `json:"franchise_id"`                      // ✅ NEW
+	FranchiseID      uint      `json:"franchise_id"`                      // Franchise that listed the product
 	Franchise        Franchise `gorm:"foreignKey:FranchiseID" json:"franchise"`
 }
 
@@ -57,8 +57,12 @@ type Franchise struct {
 	Email          string  `json:"email"`
 	IsActive       bool    `json:"is_active"`
 	ServiceArea    string  `json:"service_area"`
-	CoverageRadius float64 `json:"coverage_radius"`
+	CoverageRadius float64 `json:"coverage_radius"` // Kilometres around Latitude/Longitude
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
 	ApprovalState  string  `json:"approval_state"`
+	GSTIN          string  `gorm:"size:15" json:"gstin"`
+	Code           string  `gorm:"size:10;uniqueIndex:idx_franchises_code,where:code <> ''" json:"code"` // Short code used as the invoice number prefix, e.g. HYD01
 
 	Owner User `gorm:"foreignKey:OwnerID" json:"owner"`
 
@@ -72,7 +76,13 @@ type Location struct {
 	Name       string         `json:"name"`
 	ZipCodes   pq.StringArray `gorm:"type:text[]" json:"zip_codes"` // comma-separated ZIPs
 	IsActive   bool           `json:"is_active"`
+	Boundary   *GeoPolygon    `gorm:"type:jsonb" json:"boundary"` // Optional service-area outline
 	Franchises []Franchise    `gorm:"many2many:franchise_locations;" json:"franchises"`
+	// Bounding box of Boundary, kept with it to narrow point-in-boundary lookups
+	MinLatitude  *float64 `gorm:"index:idx_locations_bounds" json:"-"`
+	MaxLatitude  *float64 `gorm:"index:idx_locations_bounds" json:"-"`
+	MinLongitude *float64 `gorm:"index:idx_locations_bounds" json:"-"`
+	MaxLongitude *float64 `gorm:"index:idx_locations_bounds" json:"-"`
 }
 
 // FranchiseLocation is the join table for many-to-many Franchise ↔ Location
@@ -125,30 +135,46 @@ type Subscription struct {
 	NextMaintenance  time.Time `json:"next_maintenance"`
 	MaintenanceNotes string    `json:"maintenance_notes"`
 	Notes            string    `json:"notes"`
-	Order            Order     `gorm:"foreignKey:OrderID" json:"order"`
-	Customer         User      `gorm:"foreignKey:CustomerID" json:"customer"`
-	Product          Product   `gorm:"foreignKey:ProductID" json:"product"`
-	Franchise        Franchise `gorm:"foreignKey:FranchiseID" json:"franchise"`
-	ServiceAgent     *User     `gorm:"foreignKey:ServiceAgentID" json:"service_agent"`
+	// Renew for another Order.RentalDuration at the end of the term instead of expiring
+	AutoRenew        bool       `gorm:"default:false" json:"auto_renew"`
+	RenewalCount     int        `json:"renewal_count"`
+	RenewalNoticedAt *time.Time `json:"renewal_noticed_at"`
+	Order            Order      `gorm:"foreignKey:OrderID" json:"order"`
+	Customer         User       `gorm:"foreignKey:CustomerID" json:"customer"`
+	Product          Product    `gorm:"foreignKey:ProductID" json:"product"`
+	Franchise        Franchise  `gorm:"foreignKey:FranchiseID" json:"franchise"`
+	ServiceAgent     *User      `gorm:"foreignKey:ServiceAgentID" json:"service_agent"`
+	// Product upgrades and downgrades, oldest first
+	PlanChanges []SubscriptionPlanChange `gorm:"foreignKey:SubscriptionID" json:"plan_changes,omitempty"`
 }
 
 // Payment represents a payment made in the system
 type Payment struct {
 	gorm.Model
-	CustomerID     uint          `json:"customer_id"`
-	OrderID        *uint         `json:"order_id"`
-	SubscriptionID *uint         `json:"subscription_id"`
-	Amount         float64       `json:"amount"`
-	PaymentType    string        `json:"payment_type"`
-	Status         string        `json:"status"`
-	InvoiceNumber  string        `json:"invoice_number"`
-	PaymentMethod  string        `json:"payment_method"`
-	TransactionID  string        `json:"transaction_id"`
-	PaymentDetails string        `json:"payment_details"`
-	Notes          string        `json:"notes"`
-	Customer       User          `gorm:"foreignKey:CustomerID" json:"customer"`
-	Order          *Order        `gorm:"foreignKey:OrderID" json:"order"`
-	Subscription   *Subscription `gorm:"foreignKey:SubscriptionID" json:"subscription"`
+	CustomerID     uint    `json:"customer_id"`
+	OrderID        *uint   `json:"order_id"`
+	SubscriptionID *uint   `gorm:"uniqueIndex:idx_payments_subscription_period" json:"subscription_id"`
+	Amount         float64 `json:"amount"`
+	PaymentType    string  `json:"payment_type"`
+	Status         string  `json:"status"`
+	InvoiceNumber  string  `json:"invoice_number"`
+	PaymentMethod  string  `json:"payment_method"`
+	TransactionID  string  `json:"transaction_id"`
+	PaymentDetails string  `json:"payment_details"`
+	Notes          string  `json:"notes"`
+	// Late fee included in Amount and the number of dunning reminders sent so far
+	LateFee      float64 `json:"late_fee"`
+	DunningLevel int     `json:"dunning_level"`
+	// Original payment a refund was issued against
+	RefundOfID *uint `gorm:"index" json:"refund_of_id,omitempty"`
+	// Monthly invoice a credit note or proration adjustment was consumed by
+	AppliedToID *uint `gorm:"index" json:"applied_to_id,omitempty"`
+	// Billing period covered by a monthly payment; unique per subscription so a period is never billed twice
+	BillingPeriodStart *time.Time    `gorm:"uniqueIndex:idx_payments_subscription_period" json:"billing_period_start"`
+	BillingPeriodEnd   *time.Time    `json:"billing_period_end"`
+	Customer           User          `gorm:"foreignKey:CustomerID" json:"customer"`
+	Order              *Order        `gorm:"foreignKey:OrderID" json:"order"`
+	Subscription       *Subscription `gorm:"foreignKey:SubscriptionID" json:"subscription"`
 }
 
 // ServiceRequest represents a maintenance/service request
@@ -162,7 +188,11 @@ type ServiceRequest struct {
 	Status         string       `json:"status"`
 	Description    string       `json:"description"`
 	ScheduledTime  *time.Time   `json:"scheduled_time"`
+	ScheduledEnd   *time.Time   `json:"scheduled_end"` // End of the visit window
 	CompletionTime *time.Time   `json:"completion_time"`
+	DueBy          *time.Time   `gorm:"index" json:"due_by"` // Resolution deadline under the SLA
+	SLABreachedAt  *time.Time   `json:"sla_breached_at"`
+	SLAEscalation  int          `gorm:"column:sla_escalation_level" json:"sla_escalation_level"` // SLAEscalation* level reached
 	Notes          string       `json:"notes"`
 	Rating         *int         `json:"rating"`
 	Feedback       string       `json:"feedback"`
@@ -223,6 +253,7 @@ const (
 	SubscriptionStatusPaused    = "paused"
 	SubscriptionStatusCancelled = "cancelled"
 	SubscriptionStatusExpired   = "expired"
+	SubscriptionStatusSuspended = "suspended" // Overdue payments; service requests are blocked
 
 	ServiceStatusPending    = "pending"
 	ServiceStatusAssigned   = "assigned"
@@ -236,6 +267,60 @@ const (
 	PaymentStatusSuccess  = "success"
 	PaymentStatusFailed   = "failed"
 	PaymentStatusRefunded = "refunded"
+	PaymentStatusApplied  = "applied" // Credit note or adjustment consumed by an invoice
+
+	AssetStatusInWarehouse  = "in_warehouse"
+	AssetStatusReserved     = "reserved" // Held for an approved order
+	AssetStatusInstalled    = "installed"
+	AssetStatusReturned     = "returned" // Back from a customer, awaiting inspection
+	AssetStatusRefurbishing = "refurbishing"
+	AssetStatusScrapped     = "scrapped"
+
+	PlanChangePending   = "pending" // Waiting for the device swap
+	PlanChangeApplied   = "applied"
+	PlanChangeCancelled = "cancelled" // Swap cancelled; the subscription kept its product
+
+	StockReservationReserved  = "reserved"  // Held until the initial payment is verified
+	StockReservationAllocated = "allocated" // Taken by an approved order
+	StockReservationReleased  = "released"
+	StockReservationExpired   = "expired"
+
+	InventoryMovementReceipt     = "receipt"
+	InventoryMovementAllocation  = "allocation" // Reserved or allocated to an order
+	InventoryMovementReturn      = "return"     // Released by an order or reservation, or collected from a customer
+	InventoryMovementTransferOut = "transfer_out"
+	InventoryMovementTransferIn  = "transfer_in"
+	InventoryMovementWriteOff    = "write_off"
+	InventoryMovementServiceUse  = "service_use" // Parts used on a service visit
+
+	OrderRoutingCustomer = "customer" // Franchise chosen by the customer
+	OrderRoutingAuto     = "auto"     // Picked by the order router
+	OrderRoutingAdmin    = "admin"    // Assigned by an admin
+
+	OrderTriageOpen      = "open"
+	OrderTriageRouted    = "routed"
+	OrderTriageDismissed = "dismissed"
+
+	FranchiseAgentInvited  = "invited" // Waiting for the agent to accept
+	FranchiseAgentActive   = "active"
+	FranchiseAgentInactive = "inactive" // Deactivated by the franchise
+
+	ServiceDispatchAssigned  = "assigned"
+	ServiceDispatchRejected  = "rejected" // Turned down by the assigned agent
+	ServiceDispatchNoAgent   = "no_agent" // Nobody qualified; retried by the dispatch job
+	ServiceDispatchEscalated = "escalated"
+
+	SLAEscalationNone  = 0
+	SLAEscalationOwner = 1 // Franchise owner alerted of the breach
+	SLAEscalationAdmin = 2 // Breach still open; admins alerted
+
+	JobPhotoBefore = "before"
+	JobPhotoAfter  = "after"
+
+	JobCardConfirmedBySignature = "signature"
+
+	VisitSubjectOrder   = "order" // Installation visit
+	VisitSubjectService = "service_request"
 
 	// User roles
 	RoleAdmin          = "admin"
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AgentWorkingHours is a service agent's shift on one day of the week. Times are HH:MM
+// in the server's local time zone.
+type AgentWorkingHours struct {
+	gorm.Model
+	AgentID   uint   `gorm:"index" json:"agent_id"`
+	Weekday   int    `json:"weekday"` // 0 is Sunday
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// AgentLeave is a period a service agent cannot be booked for visits
+type AgentLeave struct {
+	gorm.Model
+	AgentID     uint      `gorm:"index" json:"agent_id"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	Reason      string    `json:"reason"`
+	CreatedByID *uint     `json:"created_by_id"`
+}
+
+// ServiceSlotTemplate is a visit window a franchise offers to customers on one day of the
+// week. Times are HH:MM in the server's local time zone.
+type ServiceSlotTemplate struct {
+	gorm.Model
+	FranchiseID uint   `gorm:"index" json:"franchise_id"`
+	Weekday     int    `json:"weekday"` // 0 is Sunday
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	Capacity    int    `json:"capacity"` // Visits the slot takes; 0 means one per agent on duty
+}
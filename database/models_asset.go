@@ -0,0 +1,38 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Asset is a physical purifier unit identified by its serial number. OrderID and
+// SubscriptionID point at the rental the unit is currently reserved for or installed at.
+type Asset struct {
+	gorm.Model
+	SerialNumber   string        `gorm:"uniqueIndex" json:"serial_number"`
+	ProductID      uint          `gorm:"index" json:"product_id"`
+	FranchiseID    uint          `gorm:"index" json:"franchise_id"`
+	Status         string        `gorm:"index" json:"status"`
+	OrderID        *uint         `gorm:"index" json:"order_id"`
+	SubscriptionID *uint         `gorm:"index" json:"subscription_id"`
+	InstalledAt    *time.Time    `json:"installed_at"`
+	Notes          string        `json:"notes"`
+	Product        *Product      `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	Franchise      *Franchise    `gorm:"foreignKey:FranchiseID" json:"franchise,omitempty"`
+	Subscription   *Subscription `gorm:"foreignKey:SubscriptionID" json:"subscription,omitempty"`
+}
+
+// AssetStatusHistory records a single status change of an asset
+type AssetStatusHistory struct {
+	gorm.Model
+	AssetID        uint   `gorm:"index" json:"asset_id"`
+	FromStatus     string `json:"from_status"`
+	ToStatus       string `json:"to_status"`
+	OrderID        *uint  `json:"order_id"`
+	SubscriptionID *uint  `json:"subscription_id"`
+	ActorID        *uint  `json:"actor_id"`
+	ActorRole      string `json:"actor_role"`
+	Notes          string `json:"notes"`
+	Actor          *User  `gorm:"foreignKey:ActorID" json:"actor,omitempty"`
+}
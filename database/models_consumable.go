@@ -0,0 +1,50 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProductComponent defines a consumable part of a product, such as a filter or membrane,
+// and how long it lasts. A component is due when either lifespan is reached; a zero
+// lifespan is not tracked.
+type ProductComponent struct {
+	gorm.Model
+	ProductID      uint    `gorm:"index" json:"product_id"`
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	LifespanDays   int     `json:"lifespan_days"`
+	LifespanLitres int     `json:"lifespan_litres"`
+	Price          float64 `json:"price"`
+	IsActive       bool    `gorm:"default:true" json:"is_active"`
+}
+
+// InstalledComponent is a component fitted in the unit installed for a subscription.
+// Litre readings come from the unit's flow meter.
+type InstalledComponent struct {
+	gorm.Model
+	SubscriptionID     uint              `gorm:"index" json:"subscription_id"`
+	ProductComponentID uint              `gorm:"index" json:"product_component_id"`
+	InstalledAt        time.Time         `json:"installed_at"`
+	InstalledLitres    int               `json:"installed_litres"`
+	LastMeterReading   int               `json:"last_meter_reading"`
+	LastReadingAt      *time.Time        `json:"last_reading_at"`
+	ReplacementCount   int               `json:"replacement_count"`
+	IsActive           bool              `gorm:"default:true" json:"is_active"` // False once removed by a product swap
+	ProductComponent   *ProductComponent `gorm:"foreignKey:ProductComponentID" json:"product_component,omitempty"`
+}
+
+// ComponentReplacement records a component replaced by an agent during a service visit
+type ComponentReplacement struct {
+	gorm.Model
+	InstalledComponentID uint      `gorm:"index" json:"installed_component_id"`
+	SubscriptionID       uint      `gorm:"index" json:"subscription_id"`
+	ServiceRequestID     uint      `gorm:"index" json:"service_request_id"`
+	ReplacedByID         uint      `json:"replaced_by_id"`
+	ReplacedAt           time.Time `json:"replaced_at"`
+	PreviousInstalledAt  time.Time `json:"previous_installed_at"`
+	MeterReading         int       `json:"meter_reading"`
+	LitresUsed           int       `json:"litres_used"`
+	Notes                string    `json:"notes"`
+}
@@ -0,0 +1,24 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FranchiseAgent attaches a service agent to the franchise they work for. An agent
+// belongs to one franchise at a time; User.FranchiseID mirrors an active membership.
+type FranchiseAgent struct {
+	gorm.Model
+	FranchiseID   uint       `gorm:"index" json:"franchise_id"`
+	AgentID       uint       `gorm:"uniqueIndex" json:"agent_id"`
+	Status        string     `gorm:"index" json:"status"`
+	InvitedByID   *uint      `json:"invited_by_id"`
+	InvitedAt     time.Time  `json:"invited_at"`
+	JoinedAt      *time.Time `json:"joined_at"`
+	DeactivatedAt *time.Time `json:"deactivated_at"`
+	Notes         string     `json:"notes"`
+
+	Franchise *Franchise `gorm:"foreignKey:FranchiseID" json:"franchise,omitempty"`
+	Agent     *User      `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
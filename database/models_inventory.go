@@ -0,0 +1,45 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// FranchiseInventory is the stock of a catalog product held by a franchise. Quantity is
+// the number of units available to new orders and always equals the sum of the
+// franchise's inventory movements for the product.
+type FranchiseInventory struct {
+	gorm.Model
+	FranchiseID uint       `gorm:"uniqueIndex:idx_franchise_inventory_product" json:"franchise_id"`
+	ProductID   uint       `gorm:"uniqueIndex:idx_franchise_inventory_product" json:"product_id"`
+	Quantity    int        `json:"quantity"`
+	Franchise   *Franchise `gorm:"foreignKey:FranchiseID" json:"franchise,omitempty"`
+	Product     *Product   `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+}
+
+// InventoryMovement is an entry in the append-only stock ledger of a franchise.
+// Quantity is positive for stock coming in and negative for stock going out.
+type InventoryMovement struct {
+	gorm.Model
+	FranchiseID      uint   `gorm:"index" json:"franchise_id"`
+	ProductID        uint   `gorm:"index" json:"product_id"`
+	Type             string `gorm:"index" json:"type"`
+	Quantity         int    `json:"quantity"`
+	BalanceAfter     int    `json:"balance_after"`
+	OrderID          *uint  `gorm:"index" json:"order_id"`
+	TransferID       *uint  `gorm:"index" json:"transfer_id"`
+	ServiceRequestID *uint  `gorm:"index" json:"service_request_id"`
+	ActorID          *uint  `json:"actor_id"`
+	ActorRole        string `json:"actor_role"`
+	Notes            string `json:"notes"`
+}
+
+// InventoryTransfer records stock moved from one franchise to another
+type InventoryTransfer struct {
+	gorm.Model
+	FromFranchiseID uint   `gorm:"index" json:"from_franchise_id"`
+	ToFranchiseID   uint   `gorm:"index" json:"to_franchise_id"`
+	ProductID       uint   `gorm:"index" json:"product_id"`
+	Quantity        int    `json:"quantity"`
+	ActorID         *uint  `json:"actor_id"`
+	Notes           string `json:"notes"`
+}
@@ -0,0 +1,22 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Invoice records the tax invoice rendered for a successful payment
+type Invoice struct {
+	gorm.Model
+	PaymentID     uint      `gorm:"uniqueIndex;not null" json:"payment_id"`
+	InvoiceNumber string    `gorm:"size:50" json:"invoice_number"`
+	IssuedAt      time.Time `json:"issued_at"`
+	TaxableAmount float64   `json:"taxable_amount"`
+	CGST          float64   `json:"cgst"`
+	SGST          float64   `json:"sgst"`
+	IGST          float64   `json:"igst"`
+	TotalAmount   float64   `json:"total_amount"`
+	FilePath      string    `json:"-"`
+	Payment       Payment   `gorm:"foreignKey:PaymentID" json:"-"`
+}
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"time"
+)
+
+// InvoiceSequence holds the last invoice number issued by a franchise in a fiscal year.
+// Rows are locked while a number is allocated so numbering stays gap-free under
+// concurrent payments.
+type InvoiceSequence struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	FranchiseID uint      `gorm:"uniqueIndex:idx_invoice_sequences_scope;not null" json:"franchise_id"`
+	FiscalYear  string    `gorm:"size:7;uniqueIndex:idx_invoice_sequences_scope;not null" json:"fiscal_year"`
+	LastNumber  int64     `gorm:"not null;default:0" json:"last_number"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
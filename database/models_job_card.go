@@ -0,0 +1,57 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ServiceJobCard is the completion report an agent fills in at a service visit. Once the
+// customer confirms it the card is locked and the parts used are taken from the
+// franchise's inventory.
+type ServiceJobCard struct {
+	gorm.Model
+	ServiceRequestID   uint       `gorm:"uniqueIndex" json:"service_request_id"`
+	AgentID            uint       `gorm:"index" json:"agent_id"`
+	TDSBefore          *int       `json:"tds_before"` // Total dissolved solids in ppm
+	TDSAfter           *int       `json:"tds_after"`
+	PHBefore           *float64   `json:"ph_before"`
+	PHAfter            *float64   `json:"ph_after"`
+	Summary            string     `gorm:"type:text" json:"summary"`
+	ConfirmationMethod string     `json:"confirmation_method"` // Empty until the customer confirms
+	SignedByName       string     `json:"signed_by_name"`
+	SignatureURL       string     `json:"signature_url"`
+	ConfirmedAt        *time.Time `json:"confirmed_at"`
+
+	Checklist []JobCardChecklistItem `gorm:"foreignKey:JobCardID" json:"checklist"`
+	Parts     []JobCardPart          `gorm:"foreignKey:JobCardID" json:"parts"`
+	Photos    []JobCardPhoto         `gorm:"foreignKey:JobCardID" json:"photos"`
+}
+
+// JobCardChecklistItem is a check carried out during a service visit
+type JobCardChecklistItem struct {
+	gorm.Model
+	JobCardID uint   `gorm:"index" json:"job_card_id"`
+	Item      string `json:"item"`
+	Done      bool   `json:"done"`
+	Remarks   string `json:"remarks"`
+}
+
+// JobCardPart is a part or consumable used during a service visit
+type JobCardPart struct {
+	gorm.Model
+	JobCardID           uint     `gorm:"index" json:"job_card_id"`
+	ProductID           uint     `gorm:"index" json:"product_id"`
+	Quantity            int      `json:"quantity"`
+	InventoryMovementID *uint    `json:"inventory_movement_id"` // Set once taken from stock
+	Product             *Product `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+}
+
+// JobCardPhoto is a photo taken during a service visit, served from /uploads
+type JobCardPhoto struct {
+	gorm.Model
+	JobCardID uint   `gorm:"index" json:"job_card_id"`
+	URL       string `json:"url"`
+	Stage     string `json:"stage"` // JobPhotoBefore or JobPhotoAfter
+	Caption   string `json:"caption"`
+}
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// OrderStatusHistory records a single status transition of an order
+type OrderStatusHistory struct {
+	gorm.Model
+	OrderID    uint   `gorm:"index" json:"order_id"`
+	FromStatus string `json:"from_status"`
+	ToStatus   string `json:"to_status"`
+	ActorID    *uint  `json:"actor_id"`
+	ActorRole  string `json:"actor_role"`
+	Notes      string `json:"notes"`
+	Actor      *User  `gorm:"foreignKey:ActorID" json:"actor,omitempty"`
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OrderRoutingDecision records which franchise an order was given to and why. An order
+// gets a new decision each time it is routed again.
+type OrderRoutingDecision struct {
+	gorm.Model
+	OrderID        uint     `gorm:"index" json:"order_id"`
+	FranchiseID    uint     `gorm:"index" json:"franchise_id"`
+	Method         string   `json:"method"`
+	Reason         string   `gorm:"type:text" json:"reason"`
+	MatchedBy      string   `json:"matched_by"`  // How the franchise covers the shipping location
+	DistanceKm     *float64 `json:"distance_km"` // Nil when the distance is unknown
+	OpenOrders     int64    `json:"open_orders"` // Franchise load when the decision was made
+	CandidateCount int      `json:"candidate_count"`
+	ActorID        *uint    `json:"actor_id"`
+	ActorRole      string   `json:"actor_role"`
+
+	Franchise *Franchise `gorm:"foreignKey:FranchiseID" json:"franchise,omitempty"`
+}
+
+// OrderTriage holds an order request that could not be routed to a franchise until an
+// admin routes it by hand or dismisses it
+type OrderTriage struct {
+	gorm.Model
+	CustomerID      uint       `gorm:"index" json:"customer_id"`
+	ProductID       uint       `json:"product_id"`
+	ShippingAddress string     `json:"shipping_address"`
+	BillingAddress  string     `json:"billing_address"`
+	ShippingZipCode string     `json:"shipping_zip_code"`
+	Latitude        float64    `json:"latitude"`
+	Longitude       float64    `json:"longitude"`
+	RentalDuration  int        `json:"rental_duration"`
+	Notes           string     `json:"notes"`
+	Status          string     `gorm:"index" json:"status"`
+	Reason          string     `gorm:"type:text" json:"reason"` // Why no franchise qualified
+	OrderID         *uint      `json:"order_id"`                // Set once routed
+	ResolvedByID    *uint      `json:"resolved_by_id"`
+	ResolvedAt      *time.Time `json:"resolved_at"`
+	ResolutionNotes string     `json:"resolution_notes"`
+
+	Customer *User    `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
+	Product  *Product `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+}
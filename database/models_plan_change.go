@@ -0,0 +1,31 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SubscriptionPlanChange records a product upgrade or downgrade on a subscription. The
+// subscription moves to the new product when the device swap is completed; until then
+// the change is pending and the rents and deposits are those quoted when it was requested.
+type SubscriptionPlanChange struct {
+	gorm.Model
+	SubscriptionID     uint      `gorm:"index" json:"subscription_id"`
+	Status             string    `gorm:"size:20;default:applied;index" json:"status"` // Older changes were applied when requested
+	FromProductID      uint      `json:"from_product_id"`
+	ToProductID        uint      `json:"to_product_id"`
+	OldMonthlyRent     float64   `json:"old_monthly_rent"`
+	NewMonthlyRent     float64   `json:"new_monthly_rent"`
+	OldSecurityDeposit float64   `json:"old_security_deposit"`
+	NewSecurityDeposit float64   `json:"new_security_deposit"`
+	EffectiveDate      time.Time `json:"effective_date"` // Requested swap date, then when the swap was completed
+	// Swap job raised for the technician and the payments recording the price differences
+	ServiceRequestID *uint    `json:"service_request_id"`
+	ProrationID      *uint    `json:"proration_id"`
+	DepositChangeID  *uint    `json:"deposit_change_id"`
+	RequestedByID    *uint    `json:"requested_by_id"`
+	Notes            string   `json:"notes"`
+	FromProduct      *Product `gorm:"foreignKey:FromProductID" json:"from_product,omitempty"`
+	ToProduct        *Product `gorm:"foreignKey:ToProductID" json:"to_product,omitempty"`
+}
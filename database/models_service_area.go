@@ -0,0 +1,54 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// GeoPolygon is a GeoJSON polygon: an outer ring followed by any holes, each a closed
+// list of [longitude, latitude] positions. It is stored as JSON.
+type GeoPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// Bounds returns the latitude and longitude ranges spanned by the outer ring
+func (p GeoPolygon) Bounds() (minLatitude, maxLatitude, minLongitude, maxLongitude float64) {
+	if len(p.Coordinates) == 0 || len(p.Coordinates[0]) == 0 {
+		return 0, 0, 0, 0
+	}
+	first := p.Coordinates[0][0]
+	minLongitude, maxLongitude, minLatitude, maxLatitude = first[0], first[0], first[1], first[1]
+	for _, position := range p.Coordinates[0][1:] {
+		minLongitude = math.Min(minLongitude, position[0])
+		maxLongitude = math.Max(maxLongitude, position[0])
+		minLatitude = math.Min(minLatitude, position[1])
+		maxLatitude = math.Max(maxLatitude, position[1])
+	}
+	return minLatitude, maxLatitude, minLongitude, maxLongitude
+}
+
+// Value implements driver.Valuer
+func (p GeoPolygon) Value() (driver.Value, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (p *GeoPolygon) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	case nil:
+		*p = GeoPolygon{}
+		return nil
+	}
+	return errors.New("unsupported type for GeoPolygon")
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AgentSkill is a type of service request a service agent is qualified for. Agents
+// without any skills take every type.
+type AgentSkill struct {
+	gorm.Model
+	AgentID uint   `gorm:"index" json:"agent_id"`
+	Skill   string `json:"skill"`
+}
+
+// ServiceDispatch records a step in dispatching a service request to a service agent:
+// an automatic assignment, an agent turning it down, an attempt that found nobody or an
+// escalation to the franchise owner
+type ServiceDispatch struct {
+	gorm.Model
+	ServiceRequestID uint       `gorm:"index" json:"service_request_id"`
+	AgentID          *uint      `gorm:"index" json:"agent_id"`
+	Action           string     `json:"action"`
+	Reason           string     `gorm:"type:text" json:"reason"`
+	OpenTasks        int64      `json:"open_tasks"`   // Agent workload when assigned
+	NextFreeAt       *time.Time `json:"next_free_at"` // Visit start the agent was free for
+	DistanceKm       *float64   `json:"distance_km"`  // Nil when either location is unknown
+	CandidateCount   int        `json:"candidate_count"`
+	ActorID          *uint      `json:"actor_id"`
+	ActorRole        string     `json:"actor_role"`
+
+	Agent *User `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
@@ -0,0 +1,14 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// ServiceSLAPolicy sets how long service requests of a type have to be resolved and how
+// long a breach stays with the franchise owner before admins are alerted
+type ServiceSLAPolicy struct {
+	gorm.Model
+	RequestType          string `gorm:"uniqueIndex" json:"request_type"`
+	ResolveWithinHours   int    `json:"resolve_within_hours"`
+	AdminEscalationHours int    `json:"admin_escalation_hours"`
+}
@@ -0,0 +1,21 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StockReservation holds a unit of a franchise's stock of a product for an order. A
+// reserved unit goes back into stock when the reservation expires or the order is cancelled.
+type StockReservation struct {
+	gorm.Model
+	OrderID     uint       `gorm:"uniqueIndex" json:"order_id"`
+	FranchiseID uint       `gorm:"index" json:"franchise_id"`
+	ProductID   uint       `gorm:"index" json:"product_id"`
+	Quantity    int        `json:"quantity"`
+	Status      string     `gorm:"index" json:"status"`
+	ExpiresAt   time.Time  `gorm:"index" json:"expires_at"`
+	AllocatedAt *time.Time `json:"allocated_at"`
+	ReleasedAt  *time.Time `json:"released_at"`
+}
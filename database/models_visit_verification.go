@@ -0,0 +1,25 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// VisitVerification holds the one-time code a customer gives the agent to confirm that
+// an installation or service visit took place. Each order or service request has one;
+// sending a new code replaces the previous one.
+type VisitVerification struct {
+	gorm.Model
+	SubjectType    string     `gorm:"uniqueIndex:idx_visit_verification_subject" json:"subject_type"`
+	SubjectID      uint       `gorm:"uniqueIndex:idx_visit_verification_subject" json:"subject_id"`
+	CustomerID     uint       `gorm:"index" json:"customer_id"`
+	CodeHash       string     `json:"-"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	Attempts       int        `json:"attempts"`    // Wrong codes entered for the current code
+	IssueCount     int        `json:"issue_count"` // Codes sent so far
+	IssuedByID     *uint      `json:"issued_by_id"`
+	VerifiedAt     *time.Time `json:"verified_at"`
+	OverriddenByID *uint      `json:"overridden_by_id"` // Admin who waived the code
+	OverrideReason string     `json:"override_reason"`
+}
@@ -0,0 +1,14 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// PaymentWebhookEvent records every payment gateway webhook that has been processed.
+// The unique event ID guarantees a redelivered event is applied only once.
+type PaymentWebhookEvent struct {
+	gorm.Model
+	EventID string `gorm:"size:100;uniqueIndex;not null" json:"event_id"`
+	Event   string `gorm:"size:50;index" json:"event"`
+	Payload string `gorm:"type:text" json:"payload"`
+}
@@ -0,0 +1,281 @@
+package invoices
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// SAC (Services Accounting Codes) printed against invoice lines
+const (
+	SACRental       = "997319" // Leasing or rental of machinery and equipment without operator
+	SACInstallation = "998739" // Installation services of other goods
+)
+
+// Party is the supplier or recipient printed on an invoice
+type Party struct {
+	Name    string
+	Address string
+	City    string
+	State   string
+	ZipCode string
+	Phone   string
+	Email   string
+	GSTIN   string
+}
+
+// LineItem is one charge on an invoice. Amount includes tax for taxable items.
+type LineItem struct {
+	Description string
+	SAC         string
+	Amount      float64
+	Taxable     bool
+}
+
+// Invoice holds everything printed on a tax invoice
+type Invoice struct {
+	Number           string
+	Date             time.Time
+	Supplier         Party
+	Customer         Party
+	Items            []LineItem
+	GSTRatePercent   float64
+	PaymentReference string
+	PeriodStart      *time.Time
+	PeriodEnd        *time.Time
+}
+
+// Line is a LineItem with its tax split out
+type Line struct {
+	LineItem
+	TaxableValue float64
+	Tax          float64
+}
+
+// Totals summarises the tax on an invoice
+type Totals struct {
+	TaxableValue float64
+	CGST         float64
+	SGST         float64
+	IGST         float64
+	NonTaxable   float64
+	Total        float64
+}
+
+// IntraState reports whether supplier and customer are in the same state, in which case
+// GST is split into CGST and SGST rather than charged as IGST
+func (inv *Invoice) IntraState() bool {
+	return inv.Customer.State == "" ||
+		strings.EqualFold(strings.TrimSpace(inv.Supplier.State), strings.TrimSpace(inv.Customer.State))
+}
+
+// Compute splits the tax out of every line and totals the invoice
+func (inv *Invoice) Compute() ([]Line, Totals) {
+	var totals Totals
+	lines := make([]Line, 0, len(inv.Items))
+
+	for _, item := range inv.Items {
+		line := Line{LineItem: item}
+		if item.Taxable {
+			line.TaxableValue = round(item.Amount / (1 + inv.GSTRatePercent/100))
+			line.Tax = round(item.Amount - line.TaxableValue)
+			totals.TaxableValue += line.TaxableValue
+		} else {
+			line.TaxableValue = item.Amount
+			totals.NonTaxable += item.Amount
+		}
+		totals.Total += item.Amount
+		lines = append(lines, line)
+
+		if !item.Taxable {
+			continue
+		}
+		if inv.IntraState() {
+			cgst := round(line.Tax / 2)
+			totals.CGST += cgst
+			totals.SGST += line.Tax - cgst
+		} else {
+			totals.IGST += line.Tax
+		}
+	}
+
+	totals.TaxableValue = round(totals.TaxableValue)
+	totals.CGST = round(totals.CGST)
+	totals.SGST = round(totals.SGST)
+	totals.IGST = round(totals.IGST)
+	totals.NonTaxable = round(totals.NonTaxable)
+	totals.Total = round(totals.Total)
+	return lines, totals
+}
+
+// Render produces the invoice as a PDF document
+func Render(inv *Invoice) []byte {
+	doc := newPDFDocument()
+	const left, right = 40.0, pageWidth - 40.0
+	y := pageHeight - 50.0
+
+	doc.text(left, y, 18, true, "TAX INVOICE")
+	doc.textRight(right, y, 10, false, "Original for Recipient")
+	y -= 30
+
+	// Supplier on the left, invoice details on the right
+	top := y
+	y = drawParty(doc, left, y, "From", inv.Supplier)
+
+	details := [][2]string{
+		{"Invoice No:", inv.Number},
+		{"Invoice Date:", inv.Date.Format("02 Jan 2006")},
+		{"Place of Supply:", placeOfSupply(inv)},
+	}
+	if inv.PaymentReference != "" {
+		details = append(details, [2]string{"Payment Ref:", inv.PaymentReference})
+	}
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		details = append(details, [2]string{"Billing Period:",
+			inv.PeriodStart.Format("02 Jan 2006") + " - " + inv.PeriodEnd.Format("02 Jan 2006")})
+	}
+	detailY := top
+	for _, detail := range details {
+		doc.text(330, detailY, 9, true, detail[0])
+		doc.text(410, detailY, 9, false, detail[1])
+		detailY -= 13
+	}
+	y = math.Min(y, detailY) - 12
+
+	y = drawParty(doc, left, y, "Bill To", inv.Customer) - 12
+
+	// Line items
+	columns := []float64{left, left + 25, 300, 390, 470, right}
+	doc.line(left, y+12, right, y+12)
+	doc.text(columns[0], y, 9, true, "#")
+	doc.text(columns[1], y, 9, true, "Description")
+	doc.text(columns[2], y, 9, true, "SAC")
+	doc.textRight(columns[3]+60, y, 9, true, "Taxable Value")
+	doc.textRight(columns[4]+50, y, 9, true, "GST")
+	doc.textRight(columns[5], y, 9, true, "Amount")
+	doc.line(left, y-5, right, y-5)
+	y -= 20
+
+	lines, totals := inv.Compute()
+	for i, line := range lines {
+		if y < 120 {
+			doc.addPage()
+			y = pageHeight - 50
+		}
+		doc.text(columns[0], y, 9, false, fmt.Sprintf("%d", i+1))
+		doc.text(columns[1], y, 9, false, line.Description)
+		sac := line.SAC
+		if !line.Taxable {
+			sac = "-"
+		}
+		doc.text(columns[2], y, 9, false, sac)
+		doc.textRight(columns[3]+60, y, 9, false, formatAmount(line.TaxableValue))
+		doc.textRight(columns[4]+50, y, 9, false, formatAmount(line.Tax))
+		doc.textRight(columns[5], y, 9, false, formatAmount(line.Amount))
+		y -= 15
+	}
+	doc.line(left, y+5, right, y+5)
+	y -= 12
+
+	// Tax summary
+	rate := inv.GSTRatePercent
+	summary := [][2]string{{"Taxable Value", formatAmount(totals.TaxableValue)}}
+	if inv.IntraState() {
+		summary = append(summary,
+			[2]string{fmt.Sprintf("CGST @ %s%%", formatRate(rate/2)), formatAmount(totals.CGST)},
+			[2]string{fmt.Sprintf("SGST @ %s%%", formatRate(rate/2)), formatAmount(totals.SGST)})
+	} else {
+		summary = append(summary,
+			[2]string{fmt.Sprintf("IGST @ %s%%", formatRate(rate)), formatAmount(totals.IGST)})
+	}
+	if totals.NonTaxable > 0 {
+		summary = append(summary, [2]string{"Non-taxable", formatAmount(totals.NonTaxable)})
+	}
+	for _, row := range summary {
+		doc.text(360, y, 9, false, row[0])
+		doc.textRight(right, y, 9, false, row[1])
+		y -= 13
+	}
+	doc.line(360, y+8, right, y+8)
+	y -= 6
+	doc.text(360, y, 11, true, "Total (INR)")
+	doc.textRight(right, y, 11, true, formatAmount(totals.Total))
+	y -= 30
+
+	if totals.NonTaxable > 0 {
+		doc.text(left, y, 8, false, "Security deposit is refundable and is not a taxable supply.")
+		y -= 11
+	}
+	doc.text(left, y, 8, false, "This is a computer generated invoice and does not require a signature.")
+
+	return doc.bytes()
+}
+
+// drawParty prints a name and address block and returns the y position below it
+func drawParty(doc *pdfDocument, x, y float64, heading string, party Party) float64 {
+	doc.text(x, y, 8, false, strings.ToUpper(heading))
+	y -= 13
+	doc.text(x, y, 10, true, party.Name)
+	y -= 13
+
+	rows := []string{
+		party.Address,
+		strings.Trim(strings.Join([]string{party.City, party.State, party.ZipCode}, ", "), ", "),
+	}
+	if party.Phone != "" || party.Email != "" {
+		rows = append(rows, strings.Trim(party.Phone+"  "+party.Email, " "))
+	}
+	if party.GSTIN != "" {
+		rows = append(rows, "GSTIN: "+party.GSTIN)
+	}
+	for _, row := range rows {
+		if row == "" {
+			continue
+		}
+		doc.text(x, y, 9, false, row)
+		y -= 12
+	}
+	return y
+}
+
+// placeOfSupply is the recipient's state, falling back to the supplier's
+func placeOfSupply(inv *Invoice) string {
+	if inv.Customer.State != "" {
+		return inv.Customer.State
+	}
+	return inv.Supplier.State
+}
+
+// formatAmount formats a rupee amount with Indian digit grouping, e.g. 1,23,456.00
+func formatAmount(amount float64) string {
+	s := fmt.Sprintf("%.2f", math.Abs(amount))
+	whole, fraction := s[:len(s)-3], s[len(s)-3:]
+
+	if len(whole) > 3 {
+		head, tail := whole[:len(whole)-3], whole[len(whole)-3:]
+		var groups []string
+		for len(head) > 2 {
+			groups = append([]string{head[len(head)-2:]}, groups...)
+			head = head[:len(head)-2]
+		}
+		if head != "" {
+			groups = append([]string{head}, groups...)
+		}
+		whole = strings.Join(groups, ",") + "," + tail
+	}
+
+	if amount < 0 {
+		return "-" + whole + fraction
+	}
+	return whole + fraction
+}
+
+// formatRate prints a tax rate without trailing zeros
+func formatRate(rate float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", rate), "0"), ".")
+}
+
+func round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,131 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 page size in PDF points
+const (
+	pageWidth  = 595.0
+	pageHeight = 842.0
+)
+
+// pdfDocument is a minimal PDF writer for text-and-rule documents such as invoices.
+// It uses the standard Helvetica fonts, so no font files need to be embedded.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+}
+
+// newPDFDocument creates a document with one empty page
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.addPage()
+	return d
+}
+
+// addPage starts a new page; later drawing goes to it
+func (d *pdfDocument) addPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDocument) current() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// text draws s with its baseline starting at (x, y), measured from the bottom-left corner
+func (d *pdfDocument) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.current(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escapePDFText(s))
+}
+
+// textRight draws s so that it ends at x
+func (d *pdfDocument) textRight(x, y, size float64, bold bool, s string) {
+	d.text(x-textWidth(s, size), y, size, bold, s)
+}
+
+// line draws a thin rule from (x1, y1) to (x2, y2)
+func (d *pdfDocument) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.current(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// bytes serialises the document
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	writeObject := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4: catalog, page tree and the two fonts. Pages and their content
+	// streams follow in pairs starting at object 5.
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+i*2))
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
+
+// escapePDFText escapes a string for a PDF literal. Characters outside printable ASCII
+// are not available in the standard fonts and are replaced.
+func escapePDFText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// textWidth approximates the width of s in Helvetica at the given size. Digits and
+// most lowercase letters are 0.556 em wide, which is close enough for right-aligning
+// amounts.
+func textWidth(s string, size float64) float64 {
+	width := 0.0
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '.' || r == ',' || r == ':' || r == 'i' || r == 'l':
+			width += 0.278
+		case r >= 'A' && r <= 'Z':
+			width += 0.667
+		default:
+			width += 0.556
+		}
+	}
+	return width * size
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/joho/godotenv"
 
 	"aquahome/config"
+	"aquahome/controllers"
 	"aquahome/database"
+	"aquahome/payments"
 	"aquahome/routes"
 )
 
@@ -28,6 +30,9 @@ func main() {
 	// Initialize config
 	config.InitConfig()
 
+	// Select the payment gateway
+	payments.InitGateway()
+
 	// Initialize PostgreSQL DB
 	if err := database.InitDB(); err != nil {
 		log.Fatalf("❌ Failed to initialize GORM database: %v", err)
@@ -44,14 +49,72 @@ func main() {
 		&database.Notification{},
 		&database.Location{},
 		&database.FranchiseLocation{}, // ✅ Include join table
+		&database.OrderStatusHistory{},
+		&database.PaymentWebhookEvent{},
+		&database.Invoice{},
+		&database.InvoiceSequence{},
+		&database.SubscriptionPlanChange{},
+		&database.ProductComponent{},
+		&database.InstalledComponent{},
+		&database.ComponentReplacement{},
+		&database.Asset{},
+		&database.AssetStatusHistory{},
+		&database.StockReservation{},
+		&database.FranchiseInventory{},
+		&database.InventoryMovement{},
+		&database.InventoryTransfer{},
+		&database.OrderRoutingDecision{},
+		&database.OrderTriage{},
+		&database.FranchiseAgent{},
+		&database.AgentWorkingHours{},
+		&database.AgentLeave{},
+		&database.ServiceSlotTemplate{},
+		&database.AgentSkill{},
+		&database.ServiceDispatch{},
+		&database.ServiceSLAPolicy{},
+		&database.ServiceJobCard{},
+		&database.JobCardChecklistItem{},
+		&database.JobCardPart{},
+		&database.JobCardPhoto{},
+		&database.VisitVerification{},
+		&database.Audit{},
 	); err != nil {
 		log.Fatalf("❌ AutoMigrate failed: %v", err)
 	}
 	log.Println("✅ AutoMigrate completed")
 
+	// Release invoice numbers reserved by payments that were never completed
+	if err := database.MigrateLegacyInvoiceNumbers(); err != nil {
+		log.Fatalf("❌ Invoice number migration failed: %v", err)
+	}
+
+	// Move stock recorded on products into franchise inventory
+	if err := database.MigrateProductStockToInventory(); err != nil {
+		log.Fatalf("❌ Inventory migration failed: %v", err)
+	}
+
+	// Give service agents linked to a franchise a membership of it
+	if err := database.MigrateServiceAgentMemberships(); err != nil {
+		log.Fatalf("❌ Service agent membership migration failed: %v", err)
+	}
+
+	// Store the bounding box of location boundaries saved without one
+	if err := database.MigrateLocationBounds(); err != nil {
+		log.Fatalf("❌ Location bounds migration failed: %v", err)
+	}
+
 	// ✅ Seed default admin if not exists
 	database.SeedDefaultAdmin()
 
+	// Start background jobs
+	controllers.StartBillingScheduler()
+	controllers.StartDunningScheduler()
+	controllers.StartExpiryScheduler()
+	controllers.StartMaintenanceScheduler()
+	controllers.StartReservationScheduler()
+	controllers.StartDispatchScheduler()
+	controllers.StartSLAScheduler()
+
 	// // (Optional) Initialize any legacy DB (only if needed)
 	// if err := database.InitLegacyDB(); err != nil {
 	// 	log.Fatalf("❌ Failed to initialize legacy database: %v", err)
@@ -0,0 +1,159 @@
+package payments
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeGateway is an in-memory PaymentGateway for tests and offline development.
+// Orders are paid with Pay, which returns the signature a real checkout would.
+type FakeGateway struct {
+	secret        string
+	webhookSecret string
+
+	mu       sync.Mutex
+	sequence int
+	orders   map[string]*Order
+	payments map[string]*Payment
+	refunds  map[string]*Refund
+}
+
+// NewFakeGateway creates an empty fake gateway that signs with the given secrets
+func NewFakeGateway(secret, webhookSecret string) *FakeGateway {
+	return &FakeGateway{
+		secret:        secret,
+		webhookSecret: webhookSecret,
+		orders:        map[string]*Order{},
+		payments:      map[string]*Payment{},
+		refunds:       map[string]*Refund{},
+	}
+}
+
+// Name implements PaymentGateway
+func (g *FakeGateway) Name() string {
+	return GatewayFake
+}
+
+// KeyID implements PaymentGateway
+func (g *FakeGateway) KeyID() string {
+	return "fake_key"
+}
+
+// nextID returns a new identifier with the given prefix. Callers must hold g.mu.
+func (g *FakeGateway) nextID(prefix string) string {
+	g.sequence++
+	return fmt.Sprintf("%s_fake%08d", prefix, g.sequence)
+}
+
+// CreateOrder implements PaymentGateway
+func (g *FakeGateway) CreateOrder(amount int64, currency, receipt string, notes map[string]interface{}) (*Order, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	order := &Order{
+		ID:       g.nextID("order"),
+		Amount:   amount,
+		Currency: currency,
+		Receipt:  receipt,
+		Status:   "created",
+	}
+	g.orders[order.ID] = order
+
+	copied := *order
+	return &copied, nil
+}
+
+// Pay captures the full amount of an order, as a customer completing checkout would,
+// and returns the payment with its checkout signature
+func (g *FakeGateway) Pay(orderID string) (*Payment, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	order, ok := g.orders[orderID]
+	if !ok {
+		return nil, "", fmt.Errorf("order %s not found", orderID)
+	}
+	if order.Status == "paid" {
+		return nil, "", fmt.Errorf("order %s is already paid", orderID)
+	}
+
+	payment := &Payment{
+		ID:      g.nextID("pay"),
+		OrderID: orderID,
+		Amount:  order.Amount,
+		Status:  "captured",
+	}
+	g.payments[payment.ID] = payment
+	order.Status = "paid"
+
+	copied := *payment
+	return &copied, signHMAC(orderID+"|"+payment.ID, g.secret), nil
+}
+
+// SignWebhook returns the signature a webhook delivery of body would carry
+func (g *FakeGateway) SignWebhook(body []byte) string {
+	return signHMAC(string(body), g.webhookSecret)
+}
+
+// VerifyPaymentSignature implements PaymentGateway
+func (g *FakeGateway) VerifyPaymentSignature(orderID, paymentID, signature string) bool {
+	return verifyHMAC(orderID+"|"+paymentID, signature, g.secret)
+}
+
+// VerifyWebhookSignature implements PaymentGateway
+func (g *FakeGateway) VerifyWebhookSignature(body []byte, signature string) bool {
+	return verifyHMAC(string(body), signature, g.webhookSecret)
+}
+
+// FetchPayment implements PaymentGateway
+func (g *FakeGateway) FetchPayment(paymentID string) (*Payment, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	payment, ok := g.payments[paymentID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+
+	copied := *payment
+	return &copied, nil
+}
+
+// Refund implements PaymentGateway
+func (g *FakeGateway) Refund(paymentID string, amount int64, notes map[string]interface{}) (*Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	payment, ok := g.payments[paymentID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+
+	var refunded int64
+	for _, refund := range g.refunds {
+		if refund.PaymentID == paymentID {
+			refunded += refund.Amount
+		}
+	}
+	if amount <= 0 || refunded+amount > payment.Amount {
+		return nil, fmt.Errorf("refund of %d exceeds refundable amount %d", amount, payment.Amount-refunded)
+	}
+
+	refund := &Refund{
+		ID:        g.nextID("rfnd"),
+		PaymentID: paymentID,
+		Amount:    amount,
+		Status:    "processed",
+	}
+	g.refunds[refund.ID] = refund
+	if refunded+amount == payment.Amount {
+		payment.Status = "refunded"
+	}
+
+	copied := *refund
+	return &copied, nil
+}
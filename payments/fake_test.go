@@ -0,0 +1,61 @@
+package payments
+
+import "testing"
+
+func TestFakeGatewayCheckout(t *testing.T) {
+	gateway := NewFakeGateway("secret", "webhook_secret")
+
+	order, err := gateway.CreateOrder(199900, "INR", "order_1", nil)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+
+	payment, signature, err := gateway.Pay(order.ID)
+	if err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if payment.Amount != order.Amount || payment.Status != "captured" {
+		t.Errorf("payment = %d %s, want %d captured", payment.Amount, payment.Status, order.Amount)
+	}
+	if !gateway.VerifyPaymentSignature(order.ID, payment.ID, signature) {
+		t.Error("checkout signature was rejected")
+	}
+	if gateway.VerifyPaymentSignature(order.ID, payment.ID, "forged") {
+		t.Error("forged signature was accepted")
+	}
+	if _, _, err := gateway.Pay(order.ID); err == nil {
+		t.Error("paying an order twice succeeded")
+	}
+
+	body := []byte(`{"event":"payment.captured"}`)
+	if !gateway.VerifyWebhookSignature(body, gateway.SignWebhook(body)) {
+		t.Error("webhook signature was rejected")
+	}
+}
+
+func TestFakeGatewayRefund(t *testing.T) {
+	gateway := NewFakeGateway("secret", "webhook_secret")
+	order, _ := gateway.CreateOrder(100000, "INR", "order_1", nil)
+	payment, _, _ := gateway.Pay(order.ID)
+
+	if _, err := gateway.Refund(payment.ID, 60000, nil); err != nil {
+		t.Fatalf("partial refund: %v", err)
+	}
+	if _, err := gateway.Refund(payment.ID, 50000, nil); err == nil {
+		t.Error("refund beyond the captured amount succeeded")
+	}
+	if _, err := gateway.Refund(payment.ID, 40000, nil); err != nil {
+		t.Fatalf("refunding the rest: %v", err)
+	}
+
+	fetched, err := gateway.FetchPayment(payment.ID)
+	if err != nil {
+		t.Fatalf("FetchPayment: %v", err)
+	}
+	if fetched.Status != "refunded" {
+		t.Errorf("payment status = %s, want refunded", fetched.Status)
+	}
+	if _, err := gateway.Refund("pay_unknown", 100, nil); err != ErrPaymentNotFound {
+		t.Errorf("refund of unknown payment error = %v, want ErrPaymentNotFound", err)
+	}
+}
@@ -0,0 +1,123 @@
+package payments
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/razorpay/razorpay-go"
+)
+
+// RazorpayGateway talks to the Razorpay API
+type RazorpayGateway struct {
+	key           string
+	secret        string
+	webhookSecret string
+	client        *razorpay.Client
+}
+
+// NewRazorpayGateway creates a gateway using the given API and webhook credentials
+func NewRazorpayGateway(key, secret, webhookSecret string) *RazorpayGateway {
+	return &RazorpayGateway{
+		key:           key,
+		secret:        secret,
+		webhookSecret: webhookSecret,
+		client:        razorpay.NewClient(key, secret),
+	}
+}
+
+// Name implements PaymentGateway
+func (g *RazorpayGateway) Name() string {
+	return GatewayRazorpay
+}
+
+// KeyID implements PaymentGateway
+func (g *RazorpayGateway) KeyID() string {
+	return g.key
+}
+
+// CreateOrder implements PaymentGateway
+func (g *RazorpayGateway) CreateOrder(amount int64, currency, receipt string, notes map[string]interface{}) (*Order, error) {
+	result, err := g.client.Order.Create(map[string]interface{}{
+		"amount":   amount,
+		"currency": currency,
+		"receipt":  receipt,
+		"notes":    notes,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := result["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("razorpay returned no order ID")
+	}
+	status, _ := result["status"].(string)
+
+	return &Order{
+		ID:       id,
+		Amount:   amount,
+		Currency: currency,
+		Receipt:  receipt,
+		Status:   status,
+	}, nil
+}
+
+// VerifyPaymentSignature implements PaymentGateway
+func (g *RazorpayGateway) VerifyPaymentSignature(orderID, paymentID, signature string) bool {
+	return verifyHMAC(orderID+"|"+paymentID, signature, g.secret)
+}
+
+// VerifyWebhookSignature implements PaymentGateway
+func (g *RazorpayGateway) VerifyWebhookSignature(body []byte, signature string) bool {
+	if g.webhookSecret == "" {
+		log.Printf("Razorpay webhook received but RAZORPAY_WEBHOOK_SECRET is not set")
+		return false
+	}
+	return verifyHMAC(string(body), signature, g.webhookSecret)
+}
+
+// FetchPayment implements PaymentGateway
+func (g *RazorpayGateway) FetchPayment(paymentID string) (*Payment, error) {
+	result, err := g.client.Payment.Fetch(paymentID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := result["id"].(string)
+	if id == "" {
+		return nil, ErrPaymentNotFound
+	}
+	orderID, _ := result["order_id"].(string)
+	status, _ := result["status"].(string)
+	amount, _ := result["amount"].(float64)
+
+	return &Payment{
+		ID:      id,
+		OrderID: orderID,
+		Amount:  int64(amount),
+		Status:  status,
+	}, nil
+}
+
+// Refund implements PaymentGateway
+func (g *RazorpayGateway) Refund(paymentID string, amount int64, notes map[string]interface{}) (*Refund, error) {
+	result, err := g.client.Payment.Refund(paymentID, int(amount), map[string]interface{}{
+		"notes": notes,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := result["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("razorpay returned no refund ID")
+	}
+	status, _ := result["status"].(string)
+
+	return &Refund{
+		ID:        id,
+		PaymentID: paymentID,
+		Amount:    amount,
+		Status:    status,
+	}, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"aquahome/config"
 	"aquahome/controllers"
 	"aquahome/middleware"
 )
@@ -30,6 +31,9 @@ func SetupRoutes(r *gin.Engine) {
 		// Products (public view for non-authenticated users)
 		public.GET("/products", controllers.GetProducts)
 		public.GET("/products/:id", controllers.GetProductByID)
+
+		// Payment gateway webhooks (authenticated by signature)
+		public.POST("/payments/webhook", controllers.RazorpayWebhook)
 	}
 
 	// Protected routes (authentication required)
@@ -45,6 +49,7 @@ func SetupRoutes(r *gin.Engine) {
 		protected.POST("/profile/change-password", controllers.ChangePassword)
 		protected.GET("/profile/v2", controllers.GetUserProfileNew)
 		protected.GET("/customer/products", controllers.GetCustomerProducts)
+		protected.GET("/customer/franchises", controllers.SearchFranchises)
 		protected.PUT("/profile/v2", controllers.UpdateUserProfileNew)
 		protected.POST("/profile/location", controllers.UpdateUserLocation)
 		protected.POST("/profile/change-password/v2", controllers.ChangePasswordNew)
@@ -67,6 +72,18 @@ func SetupRoutes(r *gin.Engine) {
 			admin.PUT("/products/:id", controllers.UpdateProduct)
 			admin.DELETE("/products/:id", controllers.DeleteProduct)
 			admin.PATCH("/products/:id/toggle-status", controllers.ToggleProductStatus)
+			admin.POST("/products/:id/components", controllers.CreateProductComponent)
+			admin.GET("/products/:id/components", controllers.GetProductComponents)
+			admin.PUT("/components/:id", controllers.UpdateProductComponent)
+			admin.DELETE("/components/:id", controllers.DeleteProductComponent)
+
+			// Franchise inventory
+			admin.GET("/inventory", controllers.GetInventory)
+			admin.GET("/inventory/movements", controllers.GetInventoryMovements)
+			admin.GET("/inventory/reconciliation", controllers.GetInventoryReconciliation)
+			admin.POST("/inventory/receipts", controllers.ReceiveInventory)
+			admin.POST("/inventory/write-offs", controllers.WriteOffInventory)
+			admin.POST("/inventory/transfers", controllers.TransferInventory)
 
 			// ✅ Franchise Management
 			admin.PATCH("/franchises/:id", controllers.AdminUpdateFranchise)
@@ -76,10 +93,41 @@ func SetupRoutes(r *gin.Engine) {
 
 			// ✅ Orders
 			admin.PATCH("/orders/:id/assign", controllers.AssignOrderToFranchise)
+			admin.GET("/orders/:id/routing", controllers.GetOrderRouting)
+			admin.GET("/order-triage", controllers.GetOrderTriage)
+			admin.POST("/order-triage/:id/route", controllers.RouteOrderTriage)
+			admin.POST("/order-triage/:id/dismiss", controllers.DismissOrderTriage)
 			admin.GET("/customers/:id/subscriptions", controllers.GetCustomerSubscriptionsByAdmin)
 
 			// ✅ NEW: Locations
 			admin.GET("/locations", controllers.GetAllLocations)
+			admin.POST("/locations", controllers.CreateLocation)
+			admin.GET("/locations/overlaps", controllers.GetServiceAreaOverlaps)
+			admin.GET("/locations/uncovered", controllers.GetUncoveredDemand)
+			admin.GET("/locations/:id", controllers.GetLocation)
+			admin.PUT("/locations/:id", controllers.UpdateLocation)
+			admin.DELETE("/locations/:id", controllers.DeleteLocation)
+			admin.POST("/locations/:id/zip-codes/import", controllers.ImportLocationZipCodes)
+			admin.DELETE("/locations/:id/zip-codes/:zip", controllers.RemoveLocationZipCode)
+			admin.PUT("/franchises/:id/locations", controllers.ReplaceFranchiseLocations)
+			admin.DELETE("/franchises/:id/locations/:locationId", controllers.DetachFranchiseLocation)
+			admin.GET("/franchises/:id/service-agents", controllers.GetServiceAgentsForFranchise)
+			admin.POST("/franchises/:id/service-agents/invite", controllers.InviteServiceAgent)
+			admin.POST("/franchises/:id/service-agents/:agentId/activate", controllers.ActivateServiceAgent)
+			admin.POST("/franchises/:id/service-agents/:agentId/deactivate", controllers.DeactivateServiceAgent)
+			admin.GET("/franchises/:id/service-agents/:agentId/calendar", controllers.GetAgentCalendar)
+			admin.PUT("/franchises/:id/service-agents/:agentId/working-hours", controllers.SetAgentWorkingHours)
+			admin.POST("/franchises/:id/service-agents/:agentId/leave", controllers.AddAgentLeave)
+			admin.DELETE("/franchises/:id/service-agents/:agentId/leave/:leaveId", controllers.DeleteAgentLeave)
+			admin.GET("/franchises/:id/service-agents/:agentId/skills", controllers.GetAgentSkills)
+			admin.PUT("/franchises/:id/service-agents/:agentId/skills", controllers.SetAgentSkills)
+			admin.GET("/franchises/:id/slot-templates", controllers.GetSlotTemplates)
+			admin.PUT("/franchises/:id/slot-templates", controllers.ReplaceSlotTemplates)
+			admin.GET("/sla-policies", controllers.GetSLAPolicies)
+			admin.PUT("/sla-policies/:type", controllers.SetSLAPolicy)
+			admin.DELETE("/sla-policies/:type", controllers.DeleteSLAPolicy)
+			admin.POST("/orders/:id/visit/override", controllers.OverrideOrderVisit)
+			admin.POST("/services/:id/visit/override", controllers.OverrideServiceVisit)
 		}
 
 		// 🧑‍🔧 Service Agent Routes
@@ -88,6 +136,14 @@ func SetupRoutes(r *gin.Engine) {
 		{
 			agent.GET("/tasks", controllers.GetAgentTasks)
 			agent.GET("/dashboard", controllers.GetServiceAgentDashboard)
+			agent.GET("/membership", controllers.GetMyFranchiseMembership)
+			agent.POST("/membership/accept", controllers.AcceptFranchiseMembership)
+			agent.GET("/calendar", controllers.GetAgentCalendar)
+			agent.PUT("/working-hours", controllers.SetAgentWorkingHours)
+			agent.POST("/leave", controllers.AddAgentLeave)
+			agent.DELETE("/leave/:leaveId", controllers.DeleteAgentLeave)
+			agent.GET("/skills", controllers.GetAgentSkills)
+			agent.PUT("/skills", controllers.SetAgentSkills)
 		}
 
 		// Orders
@@ -100,6 +156,11 @@ func SetupRoutes(r *gin.Engine) {
 			orders.GET("/customer", middleware.CustomerAuthMiddleware(), controllers.GetCustomerOrders)
 			orders.PUT("/:id/status", middleware.AdminOrFranchiseAuthMiddleware(), controllers.UpdateOrderStatus)
 			orders.GET("/:id", controllers.GetOrderByID)
+			orders.GET("/:id/history", controllers.GetOrderHistory)
+			orders.POST("/:id/visit/code", controllers.SendOrderVisitCode)
+			orders.POST("/:id/visit/verify", controllers.VerifyOrderVisit)
+			orders.GET("/:id/refund", middleware.AdminOrFranchiseAuthMiddleware(), controllers.GetDepositRefundQuote)
+			orders.POST("/:id/refund", middleware.AdminOrFranchiseAuthMiddleware(), controllers.RefundSecurityDeposit)
 
 			orders.PATCH("/:id/assign-agent", middleware.AdminAuthMiddleware(), controllers.AssignOrderToAgent)
 
@@ -110,8 +171,11 @@ func SetupRoutes(r *gin.Engine) {
 		{
 			subscriptions.POST("", middleware.CustomerAuthMiddleware(), controllers.CreateSubscription)
 			subscriptions.GET("/customer", middleware.CustomerAuthMiddleware(), controllers.GetMySubscriptions)
-			subscriptions.PUT("/:id", middleware.CustomerAuthMiddleware(), controllers.UpdateSubscription)
+			subscriptions.PUT("/:id", controllers.UpdateSubscription)
 			subscriptions.POST("/:id/cancel", middleware.CustomerAuthMiddleware(), controllers.CancelSubscription)
+			subscriptions.POST("/:id/change-product", middleware.CustomerAuthMiddleware(), controllers.ChangeSubscriptionProduct)
+			subscriptions.GET("/:id/plan-changes", controllers.GetSubscriptionPlanChanges)
+			subscriptions.GET("/:id/components", controllers.GetSubscriptionComponents)
 
 			subscriptions.GET("/franchise", middleware.FranchiseOwnerAuthMiddleware(), controllers.GetFranchiseSubscriptions)
 
@@ -124,8 +188,19 @@ func SetupRoutes(r *gin.Engine) {
 			services.POST("/:id/feedback", middleware.CustomerAuthMiddleware(), controllers.SubmitServiceFeedback)
 			services.POST("/:id/cancel", middleware.CustomerAuthMiddleware(), controllers.CancelServiceRequest)
 			services.GET("", controllers.GetServiceRequestsNew)
+			services.GET("/slots", controllers.GetServiceSlots)
 			services.GET("/:id", controllers.GetServiceRequestByIDNew)
 			services.PUT("/:id", controllers.UpdateServiceRequestNew)
+			services.POST("/:id/components/replacements", middleware.ServiceAgentAuthMiddleware(), controllers.ReplaceServiceComponents)
+			services.POST("/:id/reject", middleware.ServiceAgentAuthMiddleware(), controllers.RejectServiceAssignment)
+			services.PUT("/:id/job-card", middleware.ServiceAgentAuthMiddleware(), controllers.SaveJobCard)
+			services.POST("/:id/job-card/photos", middleware.ServiceAgentAuthMiddleware(), controllers.UploadJobCardPhoto)
+			services.DELETE("/:id/job-card/photos/:photoId", middleware.ServiceAgentAuthMiddleware(), controllers.DeleteJobCardPhoto)
+			services.POST("/:id/job-card/signature", middleware.ServiceAgentAuthMiddleware(), controllers.ConfirmJobCardBySignature)
+			services.POST("/:id/visit/code", controllers.SendServiceVisitCode)
+			services.POST("/:id/visit/verify", controllers.VerifyServiceVisit)
+			services.POST("/:id/dispatch", middleware.AdminOrFranchiseAuthMiddleware(), controllers.DispatchServiceRequest)
+			services.GET("/:id/dispatch", middleware.AdminOrFranchiseAuthMiddleware(), controllers.GetServiceDispatches)
 		}
 		// Service agents
 
@@ -141,6 +216,8 @@ func SetupRoutes(r *gin.Engine) {
 			franchises.GET("/search", controllers.SearchFranchises)
 			franchises.POST("/locations", controllers.AddFranchiseLocations)
 			franchises.GET("/locations", controllers.GetMyLocations)
+			franchises.PUT("/locations", controllers.ReplaceFranchiseLocations)
+			franchises.DELETE("/locations/:locationId", controllers.DetachFranchiseLocation)
 
 			//this route for dashboard
 			franchises.GET("/dashboard", controllers.GetFranchiseDashboard)
@@ -151,17 +228,42 @@ func SetupRoutes(r *gin.Engine) {
 			// ✅ Assign service agent to order (already supports franchise_owner in controller)
 			franchises.PATCH("/orders/:id/assign-agent", controllers.AssignOrderToAgent)
 			franchises.GET("/service-agents", controllers.GetServiceAgentsForFranchise)
+			franchises.POST("/service-agents/invite", controllers.InviteServiceAgent)
+			franchises.POST("/service-agents/:agentId/activate", controllers.ActivateServiceAgent)
+			franchises.POST("/service-agents/:agentId/deactivate", controllers.DeactivateServiceAgent)
+			franchises.GET("/service-agents/:agentId/calendar", controllers.GetAgentCalendar)
+			franchises.PUT("/service-agents/:agentId/working-hours", controllers.SetAgentWorkingHours)
+			franchises.POST("/service-agents/:agentId/leave", controllers.AddAgentLeave)
+			franchises.DELETE("/service-agents/:agentId/leave/:leaveId", controllers.DeleteAgentLeave)
+			franchises.GET("/service-agents/:agentId/skills", controllers.GetAgentSkills)
+			franchises.PUT("/service-agents/:agentId/skills", controllers.SetAgentSkills)
+			franchises.GET("/slot-templates", controllers.GetSlotTemplates)
+			franchises.PUT("/slot-templates", controllers.ReplaceSlotTemplates)
 
 		}
 
+		// Asset registry of purifier units
+		assets := protected.Group("/assets")
+		assets.Use(middleware.AdminOrFranchiseAuthMiddleware())
+		{
+			assets.POST("", controllers.RegisterAsset)
+			assets.GET("", controllers.GetAssets)
+			assets.GET("/:id", controllers.GetAssetByID)
+			assets.PATCH("/:id/status", controllers.UpdateAssetStatus)
+		}
+
 		// Payments
 		payments := protected.Group("/payments")
 		{
 			payments.POST("/generate-order", middleware.CustomerAuthMiddleware(), controllers.GeneratePaymentOrder)
 			payments.POST("/generate-monthly", middleware.CustomerAuthMiddleware(), controllers.GenerateMonthlyPayment)
 			payments.POST("/verify", middleware.CustomerAuthMiddleware(), controllers.VerifyPayment)
+			if config.AppConfig.PaymentGateway == "fake" {
+				payments.POST("/fake-checkout", middleware.CustomerAuthMiddleware(), controllers.FakeGatewayCheckout)
+			}
 			payments.GET("", controllers.GetPaymentHistory)
 			payments.GET("/:id", controllers.GetPaymentByID)
+			payments.GET("/:id/invoice", controllers.GetPaymentInvoice)
 		}
 
 		// Add this route for franchise dashboard